@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/gorilla/mux"
+)
+
+// accessLogMiddleware logs every request with its status, duration and
+// response size, and the trace ID of traced requests so a log line leads to
+// its trace, along with the request ID. Requests to a route with a sample rate are logged with that
+// probability, unless they fail with a 5xx. Failures are logged at ERROR
+// and every other request at INFO, so a LOG_LEVEL above INFO only keeps
+// the access logs of failed requests.
+func accessLogMiddleware(cfg config.AccessLog) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := NewResponseWriter(w)
+			next.ServeHTTP(rw, r)
+
+			route := routeTemplate(r)
+			if rate, ok := cfg.SampleRates[route]; ok && rw.statusCode < 500 && rand.Float64() >= rate {
+				accessLogsSampledOut.Inc()
+				return
+			}
+
+			fields := map[string]interface{}{
+				"method":      r.Method,
+				"path":        r.URL.Path,
+				"route":       route,
+				"status":      rw.statusCode,
+				"duration":    time.Since(start).Seconds(),
+				"bytes":       rw.written,
+				"remote_addr": clientIP(r),
+				"user_agent":  r.UserAgent(),
+				"request_id":  requestIDFromContext(r.Context()),
+			}
+			if sc, ok := spanFromContext(r.Context()); ok {
+				fields["trace_id"] = sc.traceID()
+			}
+			level := "INFO"
+			if rw.statusCode >= 500 {
+				level = "ERROR"
+			}
+			utils.WriteLogFields(level, fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, rw.statusCode), fields)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	tr := newTracer(&memorySpanExporter{}, "test", 1)
+	router := newTestRouter(tr.middleware, accessLogMiddleware(config.AccessLog{}))
+	req := httptest.NewRequest(http.MethodGet, "/api/hits", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("User-Agent", "workshop-test")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	var entry utils.Log
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, "GET /api/hits 200") {
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Failed to decode the access log: %v", err)
+			}
+		}
+	}
+	expected := map[string]interface{}{
+		"method":     "GET",
+		"path":       "/api/hits",
+		"route":      "/api/hits",
+		"status":     float64(http.StatusOK),
+		"bytes":      float64(rr.Body.Len()),
+		"user_agent": "workshop-test",
+		"trace_id":   "4bf92f3577b34da6a3ce929d0e0e4736",
+	}
+	for key, value := range expected {
+		if entry.Fields[key] != value {
+			t.Errorf("Expected %s to be %v in the access log, but got %v", key, value, entry.Fields[key])
+		}
+	}
+	if _, ok := entry.Fields["duration"]; !ok {
+		t.Errorf("Expected the access log to have the duration")
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	router := newTestRouter(accessLogMiddleware(config.AccessLog{SampleRates: map[string]float64{"/api/healthz": 0, "/test/fail": 0}}))
+	router.Path("/test/fail").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	before := testutil.ToFloat64(accessLogsSampledOut)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/healthz", nil))
+	if strings.Contains(buf.String(), "GET /api/healthz") {
+		t.Errorf("Expected a route sampled at 0 not to be logged, but got %q", buf.String())
+	}
+	if got := testutil.ToFloat64(accessLogsSampledOut) - before; got != 1 {
+		t.Errorf("Expected access_logs_sampled_out_total to increase by 1, but got %v", got)
+	}
+
+	// failures are always logged
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/fail", nil))
+	if !strings.Contains(buf.String(), "GET /test/fail 503") {
+		t.Errorf("Expected a 5xx to be logged despite sampling, but got %q", buf.String())
+	}
+}
+
+func TestAccessLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer utils.SetLogLevel(utils.GetLogLevel())
+	utils.SetLogLevel("WARNING")
+
+	router := newTestRouter(accessLogMiddleware(config.AccessLog{}))
+	router.Path("/test/fail").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/healthz", nil))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/fail", nil))
+	if strings.Contains(buf.String(), "GET /api/healthz") {
+		t.Errorf("Expected a successful request not to be logged above INFO, but got %q", buf.String())
+	}
+	var entry utils.Log
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if strings.Contains(line, "GET /test/fail 500") {
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("Failed to decode the access log: %v", err)
+			}
+		}
+	}
+	if entry.Level != "ERROR" {
+		t.Errorf("Expected a 5xx to be logged at ERROR, but got %q", entry.Level)
+	}
+}
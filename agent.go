@@ -0,0 +1,26 @@
+package main
+
+import "strings"
+
+// User-agent categories, kept to a fixed set to bound label cardinality
+const (
+	agentBrowser = "browser"
+	agentBot     = "bot"
+	agentCurl    = "curl"
+	agentOther   = "other"
+)
+
+// classifyUserAgent maps a User-Agent header to one of the agent categories
+func classifyUserAgent(ua string) string {
+	ua = strings.ToLower(ua)
+	switch {
+	case strings.Contains(ua, "bot"), strings.Contains(ua, "spider"), strings.Contains(ua, "crawler"):
+		return agentBot
+	case strings.HasPrefix(ua, "curl/"):
+		return agentCurl
+	case strings.HasPrefix(ua, "mozilla/"):
+		return agentBrowser
+	default:
+		return agentOther
+	}
+}
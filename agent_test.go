@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestClassifyUserAgent(t *testing.T) {
+	tests := []struct {
+		ua       string
+		expected string
+	}{
+		{ua: "curl/7.88.1", expected: agentCurl},
+		{ua: "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", expected: agentBot},
+		{ua: "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.3 Safari/605.1.15", expected: agentBrowser},
+		{ua: "Prometheus/2.42.0", expected: agentOther},
+		{ua: "", expected: agentOther},
+	}
+
+	for _, tt := range tests {
+		if category := classifyUserAgent(tt.ua); category != tt.expected {
+			t.Errorf("Expected category %q for %q, but got %q", tt.expected, tt.ua, category)
+		}
+	}
+}
+
+func TestRequestsByAgent(t *testing.T) {
+	router := NewServer(testConfig(t)).Handler()
+
+	curlBefore := testutil.ToFloat64(requestsByAgent.WithLabelValues(agentCurl))
+	botBefore := testutil.ToFloat64(requestsByAgent.WithLabelValues(agentBot))
+
+	for _, ua := range []string{"curl/7.88.1", "Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/hits", nil)
+		req.Header.Set("User-Agent", ua)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if got := testutil.ToFloat64(requestsByAgent.WithLabelValues(agentCurl)) - curlBefore; got != 1 {
+		t.Errorf("Expected 1 curl request, but got %v", got)
+	}
+	if got := testutil.ToFloat64(requestsByAgent.WithLabelValues(agentBot)) - botBefore; got != 1 {
+		t.Errorf("Expected 1 bot request, but got %v", got)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// aggregator serves the custom counters of every replica of the app summed
+// up, scraping them all on every request to its /api/metrics. It sums at
+// scrape time what Prometheus would otherwise sum at query time, to show
+// what that costs: a replica that restarts or fails a scrape shows up as a
+// drop of the sums, which rate() takes for counter resets.
+type aggregator struct {
+	// targets are the host:port of the replicas, or their URL with a scheme
+	targets []string
+	// dns is a host:port whose host resolves to one address per replica,
+	// like a headless Service
+	dns    string
+	path   string
+	client *http.Client
+	lookup func(ctx context.Context, host string) ([]string, error)
+}
+
+func newAggregator(targets []string, dns, path string, timeout time.Duration) *aggregator {
+	return &aggregator{
+		targets: targets,
+		dns:     dns,
+		path:    path,
+		client:  &http.Client{Timeout: timeout},
+		lookup:  net.DefaultResolver.LookupHost,
+	}
+}
+
+// discover returns the static targets and those the DNS name resolves to
+func (a *aggregator) discover(ctx context.Context) ([]string, error) {
+	targets := append([]string(nil), a.targets...)
+	if a.dns == "" {
+		return targets, nil
+	}
+	host, port, err := net.SplitHostPort(a.dns)
+	if err != nil {
+		return targets, fmt.Errorf("invalid DNS name %q: %w", a.dns, err)
+	}
+	addrs, err := a.lookup(ctx, host)
+	if err != nil {
+		return targets, fmt.Errorf("resolving %s: %w", host, err)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		targets = append(targets, net.JoinHostPort(addr, port))
+	}
+	return targets, nil
+}
+
+// scrape returns the metric families target exposes on the aggregator's path
+func (a *aggregator) scrape(ctx context.Context, target string) (map[string]*dto.MetricFamily, error) {
+	url := target + a.path
+	if !strings.Contains(target, "://") {
+		url = "http://" + url
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// the text format, which the parser reads
+	req.Header.Set("Accept", string(expfmt.FmtText))
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var parser expfmt.TextParser
+	return parser.TextToMetricFamilies(resp.Body)
+}
+
+// counterSums sums the custom counters of many scrapes, by name and by
+// their labels but the instance label that tells the replicas apart
+type counterSums struct {
+	families map[string]*dto.MetricFamily
+	metrics  map[string]*dto.Metric
+}
+
+func newCounterSums() *counterSums {
+	return &counterSums{families: map[string]*dto.MetricFamily{}, metrics: map[string]*dto.Metric{}}
+}
+
+// custom reports whether m is a custom metric of the app rather than a Go
+// or process metric
+func custom(m *dto.Metric) bool {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == "metrics" && l.GetValue() == "custom" {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds the custom counters of families to the sums
+func (c *counterSums) add(families map[string]*dto.MetricFamily) {
+	for name, mf := range families {
+		if mf.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			if !custom(m) {
+				continue
+			}
+			var labels []*dto.LabelPair
+			var key strings.Builder
+			key.WriteString(name)
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "instance" {
+					continue
+				}
+				labels = append(labels, l)
+				fmt.Fprintf(&key, "\xff%s\xff%s", l.GetName(), l.GetValue())
+			}
+
+			sum, ok := c.metrics[key.String()]
+			if !ok {
+				family, ok := c.families[name]
+				if !ok {
+					family = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+					c.families[name] = family
+				}
+				value := 0.0
+				sum = &dto.Metric{Label: labels, Counter: &dto.Counter{Value: &value}}
+				family.Metric = append(family.Metric, sum)
+				c.metrics[key.String()] = sum
+			}
+			*sum.Counter.Value += m.GetCounter().GetValue()
+		}
+	}
+}
+
+// gaugeFamily returns a gauge family of metrics
+func gaugeFamily(name, help string, metrics ...*dto.Metric) *dto.MetricFamily {
+	typ := dto.MetricType_GAUGE
+	return &dto.MetricFamily{Name: &name, Help: &help, Type: &typ, Metric: metrics}
+}
+
+// gaugeValue returns a gauge metric of value, labelled by the name and value
+// pairs of labels
+func gaugeValue(value float64, labels ...string) *dto.Metric {
+	m := &dto.Metric{Gauge: &dto.Gauge{Value: &value}}
+	for i := 0; i+1 < len(labels); i += 2 {
+		name, value := labels[i], labels[i+1]
+		m.Label = append(m.Label, &dto.LabelPair{Name: &name, Value: &value})
+	}
+	return m
+}
+
+// ServeHTTP scrapes every target concurrently and responds with the sums of
+// their custom counters in the text format, along with which targets were
+// scraped in aggregator_target_up
+func (a *aggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	targets, err := a.discover(r.Context())
+	if err != nil {
+		// the static targets are still worth serving
+		utils.WriteLog("WARNING", fmt.Sprintf("Failed to discover the replicas: %s", err))
+	}
+
+	scrapes := make([]map[string]*dto.MetricFamily, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target string) {
+			defer wg.Done()
+			families, err := a.scrape(r.Context(), target)
+			if err != nil {
+				utils.WriteLog("WARNING", fmt.Sprintf("Failed to scrape %s: %s", target, err))
+				return
+			}
+			scrapes[i] = families
+		}(i, target)
+	}
+	wg.Wait()
+
+	sums := newCounterSums()
+	var up []*dto.Metric
+	for i, families := range scrapes {
+		value := 0.0
+		if families != nil {
+			value = 1
+			sums.add(families)
+		}
+		up = append(up, gaugeValue(value, "target", targets[i]))
+	}
+	families := []*dto.MetricFamily{
+		gaugeFamily("aggregator_target_up", "Whether the last scrape of a replica succeeded.", up...),
+		gaugeFamily("aggregator_targets", "Number of replicas discovered.", gaugeValue(float64(len(targets)))),
+	}
+	for _, mf := range sums.families {
+		families = append(families, mf)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+
+	w.Header().Set("Content-Type", string(expfmt.FmtText))
+	for _, mf := range families {
+		sort.Slice(mf.Metric, func(i, j int) bool { return mf.Metric[i].String() < mf.Metric[j].String() })
+		if _, err := expfmt.MetricFamilyToText(w, mf); err != nil {
+			utils.WriteLog("ERROR", fmt.Sprintf("Failed to write %s: %s", mf.GetName(), err))
+			return
+		}
+	}
+}
+
+// runAggregate runs the aggregate command, which serves the custom counters
+// of every replica of the app summed up until it is interrupted
+func runAggregate(args []string) error {
+	fs := flag.NewFlagSet("aggregate", flag.ContinueOnError)
+	port := fs.String("port", utils.GetEnv("AGGREGATE_PORT", "9100"), "port to serve the aggregated /api/metrics on")
+	targets := fs.String("targets", utils.GetEnv("AGGREGATE_TARGETS", ""), "comma-separated host:port of the replicas")
+	dns := fs.String("dns", utils.GetEnv("AGGREGATE_DNS", ""), "host:port resolving to every replica, such as a headless Service")
+	path := fs.String("path", "/api/metrics", "path of the metrics of the replicas")
+	timeout := fs.Duration("timeout", 5*time.Second, "timeout of every replica scrape")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *targets == "" && *dns == "" {
+		return fmt.Errorf("either -targets or -dns is required")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/metrics", newAggregator(utils.SplitList(*targets), *dns, *path, *timeout))
+	mux.HandleFunc("/api/healthz", HealthCheckHandler)
+	srv := &http.Server{Addr: ":" + *port, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	utils.WriteLog("INFO", fmt.Sprintf("Aggregating the metrics of %s on port %s", strings.Trim(*targets+" "+*dns, " "), *port))
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
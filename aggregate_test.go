@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newReplica serves metrics like a replica of the app that counted hits
+func newReplica(t *testing.T, instance string, hits int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `# HELP http_requests_total Total number of requests.
+# TYPE http_requests_total counter
+http_requests_total{instance=%q,metrics="custom",path="/"} %d
+http_requests_total{instance=%q,metrics="custom",path="/api/hits"} 1
+# HELP go_gc_cycles_total GC cycles.
+# TYPE go_gc_cycles_total counter
+go_gc_cycles_total 3
+# HELP app_goroutines Goroutines.
+# TYPE app_goroutines gauge
+app_goroutines{metrics="custom"} 7
+`, instance, hits, instance)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestAggregator(t *testing.T) {
+	first, second := newReplica(t, "a", 3), newReplica(t, "b", 4)
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+
+	a := newAggregator([]string{first.URL, second.URL, down.URL}, "", "/api/metrics", time.Second)
+	rr := httptest.NewRecorder()
+	a.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+	body := rr.Body.String()
+
+	for _, series := range []string{
+		`http_requests_total{metrics="custom",path="/"} 7`,
+		`http_requests_total{metrics="custom",path="/api/hits"} 2`,
+		fmt.Sprintf(`aggregator_target_up{target=%q} 1`, first.URL),
+		fmt.Sprintf(`aggregator_target_up{target=%q} 0`, down.URL),
+		"aggregator_targets 3",
+	} {
+		if !strings.Contains(body, series) {
+			t.Errorf("Expected the aggregate to contain %s, but got:\n%s", series, body)
+		}
+	}
+	// only the custom counters are summed
+	for _, name := range []string{"go_gc_cycles_total", "app_goroutines", `instance="a"`} {
+		if strings.Contains(body, name) {
+			t.Errorf("Expected the aggregate not to contain %s, but got:\n%s", name, body)
+		}
+	}
+}
+
+func TestAggregatorDNS(t *testing.T) {
+	replica := newReplica(t, "a", 5)
+	_, port, _ := net.SplitHostPort(replica.Listener.Addr().String())
+
+	a := newAggregator(nil, "blog-headless:"+port, "/api/metrics", time.Second)
+	a.lookup = func(ctx context.Context, host string) ([]string, error) {
+		if host != "blog-headless" {
+			return nil, fmt.Errorf("unexpected host %s", host)
+		}
+		return []string{"127.0.0.1"}, nil
+	}
+	rr := httptest.NewRecorder()
+	a.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+
+	for _, series := range []string{
+		`http_requests_total{metrics="custom",path="/"} 5`,
+		fmt.Sprintf(`aggregator_target_up{target="127.0.0.1:%s"} 1`, port),
+	} {
+		if !strings.Contains(rr.Body.String(), series) {
+			t.Errorf("Expected the aggregate to contain %s, but got:\n%s", series, rr.Body.String())
+		}
+	}
+
+	if err := runAggregate(nil); err == nil {
+		t.Errorf("Expected the aggregate command to require targets")
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// connContextKey is the context key of the connection a request came in on
+type connContextKey struct{}
+
+// withConn stores conn in ctx, it is meant for http.Server.ConnContext
+func withConn(ctx context.Context, conn net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, conn)
+}
+
+// errBodyReadTimeout is returned by bodies that took too long to arrive
+var errBodyReadTimeout = errors.New("timed out reading body")
+
+// deadlineBody moves the read deadline of conn timeout ahead of every read,
+// so a body may take any time overall as long as it keeps arriving
+type deadlineBody struct {
+	io.ReadCloser
+	conn     net.Conn
+	timeout  time.Duration
+	timedOut bool
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	if b.timedOut {
+		return 0, errBodyReadTimeout
+	}
+	b.conn.SetReadDeadline(time.Now().Add(b.timeout))
+	n, err := b.ReadCloser.Read(p)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		b.timedOut = true
+		bodyReadTimeouts.Inc()
+		return n, errBodyReadTimeout
+	}
+	if err == io.EOF {
+		b.conn.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// bodyReadTimeoutMiddleware gives each read of a request body timeout to
+// return, unlike ReadHeaderTimeout which only covers the headers, so a client
+// trickling its body can't hold on to a handler. Only HTTP/1 requests are
+// covered, HTTP/2 streams share their connection and its deadline.
+func bodyReadTimeoutMiddleware(timeout time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn, ok := r.Context().Value(connContextKey{}).(net.Conn)
+			if !ok || r.ProtoMajor != 1 || r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			body := &deadlineBody{ReadCloser: r.Body, conn: conn, timeout: timeout}
+			r.Body = body
+			next.ServeHTTP(w, r)
+			// a timed out connection keeps its deadline, so net/http closes
+			// it instead of waiting for the rest of the body
+			if !body.timedOut {
+				conn.SetReadDeadline(time.Time{})
+			}
+		})
+	}
+}
+
+// writeBodyError answers a request whose body failed to read with err, a 408
+// if it was too slow to arrive, a 413 if it was over the size limit and a 400
+// otherwise
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errBodyReadTimeout) {
+		w.Header().Set("Connection", "close")
+		writeError(w, r, http.StatusRequestTimeout, err.Error())
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body must be at most %d bytes", tooLarge.Limit))
+		return
+	}
+	writeError(w, r, http.StatusBadRequest, "failed to read body")
+}
+
+// contentLengthMiddleware rejects requests whose body is shorter than their
+// declared Content-Length with a 400, and bodies over maxBytes with a 413.
+// Bodies with a declared length are buffered to compare it, so handlers read
+// them from memory, chunked bodies fail with an *http.MaxBytesError once they
+// go over maxBytes. A maxBytes of zero or less does not limit the body size.
+func contentLengthMiddleware(maxBytes int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if maxBytes > 0 {
+				if r.ContentLength > maxBytes {
+					writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("body must be at most %d bytes", maxBytes))
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+			if r.ContentLength <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// net/http never reads past the declared length, so a body can
+			// only turn out shorter than declared
+			body, err := io.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+			r.Body.Close()
+			if err == io.ErrUnexpectedEOF {
+				err = nil
+			}
+			if err != nil {
+				writeBodyError(w, r, err)
+				return
+			}
+			if int64(len(body)) != r.ContentLength {
+				badContentLength.Inc()
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("body of %d bytes does not match Content-Length %d", len(body), r.ContentLength))
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// gzipBodyMiddleware transparently decompresses request bodies sent with
+// Content-Encoding: gzip. The body is decompressed up front so a body over
+// maxBytes once decompressed, such as a zip bomb, is rejected with a 413
+// before the handler runs. A maxBytes of zero or less does not limit the size.
+func gzipBodyMiddleware(maxBytes int64) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") || r.Body == nil || r.Body == http.NoBody {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "body is not valid gzip")
+				return
+			}
+			defer zr.Close()
+
+			var body io.Reader = zr
+			if maxBytes > 0 {
+				body = io.LimitReader(zr, maxBytes+1)
+			}
+			decoded, err := io.ReadAll(body)
+			var tooLarge *http.MaxBytesError
+			if errors.Is(err, errBodyReadTimeout) || errors.As(err, &tooLarge) {
+				writeBodyError(w, r, err)
+				return
+			}
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "body is not valid gzip")
+				return
+			}
+			if maxBytes > 0 && int64(len(decoded)) > maxBytes {
+				writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("decompressed body must be at most %d bytes", maxBytes))
+				return
+			}
+
+			// handlers see the body as if it had been sent uncompressed
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = int64(len(decoded))
+			r.Body = io.NopCloser(bytes.NewReader(decoded))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestContentLengthMiddleware(t *testing.T) {
+	var received string
+	router := mux.NewRouter()
+	router.Use(contentLengthMiddleware(16))
+	router.Path("/test/upload").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeBodyError(w, r, err)
+			return
+		}
+		received = string(b)
+	})
+
+	tests := []struct {
+		name          string
+		body          string
+		contentLength int64
+		status        int
+		mismatch      bool
+	}{
+		{"matching", "hello", 5, http.StatusOK, false},
+		{"chunked", "hello", -1, http.StatusOK, false},
+		{"shorter than declared", "hello", 8, http.StatusBadRequest, true},
+		{"over the limit", strings.Repeat("a", 32), 32, http.StatusRequestEntityTooLarge, false},
+		{"chunked over the limit", strings.Repeat("a", 32), -1, http.StatusRequestEntityTooLarge, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = ""
+			before := testutil.ToFloat64(badContentLength)
+
+			req := httptest.NewRequest(http.MethodPost, "/test/upload", strings.NewReader(tt.body))
+			req.ContentLength = tt.contentLength
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("Expected status %d, but got %d", tt.status, rr.Code)
+			}
+			if tt.status == http.StatusOK && received != tt.body {
+				t.Errorf("Expected the handler to read body %q, but got %q", tt.body, received)
+			}
+			want := 0.0
+			if tt.mismatch {
+				want = 1
+			}
+			if got := testutil.ToFloat64(badContentLength) - before; got != want {
+				t.Errorf("Expected http_bad_content_length_total to increase by %v, but got %v", want, got)
+			}
+		})
+	}
+}
+
+// gzipped returns s compressed with gzip
+func gzipped(t *testing.T, s string) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatalf("Failed to compress body: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Failed to compress body: %v", err)
+	}
+	return &buf
+}
+
+func TestGzipBodyMiddleware(t *testing.T) {
+	var received, encoding string
+	router := mux.NewRouter()
+	router.Use(gzipBodyMiddleware(64))
+	router.Path("/test/upload").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received = string(b)
+		encoding = r.Header.Get("Content-Encoding")
+	})
+
+	t.Run("decoded", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/test/upload", gzipped(t, "hello, prometheus"))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+		}
+		if received != "hello, prometheus" {
+			t.Errorf("Expected the handler to read the decompressed body, but got %q", received)
+		}
+		if encoding != "" {
+			t.Errorf("Expected the Content-Encoding header to be removed, but got %q", encoding)
+		}
+	})
+
+	t.Run("too large once decompressed", func(t *testing.T) {
+		// compresses to far less than the limit
+		body := gzipped(t, strings.Repeat("a", 1024))
+		if body.Len() > 64 {
+			t.Fatalf("Expected the compressed body to fit the limit, but it is %d bytes", body.Len())
+		}
+		req := httptest.NewRequest(http.MethodPost, "/test/upload", body)
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status %d, but got %d", http.StatusRequestEntityTooLarge, rr.Code)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/test/upload", strings.NewReader("not gzip"))
+		req.Header.Set("Content-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d, but got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
+
+func TestBodyReadTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	cfg := testConfig(t)
+	cfg.BodyReadTimeout = 100 * time.Millisecond
+	s := NewServer(cfg)
+	go s.Serve(l)
+	defer s.srv.Close()
+
+	before := testutil.ToFloat64(bodyReadTimeouts)
+
+	// the headers arrive straight away, the body never finishes
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "POST /api/remote HTTP/1.1\r\nHost: localhost\r\nContent-Length: 100\r\n\r\nslow")
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read the response: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestTimeout {
+		t.Errorf("Expected status %d, but got %d", http.StatusRequestTimeout, resp.StatusCode)
+	}
+	if got := testutil.ToFloat64(bodyReadTimeouts) - before; got != 1 {
+		t.Errorf("Expected http_body_read_timeouts_total to increase by 1, but got %v", got)
+	}
+
+	// a body sent at once is read in full, and only then rejected as not a remote write
+	resp, err = http.Post("http://"+l.Addr().String()+"/api/remote", "application/x-protobuf", strings.NewReader("fast"))
+	if err != nil {
+		t.Fatalf("Failed to post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a body sent at once, but got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+type breadcrumbsKey struct{}
+
+// middlewareTrace records the order the middlewares of a router ran in, by
+// leaving a breadcrumb in the request context as each one is entered. A
+// disabled trace leaves the middlewares unwrapped so it costs nothing.
+type middlewareTrace struct {
+	enabled bool
+
+	mu         sync.Mutex
+	registered []string
+	last       []string
+}
+
+func newMiddlewareTrace(enabled bool) *middlewareTrace {
+	return &middlewareTrace{enabled: enabled}
+}
+
+// wrap records name as the next registered middleware and, when enabled,
+// returns mwf with a breadcrumb for name. The first middleware of the chain
+// keeps the breadcrumbs of the request once the rest of the chain returns.
+func (t *middlewareTrace) wrap(name string, mwf mux.MiddlewareFunc) mux.MiddlewareFunc {
+	t.mu.Lock()
+	t.registered = append(t.registered, name)
+	t.mu.Unlock()
+	if !t.enabled {
+		return mwf
+	}
+
+	return func(next http.Handler) http.Handler {
+		h := mwf(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			crumbs, ok := r.Context().Value(breadcrumbsKey{}).(*[]string)
+			if !ok {
+				crumbs = &[]string{}
+				r = r.WithContext(context.WithValue(r.Context(), breadcrumbsKey{}, crumbs))
+				defer t.record(crumbs)
+			}
+			*crumbs = append(*crumbs, name)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (t *middlewareTrace) record(crumbs *[]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.last = *crumbs
+}
+
+// middlewareOrder is the registered and the most recently executed middleware order
+type middlewareOrder struct {
+	Enabled     bool     `json:"enabled"`
+	Registered  []string `json:"registered"`
+	LastRequest []string `json:"lastRequest"`
+}
+
+// handleMiddlewareOrder returns the order the middlewares were registered in
+// and the order they ran in for the last request that completed
+func (t *middlewareTrace) handleMiddlewareOrder(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	order := middlewareOrder{
+		Enabled:     t.enabled,
+		Registered:  append([]string{}, t.registered...),
+		LastRequest: append([]string{}, t.last...),
+	}
+	t.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// overflowLabel replaces label values once a labelGuard is full
+const overflowLabel = "overflow"
+
+// otherLabel is the path label of requests that matched no route, such as
+// the 404s and 405s of the router, so scanned URLs never become labels
+const otherLabel = "other"
+
+// pathLabel returns the path label of r, its route template or otherLabel
+func pathLabel(r *http.Request) string {
+	if route := routeTemplate(r); route != "" {
+		return route
+	}
+	return otherLabel
+}
+
+// labelGuard caps the number of distinct values of label to protect against
+// cardinality explosions, a max of zero or less disables the cap
+type labelGuard struct {
+	mu    sync.Mutex
+	label string
+	max   int
+	seen  map[string]struct{}
+}
+
+func newLabelGuard(label string, max int) *labelGuard {
+	return &labelGuard{label: label, max: max, seen: map[string]struct{}{}}
+}
+
+// Label returns value while it fits within the cap and overflowLabel
+// afterwards, counting in metric_label_cardinality_dropped_total every value
+// it suppresses. otherLabel is a single series and always fits.
+func (g *labelGuard) Label(value string) string {
+	if g.max <= 0 || value == otherLabel {
+		return value
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.seen[value]; ok {
+		return value
+	}
+	if len(g.seen) >= g.max {
+		cardinalityOverflow.Inc()
+		cardinalityDropped.WithLabelValues(g.label).Inc()
+		return overflowLabel
+	}
+	g.seen[value] = struct{}{}
+	return value
+}
+
+// Reserve claims a slot for value without counting an overflow when the cap
+// is reached, it reports whether value fits within the cap
+func (g *labelGuard) Reserve(value string) bool {
+	if g.max <= 0 {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.seen[value]; ok {
+		return true
+	}
+	if len(g.seen) >= g.max {
+		return false
+	}
+	g.seen[value] = struct{}{}
+	return true
+}
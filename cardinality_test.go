@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLabelGuard(t *testing.T) {
+	before := testutil.ToFloat64(cardinalityOverflow)
+	droppedBefore := testutil.ToFloat64(cardinalityDropped.WithLabelValues("path"))
+	guard := newLabelGuard("path", 2)
+
+	for _, tt := range []struct {
+		value    string
+		expected string
+	}{
+		{value: "/a", expected: "/a"},
+		{value: "/b", expected: "/b"},
+		{value: "/c", expected: overflowLabel},
+		{value: "/a", expected: "/a"},
+		{value: "/d", expected: overflowLabel},
+		{value: otherLabel, expected: otherLabel},
+	} {
+		if label := guard.Label(tt.value); label != tt.expected {
+			t.Errorf("Expected label %q for %q, but got %q", tt.expected, tt.value, label)
+		}
+	}
+
+	if got := testutil.ToFloat64(cardinalityOverflow) - before; got != 2 {
+		t.Errorf("Expected 2 overflows, but got %v", got)
+	}
+	if got := testutil.ToFloat64(cardinalityDropped.WithLabelValues("path")) - droppedBefore; got != 2 {
+		t.Errorf("Expected 2 dropped path label values, but got %v", got)
+	}
+}
+
+func TestPathLabelWithoutRoute(t *testing.T) {
+	// a request outside of a router has no route, like an unmatched one
+	handler := prometheusMiddleware(newLabelGuard("path", 1))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+
+	before := pathRequests(otherLabel)
+	for _, path := range []string{"/wp-login.php", "/.env", "/admin"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if got := pathRequests(otherLabel) - before; got != 3 {
+		t.Errorf("Expected the 3 requests without a route under path %q, but got %v", otherLabel, got)
+	}
+	for _, path := range []string{"", "/wp-login.php"} {
+		if got := pathRequests(path); got != 0 {
+			t.Errorf("Expected no requests under path %q, but got %v", path, got)
+		}
+	}
+}
+
+func TestPathLabelCardinalityCap(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.MaxPathLabels = 2
+	router := NewServer(cfg).Handler()
+
+	overflowBefore := testutil.ToFloat64(cardinalityOverflow)
+	requestsBefore := pathRequests(overflowLabel)
+	durationBefore := histogramCount(t, httpDuration.WithLabelValues(overflowLabel, "GET", "200"))
+	readyzBefore := pathRequests("/api/readyz")
+
+	// the first two registered routes, /api/metrics and /api/healthz, are reserved at startup
+	for _, path := range []string{"/api/metrics", "/api/healthz", "/api/readyz"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := pathRequests(overflowLabel) - requestsBefore; got != 1 {
+		t.Errorf("Expected 1 request in the overflow bucket, but got %v", got)
+	}
+	if got := pathRequests("/api/readyz") - readyzBefore; got != 0 {
+		t.Errorf("Expected no requests recorded for the path past the cap, but got %v", got)
+	}
+	if got := testutil.ToFloat64(cardinalityOverflow) - overflowBefore; got != 1 {
+		t.Errorf("Expected the overflow counter to increase by 1, but got %v", got)
+	}
+	if got := histogramCount(t, httpDuration.WithLabelValues(overflowLabel, "GET", "200")) - durationBefore; got != 1 {
+		t.Errorf("Expected 1 duration observed in the overflow bucket, but got %d", got)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/cmwylie19/prometheus-workshop/utils"
+)
+
+// Chaos modes reported by chaos_active
+const (
+	chaosModeLatency = "latency"
+	chaosModeErrors  = "errors"
+	chaosModeCPU     = "cpu"
+	chaosModeMemory  = "memory"
+)
+
+// chaosDefaultDuration is how long an injection lasts when no duration is
+// given, and chaosMaxDuration bounds it so a forgotten injection ends
+// without a restart
+const (
+	chaosDefaultDuration = 5 * time.Minute
+	chaosMaxDuration     = time.Hour
+)
+
+// chaosRoute is where chaos is injected, it is left alone like the
+// operationalRoutes so an injected error rate cannot stop it being ended
+const chaosRoute = "/api/debug/chaos"
+
+// chaosExempt reports whether chaos is never injected into r
+func chaosExempt(r *http.Request) bool {
+	route := routeTemplate(r)
+	return operationalRoutes[route] || route == chaosRoute
+}
+
+// chaosMaxMemory caps the memory pressure an injection can add
+const chaosMaxMemory = 1 << 30
+
+// chaosInjection is the pressure put on the process on top of the faults
+type chaosInjection struct {
+	CPU    int
+	Memory int
+}
+
+// chaos holds the faults injected into requests. The faults start out as
+// the configured ones, and an injection replaces them for a bounded duration,
+// optionally adding CPU and memory pressure, before they go back to the
+// configured ones.
+type chaos struct {
+	baseline config.Chaos
+
+	mu       sync.RWMutex
+	current  config.Chaos
+	pressure chaosInjection
+	until    time.Time
+	cancel   context.CancelFunc
+	// id tells an injection that ended apart from one that replaced it
+	id int
+}
+
+func newChaos(cfg config.Chaos) *chaos {
+	c := &chaos{baseline: cfg, current: cfg}
+	c.setActive()
+	return c
+}
+
+// faults returns the faults currently injected into requests
+func (c *chaos) faults() config.Chaos {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.current
+}
+
+// setActive records the current faults in chaos_active, c.mu must be held
+func (c *chaos) setActive() {
+	active := map[string]bool{
+		chaosModeLatency: c.current.LatencyProb > 0 && c.current.Latency > 0,
+		chaosModeErrors:  c.current.ErrorProb > 0,
+		chaosModeCPU:     c.pressure.CPU > 0,
+		chaosModeMemory:  c.pressure.Memory > 0,
+	}
+	for mode, on := range active {
+		value := 0.0
+		if on {
+			value = 1
+		}
+		chaosActive.WithLabelValues(mode).Set(value)
+	}
+}
+
+// Inject replaces the faults with faults and adds pressure for d, replacing
+// any injection still running
+func (c *chaos) Inject(faults config.Chaos, pressure chaosInjection, d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	c.id++
+	id := c.id
+	c.current, c.pressure, c.until, c.cancel = faults, pressure, time.Now().Add(d), cancel
+	c.setActive()
+	for i := 0; i < pressure.CPU; i++ {
+		go burnCPU(ctx)
+	}
+	if pressure.Memory > 0 {
+		go holdMemory(ctx, pressure.Memory)
+	}
+
+	go func() {
+		<-ctx.Done()
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.id == id {
+			c.resetLocked()
+		}
+	}()
+}
+
+// Reset ends the running injection, going back to the configured faults
+func (c *chaos) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resetLocked()
+}
+
+func (c *chaos) resetLocked() {
+	if c.cancel != nil {
+		c.cancel()
+		c.cancel = nil
+	}
+	c.current, c.pressure, c.until = c.baseline, chaosInjection{}, time.Time{}
+	c.setActive()
+}
+
+// burnCPU keeps a CPU busy until ctx is done
+func burnCPU(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// holdMemory keeps size bytes of memory in use until ctx is done, writing to
+// every page so the memory is resident and not only reserved
+func holdMemory(ctx context.Context, size int) {
+	buf := make([]byte, size)
+	for i := 0; i < len(buf); i += 4096 {
+		buf[i] = 1
+	}
+	<-ctx.Done()
+	runtime.KeepAlive(buf)
+}
+
+// latencyMiddleware delays requests by a random duration up to the Latency
+// being injected, with probability LatencyProb, to practice latency alerting
+// on every route. It runs inside the timeout middleware, so the delay counts
+// against the request timeout like a slow handler would. A client that goes
+// away while its request is delayed is not served.
+func (c *chaos) latencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		faults := c.faults()
+		if faults.Latency <= 0 || chaosExempt(r) || rand.Float64() >= faults.LatencyProb {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		chaosInjections.Inc()
+		delay := time.NewTimer(time.Duration(rand.Int63n(int64(faults.Latency))) + 1)
+		defer delay.Stop()
+		select {
+		case <-delay.C:
+			next.ServeHTTP(w, r)
+		case <-r.Context().Done():
+		}
+	})
+}
+
+// chaosStatuses are the errors errorMiddleware answers with
+var chaosStatuses = []int{
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// errorMiddleware answers requests with a random 5xx from chaosStatuses
+// instead of calling the handler with probability ErrorProb, so error rate
+// alerts can be seen firing
+func (c *chaos) errorMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if chaosExempt(r) || rand.Float64() >= c.faults().ErrorProb {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		chaosErrors.Inc()
+		status := chaosStatuses[rand.Intn(len(chaosStatuses))]
+		writeError(w, r, status, "chaos: "+http.StatusText(status))
+	})
+}
+
+// chaosState is the body returned by /api/debug/chaos
+type chaosState struct {
+	Latency     string  `json:"latency"`
+	LatencyProb float64 `json:"latencyProb"`
+	ErrorProb   float64 `json:"errorProb"`
+	CPU         int     `json:"cpu"`
+	Memory      int     `json:"memoryBytes"`
+	Until       string  `json:"until,omitempty"`
+}
+
+func (c *chaos) state() chaosState {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	state := chaosState{
+		Latency:     c.current.Latency.String(),
+		LatencyProb: c.current.LatencyProb,
+		ErrorProb:   c.current.ErrorProb,
+		CPU:         c.pressure.CPU,
+		Memory:      c.pressure.Memory,
+	}
+	if !c.until.IsZero() {
+		state.Until = c.until.UTC().Format(time.RFC3339)
+	}
+	return state
+}
+
+// handleChaos injects faults with a POST, for the duration query parameter
+// and five minutes by default, and ends the injection with a DELETE. The
+// latency, latencyProb and errorProb query parameters set the faults, cpu
+// the number of CPUs to keep busy and memory the bytes to hold on to.
+// Every method returns the faults now injected.
+func (c *chaos) handleChaos(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		faults, pressure, d, err := parseChaosQuery(r)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		c.Inject(faults, pressure, d)
+		utils.WriteLog("WARNING", fmt.Sprintf("Injecting chaos for %s: %+v, %+v", d, faults, pressure))
+	case http.MethodDelete:
+		c.Reset()
+		utils.WriteLog("INFO", "Ended the chaos injection")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.state())
+}
+
+// parseChaosQuery returns the faults, pressure and duration of an injection
+func parseChaosQuery(r *http.Request) (config.Chaos, chaosInjection, time.Duration, error) {
+	query := r.URL.Query()
+	var faults config.Chaos
+	var pressure chaosInjection
+	d := chaosDefaultDuration
+	var err error
+
+	if value := query.Get("latency"); value != "" {
+		if faults.Latency, err = time.ParseDuration(value); err != nil || faults.Latency < 0 || faults.Latency > maxSlowDuration {
+			return faults, pressure, 0, fmt.Errorf("latency must be between 0 and %s", maxSlowDuration)
+		}
+		faults.LatencyProb = 1
+	}
+	for name, p := range map[string]*float64{"latencyProb": &faults.LatencyProb, "errorProb": &faults.ErrorProb} {
+		if value := query.Get(name); value != "" {
+			if *p, err = strconv.ParseFloat(value, 64); err != nil || *p < 0 || *p > 1 {
+				return faults, pressure, 0, fmt.Errorf("%s must be between 0 and 1", name)
+			}
+		}
+	}
+	if value := query.Get("cpu"); value != "" {
+		if pressure.CPU, err = strconv.Atoi(value); err != nil || pressure.CPU < 0 || pressure.CPU > runtime.NumCPU() {
+			return faults, pressure, 0, fmt.Errorf("cpu must be between 0 and %d", runtime.NumCPU())
+		}
+	}
+	if value := query.Get("memory"); value != "" {
+		if pressure.Memory, err = strconv.Atoi(value); err != nil || pressure.Memory < 0 || pressure.Memory > chaosMaxMemory {
+			return faults, pressure, 0, fmt.Errorf("memory must be between 0 and %d bytes", chaosMaxMemory)
+		}
+	}
+	if value := query.Get("duration"); value != "" {
+		if d, err = time.ParseDuration(value); err != nil || d <= 0 || d > chaosMaxDuration {
+			return faults, pressure, 0, fmt.Errorf("duration must be between 0 and %s", chaosMaxDuration)
+		}
+	}
+	return faults, pressure, d, nil
+}
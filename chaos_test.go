@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestChaosLatency(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Chaos = config.Chaos{Latency: 20 * time.Millisecond, LatencyProb: 1}
+	router := NewServer(cfg).Handler()
+
+	before := testutil.ToFloat64(chaosInjections)
+	for i := 0; i < 5; i++ {
+		getHits(t, router)
+	}
+	if got := testutil.ToFloat64(chaosInjections) - before; got != 5 {
+		t.Errorf("Expected every request to be delayed, but chaos_injections_total increased by %v", got)
+	}
+
+	// probes are never delayed
+	before = testutil.ToFloat64(chaosInjections)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/healthz", nil))
+	if got := testutil.ToFloat64(chaosInjections) - before; got != 0 {
+		t.Errorf("Expected /api/healthz not to be delayed, but chaos_injections_total increased by %v", got)
+	}
+}
+
+func TestChaosLatencyCanceled(t *testing.T) {
+	served := false
+	router := newTestRouter(newChaos(config.Chaos{Latency: time.Hour, LatencyProb: 1}).latencyMiddleware)
+	router.Path("/test/chaos").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/chaos", nil).WithContext(ctx))
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the delay to end with the request, but it took %s", elapsed)
+	}
+	if served {
+		t.Errorf("Expected a canceled request not to be served")
+	}
+}
+
+func TestChaosErrors(t *testing.T) {
+	for _, prob := range []float64{1, 0} {
+		served := 0
+		router := newTestRouter(newChaos(config.Chaos{ErrorProb: prob}).errorMiddleware)
+		router.Path("/test/chaos").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			served++
+		})
+
+		before := testutil.ToFloat64(chaosErrors)
+		for i := 0; i < 5; i++ {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/test/chaos", nil))
+			if prob == 1 && rr.Code < 500 {
+				t.Errorf("Expected a 5xx with probability 1, but got %d", rr.Code)
+			}
+			if prob == 0 && rr.Code != http.StatusOK {
+				t.Errorf("Expected status %d with probability 0, but got %d", http.StatusOK, rr.Code)
+			}
+		}
+
+		expected := 0.0
+		if prob == 1 {
+			expected = 5
+		}
+		if got := testutil.ToFloat64(chaosErrors) - before; got != expected {
+			t.Errorf("Expected chaos_errors_total to increase by %v with probability %v, but got %v", expected, prob, got)
+		}
+		if served != 5-int(expected) {
+			t.Errorf("Expected the handler to be called %d times with probability %v, but it was called %d times", 5-int(expected), prob, served)
+		}
+	}
+
+	// probes and scrapes are never failed
+	router := newTestRouter(newChaos(config.Chaos{ErrorProb: 1}).errorMiddleware)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected /api/healthz to be left alone, but got %d", rr.Code)
+	}
+}
+
+func TestChaosHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	s := newServer(cfg, prometheus.NewRegistry())
+	router := s.Handler()
+
+	for _, query := range []string{"errorProb=2", "latency=1h", "cpu=-1", "duration=2h", "memory=x"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/debug/chaos?"+query, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("Expected status %d for %s, but got %d", http.StatusBadRequest, query, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/debug/chaos?errorProb=1&memory=4096&duration=1m", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if got := testutil.ToFloat64(chaosActive.WithLabelValues(chaosModeErrors)); got != 1 {
+		t.Errorf("Expected chaos_active{mode=\"errors\"} to be 1, but got %v", got)
+	}
+	if got := testutil.ToFloat64(chaosActive.WithLabelValues(chaosModeMemory)); got != 1 {
+		t.Errorf("Expected chaos_active{mode=\"memory\"} to be 1, but got %v", got)
+	}
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	if rr.Code < 500 {
+		t.Errorf("Expected an injected 5xx, but got %d", rr.Code)
+	}
+
+	// the injection can still be ended while every request fails
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/api/debug/chaos", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+	if got := testutil.ToFloat64(chaosActive.WithLabelValues(chaosModeErrors)); got != 0 {
+		t.Errorf("Expected chaos_active{mode=\"errors\"} to be 0 once ended, but got %v", got)
+	}
+	getHits(t, router)
+}
+
+func TestChaosInjectionEnds(t *testing.T) {
+	c := newChaos(config.Chaos{})
+	c.Inject(config.Chaos{ErrorProb: 1}, chaosInjection{CPU: 1}, 20*time.Millisecond)
+	if got := testutil.ToFloat64(chaosActive.WithLabelValues(chaosModeCPU)); got != 1 {
+		t.Errorf("Expected chaos_active{mode=\"cpu\"} to be 1, but got %v", got)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for c.faults().ErrorProb != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := c.faults().ErrorProb; got != 0 {
+		t.Errorf("Expected the injection to end after its duration, but errorProb is %v", got)
+	}
+	if got := testutil.ToFloat64(chaosActive.WithLabelValues(chaosModeCPU)); got != 0 {
+		t.Errorf("Expected chaos_active{mode=\"cpu\"} to be 0 once ended, but got %v", got)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// goroutineCollector reports the number of goroutines when scraped. It is a
+// minimal example of a custom collector: the value is read in Collect on every
+// scrape instead of being kept up to date by the application.
+type goroutineCollector struct{}
+
+// goroutinesDesc describes app_goroutines, descriptors must be the same on every call to Describe
+var goroutinesDesc = prometheus.NewDesc(
+	"app_goroutines",
+	"Number of goroutines that currently exist.",
+	nil,
+	prometheus.Labels{"metrics": "custom"},
+)
+
+func (goroutineCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- goroutinesDesc
+}
+
+func (goroutineCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(goroutinesDesc, prometheus.GaugeValue, float64(runtime.NumGoroutine()))
+}
+
+// appCollectTimeout bounds how long a scrape waits on the hit store
+const appCollectTimeout = 2 * time.Second
+
+// startedAt is when the process started, for app_uptime_seconds
+var startedAt = time.Now()
+
+// Descriptors of the metrics appCollector gathers on every scrape
+var (
+	buildInfoDesc = prometheus.NewDesc(
+		"app_build_info",
+		"Always 1, labelled with the version and commit the app was built from.",
+		[]string{"version", "commit", "goversion"},
+		prometheus.Labels{"metrics": "custom"},
+	)
+	uptimeDesc = prometheus.NewDesc(
+		"app_uptime_seconds",
+		"Seconds since the app started.",
+		nil,
+		prometheus.Labels{"metrics": "custom"},
+	)
+	hitsStoredDesc = prometheus.NewDesc(
+		"app_hits_stored",
+		"Number of hits in the hit store, shared by every replica with the redis backend.",
+		nil,
+		prometheus.Labels{"metrics": "custom"},
+	)
+	staticFilesDesc = prometheus.NewDesc(
+		"app_static_files",
+		"Number of files served from the static directories.",
+		nil,
+		prometheus.Labels{"metrics": "custom"},
+	)
+	staticFileBytesDesc = prometheus.NewDesc(
+		"app_static_file_bytes",
+		"Total size in bytes of the files served from the static directories.",
+		nil,
+		prometheus.Labels{"metrics": "custom"},
+	)
+	collectSuccessDesc = prometheus.NewDesc(
+		"app_collect_success",
+		"1 if the source was read on the last scrape, 0 if it failed.",
+		[]string{"source"},
+		prometheus.Labels{"metrics": "custom"},
+	)
+)
+
+// appCollector gathers business metrics from the state of the app when
+// scraped, where direct instrumentation would have to track every change: the
+// hits in the hit store, the files in the static directories, the uptime and
+// the build. A source that fails to be read leaves its metrics out of the
+// scrape and sets app_collect_success to 0 instead of failing the scrape.
+type appCollector struct {
+	mu        sync.RWMutex
+	staticDir string
+}
+
+// app gathers the business metrics of the web app
+var app = &appCollector{}
+
+// configureAppCollector sets the colon-separated static directories whose files are counted
+func configureAppCollector(staticDir string) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	app.staticDir = staticDir
+}
+
+func (c *appCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- buildInfoDesc
+	ch <- uptimeDesc
+	ch <- hitsStoredDesc
+	ch <- staticFilesDesc
+	ch <- staticFileBytesDesc
+	ch <- collectSuccessDesc
+}
+
+func (c *appCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(buildInfoDesc, prometheus.GaugeValue, 1, version, commit, runtime.Version())
+	ch <- prometheus.MustNewConstMetric(uptimeDesc, prometheus.GaugeValue, time.Since(startedAt).Seconds())
+
+	ctx, cancel := context.WithTimeout(context.Background(), appCollectTimeout)
+	defer cancel()
+	hits, err := hitStore.Get(ctx)
+	c.collectSuccess(ch, "hits", err)
+	if err == nil {
+		ch <- prometheus.MustNewConstMetric(hitsStoredDesc, prometheus.GaugeValue, float64(hits))
+	}
+
+	c.mu.RLock()
+	staticDir := c.staticDir
+	c.mu.RUnlock()
+	if staticDir == "" {
+		return
+	}
+	files, size, err := staticFiles(staticDir)
+	c.collectSuccess(ch, "static", err)
+	if err == nil {
+		ch <- prometheus.MustNewConstMetric(staticFilesDesc, prometheus.GaugeValue, float64(files))
+		ch <- prometheus.MustNewConstMetric(staticFileBytesDesc, prometheus.GaugeValue, float64(size))
+	}
+}
+
+// collectSuccess reports whether source was read, logging why it was not
+func (c *appCollector) collectSuccess(ch chan<- prometheus.Metric, source string, err error) {
+	value := 1.0
+	if err != nil {
+		value = 0
+		utils.WriteLog("WARNING", fmt.Sprintf("Failed to collect the %s metrics: %s", source, err))
+	}
+	ch <- prometheus.MustNewConstMetric(collectSuccessDesc, prometheus.GaugeValue, value, source)
+}
+
+// staticFiles returns the number and total size of the files in the
+// colon-separated dirs, a file overridden by a later directory counts once
+func staticFiles(dirs string) (int, int64, error) {
+	sizes := map[string]int64{}
+	for _, dir := range strings.Split(dirs, ":") {
+		if dir == "" {
+			continue
+		}
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(dir, path)
+			sizes[rel] = info.Size()
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	var total int64
+	for _, size := range sizes {
+		total += size
+	}
+	return len(sizes), total, nil
+}
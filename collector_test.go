@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGoroutineCollector(t *testing.T) {
+	if got := testutil.ToFloat64(goroutineCollector{}); got < 1 {
+		t.Errorf("Expected at least 1 goroutine, but got %v", got)
+	}
+
+	s, _ := NewTestServer(t)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+
+	match := regexp.MustCompile(`(?m)^app_goroutines\{metrics="custom"\} (\d+)$`).FindStringSubmatch(rr.Body.String())
+	if match == nil {
+		t.Fatalf("Expected app_goroutines on /api/metrics, but got %s", rr.Body.String())
+	}
+	if n, _ := strconv.Atoi(match[1]); n < 1 {
+		t.Errorf("Expected app_goroutines to be at least 1, but got %d", n)
+	}
+}
+
+func TestAppCollector(t *testing.T) {
+	defer func(store HitStore) { hitStore = store }(hitStore)
+	hitStore = newMemoryStore()
+	hitStore.Add(context.Background(), 42)
+
+	base, override := t.TempDir(), t.TempDir()
+	os.WriteFile(filepath.Join(base, "index.html"), []byte("base"), 0o644)
+	os.WriteFile(filepath.Join(base, "app.js"), []byte("console.log()"), 0o644)
+	os.WriteFile(filepath.Join(override, "index.html"), []byte("override"), 0o644)
+	defer configureAppCollector("")
+	configureAppCollector(base + ":" + override)
+
+	expected := fmt.Sprintf(`
+# HELP app_build_info Always 1, labelled with the version and commit the app was built from.
+# TYPE app_build_info gauge
+app_build_info{commit="unknown",goversion=%q,metrics="custom",version="dev"} 1
+# HELP app_collect_success 1 if the source was read on the last scrape, 0 if it failed.
+# TYPE app_collect_success gauge
+app_collect_success{metrics="custom",source="hits"} 1
+app_collect_success{metrics="custom",source="static"} 1
+# HELP app_hits_stored Number of hits in the hit store, shared by every replica with the redis backend.
+# TYPE app_hits_stored gauge
+app_hits_stored{metrics="custom"} 42
+# HELP app_static_file_bytes Total size in bytes of the files served from the static directories.
+# TYPE app_static_file_bytes gauge
+app_static_file_bytes{metrics="custom"} 21
+# HELP app_static_files Number of files served from the static directories.
+# TYPE app_static_files gauge
+app_static_files{metrics="custom"} 2
+`, runtime.Version())
+	if err := testutil.CollectAndCompare(app, strings.NewReader(expected), "app_build_info", "app_collect_success", "app_hits_stored", "app_static_file_bytes", "app_static_files"); err != nil {
+		t.Error(err)
+	}
+
+	// a source that cannot be read is left out instead of failing the scrape
+	configureAppCollector(filepath.Join(base, "missing"))
+	expected = `
+# HELP app_collect_success 1 if the source was read on the last scrape, 0 if it failed.
+# TYPE app_collect_success gauge
+app_collect_success{metrics="custom",source="hits"} 1
+app_collect_success{metrics="custom",source="static"} 0
+`
+	if err := testutil.CollectAndCompare(app, strings.NewReader(expected), "app_collect_success", "app_static_files"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		// gzip;q=0 explicitly refuses gzip
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			q, err := strconv.ParseFloat(params[len("q="):], 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+// gzipResponseWriter compresses everything written to it
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	zw           *gzip.Writer
+	compressed   *countingWriter
+	uncompressed int64
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	// the length of the compressed response is not known up front
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.zw.Write(p)
+	w.uncompressed += int64(n)
+	return n, err
+}
+
+// gzipResponseMiddleware gzips the responses of next for clients that accept
+// it and counts the bytes before and after compression, so dashboards can
+// show the bandwidth saved
+func gzipResponseMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		compressed := &countingWriter{w: w}
+		gw := &gzipResponseWriter{ResponseWriter: w, zw: gzip.NewWriter(compressed), compressed: compressed}
+		next.ServeHTTP(gw, r)
+		gw.zw.Close()
+
+		httpUncompressedBytes.Add(float64(gw.uncompressed))
+		httpCompressedBytes.Add(float64(compressed.n))
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// routeConcurrencyRetryAfter is how long clients are asked to back off when a route is at its limit
+const routeConcurrencyRetryAfter = time.Second
+
+// routeConcurrencyMiddleware limits how many requests to each route of limits
+// run at once, rejecting the ones over a route's limit with a 503 straight
+// away. Each route has its own limit, so a saturated route leaves the others alone.
+func routeConcurrencyMiddleware(limits map[string]int) mux.MiddlewareFunc {
+	slots := make(map[string]chan struct{}, len(limits))
+	for route, limit := range limits {
+		slots[route] = make(chan struct{}, limit)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := routeTemplate(r)
+			route, ok := slots[path]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			select {
+			case route <- struct{}{}:
+			default:
+				routeConcurrencyRejected.WithLabelValues(path).Inc()
+				setRetryAfter(w, routeConcurrencyRetryAfter)
+				writeError(w, r, http.StatusServiceUnavailable, "too many concurrent requests for "+path)
+				return
+			}
+			defer func() { <-route }()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRouteConcurrencyMiddleware(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	router := mux.NewRouter()
+	router.Use(routeConcurrencyMiddleware(map[string]int{"/test/slow": 2, "/test/other": 1}))
+	router.Path("/test/slow").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+	})
+	router.Path("/test/other").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	before := testutil.ToFloat64(routeConcurrencyRejected.WithLabelValues("/test/slow"))
+
+	// saturate /test/slow
+	done := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/test/slow", nil))
+			done <- rr.Code
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected both requests to /test/slow to start")
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/test/slow", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d over the route's limit, but got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+	if got := testutil.ToFloat64(routeConcurrencyRejected.WithLabelValues("/test/slow")) - before; got != 1 {
+		t.Errorf("Expected http_route_concurrency_rejected_total{path=\"/test/slow\"} to increase by 1, but got %v", got)
+	}
+
+	// other routes keep their own limit
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/test/other", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d for /test/other, but got %d", http.StatusOK, rr.Code)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-done; code != http.StatusOK {
+			t.Errorf("Expected status %d for the requests within the limit, but got %d", http.StatusOK, code)
+		}
+	}
+}
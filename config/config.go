@@ -0,0 +1,766 @@
+// Package config loads the settings of the demo blog from a YAML or JSON
+// config file, with environment variables taking precedence over the file and
+// command line flags taking precedence over both.
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// RateLimit configures the token bucket rate limiter, a zero RPS disables it.
+// PerIPRPS and PerIPBurst limit every client IP likewise on top of it, a zero
+// PerIPRPS leaves clients limited by the global limit alone.
+type RateLimit struct {
+	RPS        float64 `yaml:"rps"`
+	Burst      int     `yaml:"burst"`
+	PerIPRPS   float64 `yaml:"perIPRPS"`
+	PerIPBurst int     `yaml:"perIPBurst"`
+}
+
+// HitStore configures where the number of hits is stored, reads are cached
+// for CacheTTL so concurrent readers share one backend call, zero disables the cache.
+// Every backend call is cancelled after Timeout, zero only cancels it with its request.
+type HitStore struct {
+	Backend  string        `yaml:"backend"`
+	File     string        `yaml:"file"`
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Redis    Redis         `yaml:"redis"`
+}
+
+// Redis configures the redis hit store backend. Up to PoolSize idle
+// connections are kept, and commands failing on a broken connection are
+// retried up to MaxRetries times.
+type Redis struct {
+	Addr       string `yaml:"addr"`
+	Password   string `yaml:"password" secret:"true"`
+	DB         int    `yaml:"db"`
+	Key        string `yaml:"key"`
+	PoolSize   int    `yaml:"poolSize"`
+	MaxRetries int    `yaml:"maxRetries"`
+}
+
+// Metrics configures the /api/metrics handler, a zero MaxRequestsInFlight
+// allows unlimited concurrent scrapes. A NativeHistogramBucketFactor above 1
+// makes the duration and size histograms native histograms as well, with that
+// growth factor between buckets, zero keeps them classic only.
+// LegacyRequestLabels labels http_requests_total and http_response_time_seconds
+// by path alone, without method and status, while dashboards are migrated.
+// A scrape taking longer than Timeout is answered with a 503, zero waits for
+// it however long it takes. The Go and process collectors are registered
+// unless disabled, GoRuntimeMetrics adds the runtime/metrics groups named
+// (gc, memory, scheduler or all) to the go_ metrics.
+type Metrics struct {
+	MaxRequestsInFlight         int           `yaml:"maxRequestsInFlight"`
+	Timeout                     time.Duration `yaml:"timeout"`
+	DisableCompression          bool          `yaml:"disableCompression"`
+	NativeHistogramBucketFactor float64       `yaml:"nativeHistogramBucketFactor"`
+	LegacyRequestLabels         bool          `yaml:"legacyRequestLabels"`
+	Auth                        MetricsAuth   `yaml:"auth"`
+	DisableGoCollector          bool          `yaml:"disableGoCollector"`
+	DisableProcessCollector     bool          `yaml:"disableProcessCollector"`
+	GoRuntimeMetrics            []string      `yaml:"goRuntimeMetrics"`
+}
+
+// MetricsAuth protects /api/metrics with basic auth when Username is set,
+// and with a bearer token when BearerToken is set. A scrape passing either
+// is served, with neither set scrapes need no credentials.
+type MetricsAuth struct {
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password" secret:"true"`
+	BearerToken string `yaml:"bearerToken" secret:"true"`
+}
+
+// SLO configures the service level objective of the web app. A request is
+// good when it does not fail with a 5xx and is answered within Latency, or
+// whatever its duration with a zero Latency. Objective is the ratio of good
+// requests aimed for, zero disables the SLO.
+type SLO struct {
+	Objective float64       `yaml:"objective"`
+	Latency   time.Duration `yaml:"latency"`
+}
+
+// Items configures the /api/v1/items demo API, its items are kept in memory
+// or in the Redis hash Key, using the Redis settings of the HitStore. Every
+// request waits a random duration up to Latency and listing the items up to
+// twice that, so its latencies are worth graphing.
+type Items struct {
+	Backend string        `yaml:"backend"`
+	Key     string        `yaml:"key"`
+	Latency time.Duration `yaml:"latency"`
+}
+
+// WorkerPool bounds the concurrent requests to Routes to Size, with up to
+// QueueSize more waiting for a worker, a zero Size disables it
+type WorkerPool struct {
+	Size      int      `yaml:"size"`
+	QueueSize int      `yaml:"queueSize"`
+	Routes    []string `yaml:"routes"`
+}
+
+// AccessLog configures logging every request. SampleRates logs only that
+// fraction of the requests to a route, for high-traffic routes such as the
+// probes. Requests answered with a 5xx are always logged, at ERROR so they
+// are kept whatever the LogLevel.
+type AccessLog struct {
+	Enabled     bool               `yaml:"enabled"`
+	SampleRates map[string]float64 `yaml:"sampleRates"`
+}
+
+// CORS configures cross-origin requests, MaxAge caches preflights and
+// AllowCredentials echoes the request origin instead of allowing any origin
+type CORS struct {
+	MaxAge           time.Duration `yaml:"maxAge"`
+	AllowCredentials bool          `yaml:"allowCredentials"`
+}
+
+// TLS configures serving the web app over HTTPS, an empty CertFile serves
+// plain HTTP. SelfSigned serves HTTPS with a certificate generated at
+// startup instead, for development only since clients cannot verify it.
+type TLS struct {
+	CertFile   string `yaml:"certFile"`
+	KeyFile    string `yaml:"keyFile"`
+	SelfSigned bool   `yaml:"selfSigned"`
+}
+
+// Enabled reports whether the web app is served over HTTPS
+func (t TLS) Enabled() bool {
+	return t.CertFile != "" || t.SelfSigned
+}
+
+// Chaos injects faults into requests to practice alerting on them. Each
+// request is delayed by up to Latency with probability LatencyProb, and
+// answered with a random 5xx with probability ErrorProb. A zero
+// probability, the default, disables the fault.
+type Chaos struct {
+	Latency     time.Duration `yaml:"latency"`
+	LatencyProb float64       `yaml:"latencyProb"`
+	ErrorProb   float64       `yaml:"errorProb"`
+}
+
+// OTLP configures pushing metrics to an OTLP/HTTP endpoint, an empty Endpoint disables it
+type OTLP struct {
+	Endpoint    string        `yaml:"endpoint" secret:"url"`
+	Interval    time.Duration `yaml:"interval"`
+	ServiceName string        `yaml:"serviceName"`
+}
+
+// Push modes, pushing to a Pushgateway or sending samples with Prometheus remote_write
+const (
+	PushPushgateway = "pushgateway"
+	PushRemoteWrite = "remote_write"
+)
+
+// Push configures pushing the metrics for batch job demos every Interval, to
+// the Pushgateway or remote_write endpoint at URL, an empty URL disables it.
+// The metrics are grouped by Job, Instance and Labels, Instance names the
+// replica like the instance label of MetricConstLabels by default.
+// /api/metrics is still served.
+type Push struct {
+	Mode     string            `yaml:"mode"`
+	URL      string            `yaml:"url" secret:"url"`
+	Interval time.Duration     `yaml:"interval"`
+	Job      string            `yaml:"job"`
+	Instance string            `yaml:"instance"`
+	Labels   map[string]string `yaml:"labels"`
+}
+
+// Tracing configures exporting a span per request to an OTLP/HTTP traces
+// endpoint, an empty Endpoint disables it. New traces are sampled with
+// probability SampleRatio, requests continuing a trace keep its decision.
+type Tracing struct {
+	Endpoint    string  `yaml:"endpoint" secret:"url"`
+	SampleRatio float64 `yaml:"sampleRatio"`
+}
+
+// Config holds every setting of the demo blog. String fields tagged
+// `secret:"true"` are masked by Redacted, and so is the password of URLs
+// tagged `secret:"url"`.
+type Config struct {
+	Port                 string                   `yaml:"port"`
+	AdminPort            string                   `yaml:"adminPort"`
+	BasePath             string                   `yaml:"basePath"`
+	StaticDir            string                   `yaml:"staticDir"`
+	SPAFallback          bool                     `yaml:"spaFallback"`
+	StaticPlaceholder    bool                     `yaml:"staticPlaceholder"`
+	HitMethods           []string                 `yaml:"hitMethods"`
+	StaticContentType    string                   `yaml:"staticContentType"`
+	StaticContentTypes   map[string]string        `yaml:"staticContentTypes"`
+	RootMode             string                   `yaml:"rootMode"`
+	RootRedirectURL      string                   `yaml:"rootRedirectURL"`
+	Debug                bool                     `yaml:"debug"`
+	Pprof                bool                     `yaml:"pprof"`
+	TraceMiddleware      bool                     `yaml:"traceMiddleware"`
+	EnableH2C            bool                     `yaml:"enableH2C"`
+	LogLevel             string                   `yaml:"logLevel"`
+	LogFormat            string                   `yaml:"logFormat"`
+	AccessLog            AccessLog                `yaml:"accessLog"`
+	ReadyAfter           time.Duration            `yaml:"readyAfter"`
+	FailReady            bool                     `yaml:"failReady"`
+	RequestTimeout       time.Duration            `yaml:"requestTimeout"`
+	RouteTimeouts        map[string]time.Duration `yaml:"routeTimeouts"`
+	RouteConcurrency     map[string]int           `yaml:"routeConcurrency"`
+	ReadHeaderTimeout    time.Duration            `yaml:"readHeaderTimeout"`
+	BodyReadTimeout      time.Duration            `yaml:"bodyReadTimeout"`
+	DisableKeepAlive     bool                     `yaml:"disableKeepAlive"`
+	SlowThreshold        time.Duration            `yaml:"slowThreshold"`
+	ShutdownDelay        time.Duration            `yaml:"shutdownDelay"`
+	FinalScrapeWait      time.Duration            `yaml:"finalScrapeWait"`
+	DrainTimeout         time.Duration            `yaml:"drainTimeout"`
+	HTTPDurationBuckets  []float64                `yaml:"httpDurationBuckets"`
+	MetricConstLabels    map[string]string        `yaml:"metricConstLabels"`
+	AddInstanceLabel     bool                     `yaml:"addInstanceLabel"`
+	IdempotencyTTL       time.Duration            `yaml:"idempotencyTTL"`
+	IdempotencyCacheSize int                      `yaml:"idempotencyCacheSize"`
+	MaxPathLabels        int                      `yaml:"maxPathLabels"`
+	MaxBodyBytes         int                      `yaml:"maxBodyBytes"`
+	TrustedProxies       []string                 `yaml:"trustedProxies"`
+	CanonicalHost        string                   `yaml:"canonicalHost"`
+	VersionHeader        string                   `yaml:"versionHeader"`
+	VersionHeaderEnabled bool                     `yaml:"versionHeaderEnabled"`
+	RateLimit            RateLimit                `yaml:"rateLimit"`
+	HitStore             HitStore                 `yaml:"hitStore"`
+	Metrics              Metrics                  `yaml:"metrics"`
+	Items                Items                    `yaml:"items"`
+	SLO                  SLO                      `yaml:"slo"`
+	Features             map[string]bool          `yaml:"features"`
+	OTLP                 OTLP                     `yaml:"otlp"`
+	Tracing              Tracing                  `yaml:"tracing"`
+	Push                 Push                     `yaml:"push"`
+	CORS                 CORS                     `yaml:"cors"`
+	WorkerPool           WorkerPool               `yaml:"workerPool"`
+	TLS                  TLS                      `yaml:"tls"`
+	Chaos                Chaos                    `yaml:"chaos"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		Port:                 "8080",
+		StaticDir:            "./static",
+		StaticPlaceholder:    true,
+		HitMethods:           []string{"GET"},
+		RootMode:             "static",
+		LogLevel:             "INFO",
+		LogFormat:            utils.LogFormatJSON,
+		MaxPathLabels:        100,
+		MaxBodyBytes:         1 << 20,
+		HTTPDurationBuckets:  prometheus.DefBuckets,
+		IdempotencyTTL:       time.Minute,
+		IdempotencyCacheSize: 1000,
+		ReadHeaderTimeout:    10 * time.Second,
+		DrainTimeout:         30 * time.Second,
+		VersionHeader:        "X-App-Version",
+		VersionHeaderEnabled: true,
+		HitStore: HitStore{
+			Backend:  "memory",
+			File:     "hits",
+			CacheTTL: 100 * time.Millisecond,
+			Timeout:  time.Second,
+			Redis: Redis{
+				Addr:       "localhost:6379",
+				Key:        "hits",
+				PoolSize:   10,
+				MaxRetries: 3,
+			},
+		},
+		SLO: SLO{
+			Objective: 0.99,
+			Latency:   300 * time.Millisecond,
+		},
+		Items: Items{
+			Backend: "memory",
+			Key:     "items",
+			Latency: 50 * time.Millisecond,
+		},
+		Features: map[string]bool{
+			"gzip":       true,
+			"tracing":    true,
+			"rate_limit": true,
+			"redis":      true,
+		},
+		OTLP: OTLP{
+			Interval:    time.Minute,
+			ServiceName: "demo-blog",
+		},
+		Tracing: Tracing{
+			SampleRatio: 1,
+		},
+		Push: Push{
+			Mode:     PushPushgateway,
+			Interval: 15 * time.Second,
+			Job:      "demo-blog",
+		},
+	}
+}
+
+// Load returns the defaults overridden by the config file at path, if any,
+// and then by environment variables
+func Load(path string) (*Config, error) {
+	cfg, err := load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// load is Load without the validation, so flags can be applied first
+func load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		// JSON is valid YAML, so this reads both
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	cfg.applyEnv()
+	return cfg, nil
+}
+
+// applyEnv overrides cfg with the environment variables that are set
+func (cfg *Config) applyEnv() {
+	cfg.Port = utils.GetEnv("PORT", cfg.Port)
+	cfg.AdminPort = utils.GetEnv("ADMIN_PORT", cfg.AdminPort)
+	cfg.BasePath = utils.GetEnv("BASE_PATH", cfg.BasePath)
+	cfg.StaticDir = utils.GetEnv("STATIC_DIR", cfg.StaticDir)
+	cfg.SPAFallback = utils.GetEnvBool("SPA_FALLBACK", cfg.SPAFallback)
+	cfg.StaticPlaceholder = utils.GetEnvBool("STATIC_PLACEHOLDER", cfg.StaticPlaceholder)
+	cfg.HitMethods = utils.GetEnvList("HIT_METHODS", cfg.HitMethods)
+	cfg.StaticContentType = utils.GetEnv("STATIC_CONTENT_TYPE", cfg.StaticContentType)
+	for _, item := range utils.GetEnvList("STATIC_CONTENT_TYPES", nil) {
+		path, contentType, err := parseContentType(item)
+		if err != nil {
+			utils.WriteLog("WARNING", fmt.Sprintf("Invalid STATIC_CONTENT_TYPES entry: %s, ignoring", err))
+			continue
+		}
+		if cfg.StaticContentTypes == nil {
+			cfg.StaticContentTypes = map[string]string{}
+		}
+		cfg.StaticContentTypes[path] = contentType
+	}
+	cfg.RootMode = utils.GetEnv("ROOT_MODE", cfg.RootMode)
+	cfg.RootRedirectURL = utils.GetEnv("ROOT_REDIRECT_URL", cfg.RootRedirectURL)
+	cfg.Debug = utils.GetEnvBool("DEBUG", cfg.Debug)
+	cfg.Pprof = utils.GetEnvBool("PPROF", cfg.Pprof)
+	cfg.TraceMiddleware = utils.GetEnvBool("TRACE_MIDDLEWARE", cfg.TraceMiddleware)
+	cfg.EnableH2C = utils.GetEnvBool("ENABLE_H2C", cfg.EnableH2C)
+	cfg.LogLevel = utils.GetEnv("LOG_LEVEL", cfg.LogLevel)
+	cfg.LogFormat = strings.ToLower(utils.GetEnv("LOG_FORMAT", cfg.LogFormat))
+	cfg.AccessLog.Enabled = utils.GetEnvBool("ACCESS_LOG", cfg.AccessLog.Enabled)
+	for _, item := range utils.GetEnvList("ACCESS_LOG_SAMPLE_RATES", nil) {
+		route, rate, err := parseSampleRate(item)
+		if err != nil {
+			utils.WriteLog("WARNING", fmt.Sprintf("Invalid ACCESS_LOG_SAMPLE_RATES entry: %s, ignoring", err))
+			continue
+		}
+		if cfg.AccessLog.SampleRates == nil {
+			cfg.AccessLog.SampleRates = map[string]float64{}
+		}
+		cfg.AccessLog.SampleRates[route] = rate
+	}
+	cfg.ReadyAfter = utils.GetEnvDuration("READY_AFTER", cfg.ReadyAfter)
+	cfg.FailReady = utils.GetEnvBool("FAIL_READY", cfg.FailReady)
+	cfg.RequestTimeout = utils.GetEnvDuration("REQUEST_TIMEOUT", cfg.RequestTimeout)
+	for _, item := range utils.GetEnvList("ROUTE_TIMEOUTS", nil) {
+		route, timeout, err := parseRouteTimeout(item)
+		if err != nil {
+			utils.WriteLog("WARNING", fmt.Sprintf("Invalid ROUTE_TIMEOUTS entry: %s, ignoring", err))
+			continue
+		}
+		if cfg.RouteTimeouts == nil {
+			cfg.RouteTimeouts = map[string]time.Duration{}
+		}
+		cfg.RouteTimeouts[route] = timeout
+	}
+	for _, item := range utils.GetEnvList("ROUTE_CONCURRENCY", nil) {
+		route, limit, err := parseRouteConcurrency(item)
+		if err != nil {
+			utils.WriteLog("WARNING", fmt.Sprintf("Invalid ROUTE_CONCURRENCY entry: %s, ignoring", err))
+			continue
+		}
+		if cfg.RouteConcurrency == nil {
+			cfg.RouteConcurrency = map[string]int{}
+		}
+		cfg.RouteConcurrency[route] = limit
+	}
+	cfg.ReadHeaderTimeout = utils.GetEnvDuration("READ_HEADER_TIMEOUT", cfg.ReadHeaderTimeout)
+	cfg.BodyReadTimeout = utils.GetEnvDuration("BODY_READ_TIMEOUT", cfg.BodyReadTimeout)
+	cfg.DisableKeepAlive = utils.GetEnvBool("DISABLE_KEEPALIVE", cfg.DisableKeepAlive)
+	cfg.SlowThreshold = utils.GetEnvDuration("SLOW_THRESHOLD", cfg.SlowThreshold)
+	cfg.ShutdownDelay = utils.GetEnvDuration("SHUTDOWN_DELAY", cfg.ShutdownDelay)
+	cfg.FinalScrapeWait = utils.GetEnvDuration("FINAL_SCRAPE_WAIT", cfg.FinalScrapeWait)
+	cfg.DrainTimeout = utils.GetEnvDuration("DRAIN_TIMEOUT", cfg.DrainTimeout)
+	cfg.IdempotencyTTL = utils.GetEnvDuration("IDEMPOTENCY_TTL", cfg.IdempotencyTTL)
+	cfg.IdempotencyCacheSize = utils.GetEnvInt("IDEMPOTENCY_CACHE_SIZE", cfg.IdempotencyCacheSize)
+	if list := utils.GetEnvList("HTTP_DURATION_BUCKETS", nil); list != nil {
+		buckets, err := parseBuckets(list)
+		if err != nil {
+			utils.WriteLog("WARNING", fmt.Sprintf("Invalid HTTP_DURATION_BUCKETS: %s, using %v", err, cfg.HTTPDurationBuckets))
+		} else {
+			cfg.HTTPDurationBuckets = buckets
+		}
+	}
+	for _, item := range utils.GetEnvList("METRIC_CONST_LABELS", nil) {
+		name, value, err := parseConstLabel(item)
+		if err != nil {
+			utils.WriteLog("WARNING", fmt.Sprintf("Invalid METRIC_CONST_LABELS entry: %s, ignoring", err))
+			continue
+		}
+		if cfg.MetricConstLabels == nil {
+			cfg.MetricConstLabels = map[string]string{}
+		}
+		cfg.MetricConstLabels[name] = value
+	}
+	cfg.AddInstanceLabel = utils.GetEnvBool("ADD_INSTANCE_LABEL", cfg.AddInstanceLabel)
+	if cfg.AddInstanceLabel {
+		if cfg.MetricConstLabels == nil {
+			cfg.MetricConstLabels = map[string]string{}
+		}
+		cfg.MetricConstLabels["instance"] = instanceName()
+		utils.WriteLog("WARNING", fmt.Sprintf("Adding instance=%q to every custom metric, each replica and restart under a new name adds its own series", cfg.MetricConstLabels["instance"]))
+	}
+	cfg.MaxPathLabels = utils.GetEnvInt("MAX_PATH_LABELS", cfg.MaxPathLabels)
+	cfg.MaxBodyBytes = utils.GetEnvInt("MAX_BODY_BYTES", cfg.MaxBodyBytes)
+	cfg.TrustedProxies = utils.GetEnvList("TRUSTED_PROXIES", cfg.TrustedProxies)
+	cfg.CanonicalHost = utils.GetEnv("CANONICAL_HOST", cfg.CanonicalHost)
+	cfg.VersionHeader = utils.GetEnv("VERSION_HEADER", cfg.VersionHeader)
+	cfg.VersionHeaderEnabled = utils.GetEnvBool("VERSION_HEADER_ENABLED", cfg.VersionHeaderEnabled)
+	cfg.RateLimit.RPS = utils.GetEnvFloat("RATE_LIMIT_RPS", cfg.RateLimit.RPS)
+	cfg.RateLimit.Burst = utils.GetEnvInt("RATE_LIMIT_BURST", cfg.RateLimit.Burst)
+	cfg.RateLimit.PerIPRPS = utils.GetEnvFloat("RATE_LIMIT_PER_IP_RPS", cfg.RateLimit.PerIPRPS)
+	cfg.RateLimit.PerIPBurst = utils.GetEnvInt("RATE_LIMIT_PER_IP_BURST", cfg.RateLimit.PerIPBurst)
+	cfg.HitStore.Backend = utils.GetEnv("HIT_STORE", cfg.HitStore.Backend)
+	cfg.HitStore.File = utils.GetEnv("HIT_STORE_FILE", cfg.HitStore.File)
+	cfg.HitStore.CacheTTL = utils.GetEnvDuration("HIT_STORE_CACHE_TTL", cfg.HitStore.CacheTTL)
+	cfg.HitStore.Timeout = utils.GetEnvDuration("HIT_STORE_TIMEOUT", cfg.HitStore.Timeout)
+	cfg.HitStore.Redis.Addr = utils.GetEnv("REDIS_ADDR", cfg.HitStore.Redis.Addr)
+	cfg.HitStore.Redis.Password = utils.GetEnv("REDIS_PASSWORD", cfg.HitStore.Redis.Password)
+	cfg.HitStore.Redis.DB = utils.GetEnvInt("REDIS_DB", cfg.HitStore.Redis.DB)
+	cfg.HitStore.Redis.Key = utils.GetEnv("REDIS_KEY", cfg.HitStore.Redis.Key)
+	cfg.HitStore.Redis.PoolSize = utils.GetEnvInt("REDIS_POOL_SIZE", cfg.HitStore.Redis.PoolSize)
+	cfg.HitStore.Redis.MaxRetries = utils.GetEnvInt("REDIS_MAX_RETRIES", cfg.HitStore.Redis.MaxRetries)
+	cfg.Metrics.MaxRequestsInFlight = utils.GetEnvInt("METRICS_MAX_REQUESTS_IN_FLIGHT", cfg.Metrics.MaxRequestsInFlight)
+	cfg.Metrics.Timeout = utils.GetEnvDuration("METRICS_TIMEOUT", cfg.Metrics.Timeout)
+	cfg.Metrics.Auth.Username = utils.GetEnv("METRICS_AUTH_USERNAME", cfg.Metrics.Auth.Username)
+	cfg.Metrics.Auth.Password = utils.GetEnv("METRICS_AUTH_PASSWORD", cfg.Metrics.Auth.Password)
+	cfg.Metrics.Auth.BearerToken = utils.GetEnv("METRICS_AUTH_BEARER_TOKEN", cfg.Metrics.Auth.BearerToken)
+	cfg.Metrics.DisableCompression = utils.GetEnvBool("METRICS_DISABLE_COMPRESSION", cfg.Metrics.DisableCompression)
+	cfg.Metrics.LegacyRequestLabels = utils.GetEnvBool("METRICS_LEGACY_REQUEST_LABELS", cfg.Metrics.LegacyRequestLabels)
+	cfg.Metrics.NativeHistogramBucketFactor = utils.GetEnvFloat("METRICS_NATIVE_HISTOGRAM_BUCKET_FACTOR", cfg.Metrics.NativeHistogramBucketFactor)
+	cfg.Metrics.DisableGoCollector = utils.GetEnvBool("METRICS_DISABLE_GO_COLLECTOR", cfg.Metrics.DisableGoCollector)
+	cfg.Metrics.DisableProcessCollector = utils.GetEnvBool("METRICS_DISABLE_PROCESS_COLLECTOR", cfg.Metrics.DisableProcessCollector)
+	cfg.Metrics.GoRuntimeMetrics = utils.GetEnvList("METRICS_GO_RUNTIME_METRICS", cfg.Metrics.GoRuntimeMetrics)
+	cfg.SLO.Objective = utils.GetEnvFloat("SLO_OBJECTIVE", cfg.SLO.Objective)
+	cfg.SLO.Latency = utils.GetEnvDuration("SLO_LATENCY", cfg.SLO.Latency)
+	cfg.Items.Backend = utils.GetEnv("ITEMS_BACKEND", cfg.Items.Backend)
+	cfg.Items.Key = utils.GetEnv("ITEMS_REDIS_KEY", cfg.Items.Key)
+	cfg.Items.Latency = utils.GetEnvDuration("ITEMS_LATENCY", cfg.Items.Latency)
+	cfg.WorkerPool.Size = utils.GetEnvInt("WORKER_POOL_SIZE", cfg.WorkerPool.Size)
+	cfg.WorkerPool.QueueSize = utils.GetEnvInt("WORKER_POOL_QUEUE_SIZE", cfg.WorkerPool.QueueSize)
+	cfg.WorkerPool.Routes = utils.GetEnvList("WORKER_POOL_ROUTES", cfg.WorkerPool.Routes)
+	cfg.TLS.CertFile = utils.GetEnv("TLS_CERT_FILE", cfg.TLS.CertFile)
+	cfg.TLS.KeyFile = utils.GetEnv("TLS_KEY_FILE", cfg.TLS.KeyFile)
+	cfg.TLS.SelfSigned = utils.GetEnvBool("TLS_SELF_SIGNED", cfg.TLS.SelfSigned)
+	cfg.Chaos.Latency = time.Duration(utils.GetEnvInt("CHAOS_LATENCY_MS", int(cfg.Chaos.Latency/time.Millisecond))) * time.Millisecond
+	cfg.Chaos.LatencyProb = utils.GetEnvFloat("CHAOS_LATENCY_PROB", cfg.Chaos.LatencyProb)
+	cfg.Chaos.ErrorProb = utils.GetEnvFloat("CHAOS_ERROR_PROB", cfg.Chaos.ErrorProb)
+	cfg.CORS.MaxAge = utils.GetEnvDuration("CORS_MAX_AGE", cfg.CORS.MaxAge)
+	cfg.CORS.AllowCredentials = utils.GetEnvBool("CORS_ALLOW_CREDENTIALS", cfg.CORS.AllowCredentials)
+	cfg.OTLP.Endpoint = utils.GetEnv("OTEL_EXPORTER_OTLP_METRICS_ENDPOINT", cfg.OTLP.Endpoint)
+	// the OpenTelemetry spec sets the export interval in milliseconds
+	cfg.OTLP.Interval = time.Duration(utils.GetEnvInt("OTEL_METRIC_EXPORT_INTERVAL", int(cfg.OTLP.Interval/time.Millisecond))) * time.Millisecond
+	cfg.OTLP.ServiceName = utils.GetEnv("OTEL_SERVICE_NAME", cfg.OTLP.ServiceName)
+	cfg.Tracing.Endpoint = utils.GetEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", cfg.Tracing.Endpoint)
+	cfg.Tracing.SampleRatio = utils.GetEnvFloat("OTEL_TRACES_SAMPLER_ARG", cfg.Tracing.SampleRatio)
+	cfg.Push.Mode = strings.ToLower(utils.GetEnv("PUSH_MODE", cfg.Push.Mode))
+	cfg.Push.URL = utils.GetEnv("PUSH_URL", cfg.Push.URL)
+	cfg.Push.Interval = utils.GetEnvDuration("PUSH_INTERVAL", cfg.Push.Interval)
+	cfg.Push.Job = utils.GetEnv("PUSH_JOB", cfg.Push.Job)
+	cfg.Push.Instance = utils.GetEnv("PUSH_INSTANCE", cfg.Push.Instance)
+	for _, item := range utils.GetEnvList("PUSH_LABELS", nil) {
+		name, value, err := parseConstLabel(item)
+		if err != nil {
+			utils.WriteLog("WARNING", fmt.Sprintf("Invalid PUSH_LABELS entry: %s, ignoring", err))
+			continue
+		}
+		if cfg.Push.Labels == nil {
+			cfg.Push.Labels = map[string]string{}
+		}
+		cfg.Push.Labels[name] = value
+	}
+	if cfg.Push.URL != "" && cfg.Push.Instance == "" {
+		cfg.Push.Instance = instanceName()
+	}
+	if cfg.Features == nil {
+		cfg.Features = map[string]bool{}
+	}
+	for _, item := range utils.GetEnvList("FEATURES", nil) {
+		name, value, err := parseFeature(item)
+		if err != nil {
+			utils.WriteLog("WARNING", fmt.Sprintf("Invalid FEATURES entry: %s, ignoring", err))
+			continue
+		}
+		cfg.Features[name] = value
+	}
+}
+
+// hitStoreBackends are the known HitStore backends
+var hitStoreBackends = []string{"memory", "file", "redis"}
+
+// itemsBackends are the known Items backends
+var itemsBackends = []string{"memory", "redis"}
+
+// GoRuntimeMetricGroups are the known Metrics.GoRuntimeMetrics groups
+var GoRuntimeMetricGroups = []string{"gc", "memory", "scheduler", "all"}
+
+// Validate returns an error for the first setting that cannot work
+func (cfg *Config) Validate() error {
+	if port, err := strconv.Atoi(cfg.Port); err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", cfg.Port)
+	}
+	if cfg.AdminPort != "" {
+		if port, err := strconv.Atoi(cfg.AdminPort); err != nil || port < 0 || port > 65535 {
+			return fmt.Errorf("invalid admin port %q", cfg.AdminPort)
+		}
+		if cfg.AdminPort == cfg.Port && cfg.Port != "0" {
+			return fmt.Errorf("admin port %s must differ from the port of the web app", cfg.AdminPort)
+		}
+	}
+	if (cfg.TLS.CertFile == "") != (cfg.TLS.KeyFile == "") {
+		return fmt.Errorf("TLS needs both a cert file and a key file")
+	}
+	if cfg.TLS.SelfSigned && cfg.TLS.CertFile != "" {
+		return fmt.Errorf("TLS cannot use both a cert file and a self-signed certificate")
+	}
+	if (cfg.Metrics.Auth.Username == "") != (cfg.Metrics.Auth.Password == "") {
+		return fmt.Errorf("metrics basic auth needs both a username and a password")
+	}
+	if cfg.Metrics.Timeout < 0 {
+		return fmt.Errorf("metrics timeout %s must not be negative", cfg.Metrics.Timeout)
+	}
+	if cfg.LogFormat != utils.LogFormatJSON && cfg.LogFormat != utils.LogFormatLogfmt {
+		return fmt.Errorf("unknown log format %q, expected %s or %s", cfg.LogFormat, utils.LogFormatJSON, utils.LogFormatLogfmt)
+	}
+	for route, rate := range cfg.AccessLog.SampleRates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("access log sample rate %v of %s must be between 0 and 1", rate, route)
+		}
+	}
+	if !contains(hitStoreBackends, cfg.HitStore.Backend) {
+		return fmt.Errorf("unknown hit store backend %q, expected one of %v", cfg.HitStore.Backend, hitStoreBackends)
+	}
+	if !contains(itemsBackends, cfg.Items.Backend) {
+		return fmt.Errorf("unknown items backend %q, expected one of %v", cfg.Items.Backend, itemsBackends)
+	}
+	if cfg.SLO.Objective < 0 || cfg.SLO.Objective >= 1 {
+		return fmt.Errorf("slo objective %v must be at least 0 and below 1", cfg.SLO.Objective)
+	}
+	if cfg.SLO.Latency < 0 {
+		return fmt.Errorf("slo latency %s must not be negative", cfg.SLO.Latency)
+	}
+	if cfg.Items.Latency < 0 {
+		return fmt.Errorf("items latency %s must not be negative", cfg.Items.Latency)
+	}
+	if cfg.StaticDir == "" {
+		return fmt.Errorf("static dir must be set")
+	}
+	if len(cfg.HTTPDurationBuckets) == 0 {
+		return fmt.Errorf("at least one http duration bucket is required")
+	}
+	for _, group := range cfg.Metrics.GoRuntimeMetrics {
+		if !contains(GoRuntimeMetricGroups, group) {
+			return fmt.Errorf("unknown go runtime metrics group %q, expected one of %v", group, GoRuntimeMetricGroups)
+		}
+	}
+	if cfg.Metrics.DisableGoCollector && len(cfg.Metrics.GoRuntimeMetrics) > 0 {
+		return fmt.Errorf("go runtime metrics need the go collector, which is disabled")
+	}
+	if f := cfg.Metrics.NativeHistogramBucketFactor; f != 0 && f <= 1 {
+		return fmt.Errorf("native histogram bucket factor %v must be above 1, or 0 for classic histograms only", f)
+	}
+	for name, p := range map[string]float64{
+		"chaos latency probability": cfg.Chaos.LatencyProb,
+		"chaos error probability":   cfg.Chaos.ErrorProb,
+		"trace sample ratio":        cfg.Tracing.SampleRatio,
+	} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("%s %v must be between 0 and 1", name, p)
+		}
+	}
+	if cfg.Push.URL != "" {
+		if cfg.Push.Mode != PushPushgateway && cfg.Push.Mode != PushRemoteWrite {
+			return fmt.Errorf("unknown push mode %q, expected %s or %s", cfg.Push.Mode, PushPushgateway, PushRemoteWrite)
+		}
+		if cfg.Push.Interval <= 0 || cfg.Push.Job == "" {
+			return fmt.Errorf("pushing metrics needs a positive interval and a job, got %s and %q", cfg.Push.Interval, cfg.Push.Job)
+		}
+	}
+	if cfg.WorkerPool.Size < 0 || cfg.WorkerPool.QueueSize < 0 {
+		return fmt.Errorf("worker pool size %d and queue size %d must not be negative", cfg.WorkerPool.Size, cfg.WorkerPool.QueueSize)
+	}
+	for route, limit := range cfg.RouteConcurrency {
+		if limit <= 0 {
+			return fmt.Errorf("concurrency limit %d of %s must be positive", limit, route)
+		}
+	}
+	if cfg.RateLimit.RPS < 0 || cfg.RateLimit.Burst < 0 || cfg.RateLimit.PerIPRPS < 0 || cfg.RateLimit.PerIPBurst < 0 {
+		return fmt.Errorf("rate limit %+v must not be negative", cfg.RateLimit)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRouteTimeout parses a route=duration timeout override
+func parseRouteTimeout(item string) (string, time.Duration, error) {
+	route, value, found := strings.Cut(item, "=")
+	if !found {
+		return "", 0, fmt.Errorf("missing timeout for route %s", route)
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid timeout %q for route %s", value, route)
+	}
+	return route, timeout, nil
+}
+
+// parseRouteConcurrency parses a route=limit concurrency limit
+func parseRouteConcurrency(item string) (string, int, error) {
+	route, value, found := strings.Cut(item, "=")
+	if !found {
+		return "", 0, fmt.Errorf("missing limit for route %s", route)
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit <= 0 {
+		return "", 0, fmt.Errorf("invalid limit %q for route %s", value, route)
+	}
+	return route, limit, nil
+}
+
+// parseSampleRate parses a route=rate access log sample rate
+func parseSampleRate(item string) (string, float64, error) {
+	route, value, found := strings.Cut(item, "=")
+	if !found {
+		return "", 0, fmt.Errorf("missing sample rate for route %s", route)
+	}
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return "", 0, fmt.Errorf("invalid sample rate %q for route %s", value, route)
+	}
+	return route, rate, nil
+}
+
+// parseContentType parses a path=content-type override, a path ending in / is a prefix
+func parseContentType(item string) (string, string, error) {
+	path, contentType, found := strings.Cut(item, "=")
+	if !found || contentType == "" {
+		return "", "", fmt.Errorf("missing content type for path %s", path)
+	}
+	return path, contentType, nil
+}
+
+// parseConstLabel parses a name=value const label. The name must be a valid
+// label name that is not reserved, and metrics is already set on every metric.
+func parseConstLabel(item string) (string, string, error) {
+	name, value, found := strings.Cut(item, "=")
+	if !found {
+		return "", "", fmt.Errorf("missing value for label %s", name)
+	}
+	if !model.LabelName(name).IsValid() || strings.HasPrefix(name, "__") {
+		return "", "", fmt.Errorf("invalid label name %q", name)
+	}
+	if name == "metrics" {
+		return "", "", fmt.Errorf("label %s is reserved", name)
+	}
+	return name, value, nil
+}
+
+// instanceName names this replica for the instance label, POD_NAME if it is
+// set, the hostname otherwise
+func instanceName() string {
+	if name := utils.GetEnv("POD_NAME", ""); name != "" {
+		return name
+	}
+	name, err := os.Hostname()
+	if err != nil {
+		utils.WriteLog("WARNING", fmt.Sprintf("Failed to get the hostname for the instance label: %s", err))
+		return "unknown"
+	}
+	return name
+}
+
+// parseFeature parses a name=bool feature flag, a bare name enables the feature
+func parseFeature(item string) (string, bool, error) {
+	name, value, found := strings.Cut(item, "=")
+	if !found {
+		return name, true, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", false, fmt.Errorf("invalid value %q for feature %s", value, name)
+	}
+	return name, enabled, nil
+}
+
+// SLOBuckets are the boundaries of the slo bucket preset, in seconds. They
+// include the usual latency objectives, 100ms, 300ms and 1s, so the share of
+// requests within an objective can be read from a single bucket.
+var SLOBuckets = []float64{0.025, 0.05, 0.1, 0.2, 0.3, 0.5, 1, 2.5, 5, 10}
+
+// bucketPresets are the bucket sets that can be selected by name
+var bucketPresets = map[string][]float64{
+	"slo": SLOBuckets,
+}
+
+// parseBuckets parses a list of strictly increasing histogram bucket
+// boundaries, or the name of a preset from bucketPresets
+func parseBuckets(list []string) ([]float64, error) {
+	if len(list) == 1 {
+		if preset, ok := bucketPresets[strings.ToLower(list[0])]; ok {
+			return append([]float64(nil), preset...), nil
+		}
+	}
+	buckets := make([]float64, 0, len(list))
+	for _, item := range list {
+		b, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q", item)
+		}
+		buckets = append(buckets, b)
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		return nil, fmt.Errorf("buckets %v are not in increasing order", buckets)
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] == buckets[i-1] {
+			return nil, fmt.Errorf("duplicate bucket %v", buckets[i])
+		}
+	}
+	return buckets, nil
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+)
+
+// Flags are the command line overrides of the config, they take precedence
+// over the config file and environment variables. Only the flags that were
+// set on the command line override anything.
+type Flags struct {
+	// ConfigFile is the path of the config file, CONFIG_FILE by default
+	ConfigFile string
+
+	set       map[string]bool
+	port      string
+	adminPort string
+	staticDir string
+	certFile  string
+	keyFile   string
+	selfSign  bool
+	buckets   string
+	native    float64
+	legacy    bool
+	redisAddr string
+	logLevel  string
+	logFormat string
+	accessLog bool
+	failReady bool
+}
+
+// ParseFlags parses the command line arguments of the program called name
+func ParseFlags(name string, args []string) (*Flags, error) {
+	f := &Flags{set: map[string]bool{}}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&f.ConfigFile, "config", utils.GetEnv("CONFIG_FILE", ""), "path of the YAML or JSON config file")
+	fs.StringVar(&f.port, "port", "", "port to listen on")
+	fs.StringVar(&f.adminPort, "admin-port", "", "port serving the metrics, probes and debug endpoints apart from the web app, unset serves them on -port")
+	fs.StringVar(&f.staticDir, "static-dir", "", "directory of the static web app")
+	fs.StringVar(&f.certFile, "tls-cert-file", "", "TLS certificate file, serves HTTPS when set with -tls-key-file")
+	fs.StringVar(&f.keyFile, "tls-key-file", "", "TLS key file")
+	fs.BoolVar(&f.selfSign, "tls-self-signed", false, "serve HTTPS with a certificate generated at startup, for development")
+	fs.StringVar(&f.buckets, "http-duration-buckets", "", "comma-separated http_response_time_seconds buckets, or a preset name")
+	fs.Float64Var(&f.native, "native-histogram-bucket-factor", 0, "growth factor between native histogram buckets, 0 for classic histograms only")
+	fs.BoolVar(&f.legacy, "legacy-request-labels", false, "label http_requests_total and http_response_time_seconds by path alone, deprecated")
+	fs.StringVar(&f.redisAddr, "redis-addr", "", "address of Redis for the redis hit store")
+	fs.StringVar(&f.logLevel, "log-level", "", "minimum level of the logs written")
+	fs.StringVar(&f.logFormat, "log-format", "", "format of the logs written, json or logfmt")
+	fs.BoolVar(&f.accessLog, "access-log", false, "log every request")
+	fs.BoolVar(&f.failReady, "fail-ready", false, "fail readiness on purpose until it is turned off with POST /api/debug/fail-ready?enabled=false")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+	fs.Visit(func(fl *flag.Flag) { f.set[fl.Name] = true })
+	return f, nil
+}
+
+// Load loads the config file and environment variables like Load, then applies the flags
+func (f *Flags) Load() (*Config, error) {
+	cfg, err := load(f.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Apply(cfg); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Apply overrides cfg with the flags that were set
+func (f *Flags) Apply(cfg *Config) error {
+	if f.set["port"] {
+		cfg.Port = f.port
+	}
+	if f.set["admin-port"] {
+		cfg.AdminPort = f.adminPort
+	}
+	if f.set["static-dir"] {
+		cfg.StaticDir = f.staticDir
+	}
+	if f.set["tls-cert-file"] {
+		cfg.TLS.CertFile = f.certFile
+	}
+	if f.set["tls-key-file"] {
+		cfg.TLS.KeyFile = f.keyFile
+	}
+	if f.set["tls-self-signed"] {
+		cfg.TLS.SelfSigned = f.selfSign
+	}
+	if f.set["http-duration-buckets"] {
+		buckets, err := parseBuckets(utils.SplitList(f.buckets))
+		if err != nil {
+			return fmt.Errorf("invalid -http-duration-buckets: %w", err)
+		}
+		cfg.HTTPDurationBuckets = buckets
+	}
+	if f.set["native-histogram-bucket-factor"] {
+		cfg.Metrics.NativeHistogramBucketFactor = f.native
+	}
+	if f.set["legacy-request-labels"] {
+		cfg.Metrics.LegacyRequestLabels = f.legacy
+	}
+	if f.set["redis-addr"] {
+		cfg.HitStore.Redis.Addr = f.redisAddr
+	}
+	if f.set["log-level"] {
+		cfg.LogLevel = strings.ToUpper(f.logLevel)
+	}
+	if f.set["log-format"] {
+		cfg.LogFormat = strings.ToLower(f.logFormat)
+	}
+	if f.set["access-log"] {
+		cfg.AccessLog.Enabled = f.accessLog
+	}
+	if f.set["fail-ready"] {
+		cfg.FailReady = f.failReady
+	}
+	return nil
+}
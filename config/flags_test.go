@@ -0,0 +1,133 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlags(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(path, []byte(`{"port": "2112", "staticDir": "/srv/static", "logLevel": "DEBUG"}`), 0o644)
+	if err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	t.Setenv("STATIC_DIR", "/env/static")
+	t.Setenv("REDIS_ADDR", "redis:6379")
+
+	flags, err := ParseFlags("test", []string{"--config", path, "-port=9090", "-admin-port", "9091", "-http-duration-buckets", "slo", "-log-level", "warning"})
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if flags.ConfigFile != path {
+		t.Errorf("Expected config file %q, but got %q", path, flags.ConfigFile)
+	}
+	cfg, err := flags.Load()
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	if cfg.Port != "9090" || cfg.AdminPort != "9091" {
+		t.Errorf("Expected ports %q and %q from the flags, but got %q and %q", "9090", "9091", cfg.Port, cfg.AdminPort)
+	}
+	if cfg.StaticDir != "/env/static" {
+		t.Errorf("Expected static dir %q from the environment, but got %q", "/env/static", cfg.StaticDir)
+	}
+	if cfg.HitStore.Redis.Addr != "redis:6379" {
+		t.Errorf("Expected the unset -redis-addr to leave %q, but got %q", "redis:6379", cfg.HitStore.Redis.Addr)
+	}
+	if !reflect.DeepEqual(cfg.HTTPDurationBuckets, SLOBuckets) {
+		t.Errorf("Expected the slo buckets from the flag, but got %v", cfg.HTTPDurationBuckets)
+	}
+	if cfg.LogLevel != "WARNING" {
+		t.Errorf("Expected log level %q from the flag, but got %q", "WARNING", cfg.LogLevel)
+	}
+}
+
+func TestFlagsConfigFileEnv(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "/etc/demo-blog.yaml")
+	flags, err := ParseFlags("test", nil)
+	if err != nil {
+		t.Fatalf("Failed to parse flags: %v", err)
+	}
+	if flags.ConfigFile != "/etc/demo-blog.yaml" {
+		t.Errorf("Expected config file %q from CONFIG_FILE, but got %q", "/etc/demo-blog.yaml", flags.ConfigFile)
+	}
+}
+
+func TestFlagsErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"-unknown"},
+		{"extra"},
+	} {
+		if _, err := ParseFlags("test", args); err == nil {
+			t.Errorf("Expected an error parsing %v", args)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-port", "http"},
+		{"-port", "70000"},
+		{"-tls-cert-file", "cert.pem"},
+		{"-http-duration-buckets", "1,0.5"},
+		{"-native-histogram-bucket-factor", "0.5"},
+	} {
+		flags, err := ParseFlags("test", args)
+		if err != nil {
+			t.Fatalf("Failed to parse flags %v: %v", args, err)
+		}
+		if _, err := flags.Load(); err == nil {
+			t.Errorf("Expected an error loading the config with %v", args)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+	}{
+		{"unknown backend", func(cfg *Config) { cfg.HitStore.Backend = "etcd" }},
+		{"missing static dir", func(cfg *Config) { cfg.StaticDir = "" }},
+		{"no buckets", func(cfg *Config) { cfg.HTTPDurationBuckets = nil }},
+		{"probability above one", func(cfg *Config) { cfg.Chaos.ErrorProb = 1.5 }},
+		{"native histogram factor of one", func(cfg *Config) { cfg.Metrics.NativeHistogramBucketFactor = 1 }},
+		{"unknown log format", func(cfg *Config) { cfg.LogFormat = "xml" }},
+		{"sample rate above one", func(cfg *Config) { cfg.AccessLog.SampleRates = map[string]float64{"/": 2} }},
+		{"negative rate limit", func(cfg *Config) { cfg.RateLimit.RPS = -1 }},
+		{"negative per-IP rate limit", func(cfg *Config) { cfg.RateLimit.PerIPBurst = -1 }},
+		{"self-signed with a cert file", func(cfg *Config) { cfg.TLS = TLS{CertFile: "cert.pem", KeyFile: "key.pem", SelfSigned: true} }},
+		{"username without password", func(cfg *Config) { cfg.Metrics.Auth.Username = "prometheus" }},
+		{"admin port of the web app", func(cfg *Config) { cfg.AdminPort = cfg.Port }},
+		{"invalid admin port", func(cfg *Config) { cfg.AdminPort = "admin" }},
+		{"negative metrics timeout", func(cfg *Config) { cfg.Metrics.Timeout = -time.Second }},
+		{"slo objective of one", func(cfg *Config) { cfg.SLO.Objective = 1 }},
+		{"negative worker pool size", func(cfg *Config) { cfg.WorkerPool.Size = -1 }},
+		{"negative worker pool queue size", func(cfg *Config) { cfg.WorkerPool = WorkerPool{Size: 2, QueueSize: -1} }},
+		{"negative route concurrency", func(cfg *Config) { cfg.RouteConcurrency = map[string]int{"/api/hits": -1} }},
+		{"zero route concurrency", func(cfg *Config) { cfg.RouteConcurrency = map[string]int{"/api/hits": 0} }},
+		{"negative slo latency", func(cfg *Config) { cfg.SLO.Latency = -time.Millisecond }},
+		{"unknown items backend", func(cfg *Config) { cfg.Items.Backend = "file" }},
+		{"negative items latency", func(cfg *Config) { cfg.Items.Latency = -time.Millisecond }},
+		{"unknown go runtime metrics", func(cfg *Config) { cfg.Metrics.GoRuntimeMetrics = []string{"heap"} }},
+		{"go runtime metrics without the go collector", func(cfg *Config) {
+			cfg.Metrics.DisableGoCollector = true
+			cfg.Metrics.GoRuntimeMetrics = []string{"gc"}
+		}},
+	}
+
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("Expected the defaults to be valid, but got %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+			if err := cfg.Validate(); err == nil {
+				t.Errorf("Expected a validation error")
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"net/url"
+	"reflect"
+)
+
+// redacted replaces the value of secret settings
+const redacted = "REDACTED"
+
+// Redacted returns a copy of cfg safe to show to users, with every string field
+// tagged `secret:"true"` masked when it is set, and the password of every URL
+// tagged `secret:"url"` masked
+func (cfg Config) Redacted() Config {
+	redact(reflect.ValueOf(&cfg).Elem())
+	return cfg
+}
+
+// redact masks the secret string fields of the struct v, recursing into nested structs
+func redact(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() == reflect.Struct {
+			redact(field)
+			continue
+		}
+		if field.Kind() != reflect.String || field.String() == "" {
+			continue
+		}
+		switch v.Type().Field(i).Tag.Get("secret") {
+		case "true":
+			field.SetString(redacted)
+		case "url":
+			field.SetString(redactURL(field.String()))
+		}
+	}
+}
+
+// redactURL masks the password of rawURL, an invalid URL is masked whole
+// since where its password is cannot be told
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redacted
+	}
+	return u.Redacted()
+}
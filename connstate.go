@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// connTracker keeps gauge in line with the state of every connection of an
+// http.Server. Connections are counted in their current state, and once they
+// end they stay counted in the terminal closed or hijacked state.
+type connTracker struct {
+	mu     sync.Mutex
+	states map[net.Conn]http.ConnState
+	gauge  *prometheus.GaugeVec
+}
+
+func newConnTracker(gauge *prometheus.GaugeVec) *connTracker {
+	for _, state := range []http.ConnState{http.StateNew, http.StateActive, http.StateIdle, http.StateHijacked, http.StateClosed} {
+		gauge.WithLabelValues(state.String())
+	}
+	return &connTracker{states: map[net.Conn]http.ConnState{}, gauge: gauge}
+}
+
+// ConnState moves conn from its previous state to state, it is meant for http.Server.ConnState
+func (c *connTracker) ConnState(conn net.Conn, state http.ConnState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if prev, ok := c.states[conn]; ok {
+		c.gauge.WithLabelValues(prev.String()).Dec()
+	}
+	c.gauge.WithLabelValues(state.String()).Inc()
+
+	switch state {
+	case http.StateClosed, http.StateHijacked:
+		delete(c.states, conn)
+	default:
+		c.states[conn] = state
+	}
+}
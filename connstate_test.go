@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnTracker(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := l.Addr().String()
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_http_connections"}, []string{"state"})
+	cfg := testConfig(t)
+	cfg.Debug = true
+	s := NewServer(cfg)
+	s.srv.ConnState = newConnTracker(gauge).ConnState
+	go s.Serve(l)
+	defer s.srv.Close()
+
+	// waitFor polls the gauges since the server updates them after the client sees the response
+	waitFor := func(expected map[string]float64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			got := map[string]float64{}
+			for state := range expected {
+				got[state] = testutil.ToFloat64(gauge.WithLabelValues(state))
+			}
+			if reflect.DeepEqual(got, expected) {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected connection states %v, but got %v", expected, got)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	transport := &http.Transport{}
+	client := &http.Client{Transport: transport}
+	request := func(path string) {
+		resp, err := client.Get("http://" + addr + path)
+		if err != nil {
+			t.Errorf("Failed to get %s: %v", path, err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	request("/api/healthz")
+	waitFor(map[string]float64{"active": 0, "idle": 1, "closed": 0})
+
+	// the second request reuses the idle keep-alive connection
+	done := make(chan struct{})
+	go func() {
+		request("/api/debug/slow?duration=300ms")
+		close(done)
+	}()
+	waitFor(map[string]float64{"new": 0, "active": 1, "idle": 0})
+	<-done
+	waitFor(map[string]float64{"active": 0, "idle": 1, "closed": 0})
+
+	transport.CloseIdleConnections()
+	waitFor(map[string]float64{"new": 0, "active": 0, "idle": 0, "closed": 1})
+}
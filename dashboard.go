@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// dashboardJSON is a Grafana dashboard graphing http_requests_total,
+// response_status and http_response_time_seconds, ready to be imported
+//
+//go:embed dashboard.json
+var dashboardJSON []byte
+
+// handleDashboard serves the bundled Grafana dashboard
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(dashboardJSON)
+}
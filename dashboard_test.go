@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboardHandler(t *testing.T) {
+	// served from the binary, not the static directory
+	cfg := testConfig(t)
+	cfg.StaticDir = t.TempDir()
+	router := NewServer(cfg).Handler()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/dashboard.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected Content-Type application/json, but got %q", got)
+	}
+
+	body := rr.Body.String()
+	var dashboard map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &dashboard); err != nil {
+		t.Fatalf("Expected the dashboard to be valid JSON, but got %v", err)
+	}
+	for _, name := range []string{"http_requests_total", "response_status", "http_response_time_seconds"} {
+		if !strings.Contains(body, name) {
+			t.Errorf("Expected the dashboard to graph %s", name)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// routeInfo describes a single route of the router
+type routeInfo struct {
+	Path         string   `json:"path"`
+	Methods      []string `json:"methods,omitempty"`
+	HitCounted   bool     `json:"hitCounted"`
+	Instrumented bool     `json:"instrumented"`
+}
+
+// routesHandler returns the route table of router as JSON
+func routesHandler(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes := []routeInfo{}
+		err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+			path, err := route.GetPathTemplate()
+			if err != nil {
+				return nil
+			}
+			methods, _ := route.GetMethods()
+			_, hitCounted := route.GetHandler().(hitCounter)
+
+			routes = append(routes, routeInfo{
+				Path:       path,
+				Methods:    methods,
+				HitCounted: hitCounted,
+				// every route on the router goes through prometheusMiddleware
+				Instrumented: true,
+			})
+			return nil
+		})
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(routes)
+	})
+}
+
+// heapStats is a summary of runtime.MemStats
+type heapStats struct {
+	HeapAlloc   uint64 `json:"heapAlloc"`
+	HeapInuse   uint64 `json:"heapInuse"`
+	HeapObjects uint64 `json:"heapObjects"`
+	NumGC       uint32 `json:"numGC"`
+}
+
+func readHeapStats() heapStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return heapStats{
+		HeapAlloc:   m.HeapAlloc,
+		HeapInuse:   m.HeapInuse,
+		HeapObjects: m.HeapObjects,
+		NumGC:       m.NumGC,
+	}
+}
+
+// pprofRoute is where the net/http/pprof profiles are served
+const pprofRoute = "/debug/pprof/"
+
+// pprofHandler serves the net/http/pprof index and profiles under pprofRoute,
+// without registering them on http.DefaultServeMux
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(pprofRoute, pprof.Index)
+	mux.HandleFunc(pprofRoute+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(pprofRoute+"profile", pprof.Profile)
+	mux.HandleFunc(pprofRoute+"symbol", pprof.Symbol)
+	mux.HandleFunc(pprofRoute+"trace", pprof.Trace)
+	return mux
+}
+
+// handleGC forces a garbage collection and returns the heap stats from before and after it
+func handleGC(w http.ResponseWriter, r *http.Request) {
+	before := readHeapStats()
+	runtime.GC()
+	after := readHeapStats()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]heapStats{"before": before, "after": after})
+}
+
+// maxSlowDuration caps how long handleSlow can be asked to take
+const maxSlowDuration = time.Minute
+
+// handleSlow responds after the duration query parameter, one second by default,
+// which is useful for demonstrating latency and in-flight requests
+func handleSlow(w http.ResponseWriter, r *http.Request) {
+	d := time.Second
+	if value := r.URL.Query().Get("duration"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 || parsed > maxSlowDuration {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("duration must be between 0 and %s", maxSlowDuration))
+			return
+		}
+		d = parsed
+	}
+
+	select {
+	case <-time.After(d):
+		fmt.Fprintf(w, "slept for %s", d)
+	case <-r.Context().Done():
+	}
+}
+
+// handleConfig returns the effective config, after the file and environment
+// variables were applied, with secrets redacted
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	cfg := s.cfg.Redacted()
+	s.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
+
+// handleMetric returns the exposition text of the single metric family named
+// in the path, to look at one metric without the whole /api/metrics output
+func (s *Server) handleMetric(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	families, err := s.gatherer.Gather()
+	if err != nil && len(families) == 0 {
+		writeError(w, r, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for _, mf := range families {
+		if mf.GetName() == name {
+			w.Header().Set("Content-Type", string(expfmt.FmtText))
+			expfmt.MetricFamilyToText(w, mf)
+			return
+		}
+	}
+	writeError(w, r, http.StatusNotFound, fmt.Sprintf("metric %s not found", name))
+}
+
+// pathVecs returns every metric vector with a path label
+func pathVecs() []*prometheus.MetricVec {
+	return []*prometheus.MetricVec{
+		totalRequests.MetricVec,
+		responseStatusByPath.MetricVec,
+		httpDuration.MetricVec,
+		httpTTFB.MetricVec,
+		requestBytesReceived.MetricVec,
+		httpRequestSize.MetricVec,
+		httpResponseSize.MetricVec,
+		httpRequestsInFlight.MetricVec,
+		httpPanics.MetricVec,
+		routeConcurrencyRejected.MetricVec,
+		throttledRequests.MetricVec,
+	}
+}
+
+// handleResetPath deletes every series for the path query parameter, so the
+// metrics of one route can be cleaned up without clearing everything
+func handleResetPath(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		writeError(w, r, http.StatusBadRequest, "path is required")
+		return
+	}
+
+	deleted := 0
+	for _, vec := range pathVecs() {
+		deleted += vec.DeletePartialMatch(prometheus.Labels{"path": path})
+	}
+	utils.WriteLog("INFO", fmt.Sprintf("Deleted %d series for path %s", deleted, path))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": path, "deleted": deleted})
+}
+
+// echoHeaders are the request headers returned by handleEcho, the ones
+// proxies and tracing add that affect how a request is attributed
+var echoHeaders = []string{
+	"User-Agent",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Real-Ip",
+	"Forwarded",
+	"Traceparent",
+	"X-Request-Id",
+}
+
+// echoInfo describes a request as the web app sees it
+type echoInfo struct {
+	Method     string            `json:"method"`
+	Host       string            `json:"host"`
+	Path       string            `json:"path"`
+	RemoteAddr string            `json:"remoteAddr"`
+	ClientIP   string            `json:"clientIP"`
+	Headers    map[string]string `json:"headers"`
+}
+
+// handleEcho returns the request metadata, including the client IP the
+// trusted proxies resolved, to show how proxies change what the app sees
+func handleEcho(w http.ResponseWriter, r *http.Request) {
+	info := echoInfo{
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		RemoteAddr: r.RemoteAddr,
+		ClientIP:   clientIP(r),
+		Headers:    map[string]string{},
+	}
+	for _, name := range echoHeaders {
+		if values := r.Header.Values(name); len(values) > 0 {
+			info.Headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
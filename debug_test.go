@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestRoutesHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	router := NewServer(cfg).Handler()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/debug/routes", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	var routes []routeInfo
+	if err := json.NewDecoder(rr.Body).Decode(&routes); err != nil {
+		t.Fatalf("Failed to decode routes: %v", err)
+	}
+
+	found := map[string]routeInfo{}
+	for _, route := range routes {
+		found[route.Path] = route
+	}
+
+	for _, path := range []string{"/api/hits", "/api/metrics"} {
+		route, ok := found[path]
+		if !ok {
+			t.Errorf("Expected route %s in %+v", path, routes)
+			continue
+		}
+		expected := []string{http.MethodGet, http.MethodOptions}
+		if !reflect.DeepEqual(route.Methods, expected) {
+			t.Errorf("Expected methods %v for %s, but got %v", expected, path, route.Methods)
+		}
+		if !route.Instrumented || route.HitCounted {
+			t.Errorf("Expected %s to be instrumented and not hit counted, but got %+v", path, route)
+		}
+	}
+
+	if !found["/"].HitCounted {
+		t.Errorf("Expected the web app route to be hit counted, but got %+v", found["/"])
+	}
+}
+
+func TestRoutesHandlerDisabled(t *testing.T) {
+	router := NewServer(testConfig(t)).Handler()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/debug/routes", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Pprof = true
+	router := NewServer(cfg).Handler()
+
+	for path, expected := range map[string]string{
+		"/debug/pprof/":                  "goroutine",
+		"/debug/pprof/cmdline":           ".test",
+		"/debug/pprof/heap?debug=1":      "heap profile",
+		"/debug/pprof/goroutine?debug=1": "goroutine profile",
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected status %d for %s, but got %d", http.StatusOK, path, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("Expected %s to contain %q, but got %q", path, expected, rr.Body.String())
+		}
+	}
+}
+
+func TestPprofDisabled(t *testing.T) {
+	router := NewServer(testConfig(t)).Handler()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestGCHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	router := NewServer(cfg).Handler()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/debug/gc", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	var stats map[string]heapStats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode heap stats: %v", err)
+	}
+	before, after := stats["before"], stats["after"]
+	if after.NumGC <= before.NumGC {
+		t.Errorf("Expected a garbage collection to run, but NumGC went from %d to %d", before.NumGC, after.NumGC)
+	}
+	if after.HeapInuse == 0 {
+		t.Errorf("Expected heap stats after the garbage collection, but got %+v", after)
+	}
+}
+
+func TestGCHandlerDisabled(t *testing.T) {
+	router := NewServer(testConfig(t)).Handler()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/debug/gc", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	t.Setenv("PORT", "9090")
+	cfg := testConfig(t)
+	cfg.Debug = true
+	router := NewServer(cfg).Handler()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/debug/config", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	var got config.Config
+	if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+	if got.Port != "9090" || !got.Debug {
+		t.Errorf("Expected the effective config with port 9090 and debug enabled, but got %+v", got)
+	}
+}
+
+func TestResetPathHandler(t *testing.T) {
+	t.Setenv("DEBUG", "true")
+	s, _ := NewTestServer(t)
+
+	for _, path := range []string{"/api/hits", "/api/healthz"} {
+		s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/debug/metrics/reset-path?path=/api/hits", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	paths := map[string]bool{}
+	for _, c := range []prometheus.Collector{totalRequests, responseStatusByPath, httpDuration, httpTTFB} {
+		ch := make(chan prometheus.Metric, 100)
+		c.Collect(ch)
+		close(ch)
+		for m := range ch {
+			var pb dto.Metric
+			m.Write(&pb)
+			for _, l := range pb.GetLabel() {
+				if l.GetName() == "path" {
+					paths[l.GetValue()] = true
+				}
+			}
+		}
+	}
+	if paths["/api/hits"] {
+		t.Errorf("Expected every series for /api/hits to be deleted")
+	}
+	if !paths["/api/healthz"] {
+		t.Errorf("Expected the series for /api/healthz to be kept")
+	}
+
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/debug/metrics/reset-path", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without a path, but got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestMetricHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	router := NewServer(cfg).Handler()
+	getHits(t, router)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/debug/metric/http_requests_total", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+
+	families, err := new(expfmt.TextParser).TextToMetricFamilies(rr.Body)
+	if err != nil {
+		t.Fatalf("Failed to parse the exposition text: %v", err)
+	}
+	if _, ok := families["http_requests_total"]; !ok || len(families) != 1 {
+		names := []string{}
+		for name := range families {
+			names = append(names, name)
+		}
+		t.Errorf("Expected only http_requests_total, but got %v", names)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/debug/metric/not_a_metric", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown metric, but got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestEchoHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	cfg.TrustedProxies = []string{"10.0.0.0/8"}
+	router := NewServer(cfg).Handler()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		clientIP   string
+	}{
+		{"trusted proxy", "10.1.2.3:4242", "198.51.100.20"},
+		{"untrusted source", "203.0.113.7:4242", "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/debug/echo", nil)
+		req.RemoteAddr = tt.remoteAddr
+		req.Header.Set("X-Forwarded-For", "198.51.100.20")
+		req.Header.Set("X-Secret", "not echoed")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+		}
+		var got echoInfo
+		if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+			t.Fatalf("Failed to decode echo: %v", err)
+		}
+		if got.ClientIP != tt.clientIP {
+			t.Errorf("Expected client IP %q from a %s, but got %q", tt.clientIP, tt.name, got.ClientIP)
+		}
+		if got.Method != http.MethodGet || got.Path != "/api/debug/echo" || got.RemoteAddr != tt.remoteAddr {
+			t.Errorf("Expected the request metadata to be echoed, but got %+v", got)
+		}
+		if got.Headers["X-Forwarded-For"] != "198.51.100.20" {
+			t.Errorf("Expected X-Forwarded-For to be echoed, but got %q", got.Headers["X-Forwarded-For"])
+		}
+		if _, ok := got.Headers["X-Secret"]; ok {
+			t.Errorf("Expected only the selected headers to be echoed")
+		}
+	}
+}
+
+func TestMiddlewareOrderHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	cfg.TraceMiddleware = true
+	cfg.RequestTimeout = time.Minute
+	router := NewServer(cfg).Handler()
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/debug/middleware-order", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+	var order middlewareOrder
+	if err := json.NewDecoder(rr.Body).Decode(&order); err != nil {
+		t.Fatalf("Failed to decode middleware order: %v", err)
+	}
+
+	expected := []string{"clientIP", "prometheus", "slo", "recovery", "slowRequest", "cors", "versionHeader", "rateLimit", "contentLength", "gzipBody", "timeout", "chaosLatency", "chaosErrors"}
+	if !reflect.DeepEqual(order.Registered, expected) {
+		t.Errorf("Expected the registered order %v, but got %v", expected, order.Registered)
+	}
+	if !reflect.DeepEqual(order.LastRequest, order.Registered) {
+		t.Errorf("Expected the last request to run the middlewares in the registered order %v, but got %v", order.Registered, order.LastRequest)
+	}
+}
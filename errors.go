@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// errorResponse is the JSON body of an error response
+type errorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// acceptsJSON reports whether the Accept header of r asks for JSON
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeError responds with status and msg, as a JSON error document when the
+// client accepts JSON and as plain text like http.Error otherwise
+func writeError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	if !acceptsJSON(r) {
+		http.Error(w, msg, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg, Status: status})
+}
+
+// errorHandler responds to every request with status through writeError
+func errorHandler(status int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, status, http.StatusText(status))
+	})
+}
+
+// notFoundHandler answers requests that no route matched, such as paths outside
+// the base path, counting them in http_unmatched_requests_total since they never
+// reach the route metrics. Missing static files are matched by the web app.
+func notFoundHandler() http.Handler {
+	next := errorHandler(http.StatusNotFound)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		unmatchedRequests.Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// errorWriter replaces the plain text error responses written by net/http
+// handlers we do not control, such as http.FileServer and http.TimeoutHandler
+type errorWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	replaced bool
+}
+
+func (w *errorWriter) WriteHeader(code int) {
+	contentType := w.Header().Get("Content-Type")
+	if code >= http.StatusBadRequest && (contentType == "" || strings.HasPrefix(contentType, "text/plain")) {
+		w.replaced = true
+		writeError(w.ResponseWriter, w.r, code, http.StatusText(code))
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// jsonErrors makes the error responses of next consistent with writeError for
+// clients that accept JSON, other clients get the responses of next unchanged
+func jsonErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsJSON(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&errorWriter{ResponseWriter: w, r: r}, r)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+// decodeError checks rr is a JSON error response with status and returns its body
+func decodeError(t *testing.T, rr *httptest.ResponseRecorder, status int) errorResponse {
+	t.Helper()
+	if rr.Code != status {
+		t.Fatalf("Expected status %d, but got %d", status, rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Expected Content-Type application/json, but got %q", got)
+	}
+	var body errorResponse
+	if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+		t.Fatalf("Failed to decode the error body: %v", err)
+	}
+	if body.Status != status || body.Error == "" {
+		t.Errorf("Expected an error body with status %d and a message, but got %+v", status, body)
+	}
+	return body
+}
+
+func TestJSONErrorNotFound(t *testing.T) {
+	s, _ := NewTestServer(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/does-not-exist", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	decodeError(t, rr, http.StatusNotFound)
+
+	// clients that do not ask for JSON keep the plain text response
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/does-not-exist", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Fatalf("Expected status %d, but got %d", http.StatusNotFound, rr.Code)
+	}
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Expected a plain text 404, but got Content-Type %q", got)
+	}
+}
+
+func TestUnmatchedRequests(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.BasePath = "/workshop"
+	h := NewServer(cfg).Handler()
+
+	tests := []struct {
+		path      string
+		unmatched float64
+	}{
+		{path: "/somewhere-else", unmatched: 1},
+		{path: "/workshop/missing.js", unmatched: 0},
+		{path: "/workshop/api/hits", unmatched: 0},
+	}
+
+	for _, tt := range tests {
+		before := testutil.ToFloat64(unmatchedRequests)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if tt.unmatched > 0 && rr.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d for %s, but got %d", http.StatusNotFound, tt.path, rr.Code)
+		}
+
+		if got := testutil.ToFloat64(unmatchedRequests) - before; got != tt.unmatched {
+			t.Errorf("Expected http_unmatched_requests_total to increase by %v for %s, but got %v", tt.unmatched, tt.path, got)
+		}
+	}
+}
+
+func TestJSONErrorTooManyRequests(t *testing.T) {
+	router := newTestRouter(rateLimitMiddleware(rate.NewLimiter(0.5, 1), newIPLimiters(rate.Inf, 0)))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/hits", nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if i == 0 {
+			continue
+		}
+		body := decodeError(t, rr, http.StatusTooManyRequests)
+		if body.Error != http.StatusText(http.StatusTooManyRequests) {
+			t.Errorf("Expected error %q, but got %q", http.StatusText(http.StatusTooManyRequests), body.Error)
+		}
+		if rr.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected the Retry-After header to be kept")
+		}
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/html", false},
+		{"application/json", true},
+		{"text/html, application/json;q=0.9", true},
+		{"application/problem+json", true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", tt.accept)
+		if got := acceptsJSON(req); got != tt.want {
+			t.Errorf("Expected acceptsJSON(%q) to be %t, but got %t", tt.accept, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exemplarLabels returns the exemplar of a request, the trace ID when it is
+// sampled and its request ID, nil when it has neither
+func exemplarLabels(r *http.Request) prometheus.Labels {
+	labels := prometheus.Labels{}
+	if sc, ok := spanFromContext(r.Context()); ok && sc.Sampled {
+		labels["trace_id"] = sc.traceID()
+	}
+	if id := requestIDFromContext(r.Context()); id != "" {
+		labels["request_id"] = id
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	return labels
+}
+
+// exemplarRunes returns the runes labels count for against ExemplarMaxRunes
+func exemplarRunes(labels prometheus.Labels) int {
+	runes := 0
+	for name, value := range labels {
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	return runes
+}
+
+// observeWithExemplar observes v on o with labels as an exemplar, so a slow
+// bucket links to a trace or the logs of a request that landed in it
+func observeWithExemplar(o prometheus.Observer, v float64, labels prometheus.Labels) {
+	if eo, ok := o.(prometheus.ExemplarObserver); ok && labels != nil && exemplarRunes(labels) <= prometheus.ExemplarMaxRunes {
+		eo.ObserveWithExemplar(v, labels)
+		return
+	}
+	o.Observe(v)
+}
+
+// incWithExemplar increments c with labels as an exemplar, so a spike of
+// errors links to one of the requests that failed
+func incWithExemplar(c prometheus.Counter, labels prometheus.Labels) {
+	if ea, ok := c.(prometheus.ExemplarAdder); ok && labels != nil && exemplarRunes(labels) <= prometheus.ExemplarMaxRunes {
+		ea.AddWithExemplar(1, labels)
+		return
+	}
+	c.Inc()
+}
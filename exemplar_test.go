@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// exemplarLabel returns the value of the name label of exemplar, empty without one
+func exemplarLabel(exemplar *dto.Exemplar, name string) string {
+	for _, l := range exemplar.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestRequestExemplars(t *testing.T) {
+	router := NewServer(testConfig(t)).Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/hits", nil)
+	req.Header.Set(requestIDHeader, "exemplar-request-1")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	var counter dto.Metric
+	if err := totalRequests.WithLabelValues("/api/hits", "GET", "200").Write(&counter); err != nil {
+		t.Fatalf("Failed to read http_requests_total: %v", err)
+	}
+	if got := exemplarLabel(counter.GetCounter().GetExemplar(), "request_id"); got != "exemplar-request-1" {
+		t.Errorf("Expected an exemplar with request_id %q on http_requests_total, but got %q", "exemplar-request-1", got)
+	}
+
+	var histogram dto.Metric
+	if err := httpDuration.WithLabelValues("/api/hits", "GET", "200").(prometheus.Histogram).Write(&histogram); err != nil {
+		t.Fatalf("Failed to read http_response_time_seconds: %v", err)
+	}
+	found := false
+	for _, b := range histogram.GetHistogram().GetBucket() {
+		found = found || exemplarLabel(b.GetExemplar(), "request_id") == "exemplar-request-1"
+	}
+	if !found {
+		t.Errorf("Expected an exemplar with the request ID on http_response_time_seconds")
+	}
+
+	// exemplars are only exposed to scrapes negotiating OpenMetrics
+	scrape := func(accept string) string {
+		req := httptest.NewRequest(http.MethodGet, "/api/metrics", nil)
+		req.Header.Set("Accept", accept)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		body, _ := io.ReadAll(rr.Body)
+		return string(body)
+	}
+	if body := scrape(string(expfmt.FmtOpenMetrics)); !strings.Contains(body, `request_id="exemplar-request-1"`) {
+		t.Errorf("Expected the OpenMetrics exposition to have the exemplar")
+	}
+	if body := scrape(string(expfmt.FmtText)); strings.Contains(body, `request_id="exemplar-request-1"`) {
+		t.Errorf("Expected the text exposition not to have the exemplar")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/gorilla/mux"
+)
+
+// Feature flags that can be toggled at runtime from the config
+const (
+	featureGzip      = "gzip"
+	featureTracing   = "tracing"
+	featureRateLimit = "rate_limit"
+	featureRedis     = "redis"
+)
+
+// knownFeatures are exported by feature_enabled whether they are configured or not
+var knownFeatures = []string{featureGzip, featureTracing, featureRateLimit, featureRedis}
+
+// activeFeatures are the flags of the running server, for the code that
+// runs outside of its handlers such as the hit store
+var activeFeatures atomic.Pointer[featureFlags]
+
+// activeFeatureEnabled reports whether the feature name is enabled on the
+// running server, features are enabled outside of one
+func activeFeatureEnabled(name string) bool {
+	flags := activeFeatures.Load()
+	return flags == nil || flags.Enabled(name)
+}
+
+// featureFlags holds which features are enabled, unknown or unset features are disabled
+type featureFlags struct {
+	mu      sync.RWMutex
+	enabled map[string]bool
+}
+
+func newFeatureFlags(flags map[string]bool) *featureFlags {
+	f := &featureFlags{}
+	f.Set(flags)
+	return f
+}
+
+// Set replaces every flag with flags and updates feature_enabled
+func (f *featureFlags) Set(flags map[string]bool) {
+	enabled := make(map[string]bool, len(knownFeatures))
+	for _, name := range knownFeatures {
+		enabled[name] = flags[name]
+	}
+
+	unknown := []string{}
+	for name := range flags {
+		if _, ok := enabled[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		utils.WriteLog("WARNING", fmt.Sprintf("Ignoring unknown feature flags %v, known flags are %v", unknown, knownFeatures))
+	}
+
+	f.mu.Lock()
+	f.enabled = enabled
+	f.mu.Unlock()
+
+	for name, on := range enabled {
+		value := 0.0
+		if on {
+			value = 1
+		}
+		featureEnabled.WithLabelValues(name).Set(value)
+	}
+}
+
+// Enabled reports whether the feature name is enabled
+func (f *featureFlags) Enabled(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.enabled[name]
+}
+
+// gate applies mwf only while the feature name is enabled
+func (f *featureFlags) gate(name string, mwf mux.MiddlewareFunc) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return f.choose(name, mwf(next), next)
+	}
+}
+
+// choose serves requests with on while the feature name is enabled and with off otherwise
+func (f *featureFlags) choose(name string, on, off http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f.Enabled(name) {
+			on.ServeHTTP(w, r)
+			return
+		}
+		off.ServeHTTP(w, r)
+	})
+}
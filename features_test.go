@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFeatureEnabledGauge(t *testing.T) {
+	flags := newFeatureFlags(map[string]bool{featureGzip: true, featureRedis: false, "unknown": true})
+
+	expected := map[string]float64{featureGzip: 1, featureTracing: 0, featureRateLimit: 0, featureRedis: 0}
+	for feature, value := range expected {
+		if got := testutil.ToFloat64(featureEnabled.WithLabelValues(feature)); got != value {
+			t.Errorf("Expected feature_enabled{feature=%q} to be %v, but got %v", feature, value, got)
+		}
+	}
+	if flags.Enabled("unknown") {
+		t.Errorf("Expected unknown features to stay disabled")
+	}
+
+	flags.Set(map[string]bool{featureTracing: true})
+	if got := testutil.ToFloat64(featureEnabled.WithLabelValues(featureGzip)); got != 0 {
+		t.Errorf("Expected feature_enabled{feature=%q} to be 0 once unset, but got %v", featureGzip, got)
+	}
+	if !flags.Enabled(featureTracing) {
+		t.Errorf("Expected %s to be enabled", featureTracing)
+	}
+}
+
+func TestFeatureGzip(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		encoding string
+	}{
+		{"enabled", true, "gzip"},
+		{"disabled", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FEATURES", featureGzip+"="+strconv.FormatBool(tt.enabled))
+			s, _ := NewTestServer(t)
+			router := s.Handler()
+
+			req := httptest.NewRequest(http.MethodGet, "/api/metrics", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if got := rr.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Expected Content-Encoding %q, but got %q", tt.encoding, got)
+			}
+		})
+	}
+}
+
+func TestFeatureRateLimit(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RateLimit.RPS = 1
+	cfg.RateLimit.Burst = 1
+	cfg.Features[featureRateLimit] = false
+	s := NewServer(cfg)
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected status %d with rate limiting disabled, but got %d", http.StatusOK, rr.Code)
+		}
+	}
+
+	reloaded := *cfg
+	reloaded.Features = map[string]bool{featureRateLimit: true}
+	if err := s.Reload(&reloaded); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+
+	// the burst was left untouched while rate limiting was disabled
+	var rr *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		rr = httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	}
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status %d once rate limiting is enabled, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
+
+func TestFeatureTracing(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Tracing.Endpoint = "http://127.0.0.1:0"
+	cfg.Features[featureTracing] = false
+	s := NewServer(cfg)
+	exporter := &memorySpanExporter{}
+	s.tracer.exporter = exporter
+
+	traced := func() {
+		req := httptest.NewRequest(http.MethodGet, "/api/hits", nil)
+		req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	}
+	traced()
+	s.features.Set(map[string]bool{featureTracing: true})
+	traced()
+
+	if err := s.tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to flush spans: %v", err)
+	}
+	if len(exporter.spans) != 1 {
+		t.Errorf("Expected only the request with tracing enabled to be traced, but got %d spans", len(exporter.spans))
+	}
+}
+
+func TestFeatureRedis(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cfg := testConfig(t)
+	cfg.HitStore.Redis.Addr = server.l.Addr().String()
+	cfg.Items.Backend = backendRedis
+	cfg.Items.Latency = 0
+	cfg.Features[featureRedis] = false
+	s := NewServer(cfg)
+	defer activeFeatures.Store(nil)
+
+	// the hit store falls back to memory rather than sending commands to Redis
+	redisStore := newFallbackStore(backendRedis, newRedisStore(cfg.HitStore.Redis), newMemoryStore())
+	if n, err := redisStore.Incr(context.Background()); err != nil || n != 1 {
+		t.Errorf("Expected the fallback to count the hit, but got %d and %v", n, err)
+	}
+	if _, err := newRedisStore(cfg.HitStore.Redis).Get(context.Background()); !errors.Is(err, errRedisDisabled) {
+		t.Errorf("Expected errRedisDisabled from the redis store, but got %v", err)
+	}
+	server.mu.Lock()
+	sent := len(server.values)
+	server.mu.Unlock()
+	if sent != 0 {
+		t.Errorf("Expected no values stored in Redis, but got %d", sent)
+	}
+
+	if status, _ := serveItem(t, s.Handler(), http.MethodPost, itemsRoute, `{"name": "book"}`); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d with redis disabled, but got %d", http.StatusServiceUnavailable, status)
+	}
+	s.features.Set(map[string]bool{featureRedis: true})
+	if status, body := serveItem(t, s.Handler(), http.MethodPost, itemsRoute, `{"name": "book"}`); status != http.StatusCreated {
+		t.Errorf("Expected status %d with redis enabled, but got %d: %s", http.StatusCreated, status, body)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Health statuses reported by /api/health
+const (
+	statusOK       = "ok"
+	statusDegraded = "degraded"
+)
+
+// healthCheckTimeout bounds how long a single health check may take
+const healthCheckTimeout = 2 * time.Second
+
+// HealthCheck returns an error if a subsystem is degraded
+type HealthCheck func(ctx context.Context) error
+
+// checkResult is the outcome of a single health check
+type checkResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthReport is the body returned by /api/health
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// healthRegistry holds the named health checks of every subsystem
+type healthRegistry struct {
+	mu     sync.RWMutex
+	checks map[string]HealthCheck
+}
+
+func newHealthRegistry() *healthRegistry {
+	return &healthRegistry{checks: map[string]HealthCheck{}}
+}
+
+// Register adds a named health check, replacing any check with the same name
+func (h *healthRegistry) Register(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checks[name] = check
+}
+
+// Report runs every check and returns their results, recording each in health_check_status
+func (h *healthRegistry) Report(ctx context.Context) healthReport {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	report := healthReport{Status: statusOK, Checks: map[string]checkResult{}}
+	for name, check := range h.checks {
+		if err := runHealthCheck(ctx, name, check); err != nil {
+			report.Status = statusDegraded
+			report.Checks[name] = checkResult{Status: statusDegraded, Error: err.Error()}
+			continue
+		}
+		report.Checks[name] = checkResult{Status: statusOK}
+	}
+	return report
+}
+
+// runHealthCheck runs check with healthCheckTimeout, recording its result in health_check_status
+func runHealthCheck(ctx context.Context, name string, check HealthCheck) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	if err := check(ctx); err != nil {
+		healthCheckStatus.WithLabelValues(name).Set(0)
+		return err
+	}
+	healthCheckStatus.WithLabelValues(name).Set(1)
+	return nil
+}
+
+// ReadinessCheck returns the named health check as a readiness check, so a
+// subsystem the server cannot serve without also takes it out of rotation
+func (h *healthRegistry) ReadinessCheck(name string) ReadinessCheck {
+	return func() error {
+		h.mu.RLock()
+		check, ok := h.checks[name]
+		h.mu.RUnlock()
+		if !ok {
+			return nil
+		}
+		return runHealthCheck(context.Background(), name, check)
+	}
+}
+
+// handleHealth returns the status of every subsystem, with a 503 if any is degraded
+func (h *healthRegistry) handleHealth(w http.ResponseWriter, r *http.Request) {
+	report := h.Report(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != statusOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// hitStoreCheck reports the hit store as degraded if it cannot be read
+func hitStoreCheck(ctx context.Context) error {
+	_, err := hitStore.Get(ctx)
+	return err
+}
+
+// limiterCheck reports the rate limiter as degraded if it is configured to
+// reject every request, with no burst or a limit that never adds tokens. An
+// empty bucket is the normal state under load and is not reported.
+func limiterCheck(limiter *rate.Limiter) HealthCheck {
+	return func(ctx context.Context) error {
+		if limiter.Limit() == rate.Inf {
+			return nil
+		}
+		if limiter.Burst() == 0 {
+			return errors.New("rate limit burst is 0, every request is rejected")
+		}
+		if limiter.Limit() <= 0 {
+			return errors.New("rate limit is 0, every request is rejected once the burst is used")
+		}
+		return nil
+	}
+}
+
+// diskCheck reports the disk as degraded if a file cannot be written to dir
+func diskCheck(dir string) HealthCheck {
+	return func(ctx context.Context) error {
+		f, err := os.CreateTemp(dir, ".healthcheck-*")
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return os.Remove(f.Name())
+	}
+}
+
+// staticDirCheck reports the web app as degraded if any directory of the
+// colon-separated overlay list dirs cannot be read, empty entries are skipped
+// like newOverlayFS does
+func staticDirCheck(dirs string) HealthCheck {
+	return func(ctx context.Context) error {
+		for _, dir := range strings.Split(dirs, ":") {
+			if dir == "" {
+				continue
+			}
+			if err := readableDir(dir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// readableDir returns an error if dir cannot be opened or is not a directory
+func readableDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// redisCheck reports Redis as degraded if it does not answer a PING. The redis
+// hit store falls back to memory, so hitStoreCheck keeps passing while Redis is down.
+func redisCheck(client *redisClient) HealthCheck {
+	return func(ctx context.Context) error {
+		reply, err := client.Do(ctx, "PING")
+		if err != nil {
+			return err
+		}
+		if reply != "PONG" {
+			return fmt.Errorf("unexpected PING reply %v", reply)
+		}
+		return nil
+	}
+}
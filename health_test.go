@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+func getHealth(t *testing.T, h http.Handler) (int, healthReport) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+
+	var report healthReport
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatalf("Failed to decode health report: %v", err)
+	}
+	return rr.Code, report
+}
+
+func TestHealthHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HitStore.Backend = backendFile
+	cfg.HitStore.File = filepath.Join(t.TempDir(), "hits")
+	s := NewServer(cfg)
+
+	status, report := getHealth(t, s.Handler())
+	if status != http.StatusOK || report.Status != statusOK {
+		t.Fatalf("Expected a healthy report, but got %d %+v", status, report)
+	}
+	for _, name := range []string{"hitStore", "rateLimiter", "staticDir", "disk"} {
+		if report.Checks[name].Status != statusOK {
+			t.Errorf("Expected check %s to be %q, but got %+v", name, statusOK, report.Checks[name])
+		}
+	}
+
+	s.health.Register("broken", func(ctx context.Context) error { return errors.New("boom") })
+
+	status, report = getHealth(t, s.Handler())
+	if status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d with a degraded subsystem, but got %d", http.StatusServiceUnavailable, status)
+	}
+	if report.Status != statusDegraded {
+		t.Errorf("Expected overall status %q, but got %q", statusDegraded, report.Status)
+	}
+	if got := report.Checks["broken"]; got.Status != statusDegraded || got.Error != "boom" {
+		t.Errorf("Expected the broken check to be degraded with error %q, but got %+v", "boom", got)
+	}
+	if got := report.Checks["hitStore"]; got.Status != statusOK {
+		t.Errorf("Expected the hit store check to stay %q, but got %+v", statusOK, got)
+	}
+	if got := testutil.ToFloat64(healthCheckStatus.WithLabelValues("broken")); got != 0 {
+		t.Errorf("Expected health_check_status{check=\"broken\"} to be 0, but got %v", got)
+	}
+	if got := testutil.ToFloat64(healthCheckStatus.WithLabelValues("hitStore")); got != 1 {
+		t.Errorf("Expected health_check_status{check=\"hitStore\"} to be 1, but got %v", got)
+	}
+}
+
+func TestLimiterCheck(t *testing.T) {
+	if err := limiterCheck(rate.NewLimiter(rate.Inf, 0))(context.Background()); err != nil {
+		t.Errorf("Expected a disabled limiter to be healthy, but got %v", err)
+	}
+
+	limiter := rate.NewLimiter(0.1, 1)
+	if err := limiterCheck(limiter)(context.Background()); err != nil {
+		t.Errorf("Expected a limiter with tokens to be healthy, but got %v", err)
+	}
+	// an empty bucket is only the limiter at work
+	limiter.Allow()
+	if err := limiterCheck(limiter)(context.Background()); err != nil {
+		t.Errorf("Expected a limiter without tokens left to be healthy, but got %v", err)
+	}
+
+	for _, limiter := range []*rate.Limiter{rate.NewLimiter(0, 0), rate.NewLimiter(10, 0), rate.NewLimiter(0, 5)} {
+		if err := limiterCheck(limiter)(context.Background()); err == nil {
+			t.Errorf("Expected a limiter of %v rps and burst %d to be degraded", limiter.Limit(), limiter.Burst())
+		}
+	}
+}
+
+func TestStaticDirCheck(t *testing.T) {
+	dir := t.TempDir()
+	if err := staticDirCheck(dir)(context.Background()); err != nil {
+		t.Errorf("Expected an existing static dir to be healthy, but got %v", err)
+	}
+	if err := staticDirCheck(filepath.Join(dir, "missing"))(context.Background()); err == nil {
+		t.Errorf("Expected a missing static dir to be degraded")
+	}
+	file := filepath.Join(dir, "index.html")
+	writeFile(t, dir, "index.html", "hello")
+	if err := staticDirCheck(file)(context.Background()); err == nil {
+		t.Errorf("Expected a file instead of a static dir to be degraded")
+	}
+
+	// STATIC_DIR is an overlay of directories
+	other := t.TempDir()
+	if err := staticDirCheck(dir + ":" + other + ":")(context.Background()); err != nil {
+		t.Errorf("Expected two existing static dirs to be healthy, but got %v", err)
+	}
+	if err := staticDirCheck(dir + ":" + filepath.Join(other, "missing"))(context.Background()); err == nil {
+		t.Errorf("Expected a missing second static dir to be degraded")
+	}
+}
+
+func TestRedisCheck(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cfg := testConfig(t)
+	cfg.HitStore.Backend = backendRedis
+	cfg.HitStore.Redis.Addr = server.l.Addr().String()
+	s := NewServer(cfg)
+
+	if _, report := getHealth(t, s.Handler()); report.Checks["redis"].Status != statusOK {
+		t.Errorf("Expected the redis check to be %q, but got %+v", statusOK, report.Checks["redis"])
+	}
+
+	server.l.Close()
+	server.dropConns.Store(1 << 20)
+	if _, report := getHealth(t, s.Handler()); report.Checks["redis"].Status != statusDegraded {
+		t.Errorf("Expected the redis check to be %q with Redis unreachable, but got %+v", statusDegraded, report.Checks["redis"])
+	}
+}
+
+func TestReadinessHealthChecks(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StaticDir = t.TempDir()
+	s := NewServer(cfg)
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/readyz", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d with the static dir readable, but got %d", http.StatusOK, rr.Code)
+	}
+
+	overlay := *cfg
+	overlay.StaticDir = cfg.StaticDir + ":" + t.TempDir()
+	rr = httptest.NewRecorder()
+	NewServer(&overlay).Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/readyz", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d with two static dirs readable, but got %d", http.StatusOK, rr.Code)
+	}
+
+	cfg.StaticDir = filepath.Join(cfg.StaticDir, "missing")
+	s = NewServer(cfg)
+	rr = httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/readyz", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d with the static dir missing, but got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if got := testutil.ToFloat64(healthCheckStatus.WithLabelValues("staticDir")); got != 0 {
+		t.Errorf("Expected health_check_status{check=\"staticDir\"} to be 0, but got %v", got)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// operationalRoutes are the routes probes and scrapes use. They are served on
+// any host, so requests addressing a pod directly are not redirected away
+// from it, and chaos is never injected into them.
+var operationalRoutes = map[string]bool{
+	"/api/metrics": true,
+	"/api/healthz": true,
+	"/api/health":  true,
+	"/api/readyz":  true,
+}
+
+// canonicalHostMiddleware redirects requests for any other host than host to
+// the same path and query on host, so www. and IP based hosts are recorded once
+func canonicalHostMiddleware(host string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.EqualFold(r.Host, host) || operationalRoutes[routeTemplate(r)] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			// RequestURI still has the base path StripPrefix took off r.URL
+			http.Redirect(w, r, scheme+"://"+host+r.RequestURI, http.StatusMovedPermanently)
+		})
+	}
+}
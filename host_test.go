@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCanonicalHostMiddleware(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.CanonicalHost = "blog.example.com"
+	cfg.BasePath = "/workshop"
+	h := NewServer(cfg).Handler()
+
+	tests := []struct {
+		host     string
+		path     string
+		status   int
+		location string
+	}{
+		{host: "www.blog.example.com", path: "/workshop/api/hits?page=2", status: http.StatusMovedPermanently, location: "http://blog.example.com/workshop/api/hits?page=2"},
+		{host: "10.0.0.7:8080", path: "/workshop/", status: http.StatusMovedPermanently, location: "http://blog.example.com/workshop/"},
+		{host: "blog.example.com", path: "/workshop/api/hits", status: http.StatusOK},
+		{host: "Blog.Example.com", path: "/workshop/api/hits", status: http.StatusOK},
+		{host: "10.0.0.7:8080", path: "/workshop/api/healthz", status: http.StatusOK},
+		{host: "10.0.0.7:8080", path: "/workshop/api/metrics", status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Host = tt.host
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		if rr.Code != tt.status {
+			t.Errorf("Expected status %d for %s%s, but got %d", tt.status, tt.host, tt.path, rr.Code)
+		}
+		if got := rr.Header().Get("Location"); got != tt.location {
+			t.Errorf("Expected Location %q for %s%s, but got %q", tt.location, tt.host, tt.path, got)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cachedResponse is a response recorded for an Idempotency-Key
+type cachedResponse struct {
+	key     string
+	done    chan struct{}
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// idempotencyCache replays the response of a request for a repeated
+// Idempotency-Key within ttl, so a retried operation is only applied once.
+// It keeps up to size keys, evicting the least recently used one to make
+// room, a size of zero or less does not limit it.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	// recently used keys first
+	lru *list.List
+}
+
+func newIdempotencyCache(ttl time.Duration, size int) *idempotencyCache {
+	idempotencyCacheEntries.Set(0)
+	return &idempotencyCache{ttl: ttl, size: size, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+// remove deletes the key of el, c.mu must be held
+func (c *idempotencyCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cachedResponse).key)
+	idempotencyCacheEntries.Set(float64(c.lru.Len()))
+}
+
+// recordingWriter keeps a copy of the response it writes
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// start returns the entry for key and whether it was already there, sweeping expired entries
+func (c *idempotencyCache) start(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for _, el := range c.entries {
+		if entry := el.Value.(*cachedResponse); !entry.expires.IsZero() && now.After(entry.expires) {
+			c.remove(el)
+		}
+	}
+
+	if el, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*cachedResponse), true
+	}
+	entry := &cachedResponse{key: key, done: make(chan struct{})}
+	c.entries[key] = c.lru.PushFront(entry)
+	if c.size > 0 && c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		idempotencyCacheEvictions.Inc()
+	}
+	idempotencyCacheEntries.Set(float64(c.lru.Len()))
+	return entry, false
+}
+
+// middleware applies the Idempotency-Key header, requests without it are passed through
+func (c *idempotencyCache) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key = r.Method + " " + r.URL.Path + " " + key
+		entry, found := c.start(key)
+		if found {
+			// wait for the first request with this key to finish, then replay it
+			<-entry.done
+			for k, v := range entry.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+
+		rw := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			c.mu.Lock()
+			if completed {
+				entry.status = rw.status
+				entry.header = w.Header().Clone()
+				entry.body = rw.body.Bytes()
+				entry.expires = time.Now().Add(c.ttl)
+			} else {
+				// the handler panicked, let a retry apply the operation again
+				entry.status = http.StatusInternalServerError
+				if el, ok := c.entries[key]; ok && el.Value == entry {
+					c.remove(el)
+				}
+			}
+			c.mu.Unlock()
+			close(entry.done)
+		}()
+
+		next.ServeHTTP(rw, r)
+		completed = true
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestIdempotencyMiddleware(t *testing.T) {
+	calls := 0
+	h := newIdempotencyCache(time.Minute, 0).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "call %d", calls)
+	}))
+
+	post := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/hits/reset", nil)
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := post("abc")
+	second := post("abc")
+
+	if calls != 1 {
+		t.Errorf("Expected the operation to be applied once, but it was applied %d times", calls)
+	}
+	if first.Code != second.Code || first.Body.String() != second.Body.String() {
+		t.Errorf("Expected identical responses, but got %d %q and %d %q", first.Code, first.Body.String(), second.Code, second.Body.String())
+	}
+	if second.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("Expected the repeated response to be marked as replayed")
+	}
+
+	post("def")
+	post("")
+	if calls != 3 {
+		t.Errorf("Expected new and missing keys to apply the operation, but it was applied %d times", calls)
+	}
+}
+
+func TestIdempotencyExpiry(t *testing.T) {
+	calls := 0
+	h := newIdempotencyCache(10*time.Millisecond, 0).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/hits/reset", nil)
+		req.Header.Set("Idempotency-Key", "abc")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if calls != 2 {
+		t.Errorf("Expected the key to expire after the TTL, but the operation was applied %d times", calls)
+	}
+}
+
+func TestHitsResetIdempotent(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	router := NewServer(cfg).Handler()
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/hits/reset", nil)
+		req.Header.Set("Idempotency-Key", "reset-1")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK || rr.Body.String() != "0" {
+			t.Errorf("Expected reset to return %d %q, but got %d %q", http.StatusOK, "0", rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	if rr.Body.String() != "0" {
+		t.Errorf("Expected hits to be %q after reset, but got %q", "0", rr.Body.String())
+	}
+}
+
+func TestIdempotencyCacheSize(t *testing.T) {
+	calls := map[string]int{}
+	h := newIdempotencyCache(time.Minute, 2).middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls[r.Header.Get("Idempotency-Key")]++
+	}))
+	post := func(key string) {
+		req := httptest.NewRequest(http.MethodPost, "/api/hits/reset", nil)
+		req.Header.Set("Idempotency-Key", key)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	evictionsBefore := testutil.ToFloat64(idempotencyCacheEvictions)
+
+	// a is used again after b, so b is the least recently used once c comes in
+	for _, key := range []string{"a", "b", "a", "c"} {
+		post(key)
+	}
+
+	if got := testutil.ToFloat64(idempotencyCacheEvictions) - evictionsBefore; got != 1 {
+		t.Errorf("Expected idempotency_cache_evictions_total to increase by 1, but got %v", got)
+	}
+	if got := testutil.ToFloat64(idempotencyCacheEntries); got != 2 {
+		t.Errorf("Expected idempotency_cache_entries to stay at the size 2, but got %v", got)
+	}
+
+	post("a")
+	post("b")
+	if calls["a"] != 1 {
+		t.Errorf("Expected the recently used key a to be replayed, but it was applied %d times", calls["a"])
+	}
+	if calls["b"] != 2 {
+		t.Errorf("Expected the evicted key b to be applied again, but it was applied %d times", calls["b"])
+	}
+	if got := testutil.ToFloat64(idempotencyCacheEntries); got != 2 {
+		t.Errorf("Expected idempotency_cache_entries to stay at the size 2, but got %v", got)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// inflightTracker keeps the start time of every request being served
+type inflightTracker struct {
+	mu     sync.Mutex
+	next   uint64
+	starts map[uint64]time.Time
+}
+
+func newInflightTracker() *inflightTracker {
+	return &inflightTracker{starts: map[uint64]time.Time{}}
+}
+
+// start records a request starting now, done must be called once it completes
+func (t *inflightTracker) start() (done func()) {
+	t.mu.Lock()
+	id := t.next
+	t.next++
+	t.starts[id] = time.Now()
+	t.mu.Unlock()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.starts, id)
+		t.mu.Unlock()
+	}
+}
+
+// oldest returns the age of the longest running request, 0 if there is none
+func (t *inflightTracker) oldest() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var oldest time.Duration
+	for _, start := range t.starts {
+		if age := time.Since(start); age > oldest {
+			oldest = age
+		}
+	}
+	return oldest
+}
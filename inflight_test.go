@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOldestInflightRequest(t *testing.T) {
+	if got := testutil.ToFloat64(oldestInflight); got != 0 {
+		t.Fatalf("Expected http_oldest_inflight_request_seconds to be 0 without requests, but got %v", got)
+	}
+
+	release := make(chan struct{})
+	router := mux.NewRouter()
+	router.Use(prometheusMiddleware(newLabelGuard("path", 0)))
+	router.Path("/test/stuck").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/stuck", nil))
+		close(done)
+	}()
+
+	age := 150 * time.Millisecond
+	time.Sleep(age)
+	if got := testutil.ToFloat64(oldestInflight); got < age.Seconds() {
+		t.Errorf("Expected the in-flight request to be at least %s old, but got %vs", age, got)
+	}
+
+	close(release)
+	<-done
+	if got := testutil.ToFloat64(oldestInflight); got != 0 {
+		t.Errorf("Expected http_oldest_inflight_request_seconds to be 0 once the request completed, but got %v", got)
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/gorilla/mux"
+)
+
+// itemsRoute and itemRoute are the routes of the items API
+const (
+	itemsRoute = "/api/v1/items"
+	itemRoute  = "/api/v1/items/{id}"
+)
+
+// maxItemName caps the length of an item name
+const maxItemName = 100
+
+// item is an entry of the items API
+type item struct {
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Price float64  `json:"price"`
+	Tags  []string `json:"tags,omitempty"`
+}
+
+// validate returns why it cannot be stored, nil if it can
+func (it item) validate() error {
+	switch {
+	case strings.TrimSpace(it.Name) == "":
+		return errors.New("name is required")
+	case len(it.Name) > maxItemName:
+		return fmt.Errorf("name must be at most %d characters", maxItemName)
+	case it.Price < 0:
+		return errors.New("price must not be negative")
+	}
+	return nil
+}
+
+// errItemNotFound is returned for an item that is not stored
+var errItemNotFound = errors.New("item not found")
+
+// ItemStore persists the items of the items API
+type ItemStore interface {
+	// List returns every item, ordered by ID
+	List(ctx context.Context) ([]item, error)
+	// Get returns the item with id, or errItemNotFound
+	Get(ctx context.Context, id string) (item, error)
+	// Create stores it with a new ID and returns it
+	Create(ctx context.Context, it item) (item, error)
+	// Update replaces the item with the ID of it, or returns errItemNotFound
+	Update(ctx context.Context, it item) error
+	// Delete removes the item with id, or returns errItemNotFound
+	Delete(ctx context.Context, id string) error
+}
+
+// newItemStore returns the item store for cfg.Backend, reaching Redis with
+// redis for the redis backend. Validate rejects any other backend than the
+// memory one.
+func newItemStore(cfg config.Items, redis config.Redis) ItemStore {
+	if cfg.Backend == backendRedis {
+		return newRedisItemStore(newRedisClient(redis), cfg.Key)
+	}
+	return newMemoryItemStore()
+}
+
+// sortItems orders items by ID. IDs are decimal numbers without leading
+// zeros, so a shorter ID is always the smaller one.
+func sortItems(items []item) {
+	sort.Slice(items, func(i, j int) bool {
+		if len(items[i].ID) != len(items[j].ID) {
+			return len(items[i].ID) < len(items[j].ID)
+		}
+		return items[i].ID < items[j].ID
+	})
+}
+
+// memoryItemStore keeps the items in memory, like the memory hit store they
+// are lost on restart and not shared between replicas
+type memoryItemStore struct {
+	mu     sync.Mutex
+	lastID int64
+	items  map[string]item
+}
+
+func newMemoryItemStore() *memoryItemStore {
+	return &memoryItemStore{items: map[string]item{}}
+}
+
+func (s *memoryItemStore) List(ctx context.Context) ([]item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	items := make([]item, 0, len(s.items))
+	for _, it := range s.items {
+		items = append(items, it)
+	}
+	sortItems(items)
+	return items, nil
+}
+
+func (s *memoryItemStore) Get(ctx context.Context, id string) (item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	it, ok := s.items[id]
+	if !ok {
+		return item{}, errItemNotFound
+	}
+	return it, nil
+}
+
+func (s *memoryItemStore) Create(ctx context.Context, it item) (item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	it.ID = strconv.FormatInt(s.lastID, 10)
+	s.items[it.ID] = it
+	return it, nil
+}
+
+func (s *memoryItemStore) Update(ctx context.Context, it item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[it.ID]; !ok {
+		return errItemNotFound
+	}
+	s.items[it.ID] = it
+	return nil
+}
+
+func (s *memoryItemStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.items[id]; !ok {
+		return errItemNotFound
+	}
+	delete(s.items, id)
+	return nil
+}
+
+// redisItemStore keeps the items as JSON in a Redis hash keyed by ID, with
+// the last ID handed out in key:id, so every replica shares them
+type redisItemStore struct {
+	client *redisClient
+	key    string
+}
+
+func newRedisItemStore(client *redisClient, key string) *redisItemStore {
+	return &redisItemStore{client: client, key: key}
+}
+
+// decodeItem decodes the stored JSON of an item
+func decodeItem(reply interface{}) (item, error) {
+	value, ok := reply.(string)
+	if !ok {
+		return item{}, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	var it item
+	if err := json.Unmarshal([]byte(value), &it); err != nil {
+		return item{}, fmt.Errorf("decoding item: %w", err)
+	}
+	return it, nil
+}
+
+func (s *redisItemStore) List(ctx context.Context) ([]item, error) {
+	reply, err := storeDo(ctx, s.client, "HVALS", s.key)
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+	items := make([]item, 0, len(values))
+	for _, value := range values {
+		it, err := decodeItem(value)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, it)
+	}
+	sortItems(items)
+	return items, nil
+}
+
+func (s *redisItemStore) Get(ctx context.Context, id string) (item, error) {
+	reply, err := storeDo(ctx, s.client, "HGET", s.key, id)
+	if err != nil {
+		return item{}, err
+	}
+	if reply == nil {
+		return item{}, errItemNotFound
+	}
+	return decodeItem(reply)
+}
+
+// set stores it under its ID
+func (s *redisItemStore) set(ctx context.Context, it item) error {
+	data, err := json.Marshal(it)
+	if err != nil {
+		return err
+	}
+	_, err = storeDo(ctx, s.client, "HSET", s.key, it.ID, string(data))
+	return err
+}
+
+func (s *redisItemStore) Create(ctx context.Context, it item) (item, error) {
+	id, err := integer(storeDo(ctx, s.client, "INCR", s.key+":id"))
+	if err != nil {
+		return item{}, err
+	}
+	it.ID = strconv.FormatInt(id, 10)
+	return it, s.set(ctx, it)
+}
+
+// Update checks the item exists before replacing it, an item deleted in
+// between by another replica is stored again
+func (s *redisItemStore) Update(ctx context.Context, it item) error {
+	exists, err := integer(storeDo(ctx, s.client, "HEXISTS", s.key, it.ID))
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return errItemNotFound
+	}
+	return s.set(ctx, it)
+}
+
+func (s *redisItemStore) Delete(ctx context.Context, id string) error {
+	deleted, err := integer(storeDo(ctx, s.client, "HDEL", s.key, id))
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return errItemNotFound
+	}
+	return nil
+}
+
+// itemsAPI serves /api/v1/items, a small CRUD API that gives the request
+// metrics a few routes, methods and statuses to explore. Every request waits
+// a random duration up to latency first, listing up to twice as long.
+type itemsAPI struct {
+	store   ItemStore
+	latency time.Duration
+}
+
+func newItemsAPI(store ItemStore, latency time.Duration) *itemsAPI {
+	return &itemsAPI{store: store, latency: latency}
+}
+
+// routes registers the items API on router
+func (a *itemsAPI) routes(router *mux.Router) {
+	router.Path(itemsRoute).Methods(http.MethodGet, http.MethodOptions).HandlerFunc(a.handleList)
+	router.Path(itemsRoute).Methods(http.MethodPost).HandlerFunc(a.handleCreate)
+	router.Path(itemRoute).Methods(http.MethodGet, http.MethodOptions).HandlerFunc(a.handleGet)
+	router.Path(itemRoute).Methods(http.MethodPut).HandlerFunc(a.handleUpdate)
+	router.Path(itemRoute).Methods(http.MethodDelete).HandlerFunc(a.handleDelete)
+}
+
+// wait delays r by a random duration up to max, and reports whether the
+// client is still there to be answered
+func (a *itemsAPI) wait(r *http.Request, max time.Duration) bool {
+	if max <= 0 {
+		return true
+	}
+	delay := time.NewTimer(time.Duration(rand.Int63n(int64(max))) + 1)
+	defer delay.Stop()
+	select {
+	case <-delay.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// writeItems responds with v as JSON and status
+func writeItems(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeStoreError answers a request the item store failed with err, a 404 for
+// a missing item and a 500 otherwise
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errItemNotFound) {
+		writeError(w, r, http.StatusNotFound, err.Error())
+		return
+	}
+	if errors.Is(err, errRedisDisabled) {
+		writeError(w, r, http.StatusServiceUnavailable, err.Error())
+		return
+	}
+	utils.WriteLog("ERROR", fmt.Sprintf("Item store failed for %s %s: %s", r.Method, r.URL.Path, err))
+	writeError(w, r, http.StatusInternalServerError, "item store failed")
+}
+
+// decodeItemBody decodes the item in the body of r, answering the request
+// through writeBodyError or with a 400 and returning false if it cannot be
+// stored
+func decodeItemBody(w http.ResponseWriter, r *http.Request) (item, bool) {
+	var it item
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return it, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&it); err != nil {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid item: %s", err))
+		return it, false
+	}
+	if err := it.validate(); err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return it, false
+	}
+	return it, true
+}
+
+func (a *itemsAPI) handleList(w http.ResponseWriter, r *http.Request) {
+	if !a.wait(r, 2*a.latency) {
+		return
+	}
+	items, err := a.store.List(r.Context())
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeItems(w, http.StatusOK, items)
+}
+
+func (a *itemsAPI) handleGet(w http.ResponseWriter, r *http.Request) {
+	if !a.wait(r, a.latency) {
+		return
+	}
+	it, err := a.store.Get(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeItems(w, http.StatusOK, it)
+}
+
+func (a *itemsAPI) handleCreate(w http.ResponseWriter, r *http.Request) {
+	it, ok := decodeItemBody(w, r)
+	if !ok || !a.wait(r, a.latency) {
+		return
+	}
+	it, err := a.store.Create(r.Context(), it)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	// relative to the request path, so it holds behind a base path too
+	w.Header().Set("Location", "items/"+it.ID)
+	writeItems(w, http.StatusCreated, it)
+}
+
+func (a *itemsAPI) handleUpdate(w http.ResponseWriter, r *http.Request) {
+	it, ok := decodeItemBody(w, r)
+	if !ok || !a.wait(r, a.latency) {
+		return
+	}
+	it.ID = mux.Vars(r)["id"]
+	if err := a.store.Update(r.Context(), it); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeItems(w, http.StatusOK, it)
+}
+
+func (a *itemsAPI) handleDelete(w http.ResponseWriter, r *http.Request) {
+	if !a.wait(r, a.latency) {
+		return
+	}
+	if err := a.store.Delete(r.Context(), mux.Vars(r)["id"]); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestItemStores(t *testing.T) {
+	server := newFakeRedis(t, "")
+	redis := config.Default().HitStore.Redis
+	redis.Addr = server.l.Addr().String()
+
+	stores := map[string]ItemStore{
+		backendMemory: newItemStore(config.Items{Backend: backendMemory}, redis),
+		backendRedis:  newItemStore(config.Items{Backend: backendRedis, Key: "items"}, redis),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			var created []item
+			for i := 0; i < 11; i++ {
+				it, err := store.Create(ctx, item{Name: "book", Price: float64(i)})
+				if err != nil {
+					t.Fatalf("Failed to create an item: %v", err)
+				}
+				created = append(created, it)
+			}
+			if created[0].ID != "1" || created[10].ID != "11" {
+				t.Fatalf("Expected IDs 1 to 11, but got %s to %s", created[0].ID, created[10].ID)
+			}
+
+			items, err := store.List(ctx)
+			if err != nil {
+				t.Fatalf("Failed to list items: %v", err)
+			}
+			if !reflect.DeepEqual(items, created) {
+				t.Errorf("Expected the items ordered by ID %v, but got %v", created, items)
+			}
+
+			updated := item{ID: "2", Name: "journal", Price: 3.5, Tags: []string{"paper"}}
+			if err := store.Update(ctx, updated); err != nil {
+				t.Fatalf("Failed to update an item: %v", err)
+			}
+			if it, err := store.Get(ctx, "2"); err != nil || !reflect.DeepEqual(it, updated) {
+				t.Errorf("Expected %v, but got %v and %v", updated, it, err)
+			}
+
+			if err := store.Delete(ctx, "2"); err != nil {
+				t.Fatalf("Failed to delete an item: %v", err)
+			}
+			if _, err := store.Get(ctx, "2"); !errors.Is(err, errItemNotFound) {
+				t.Errorf("Expected errItemNotFound for a deleted item, but got %v", err)
+			}
+			if err := store.Update(ctx, updated); !errors.Is(err, errItemNotFound) {
+				t.Errorf("Expected errItemNotFound updating a deleted item, but got %v", err)
+			}
+			if err := store.Delete(ctx, "2"); !errors.Is(err, errItemNotFound) {
+				t.Errorf("Expected errItemNotFound deleting a deleted item, but got %v", err)
+			}
+		})
+	}
+}
+
+// serveItem sends a request to the items API of router and returns the status and body
+func serveItem(t *testing.T, router http.Handler, method, path, body string) (int, string) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr.Code, rr.Body.String()
+}
+
+func TestItemsAPI(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Items.Latency = 0
+	router := NewServer(cfg).Handler()
+
+	req := httptest.NewRequest(http.MethodPost, itemsRoute, strings.NewReader(`{"name": "book", "price": 12.5}`))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("Expected status %d, but got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Location"); got != "items/1" {
+		t.Errorf("Expected Location %q, but got %q", "items/1", got)
+	}
+
+	notFound := testutil.ToFloat64(totalRequests.WithLabelValues(itemRoute, http.MethodGet, "404"))
+	tests := []struct {
+		method, path, body string
+		status             int
+		expected           string
+	}{
+		{http.MethodGet, "/api/v1/items/1", "", http.StatusOK, `"name":"book"`},
+		{http.MethodPut, "/api/v1/items/1", `{"name": "journal", "price": 8}`, http.StatusOK, `"name":"journal"`},
+		{http.MethodGet, itemsRoute, "", http.StatusOK, `[{"id":"1","name":"journal","price":8}]`},
+		{http.MethodPost, itemsRoute, `{"name": ""}`, http.StatusBadRequest, "name is required"},
+		{http.MethodPost, itemsRoute, `{"name": "book", "price": -1}`, http.StatusBadRequest, "price must not be negative"},
+		{http.MethodPost, itemsRoute, `{"name": "book", "colour": "red"}`, http.StatusBadRequest, "unknown field"},
+		{http.MethodPost, itemsRoute, `{"name": `, http.StatusBadRequest, "invalid item"},
+		{http.MethodPut, "/api/v1/items/7", `{"name": "book"}`, http.StatusNotFound, "item not found"},
+		{http.MethodDelete, "/api/v1/items/1", "", http.StatusNoContent, ""},
+		{http.MethodGet, "/api/v1/items/1", "", http.StatusNotFound, "item not found"},
+		{http.MethodDelete, "/api/v1/items/1", "", http.StatusNotFound, "item not found"},
+	}
+	for _, tt := range tests {
+		status, body := serveItem(t, router, tt.method, tt.path, tt.body)
+		if status != tt.status {
+			t.Errorf("Expected status %d for %s %s, but got %d: %s", tt.status, tt.method, tt.path, status, body)
+		}
+		if !strings.Contains(body, tt.expected) {
+			t.Errorf("Expected %s %s to respond with %s, but got %s", tt.method, tt.path, tt.expected, body)
+		}
+	}
+
+	// the route is the path label, whatever the ID
+	if got := testutil.ToFloat64(totalRequests.WithLabelValues(itemRoute, http.MethodGet, "404")) - notFound; got != 1 {
+		t.Errorf("Expected http_requests_total for %s to count 1 GET 404, but got %v", itemRoute, got)
+	}
+}
+
+func TestItemsAPIBodyTooLarge(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Items.Latency = 0
+	cfg.MaxBodyBytes = 64
+	router := NewServer(cfg).Handler()
+
+	body, _ := json.Marshal(item{Name: strings.Repeat("a", 100)})
+	if status, _ := serveItem(t, router, http.MethodPost, itemsRoute, string(body)); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d, but got %d", http.StatusRequestEntityTooLarge, status)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// liveRoute streams a liveSnapshot every liveInterval as Server-Sent Events
+const liveRoute = "/live"
+
+// liveInterval is how often /live sends a snapshot
+var liveInterval = time.Second
+
+// liveSnapshot is the app telemetry /live streams. RequestRate and P99 are
+// computed from http_request_duration_seconds over the last interval, like
+// rate() and histogram_quantile() would, P99 is zero without requests.
+type liveSnapshot struct {
+	Time        time.Time `json:"time"`
+	Hits        int64     `json:"hits"`
+	RequestRate float64   `json:"requestRate"`
+	P99         float64   `json:"p99Seconds"`
+}
+
+// liveSampler takes the snapshots of a single /live stream, each one since
+// the one before
+type liveSampler struct {
+	gatherer prometheus.Gatherer
+	last     *dto.Histogram
+	lastTime time.Time
+}
+
+// requestDuration returns http_request_duration_seconds out of families, nil
+// if it is missing
+func requestDuration(families []*dto.MetricFamily) *dto.Histogram {
+	for _, mf := range families {
+		if mf.GetName() == "http_request_duration_seconds" && len(mf.GetMetric()) > 0 {
+			return mf.GetMetric()[0].GetHistogram()
+		}
+	}
+	return nil
+}
+
+// sample returns the snapshot at now, the first one has no request rate or p99
+func (ls *liveSampler) sample(ctx context.Context, now time.Time) liveSnapshot {
+	snapshot := liveSnapshot{Time: now.UTC()}
+	if hits, err := hitStore.Get(ctx); err == nil {
+		snapshot.Hits = hits
+	}
+
+	families, _ := ls.gatherer.Gather()
+	current := requestDuration(families)
+	if current == nil {
+		return snapshot
+	}
+	if ls.last != nil && now.After(ls.lastTime) {
+		requests := float64(current.GetSampleCount() - ls.last.GetSampleCount())
+		snapshot.RequestRate = requests / now.Sub(ls.lastTime).Seconds()
+		snapshot.P99 = bucketQuantile(0.99, ls.last, current)
+	}
+	ls.last, ls.lastTime = current, now
+	return snapshot
+}
+
+// bucketQuantile estimates the q quantile of the observations current made
+// since before, interpolating linearly within the bucket it falls in like
+// histogram_quantile. A quantile past the last bucket is its upper bound.
+func bucketQuantile(q float64, before, current *dto.Histogram) float64 {
+	total := float64(current.GetSampleCount() - before.GetSampleCount())
+	if total <= 0 {
+		return 0
+	}
+	previous := map[float64]uint64{}
+	for _, b := range before.GetBucket() {
+		previous[b.GetUpperBound()] = b.GetCumulativeCount()
+	}
+
+	rank := q * total
+	var lower, count float64
+	for _, b := range current.GetBucket() {
+		cumulative := float64(b.GetCumulativeCount() - previous[b.GetUpperBound()])
+		if cumulative >= rank {
+			if cumulative == count {
+				return b.GetUpperBound()
+			}
+			return lower + (b.GetUpperBound()-lower)*(rank-count)/(cumulative-count)
+		}
+		lower, count = b.GetUpperBound(), cumulative
+	}
+	return lower
+}
+
+// handleLive streams a liveSnapshot every liveInterval until the client goes
+// away or the server starts draining. It is not subject to the request
+// timeout, since the stream only ends with one of those.
+func (s *Server) handleLive(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// proxies such as nginx would buffer the events otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	sampler := &liveSampler{gatherer: s.gatherer}
+	ticker := time.NewTicker(liveInterval)
+	defer ticker.Stop()
+	for now := time.Now(); ; {
+		data, err := json.Marshal(sampler.sample(r.Context(), now))
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+			return
+		}
+		flusher.Flush()
+
+		select {
+		case now = <-ticker.C:
+		case <-r.Context().Done():
+			return
+		case <-s.draining:
+			return
+		}
+	}
+}
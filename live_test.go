@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestLiveSampler(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h := prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Buckets: []float64{0.1, 0.5, 1},
+	})
+	reg.MustRegister(h)
+	sampler := &liveSampler{gatherer: reg}
+	start := time.Now()
+
+	// observations before the first snapshot are not counted
+	h.Observe(5)
+	if first := sampler.sample(context.Background(), start); first.RequestRate != 0 || first.P99 != 0 {
+		t.Errorf("Expected the first snapshot without a rate or p99, but got %+v", first)
+	}
+
+	for i := 0; i < 100; i++ {
+		h.Observe(0.05)
+	}
+	for i := 0; i < 100; i++ {
+		h.Observe(0.3)
+	}
+	second := sampler.sample(context.Background(), start.Add(2*time.Second))
+	if second.RequestRate != 100 {
+		t.Errorf("Expected a rate of 100 requests per second, but got %v", second.RequestRate)
+	}
+	// rank 198 of 200 is 98 of the 100 observations in (0.1, 0.5]
+	if expected := 0.1 + 0.4*0.98; math.Abs(second.P99-expected) > 1e-9 {
+		t.Errorf("Expected a p99 of %v, but got %v", expected, second.P99)
+	}
+
+	h.Observe(5)
+	if third := sampler.sample(context.Background(), start.Add(3*time.Second)); third.P99 != 1 {
+		t.Errorf("Expected a p99 past the last bucket to be its bound, but got %v", third.P99)
+	}
+	if fourth := sampler.sample(context.Background(), start.Add(4*time.Second)); fourth.RequestRate != 0 || fourth.P99 != 0 {
+		t.Errorf("Expected no rate or p99 without requests, but got %+v", fourth)
+	}
+}
+
+func TestLive(t *testing.T) {
+	interval := liveInterval
+	liveInterval = 10 * time.Millisecond
+	defer func() { liveInterval = interval }()
+
+	cfg := testConfig(t)
+	cfg.Port = "0"
+	cfg.RequestTimeout = 50 * time.Millisecond
+	cfg.AccessLog.Enabled = true
+	s := NewServer(cfg)
+	served, err := s.Start()
+	if err != nil {
+		t.Fatalf("Failed to start the server: %v", err)
+	}
+
+	resp, err := http.Get("http://" + s.Addr() + liveRoute)
+	if err != nil {
+		t.Fatalf("Failed to get %s: %v", liveRoute, err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Expected Content-Type %q, but got %q", "text/event-stream", got)
+	}
+
+	// events keep coming through the middlewares past the request timeout
+	events := bufio.NewScanner(resp.Body)
+	var received []liveSnapshot
+	for len(received) < 10 && events.Scan() {
+		if !strings.HasPrefix(events.Text(), "data: ") {
+			continue
+		}
+		var snapshot liveSnapshot
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(events.Text(), "data: ")), &snapshot); err != nil {
+			t.Fatalf("Failed to decode %q: %v", events.Text(), err)
+		}
+		received = append(received, snapshot)
+	}
+	if len(received) < 10 {
+		t.Fatalf("Expected 10 snapshots, but got %d: %v", len(received), events.Err())
+	}
+
+	// the stream ends once the shutdown drains, rather than holding it up
+	start := time.Now()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the shutdown not to wait on the stream, but it took %s", elapsed)
+	}
+	for events.Scan() {
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Expected serving to end with %v, but got %v", http.ErrServerClosed, err)
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"golang.org/x/time/rate"
+)
+
+// Load generator results
+const (
+	loadgenSuccess = "success"
+	loadgenError   = "error"
+)
+
+// Load generator traffic patterns
+const (
+	// patternConstant sends RPS for the whole run
+	patternConstant = "constant"
+	// patternRamp ramps up from zero to RPS over the run, or over a minute if it has no duration
+	patternRamp = "ramp"
+	// patternBurst sends RPS, with a second of burstFactor times RPS every burstPeriod
+	patternBurst = "burst"
+)
+
+// burstPeriod and burstFactor shape the burst pattern
+const (
+	burstPeriod = 10 * time.Second
+	burstFactor = 10
+)
+
+// loadgenRateUpdate is how often the pattern adjusts the request rate
+const loadgenRateUpdate = 100 * time.Millisecond
+
+// loadgenMinRPS is the lowest rate the limiter is set to, a zero limit takes
+// the token of a request out of the limiter's burst and stalls it for good
+const loadgenMinRPS = 1
+
+// loadProfile is the traffic a loadGenerator sends
+type loadProfile struct {
+	RPS      float64
+	Pattern  string
+	Duration time.Duration
+}
+
+// rateAt returns the requests per second the profile sends elapsed into the run
+func (p loadProfile) rateAt(elapsed time.Duration) float64 {
+	switch p.Pattern {
+	case patternRamp:
+		ramp := p.Duration
+		if ramp <= 0 {
+			ramp = time.Minute
+		}
+		if elapsed >= ramp {
+			return p.RPS
+		}
+		return p.RPS * float64(elapsed) / float64(ramp)
+	case patternBurst:
+		if elapsed%burstPeriod < time.Second {
+			return p.RPS * burstFactor
+		}
+		return p.RPS
+	default:
+		return p.RPS
+	}
+}
+
+// limitAt returns the limiter setting of the rate elapsed into the run, never
+// below loadgenMinRPS unless the profile itself is
+func (p loadProfile) limitAt(elapsed time.Duration) rate.Limit {
+	minimum := p.RPS
+	if minimum > loadgenMinRPS {
+		minimum = loadgenMinRPS
+	}
+	if r := p.rateAt(elapsed); r > minimum {
+		return rate.Limit(r)
+	}
+	return rate.Limit(minimum)
+}
+
+// validate returns an error if the profile cannot be run
+func (p loadProfile) validate() error {
+	if p.RPS <= 0 {
+		return fmt.Errorf("rps must be positive")
+	}
+	if p.Duration < 0 {
+		return fmt.Errorf("duration must not be negative")
+	}
+	switch p.Pattern {
+	case patternConstant, patternRamp, patternBurst:
+		return nil
+	default:
+		return fmt.Errorf("unknown pattern %q, expected %s, %s or %s", p.Pattern, patternConstant, patternRamp, patternBurst)
+	}
+}
+
+// loadGenerator sends requests for paths to the app at target from a number
+// of concurrent workers, so the dashboards have traffic to show
+type loadGenerator struct {
+	client  *http.Client
+	target  string
+	paths   []string
+	workers int
+	profile loadProfile
+	limiter *rate.Limiter
+}
+
+func newLoadGenerator(target string, paths []string, workers int, profile loadProfile) *loadGenerator {
+	return &loadGenerator{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		target:  target,
+		paths:   paths,
+		workers: workers,
+		profile: profile,
+		limiter: rate.NewLimiter(profile.limitAt(0), 1),
+	}
+}
+
+// Run sends requests until ctx is done or the profile's duration is up, the
+// workers share the request rate of the profile
+func (g *loadGenerator) Run(ctx context.Context) {
+	loadgenRequests.WithLabelValues(loadgenSuccess)
+	loadgenRequests.WithLabelValues(loadgenError)
+
+	if g.profile.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, g.profile.Duration)
+		defer cancel()
+	}
+	go g.shape(ctx)
+
+	var wg sync.WaitGroup
+	for i := 0; i < g.workers; i++ {
+		wg.Add(1)
+		go func(offset int) {
+			defer wg.Done()
+			loadgenActiveWorkers.Inc()
+			defer loadgenActiveWorkers.Dec()
+			g.work(ctx, offset)
+		}(i)
+	}
+	wg.Wait()
+}
+
+// shape adjusts the request rate to the pattern until ctx is done
+func (g *loadGenerator) shape(ctx context.Context) {
+	start := time.Now()
+	ticker := time.NewTicker(loadgenRateUpdate)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.limiter.SetLimit(g.profile.limitAt(time.Since(start)))
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// work cycles through the paths starting at offset, so workers spread over
+// them. A wait the limiter refuses, because at the current rate it would
+// outlast the run, is retried once the pattern had a chance to raise it.
+func (g *loadGenerator) work(ctx context.Context, offset int) {
+	for i := offset; ; {
+		if err := g.limiter.Wait(ctx); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			select {
+			case <-time.After(loadgenRateUpdate):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		g.send(ctx, g.paths[i%len(g.paths)])
+		i++
+	}
+}
+
+// send requests path once and counts the result, any status of 400 or more is an error
+func (g *loadGenerator) send(ctx context.Context, path string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, g.target+path, nil)
+	if err != nil {
+		loadgenRequests.WithLabelValues(loadgenError).Inc()
+		return
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		// requests cut short by stopping the generator are not errors of the app
+		if ctx.Err() == nil {
+			loadgenRequests.WithLabelValues(loadgenError).Inc()
+		}
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		loadgenRequests.WithLabelValues(loadgenError).Inc()
+		return
+	}
+	loadgenRequests.WithLabelValues(loadgenSuccess).Inc()
+}
+
+// runLoadgen runs the loadgen command, which sends load to a running app
+// until the duration is up or it is interrupted
+func runLoadgen(args []string) error {
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	target := fs.String("target", "http://localhost:8080", "URL of the app to send load to")
+	paths := fs.String("paths", "/,/api/hits", "comma-separated paths to request in turn")
+	workers := fs.Int("workers", 10, "number of concurrent workers")
+	var profile loadProfile
+	fs.Float64Var(&profile.RPS, "rps", 10, "requests per second")
+	fs.StringVar(&profile.Pattern, "pattern", patternConstant, "traffic pattern, constant, ramp or burst")
+	fs.DurationVar(&profile.Duration, "duration", 0, "how long to send load, until interrupted if zero")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := profile.validate(); err != nil {
+		return err
+	}
+	if *workers <= 0 {
+		return fmt.Errorf("workers must be positive")
+	}
+	list := utils.SplitList(*paths)
+	if len(list) == 0 {
+		return fmt.Errorf("paths must not be empty")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	utils.WriteLog("INFO", fmt.Sprintf("Sending %g rps (%s) to %s from %d workers", profile.RPS, profile.Pattern, *target, *workers))
+	newLoadGenerator(strings.TrimSuffix(*target, "/"), list, *workers, profile).Run(ctx)
+	return nil
+}
+
+// loadgenRun is the load generator started through /api/debug/loadgen
+type loadgenRun struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	// id tells a finished run apart from one started after it
+	id int
+}
+
+// stop stops the running load generator, if any, run.mu must be held
+func (run *loadgenRun) stop() {
+	if run.cancel != nil {
+		run.cancel()
+		run.cancel = nil
+		utils.WriteLog("INFO", "Stopped the load generator")
+	}
+}
+
+// handleLoadgen starts the load generator against the server itself with a
+// POST, and stops it with a DELETE. The rps, pattern, duration, paths and
+// workers query parameters configure it, only one can run at a time.
+func (s *Server) handleLoadgen(w http.ResponseWriter, r *http.Request) {
+	run := &s.loadgen
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	if r.Method == http.MethodDelete {
+		run.stop()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if run.cancel != nil {
+		writeError(w, r, http.StatusConflict, "the load generator is already running, stop it with DELETE first")
+		return
+	}
+	profile, paths, workers, err := parseLoadgenQuery(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	run.id++
+	run.cancel = cancel
+	id := run.id
+	g := newLoadGenerator(s.selfURL(), paths, workers, profile)
+	if s.cfg.TLS.Enabled() {
+		// the certificate of the server is not necessarily valid for 127.0.0.1, or self-signed
+		g.client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	go func() {
+		g.Run(ctx)
+		cancel()
+		run.mu.Lock()
+		defer run.mu.Unlock()
+		if run.id == id {
+			run.cancel = nil
+		}
+	}()
+	utils.WriteLog("INFO", fmt.Sprintf("Started the load generator, %g rps (%s) for %s from %d workers", profile.RPS, profile.Pattern, profile.Duration, workers))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"rps":      profile.RPS,
+		"pattern":  profile.Pattern,
+		"duration": profile.Duration.String(),
+		"paths":    paths,
+		"workers":  workers,
+	})
+}
+
+// parseLoadgenQuery returns the load generator settings of the query, by
+// default the traffic of the loadgen command for a minute
+func parseLoadgenQuery(r *http.Request) (loadProfile, []string, int, error) {
+	query := r.URL.Query()
+	profile := loadProfile{RPS: 10, Pattern: patternConstant, Duration: time.Minute}
+	paths := []string{"/", "/api/hits"}
+	workers := 10
+
+	var err error
+	if value := query.Get("rps"); value != "" {
+		if profile.RPS, err = strconv.ParseFloat(value, 64); err != nil {
+			return profile, nil, 0, fmt.Errorf("invalid rps %q", value)
+		}
+	}
+	if value := query.Get("pattern"); value != "" {
+		profile.Pattern = value
+	}
+	if value := query.Get("duration"); value != "" {
+		if profile.Duration, err = time.ParseDuration(value); err != nil {
+			return profile, nil, 0, fmt.Errorf("invalid duration %q", value)
+		}
+	}
+	if value := query.Get("paths"); value != "" {
+		// every worker cycles through the paths, so there has to be one
+		if paths = utils.SplitList(value); len(paths) == 0 {
+			return profile, nil, 0, fmt.Errorf("invalid paths %q", value)
+		}
+	}
+	if value := query.Get("workers"); value != "" {
+		if workers, err = strconv.Atoi(value); err != nil || workers <= 0 {
+			return profile, nil, 0, fmt.Errorf("invalid workers %q", value)
+		}
+	}
+	if err := profile.validate(); err != nil {
+		return profile, nil, 0, err
+	}
+	return profile, paths, workers, nil
+}
+
+// selfURL returns the URL the server can reach itself on, over loopback
+func (s *Server) selfURL() string {
+	scheme := "http"
+	if s.cfg.TLS.Enabled() {
+		scheme = "https"
+	}
+	port := s.cfg.Port
+	if _, bound, err := net.SplitHostPort(s.Addr()); err == nil {
+		port = bound
+	}
+	base := strings.TrimSuffix("/"+strings.Trim(s.cfg.BasePath, "/"), "/")
+	return scheme + "://127.0.0.1:" + port + base
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLoadGenerator(t *testing.T) {
+	s, reg := NewTestServer(t)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	successBefore := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenSuccess))
+	errorBefore := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenError))
+
+	g := newLoadGenerator(ts.URL, []string{"/api/hits", "/api/does-not-exist"}, 2, loadProfile{RPS: 100, Pattern: patternConstant})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		g.Run(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(loadgenActiveWorkers) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(loadgenActiveWorkers); got != 2 {
+		t.Errorf("Expected loadgen_active_workers to be 2 while running, but got %v", got)
+	}
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+
+	if got := testutil.ToFloat64(loadgenActiveWorkers); got != 0 {
+		t.Errorf("Expected loadgen_active_workers to be 0 once stopped, but got %v", got)
+	}
+	if got := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenSuccess)) - successBefore; got == 0 {
+		t.Errorf("Expected loadgen_requests_total{result=%q} to increase", loadgenSuccess)
+	}
+	if got := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenError)) - errorBefore; got == 0 {
+		t.Errorf("Expected loadgen_requests_total{result=%q} to increase for the 404s", loadgenError)
+	}
+
+	// the generated load shows up on the app's own metrics
+	if got := pathRequests("/api/hits"); got == 0 {
+		t.Errorf("Expected the generated requests to be counted by http_requests_total")
+	}
+	if count, err := testutil.GatherAndCount(reg, "loadgen_requests_total"); err != nil || count != 2 {
+		t.Errorf("Expected loadgen_requests_total to be registered with both results, but got %d (%v)", count, err)
+	}
+}
+
+func TestLoadGeneratorRamp(t *testing.T) {
+	var requests atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer ts.Close()
+
+	// the ramp starts from zero, which must not stall the limiter
+	g := newLoadGenerator(ts.URL, []string{"/"}, 2, loadProfile{RPS: 100, Pattern: patternRamp, Duration: time.Second})
+	start := time.Now()
+	g.Run(context.Background())
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Expected the ramp to run for its duration, but it returned after %s", elapsed)
+	}
+	// about half of 100 rps over the second
+	if got := requests.Load(); got <= 10 {
+		t.Errorf("Expected the ramp to send more than 10 requests, but it sent %d", got)
+	}
+}
+
+func TestLoadProfileRate(t *testing.T) {
+	tests := []struct {
+		profile loadProfile
+		elapsed time.Duration
+		want    float64
+	}{
+		{loadProfile{RPS: 50, Pattern: patternConstant}, time.Hour, 50},
+		{loadProfile{RPS: 50, Pattern: patternRamp, Duration: 10 * time.Second}, 0, 0},
+		{loadProfile{RPS: 50, Pattern: patternRamp, Duration: 10 * time.Second}, 5 * time.Second, 25},
+		{loadProfile{RPS: 50, Pattern: patternRamp, Duration: 10 * time.Second}, 20 * time.Second, 50},
+		{loadProfile{RPS: 50, Pattern: patternRamp}, 30 * time.Second, 25},
+		{loadProfile{RPS: 50, Pattern: patternBurst}, burstPeriod + 500*time.Millisecond, 50 * burstFactor},
+		{loadProfile{RPS: 50, Pattern: patternBurst}, burstPeriod + 5*time.Second, 50},
+	}
+
+	for _, tt := range tests {
+		if got := tt.profile.rateAt(tt.elapsed); got != tt.want {
+			t.Errorf("Expected %+v to send %v rps after %s, but got %v", tt.profile, tt.want, tt.elapsed, got)
+		}
+	}
+
+	ramp := loadProfile{RPS: 50, Pattern: patternRamp, Duration: 10 * time.Second}
+	if got := ramp.limitAt(0); got != loadgenMinRPS {
+		t.Errorf("Expected the limit at the start of a ramp to be %v, but got %v", loadgenMinRPS, got)
+	}
+	if slow := (loadProfile{RPS: 0.5, Pattern: patternRamp}); slow.limitAt(0) != 0.5 {
+		t.Errorf("Expected the limit of a profile slower than the minimum to be its rps, but got %v", slow.limitAt(0))
+	}
+
+	for _, invalid := range []loadProfile{{RPS: 0, Pattern: patternConstant}, {RPS: 1, Pattern: "sine"}} {
+		if err := invalid.validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", invalid)
+		}
+	}
+}
+
+func TestRunLoadgenWithoutPaths(t *testing.T) {
+	if err := runLoadgen([]string{"-paths", "", "-duration", "10ms"}); err == nil {
+		t.Errorf("Expected an error for the loadgen command without paths")
+	}
+}
+
+func TestLoadgenHandler(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	cfg.Port = "0"
+	s := NewServer(cfg)
+	if _, err := s.Start(); err != nil {
+		t.Fatalf("Failed to start the server: %v", err)
+	}
+	defer s.srv.Close()
+
+	url := "http://" + s.Addr() + "/api/debug/loadgen"
+	post := func(query string) int {
+		resp, err := http.Post(url+query, "", nil)
+		if err != nil {
+			t.Fatalf("Failed to request the load generator: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := post("?pattern=sine"); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown pattern, but got %d", http.StatusBadRequest, status)
+	}
+	if status := post("?paths=,"); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d without paths, but got %d", http.StatusBadRequest, status)
+	}
+
+	before := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenSuccess))
+	if status := post("?rps=100&duration=1m&paths=/api/healthz&workers=2"); status != http.StatusAccepted {
+		t.Fatalf("Expected status %d starting the load generator, but got %d", http.StatusAccepted, status)
+	}
+	if status := post(""); status != http.StatusConflict {
+		t.Errorf("Expected status %d while it is running, but got %d", http.StatusConflict, status)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenSuccess)) == before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenSuccess)) - before; got == 0 {
+		t.Errorf("Expected the load generator to send requests to the server")
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, url, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to stop the load generator: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %d stopping the load generator, but got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(loadgenActiveWorkers) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(loadgenActiveWorkers); got != 0 {
+		t.Errorf("Expected the workers to stop, but %v are running", got)
+	}
+	if status := post("?duration=10ms"); status != http.StatusAccepted {
+		t.Errorf("Expected status %d starting it again once stopped, but got %d", http.StatusAccepted, status)
+	}
+}
@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/cmwylie19/prometheus-workshop/config"
 	"github.com/cmwylie19/prometheus-workshop/utils"
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/storage/remote"
 )
@@ -19,26 +25,111 @@ import (
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	start      time.Time
+	firstByte  time.Time
+	// written is the number of body bytes written
+	written int64
+}
+
+// wroteHeader reports whether the status and headers were already sent
+func (rw *responseWriter) wroteHeader() bool {
+	return !rw.firstByte.IsZero()
 }
 
 func NewResponseWriter(w http.ResponseWriter) *responseWriter {
-	return &responseWriter{w, http.StatusOK}
+	return &responseWriter{ResponseWriter: w, statusCode: http.StatusOK, start: time.Now()}
+}
+
+// markFirstByte records when the response started being sent
+func (rw *responseWriter) markFirstByte() {
+	if rw.firstByte.IsZero() {
+		rw.firstByte = time.Now()
+	}
+}
+
+// timeToFirstByte returns how long it took to start sending the response
+func (rw *responseWriter) timeToFirstByte() time.Duration {
+	if rw.firstByte.IsZero() {
+		// nothing was written, net/http sends the headers once the handler returns
+		return time.Since(rw.start)
+	}
+	return rw.firstByte.Sub(rw.start)
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
+	rw.markFirstByte()
 	rw.statusCode = code
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// Total requests per path
-var totalRequests = prometheus.NewCounterVec(
-	prometheus.CounterOpts{
-		Name:        "http_requests_total",
-		Help:        "Number of get requests.",
-		ConstLabels: prometheus.Labels{"metrics": "custom"},
-	},
-	[]string{"path"},
-)
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.markFirstByte()
+	n, err := rw.ResponseWriter.Write(b)
+	rw.written += int64(n)
+	return n, err
+}
+
+// Flush sends the response written so far, so streaming handlers such as
+// /live still stream through the wrapper
+func (rw *responseWriter) Flush() {
+	rw.markFirstByte()
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, for protocols such as
+// WebSocket that take over the connection after an upgrade
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", rw.ResponseWriter)
+	}
+	rw.markFirstByte()
+	return h.Hijack()
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// version of the build, set at compile time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// commit the build is from, set at compile time with -ldflags "-X main.commit=..."
+var commit = "unknown"
+
+// Total requests per path, method and status, replaced by configureRequestLabels with the legacy labels
+var totalRequests = newHTTPRequests()
+
+// Distinct path label values tracked by http_requests_total
+var distinctPaths = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name:        "http_distinct_paths",
+	Help:        "Number of distinct path label values of http_requests_total.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, func() float64 {
+	return float64(countLabelValues(totalRequests, "path"))
+})
+
+// Requests currently being served
+var inflight = newInflightTracker()
+
+// Age of the longest running request, computed on scrape
+var oldestInflight = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name:        "http_oldest_inflight_request_seconds",
+	Help:        "Age of the longest running in-flight HTTP request, 0 if there is none.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, func() float64 {
+	return inflight.oldest().Seconds()
+})
 
 // Response statuses
 var responseStatus = prometheus.NewCounterVec(
@@ -50,23 +141,506 @@ var responseStatus = prometheus.NewCounterVec(
 	[]string{"status"},
 )
 
-// Response time per path
-var httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
-	Name:        "http_response_time_seconds",
-	Help:        "Duration of HTTP requests.",
+// Response statuses per path
+var responseStatusByPath = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:        "http_response_status_by_path_total",
+		Help:        "Status of HTTP responses by path.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	},
+	[]string{"path", "status"},
+)
+
+// Requests per user-agent category
+var requestsByAgent = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:        "http_requests_by_agent_total",
+		Help:        "Number of requests by user-agent category.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	},
+	[]string{"category"},
+)
+
+// Response time per path, replaced by configureHTTPDuration when buckets are configured
+var httpDuration = newHTTPDuration(prometheus.DefBuckets, 0)
+
+// Response time of every request, without a path label for a single overall latency panel
+var httpRequestDuration = newHTTPRequestDuration(prometheus.DefBuckets, 0)
+
+// Bytes received in request bodies per path
+var requestBytesReceived = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:        "http_request_bytes_received_total",
+		Help:        "Number of bytes received in HTTP request bodies.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	},
+	[]string{"path"},
+)
+
+// Time to first byte per path, replaced by configureHTTPDuration when buckets are configured
+var httpTTFB = newHTTPTTFB(prometheus.DefBuckets, 0)
+
+// Request and response body sizes per path, replaced by configureHTTPDuration with native histograms
+var (
+	httpRequestSize  = newHTTPRequestSize(0)
+	httpResponseSize = newHTTPResponseSize(0)
+)
+
+// Requests currently being served per path
+var httpRequestsInFlight = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name:        "http_requests_in_flight",
+		Help:        "Number of HTTP requests currently being served.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	},
+	[]string{"path"},
+)
+
+// Configured bucket boundaries of the response time histogram
+var httpDurationBucketConfig = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name:        "http_duration_bucket_config",
+	Help:        "Bucket boundaries configured for http_response_time_seconds.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"le"})
+
+// Static file requests per extension
+var staticRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:        "static_requests_total",
+		Help:        "Number of static file requests by extension.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	},
+	[]string{"ext"},
+)
+
+// Bytes of static files sent in response bodies
+var staticBytesServed = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "static_bytes_served_total",
+	Help:        "Number of bytes of static files sent in response bodies.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Conditional static file requests answered with a 304
+var staticNotModified = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "static_not_modified_total",
+	Help:        "Number of static file requests answered with 304 Not Modified because the client's copy was current.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Deep links served index.html by the SPA fallback
+var spaFallback = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "spa_fallback_total",
+	Help:        "Number of requests served index.html by the SPA fallback.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Static file open, stat and read failures
+var staticReadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name:        "static_read_errors_total",
+	Help:        "Number of static file open, stat and read failures, by not_found or io reason.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"reason"})
+
+// Requests whose path label was replaced because of the cardinality cap
+var cardinalityOverflow = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "metric_cardinality_overflow_total",
+	Help:        "Number of requests recorded with path=\"overflow\" because the path label cap was reached.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Label values replaced by "overflow" because their label cap was reached, per label
+var cardinalityDropped = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:        "metric_label_cardinality_dropped_total",
+		Help:        "Number of label values suppressed rather than creating a new series because the label cap was reached.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	},
+	[]string{"label"},
+)
+
+// Scrapes of /api/metrics rejected for missing or wrong credentials
+var metricsAuthFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "metrics_auth_failures_total",
+	Help:        "Number of scrapes rejected for missing or wrong credentials.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// TLS connections that closed before completing their handshake
+var tlsHandshakeErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "tls_handshake_errors_total",
+	Help:        "Number of TLS connections that failed or never completed their handshake.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Connections per state, closed and hijacked count every connection that ended that way
+var httpConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name:        "http_connections",
+	Help:        "Number of HTTP connections per state, closed and hijacked are cumulative.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"state"})
+
+// Panics recovered per path
+var httpPanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name:        "http_panics_total",
+	Help:        "Number of panics recovered while serving HTTP requests.",
 	ConstLabels: prometheus.Labels{"metrics": "custom"},
 }, []string{"path"})
 
-// initial count
-var count int = 0
+// Requests waiting for a worker of the worker pool
+var workerPoolQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "worker_pool_queue_depth",
+	Help:        "Number of requests queued for a worker of the worker pool.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Requests rejected because the worker pool queue was full
+var workerPoolRejected = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "worker_pool_rejected_total",
+	Help:        "Number of requests rejected with a 503 because the worker pool queue was full.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Configured rate limit, 0 when rate limiting is disabled
+var rateLimiterLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "rate_limiter_limit_rps",
+	Help:        "Requests per second allowed by the rate limiter, 0 when disabled.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Configured rate limiter burst, 0 when rate limiting is disabled
+var rateLimiterBurst = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "rate_limiter_burst",
+	Help:        "Burst of requests allowed by the rate limiter, 0 when disabled.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Tokens left in the rate limiter, 0 when rate limiting is disabled
+var rateLimiterTokens = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+	Name:        "rate_limiter_tokens",
+	Help:        "Tokens currently available in the global rate limiter, 0 when disabled.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, limiterTokens)
+
+// Requests rejected with a 429 by the global or a per-IP rate limit, per path
+var throttledRequests = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:        "http_requests_throttled_total",
+		Help:        "Number of requests rejected with a 429 by the rate limiter.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	},
+	[]string{"path"},
+)
+
+// Requests of the web app counted against the SLO
+var sloRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "slo_requests_total",
+	Help:        "Number of web app requests counted against the SLO.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Requests of the web app meeting the SLO, not a 5xx and within its latency
+var sloGoodRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "slo_requests_good_total",
+	Help:        "Number of web app requests answered without a 5xx within the SLO latency.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Configured SLO objective, 0 when the SLO is disabled
+var sloObjective = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "slo_objective_ratio",
+	Help:        "Ratio of good requests the SLO aims for, 0 when disabled.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Bytes of gzipped responses before compression
+var httpUncompressedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "http_uncompressed_bytes_total",
+	Help:        "Number of bytes of gzipped responses before compression.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Bytes of gzipped responses after compression, as sent to clients
+var httpCompressedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "http_compressed_bytes_total",
+	Help:        "Number of bytes of gzipped responses after compression.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Requests rejected because their route was at its concurrency limit
+var routeConcurrencyRejected = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name:        "http_route_concurrency_rejected_total",
+		Help:        "Number of requests rejected because their route was at its concurrency limit.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	},
+	[]string{"path"},
+)
+
+// Idempotency-Key responses kept for replay
+var idempotencyCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "idempotency_cache_entries",
+	Help:        "Number of Idempotency-Key responses kept for replay.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Idempotency-Keys evicted to stay within the cache size
+var idempotencyCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "idempotency_cache_evictions_total",
+	Help:        "Number of least recently used Idempotency-Keys evicted to stay within the cache size.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Requests delayed by the chaos middleware
+var chaosInjections = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "chaos_injections_total",
+	Help:        "Number of requests delayed on purpose by the chaos latency injection.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Requests answered with a 5xx by the chaos middleware
+var chaosErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "chaos_errors_total",
+	Help:        "Number of requests answered with a 5xx on purpose by the chaos error injection.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Faults being injected, by mode
+var chaosActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name:        "chaos_active",
+	Help:        "Whether a chaos fault is being injected, 1 for latency, errors, cpu or memory if it is.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"mode"})
+
+// Access log lines skipped by sampling
+var accessLogsSampledOut = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "access_logs_sampled_out_total",
+	Help:        "Number of requests not written to the access log because of its sample rates.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Pushes of the metrics to a Pushgateway or remote_write endpoint by mode and result
+var pushes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name:        "metrics_push_total",
+	Help:        "Number of times the metrics were pushed, by push mode and result.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"mode", "result"})
+
+// Time taken to push the metrics by mode
+var pushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:        "metrics_push_duration_seconds",
+	Help:        "Duration of pushes of the metrics.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+	Buckets:     prometheus.DefBuckets,
+}, []string{"mode"})
+
+// Time of the last successful push by mode
+var lastPushSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name:        "metrics_push_last_success_timestamp_seconds",
+	Help:        "Unix time of the last successful push of the metrics.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"mode"})
+
+// Requests that no route matched
+var unmatchedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "http_unmatched_requests_total",
+	Help:        "Number of requests that did not match any route.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Requests whose body took too long to arrive
+var bodyReadTimeouts = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "http_body_read_timeouts_total",
+	Help:        "Number of requests rejected because their body took too long to arrive.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Requests whose body did not match the declared Content-Length
+var badContentLength = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "http_bad_content_length_total",
+	Help:        "Number of requests rejected because the body did not match the Content-Length.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Load generator workers currently sending requests
+var loadgenActiveWorkers = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "loadgen_active_workers",
+	Help:        "Number of load generator workers currently running.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Requests sent by the load generator by result, success or error
+var loadgenRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name:        "loadgen_requests_total",
+	Help:        "Number of requests sent by the load generator.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"result"})
+
+// Config reload attempts
+var configReloads = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "config_reloads_total",
+	Help:        "Number of config reloads attempted.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Config reloads that failed and left the previous config in place
+var configReloadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "config_reload_errors_total",
+	Help:        "Number of config reloads that failed.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Time of the last successful config reload
+var configLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "config_last_reload_timestamp_seconds",
+	Help:        "Unix time of the last successful config reload.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Feature flags, 1 when enabled
+var featureEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name:        "feature_enabled",
+	Help:        "Whether a feature flag is enabled (1) or disabled (0).",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"feature"})
+
+// Hit store operation latency
+var hitStoreOpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:        "hit_store_op_duration_seconds",
+	Help:        "Duration of hit store operations.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"op"})
+
+// Hit store operations served from memory because the backend failed
+var hitStoreFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "hit_store_fallbacks_total",
+	Help:        "Number of hit store operations served from memory because the backend failed.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Result of each health check the last time /api/health or /api/readyz ran it
+var healthCheckStatus = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name:        "health_check_status",
+	Help:        "1 if the health check passed the last time it ran, 0 if it failed.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"check"})
+
+// Spans of traced requests that were dropped instead of exported
+var tracingSpansDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name:        "tracing_spans_dropped_total",
+	Help:        "Spans dropped because the export queue was full or exporting them failed.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Active hit store backend
+var hitStoreBackend = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name:        "hit_store_backend",
+	Help:        "Type of the active hit store backend.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+}, []string{"type"})
+
+// Unix time the process started, for uptime as time() - app_start_time_seconds
+var appStartTime = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "app_start_time_seconds",
+	Help:        "Unix time the app started.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Whether the server is shutting down
+var shutdownInProgress = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "shutdown_in_progress",
+	Help:        "1 once the server started shutting down, 0 otherwise.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Configured time in-flight requests get to finish on shutdown
+var shutdownDrainTimeout = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "shutdown_drain_timeout_seconds",
+	Help:        "Time in-flight requests get to finish once the listeners are closed on shutdown, 0 if unbounded.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// Time the last shutdown took, from the start of Shutdown until in-flight requests were drained
+var shutdownDuration = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name:        "server_shutdown_duration_seconds",
+	Help:        "Time the last graceful shutdown took, from the shutdown signal until in-flight requests were drained.",
+	ConstLabels: prometheus.Labels{"metrics": "custom"},
+})
+
+// hitStore holds the number of hits to the web app
+var hitStore HitStore = newInstrumentedStore(newMemoryStore(), hitStoreOpDuration)
+
+// setHitStoreBackend marks backend as the active hit store type
+func setHitStoreBackend(backend string) {
+	hitStoreBackend.Reset()
+	hitStoreBackend.WithLabelValues(backend).Set(1)
+}
+
+// configureHitStore replaces the hit store with one configured by cfg.
+// Reads are cached for CacheTTL in front of the instrumented backend so
+// hit_store_op_duration_seconds only records actual backend calls.
+func configureHitStore(cfg config.HitStore) error {
+	store, err := newHitStore(cfg)
+	if err != nil {
+		return err
+	}
+	hitStore = newInstrumentedStore(store, hitStoreOpDuration)
+	if cfg.Timeout > 0 {
+		hitStore = newTimeoutStore(hitStore, cfg.Timeout)
+	}
+	if cfg.CacheTTL > 0 {
+		hitStore = newCachedStore(hitStore, cfg.CacheTTL, cfg.Timeout)
+	}
+	setHitStoreBackend(cfg.Backend)
+	return nil
+}
 
 // handleHit returns the number of hits to the web app
 func handleHit(w http.ResponseWriter, r *http.Request) {
-	string_hits := strconv.Itoa(count)
+	hits, err := hitStore.Get(r.Context())
+	if err != nil {
+		utils.WriteLog("ERROR", fmt.Sprintf("Failed to get hits: %s", err))
+		writeError(w, r, http.StatusInternalServerError, "failed to get hits")
+		return
+	}
+	string_hits := strconv.FormatInt(hits, 10)
 	utils.WriteLog("INFO", fmt.Sprintf("Request to handleHit endpoint, hit number %s", string_hits))
 	w.Write([]byte(string_hits))
 }
 
+// handleReset sets the number of hits to the web app back to zero
+func handleReset(w http.ResponseWriter, r *http.Request) {
+	if err := hitStore.Reset(r.Context()); err != nil {
+		utils.WriteLog("ERROR", fmt.Sprintf("Failed to reset hits: %s", err))
+		writeError(w, r, http.StatusInternalServerError, "failed to reset hits")
+		return
+	}
+	utils.WriteLog("INFO", "Request to handleReset endpoint, hits reset")
+	w.Write([]byte("0"))
+}
+
+// maxHitsAdd caps how many hits a single call to handleAdd can add
+const maxHitsAdd = 1000000
+
+// handleAdd adds the n query parameter to the number of hits to the web app
+// and returns the new value, which seeds demo data without generating traffic
+func handleAdd(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.ParseInt(r.URL.Query().Get("n"), 10, 64)
+	if err != nil || n <= 0 || n > maxHitsAdd {
+		writeError(w, r, http.StatusBadRequest, fmt.Sprintf("n must be an integer between 1 and %d", maxHitsAdd))
+		return
+	}
+
+	hits, err := hitStore.Add(r.Context(), n)
+	if err != nil {
+		utils.WriteLog("ERROR", fmt.Sprintf("Failed to add hits: %s", err))
+		writeError(w, r, http.StatusInternalServerError, "failed to add hits")
+		return
+	}
+	string_hits := strconv.FormatInt(hits, 10)
+	utils.WriteLog("INFO", fmt.Sprintf("Request to handleAdd endpoint, added %d hits, hit number %s", n, string_hits))
+	w.Write([]byte(string_hits))
+}
+
 // HealthCheckHandler returns a 200 if the server is up
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	utils.WriteLog("INFO", "Request to healthCheck endpoint")
@@ -76,23 +650,43 @@ func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, `{"alive": true}`)
 }
 
-// Middleware for counting hits to the web app
-// This only works if there is one replicas of the backend.
-// This data is ephemeral and will be lost if the backend is restarted.
-// use a cache like redis to persist the data
-func hitCounterMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		count += 1
-		next.ServeHTTP(w, r)
-	})
+// hitCounter counts hits to the web app before calling the next handler,
+// only requests with one of methods count so HEAD and OPTIONS probes do not
+type hitCounter struct {
+	next    http.Handler
+	methods map[string]bool
+}
+
+func (h hitCounter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.methods[r.Method] {
+		// the request context, so a slow store is cancelled when the client goes away
+		if _, err := hitStore.Incr(r.Context()); err != nil {
+			utils.WriteLog("ERROR", fmt.Sprintf("Failed to increment hits: %s", err))
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// Middleware for counting hits to the web app with one of methods
+func hitCounterMiddleware(next http.Handler, methods []string) http.Handler {
+	h := hitCounter{next: next, methods: map[string]bool{}}
+	for _, method := range methods {
+		h.methods[strings.ToUpper(method)] = true
+	}
+	return h
 }
 
 // handleMetrics receives metrics from prometheus
 func handleMetrics(w http.ResponseWriter, r *http.Request) {
 	// utils.WriteLog("INFO", "Request to handleMetrics endpoint")
 	req, err := remote.DecodeWriteRequest(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.Is(err, errBodyReadTimeout) || errors.As(err, &tooLarge) {
+		writeBodyError(w, r, err)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, r, http.StatusBadRequest, err.Error())
 		return
 	}
 
@@ -117,75 +711,275 @@ func handleMetrics(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+// EnableCors allows cross-origin requests from any origin, without credentials
 func EnableCors(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
-		}
+	return corsMiddleware(config.CORS{})(next)
+}
+
+// corsMiddleware allows cross-origin requests. Preflights are cached for MaxAge
+// when it is set. With AllowCredentials the request origin is echoed instead of
+// the wildcard, which browsers reject for credentialed requests.
+func corsMiddleware(cfg config.CORS) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if cfg.AllowCredentials {
+				if origin := r.Header.Get("Origin"); origin != "" {
+					w.Header().Set("Access-Control-Allow-Origin", origin)
+					w.Header().Set("Access-Control-Allow-Credentials", "true")
+				}
+				w.Header().Add("Vary", "Origin")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, Authorization, X-Request-Id")
+			w.Header().Set("Access-Control-Expose-Headers", requestIDHeader)
+
+			if r.Method == "OPTIONS" {
+				if cfg.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+				}
+				w.WriteHeader(http.StatusOK)
+				return
+			}
 
-		next.ServeHTTP(w, r)
-	})
+			next.ServeHTTP(w, r)
+		})
+	}
 }
 
-// Middleware for prometheus metrics for each endpoint
-func prometheusMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		route := mux.CurrentRoute(r)
-		path, _ := route.GetPathTemplate()
+// versionHeaderMiddleware sets header to the build version on every response
+// so it is visible which replica served a request during canary rollouts
+func versionHeaderMiddleware(header string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(header, version)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
 
-		timer := prometheus.NewTimer(httpDuration.WithLabelValues(path))
-		rw := NewResponseWriter(w)
-		next.ServeHTTP(rw, r)
+// routeTemplate returns the path template of the route matched for r, or "" if there is none
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	path, _ := route.GetPathTemplate()
+	return path
+}
+
+// Middleware for prometheus metrics for each endpoint,
+// paths is used to cap the number of distinct path labels
+func prometheusMiddleware(paths *labelGuard) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path := paths.Label(pathLabel(r))
+
+			done := inflight.start()
+			defer done()
+			httpRequestsInFlight.WithLabelValues(path).Inc()
+			defer httpRequestsInFlight.WithLabelValues(path).Dec()
+
+			start := time.Now()
+			rw := NewResponseWriter(w)
+
+			// without a Content-Length only the bytes the handler actually reads are known
+			var body *countingReader
+			if r.ContentLength < 0 && r.Body != nil {
+				body = &countingReader{ReadCloser: r.Body}
+				r.Body = body
+			}
 
-		statusCode := rw.statusCode
+			next.ServeHTTP(rw, r)
 
-		responseStatus.WithLabelValues(strconv.Itoa(statusCode)).Inc()
-		totalRequests.WithLabelValues(path).Inc()
+			statusCode := rw.statusCode
+
+			var received int64
+			if body != nil {
+				received = body.n
+			} else if r.ContentLength > 0 {
+				received = r.ContentLength
+			}
+			requestBytesReceived.WithLabelValues(path).Add(float64(received))
+			httpRequestSize.WithLabelValues(path).Observe(float64(received))
+			httpResponseSize.WithLabelValues(path).Observe(float64(rw.written))
+
+			responseStatus.WithLabelValues(strconv.Itoa(statusCode)).Inc()
+			responseStatusByPath.WithLabelValues(path, strconv.Itoa(statusCode)).Inc()
+			exemplar := exemplarLabels(r)
+			incWithExemplar(totalRequests.WithLabelValues(requestLabelValues(path, r.Method, statusCode)...), exemplar)
+			requestsByAgent.WithLabelValues(classifyUserAgent(r.UserAgent())).Inc()
+
+			httpTTFB.WithLabelValues(path).Observe(rw.timeToFirstByte().Seconds())
+			elapsed := time.Since(start).Seconds()
+			observeWithExemplar(httpDuration.WithLabelValues(requestLabelValues(path, r.Method, statusCode)...), elapsed, exemplar)
+			httpRequestDuration.Observe(elapsed)
+		})
+	}
+}
 
-		timer.ObserveDuration()
-	})
+// collectors returns every custom metric of the web app
+func collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		totalRequests,
+		distinctPaths,
+		oldestInflight,
+		responseStatus,
+		responseStatusByPath,
+		requestsByAgent,
+		httpDuration,
+		httpRequestDuration,
+		httpTTFB,
+		requestBytesReceived,
+		httpRequestSize,
+		httpResponseSize,
+		httpRequestsInFlight,
+		hitStoreOpDuration,
+		hitStoreBackend,
+		healthCheckStatus,
+		tracingSpansDropped,
+		hitStoreFallbacks,
+		cardinalityOverflow,
+		cardinalityDropped,
+		staticRequests,
+		staticBytesServed,
+		staticNotModified,
+		spaFallback,
+		staticReadErrors,
+		httpDurationBucketConfig,
+		featureEnabled,
+		httpPanics,
+		workerPoolQueueDepth,
+		workerPoolRejected,
+		routeConcurrencyRejected,
+		rateLimiterLimit,
+		rateLimiterBurst,
+		rateLimiterTokens,
+		throttledRequests,
+		sloRequests,
+		sloGoodRequests,
+		sloObjective,
+		httpUncompressedBytes,
+		httpCompressedBytes,
+		unmatchedRequests,
+		chaosInjections,
+		chaosErrors,
+		chaosActive,
+		accessLogsSampledOut,
+		pushes,
+		pushDuration,
+		lastPushSuccess,
+		idempotencyCacheEntries,
+		idempotencyCacheEvictions,
+		badContentLength,
+		bodyReadTimeouts,
+		loadgenActiveWorkers,
+		loadgenRequests,
+		configReloads,
+		configReloadErrors,
+		configLastReload,
+		httpConnections,
+		tlsHandshakeErrors,
+		metricsAuthFailures,
+		appStartTime,
+		shutdownInProgress,
+		shutdownDrainTimeout,
+		shutdownDuration,
+		goroutineCollector{},
+		app,
+	}
 }
+
 func init() {
 	// register custom prometheus metrics
-	prometheus.Register(totalRequests)
-	prometheus.Register(responseStatus)
-	prometheus.Register(httpDuration)
-}
+	if err := registerMetrics(metricsRegisterer); err != nil {
+		utils.WriteLog("ERROR", fmt.Sprintf("Failed to register metrics: %s", err))
+	}
 
-func main() {
+	setHTTPDurationBucketConfig(prometheus.DefBuckets)
 
-	router := mux.NewRouter()
-	router.Use(prometheusMiddleware)
-	router.Use(EnableCors)
+	setHitStoreBackend(backendMemory)
 
-	// Static files
-	fs := http.FileServer(http.Dir("./static"))
+	appStartTime.Set(float64(startedAt.Unix()))
+}
 
-	// metrics endpoint
-	router.Path("/api/metrics").Handler(promhttp.Handler())
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "loadgen" {
+		if err := runLoadgen(os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			utils.WriteLog("ERROR", err.Error())
+			os.Exit(2)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "aggregate" {
+		if err := runAggregate(os.Args[2:]); err != nil && !errors.Is(err, flag.ErrHelp) {
+			utils.WriteLog("ERROR", err.Error())
+			os.Exit(2)
+		}
+		return
+	}
+
+	flags, err := config.ParseFlags(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		utils.WriteLog("ERROR", err.Error())
+		os.Exit(2)
+	}
+	cfg, err := flags.Load()
+	if err != nil {
+		utils.WriteLog("ERROR", err.Error())
+		log.Fatal(err)
+	}
+	if err := utils.SetLogLevel(cfg.LogLevel); err != nil {
+		utils.WriteLog("ERROR", err.Error())
+		log.Fatal(err)
+	}
+	if err := utils.SetLogFormat(cfg.LogFormat); err != nil {
+		utils.WriteLog("ERROR", err.Error())
+		log.Fatal(err)
+	}
 
-	// health check endpoint
-	router.Path("/api/healthz").HandlerFunc(HealthCheckHandler)
+	configureRequestLabels(cfg.Metrics.LegacyRequestLabels)
+	if cfg.Metrics.LegacyRequestLabels {
+		utils.WriteLog("WARNING", "legacyRequestLabels is deprecated and will be removed, migrate queries of http_requests_total and http_response_time_seconds to their method and status labels")
+	}
+	if err := configureConstLabels(cfg.MetricConstLabels); err != nil {
+		utils.WriteLog("ERROR", err.Error())
+		log.Fatal(err)
+	}
+	configureHTTPDuration(cfg.HTTPDurationBuckets, cfg.Metrics.NativeHistogramBucketFactor)
+	configureRuntimeCollectors(cfg.Metrics)
 
-	// hits at the web app endpoint
-	router.Path("/api/hits").HandlerFunc(handleHit)
+	if err := configureHitStore(cfg.HitStore); err != nil {
+		utils.WriteLog("ERROR", err.Error())
+		log.Fatal(err)
+	}
+	configureAppCollector(cfg.StaticDir)
 
-	// remoteWrite endpoint
-	router.Path("/api/remote").HandlerFunc(handleMetrics)
+	server := NewServer(cfg)
+	if flags.ConfigFile != "" {
+		server.WatchReload(flags)
+	}
 
-	// web app
-	router.PathPrefix("/").Handler(hitCounterMiddleware(fs))
+	shutdown := server.ShutdownOnSignal()
 
-	utils.WriteLog("INFO", fmt.Sprintf("Server started at port %s", utils.GetPort()))
-	err := http.ListenAndServe(":"+utils.GetPort(), router)
+	served, err := server.Start()
 	if err != nil {
 		utils.WriteLog("ERROR", err.Error())
 		log.Fatal(err)
 	}
+	logStartup(cfg)
+	if err := <-served; err != nil && err != http.ErrServerClosed {
+		utils.WriteLog("ERROR", err.Error())
+		log.Fatal(err)
+	}
+	if err := <-shutdown; err != nil {
+		utils.WriteLog("ERROR", fmt.Sprintf("Failed to shut down gracefully: %s", err))
+	}
+	utils.WriteLog("INFO", "Server stopped")
 
 }
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramCount returns the number of observations recorded by a histogram
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestVersionHeader(t *testing.T) {
+	router := NewServer(testConfig(t)).Handler()
+
+	for _, path := range []string{"/", "/api/hits"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if got := rr.Header().Get("X-App-Version"); got != version {
+			t.Errorf("Expected X-App-Version %q on %s, but got %q", version, path, got)
+		}
+	}
+}
+
+func TestVersionHeaderConfig(t *testing.T) {
+	t.Setenv("VERSION_HEADER", "X-Build")
+	router := NewServer(testConfig(t)).Handler()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	if got := rr.Header().Get("X-Build"); got != version {
+		t.Errorf("Expected X-Build %q, but got %q", version, got)
+	}
+
+	t.Setenv("VERSION_HEADER_ENABLED", "false")
+	router = NewServer(testConfig(t)).Handler()
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	if got := rr.Header().Get("X-Build"); got != "" {
+		t.Errorf("Expected no version header when disabled, but got %q", got)
+	}
+}
+
+func TestResponseStatusByPath(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ReadyAfter = time.Hour
+	router := NewServer(cfg).Handler()
+
+	series := []struct {
+		path   string
+		status string
+	}{
+		{path: "/api/hits", status: "200"},
+		{path: "/api/readyz", status: "503"},
+		{path: "/api/hits", status: "503"},
+		{path: "/api/readyz", status: "200"},
+	}
+	before := make([]float64, len(series))
+	for i, s := range series {
+		before[i] = testutil.ToFloat64(responseStatusByPath.WithLabelValues(s.path, s.status))
+	}
+
+	for _, path := range []string{"/api/hits", "/api/readyz"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	for i, s := range series {
+		expected := 0.0
+		if i < 2 {
+			expected = 1
+		}
+		if got := testutil.ToFloat64(responseStatusByPath.WithLabelValues(s.path, s.status)) - before[i]; got != expected {
+			t.Errorf("Expected %v responses for path %s status %s, but got %v", expected, s.path, s.status, got)
+		}
+	}
+}
+
+func TestHandleAdd(t *testing.T) {
+	t.Setenv("DEBUG", "true")
+	s, _ := NewTestServer(t)
+	router := s.Handler()
+
+	tests := []struct {
+		n      string
+		status int
+		body   string
+	}{
+		{"5", http.StatusOK, "5"},
+		{"10", http.StatusOK, "15"},
+		{"-3", http.StatusBadRequest, ""},
+		{"0", http.StatusBadRequest, ""},
+		{"abc", http.StatusBadRequest, ""},
+		{strconv.Itoa(maxHitsAdd + 1), http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/hits/add?n="+tt.n, nil))
+
+		if rr.Code != tt.status {
+			t.Errorf("Expected status %d for n=%s, but got %d", tt.status, tt.n, rr.Code)
+		}
+		if tt.body != "" && rr.Body.String() != tt.body {
+			t.Errorf("Expected body %q for n=%s, but got %q", tt.body, tt.n, rr.Body.String())
+		}
+	}
+
+	if n, _ := hitStore.Get(context.Background()); n != 15 {
+		t.Errorf("Expected %d hits after rejected adds, but got %d", 15, n)
+	}
+}
+
+func TestCorsMaxAge(t *testing.T) {
+	t.Setenv("CORS_MAX_AGE", "10m")
+	router := NewServer(testConfig(t)).Handler()
+
+	req := httptest.NewRequest(http.MethodOptions, "/api/hits", nil)
+	req.Header.Set("Origin", "https://workshop.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d for the preflight, but got %d", http.StatusOK, rr.Code)
+	}
+	if got := rr.Header().Get("Access-Control-Max-Age"); got != "600" {
+		t.Errorf("Expected Access-Control-Max-Age %q, but got %q", "600", got)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Expected any origin to be allowed without credentials, but got %q", got)
+	}
+}
+
+func TestCorsCredentials(t *testing.T) {
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	router := NewServer(testConfig(t)).Handler()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/hits", nil)
+	req.Header.Set("Origin", "https://workshop.example.com")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if got := rr.Header().Get("Access-Control-Allow-Origin"); got != "https://workshop.example.com" {
+		t.Errorf("Expected the request origin to be echoed, but got %q", got)
+	}
+	if got := rr.Header().Get("Access-Control-Allow-Credentials"); got != "true" {
+		t.Errorf("Expected Access-Control-Allow-Credentials %q, but got %q", "true", got)
+	}
+	if got := rr.Header().Get("Vary"); got != "Origin" {
+		t.Errorf("Expected Vary %q, but got %q", "Origin", got)
+	}
+	if got := rr.Header().Get("Access-Control-Max-Age"); got != "" {
+		t.Errorf("Expected no Access-Control-Max-Age outside preflights, but got %q", got)
+	}
+}
+
+// testStart is initialized before init runs, when the test binary starts
+var testStart = time.Now()
+
+func TestResponseWriterFlushHijack(t *testing.T) {
+	rr := httptest.NewRecorder()
+	rw := NewResponseWriter(rr)
+	rw.Flush()
+	if !rr.Flushed || !rw.wroteHeader() {
+		t.Errorf("Expected Flush to reach the wrapped writer and send the headers")
+	}
+	if _, _, err := rw.Hijack(); err == nil {
+		t.Errorf("Expected Hijack to fail for a writer that does not support it")
+	}
+
+	hijacked := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := NewResponseWriter(w).Hijack()
+		if err != nil {
+			hijacked <- err
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		hijacked <- buf.Flush()
+	}))
+	defer server.Close()
+
+	status, body := get(t, server.URL)
+	if err := <-hijacked; err != nil {
+		t.Fatalf("Failed to hijack the connection: %v", err)
+	}
+	if status != http.StatusOK || body != "hijacked" {
+		t.Errorf("Expected the hijacked response, but got %d %q", status, body)
+	}
+}
+
+func TestAppStartTime(t *testing.T) {
+	got := testutil.ToFloat64(appStartTime)
+	if diff := got - float64(testStart.Unix()); diff < -1 || diff > 1 {
+		t.Errorf("Expected app_start_time_seconds to be within a second of %d, but got %v", testStart.Unix(), got)
+	}
+}
+
+func TestHitMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []string
+		counted map[string]bool
+	}{
+		{"default", nil, map[string]bool{http.MethodGet: true, http.MethodHead: false, http.MethodOptions: false}},
+		{"configured", []string{"get", "head"}, map[string]bool{http.MethodGet: true, http.MethodHead: true, http.MethodOptions: false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.methods != nil {
+				t.Setenv("HIT_METHODS", strings.Join(tt.methods, ","))
+			}
+			s, _ := NewTestServer(t)
+
+			for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodOptions} {
+				before := getHits(t, s.Handler())
+				s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/", nil))
+				counted := getHits(t, s.Handler()) > before
+				if counted != tt.counted[method] {
+					t.Errorf("Expected a %s to / to be counted %t, but got %t", method, tt.counted[method], counted)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	promcollectors "github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Native histograms are capped at nativeHistogramMaxBuckets buckets, once a
+// histogram has more it widens them, after nativeHistogramMinResetDuration
+// since the last reset it starts over instead
+const (
+	nativeHistogramMaxBuckets       = 160
+	nativeHistogramMinResetDuration = time.Hour
+)
+
+// requestLabels are the labels of http_requests_total and
+// http_response_time_seconds, path alone with the legacy request labels
+var requestLabels = []string{"path", "method", "status"}
+
+// configureRequestLabels labels http_requests_total and
+// http_response_time_seconds by path alone if legacy, the labels they had
+// before method and status were added, so dashboards can be migrated. A
+// registry never accepts a metric name with other label names than the first
+// time, so the custom metrics move to a new registry that is gathered along
+// with the default one, like configureConstLabels does. It must be called
+// before configureConstLabels and configureHTTPDuration.
+func configureRequestLabels(legacy bool) {
+	labels := []string{"path", "method", "status"}
+	if legacy {
+		labels = []string{"path"}
+	}
+	if len(labels) == len(requestLabels) {
+		return
+	}
+
+	for _, c := range collectors() {
+		metricsRegisterer.Unregister(c)
+	}
+	requestLabels = labels
+	totalRequests = newHTTPRequests()
+	httpDuration = newHTTPDuration(prometheus.DefBuckets, 0)
+
+	reg := prometheus.NewRegistry()
+	registerMetrics(reg)
+	metricsRegisterer = reg
+	metricsGatherer = prometheus.Gatherers{prometheus.DefaultGatherer, reg}
+}
+
+// requestLabelValues returns the values of the requestLabels for a request
+func requestLabelValues(path, method string, status int) []string {
+	if len(requestLabels) == 1 {
+		return []string{path}
+	}
+	return []string{path, methodLabel(method), strconv.Itoa(status)}
+}
+
+// methodLabel returns method if it is a standard HTTP method and "other"
+// otherwise, since clients can send any method
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "other"
+	}
+}
+
+// newHTTPRequests returns the request counter with the requestLabels
+func newHTTPRequests() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name:        "http_requests_total",
+		Help:        "Number of HTTP requests.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	}, requestLabels)
+}
+
+// withNativeHistogram makes opts a native histogram with nativeFactor as the
+// growth factor between buckets, alongside the classic buckets so scrapes in
+// the text format still see them. A zero nativeFactor leaves opts classic.
+func withNativeHistogram(opts prometheus.HistogramOpts, nativeFactor float64) prometheus.HistogramOpts {
+	if nativeFactor > 0 {
+		opts.NativeHistogramBucketFactor = nativeFactor
+		opts.NativeHistogramMaxBucketNumber = nativeHistogramMaxBuckets
+		opts.NativeHistogramMinResetDuration = nativeHistogramMinResetDuration
+	}
+	return opts
+}
+
+// newHTTPDuration returns the response time histogram with the given bucket boundaries and the requestLabels
+func newHTTPDuration(buckets []float64, nativeFactor float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(withNativeHistogram(prometheus.HistogramOpts{
+		Name:        "http_response_time_seconds",
+		Help:        "Duration of HTTP requests.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+		Buckets:     buckets,
+	}, nativeFactor), requestLabels)
+}
+
+// newHTTPRequestDuration returns the response time histogram across all paths with the given bucket boundaries
+func newHTTPRequestDuration(buckets []float64, nativeFactor float64) prometheus.Histogram {
+	return prometheus.NewHistogram(withNativeHistogram(prometheus.HistogramOpts{
+		Name:        "http_request_duration_seconds",
+		Help:        "Duration of HTTP requests across all paths.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+		Buckets:     buckets,
+	}, nativeFactor))
+}
+
+// newHTTPTTFB returns the time to first byte histogram with the given bucket boundaries
+func newHTTPTTFB(buckets []float64, nativeFactor float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(withNativeHistogram(prometheus.HistogramOpts{
+		Name:        "http_ttfb_seconds",
+		Help:        "Time from the start of HTTP requests to the first byte of their response.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+		Buckets:     buckets,
+	}, nativeFactor), []string{"path"})
+}
+
+// sizeBuckets are the classic bucket boundaries of the size histograms, from
+// 100 bytes to 10MB
+var sizeBuckets = prometheus.ExponentialBuckets(100, 10, 6)
+
+// newHTTPRequestSize returns the request body size histogram
+func newHTTPRequestSize(nativeFactor float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(withNativeHistogram(prometheus.HistogramOpts{
+		Name:        "http_request_size_bytes",
+		Help:        "Size of HTTP request bodies.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+		Buckets:     sizeBuckets,
+	}, nativeFactor), []string{"path"})
+}
+
+// newHTTPResponseSize returns the response body size histogram
+func newHTTPResponseSize(nativeFactor float64) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(withNativeHistogram(prometheus.HistogramOpts{
+		Name:        "http_response_size_bytes",
+		Help:        "Size of HTTP response bodies.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+		Buckets:     sizeBuckets,
+	}, nativeFactor), []string{"path"})
+}
+
+// configureHTTPDuration replaces the response time and time to first byte histograms
+// with ones using buckets, which are also native histograms with a nativeFactor
+// above zero, as are the size histograms. It must be called before the server
+// starts handling requests.
+func configureHTTPDuration(buckets []float64, nativeFactor float64) {
+	metricsRegisterer.Unregister(httpDuration)
+	httpDuration = newHTTPDuration(buckets, nativeFactor)
+	metricsRegisterer.MustRegister(httpDuration)
+
+	metricsRegisterer.Unregister(httpRequestDuration)
+	httpRequestDuration = newHTTPRequestDuration(buckets, nativeFactor)
+	metricsRegisterer.MustRegister(httpRequestDuration)
+
+	metricsRegisterer.Unregister(httpTTFB)
+	httpTTFB = newHTTPTTFB(buckets, nativeFactor)
+	metricsRegisterer.MustRegister(httpTTFB)
+
+	metricsRegisterer.Unregister(httpRequestSize)
+	httpRequestSize = newHTTPRequestSize(nativeFactor)
+	metricsRegisterer.MustRegister(httpRequestSize)
+
+	metricsRegisterer.Unregister(httpResponseSize)
+	httpResponseSize = newHTTPResponseSize(nativeFactor)
+	metricsRegisterer.MustRegister(httpResponseSize)
+
+	setHTTPDurationBucketConfig(buckets)
+}
+
+// setHTTPDurationBucketConfig exposes one series per bucket boundary
+func setHTTPDurationBucketConfig(buckets []float64) {
+	httpDurationBucketConfig.Reset()
+	for _, b := range buckets {
+		httpDurationBucketConfig.WithLabelValues(strconv.FormatFloat(b, 'f', -1, 64)).Set(1)
+	}
+}
+
+// seedRouteMetrics creates the per-path series of every route of router at zero,
+// so dashboards and rate() see routes before their first request. Routes are
+// reserved in paths in the order they were registered, up to its cap.
+func seedRouteMetrics(router *mux.Router, paths *labelGuard) {
+	responseStatus.WithLabelValues(strconv.Itoa(http.StatusOK))
+	router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !paths.Reserve(path) {
+			return nil
+		}
+		for _, method := range seedMethods(route) {
+			totalRequests.WithLabelValues(requestLabelValues(path, method, http.StatusOK)...)
+			httpDuration.WithLabelValues(requestLabelValues(path, method, http.StatusOK)...)
+		}
+		responseStatusByPath.WithLabelValues(path, strconv.Itoa(http.StatusOK))
+		httpTTFB.WithLabelValues(path)
+		httpRequestsInFlight.WithLabelValues(path)
+		return nil
+	})
+}
+
+// seedMethods returns the methods route is seeded for, the ones it matches
+// besides OPTIONS, or GET for a route matching any method
+func seedMethods(route *mux.Route) []string {
+	var seed []string
+	methods, _ := route.GetMethods()
+	for _, method := range methods {
+		if method != http.MethodOptions {
+			seed = append(seed, method)
+		}
+	}
+	if len(seed) == 0 {
+		return []string{http.MethodGet}
+	}
+	return seed
+}
+
+// countLabelValues returns the number of distinct values of the label name
+// across the series c currently exports
+func countLabelValues(c prometheus.Collector, name string) int {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	values := map[string]bool{}
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == name {
+				values[l.GetValue()] = true
+			}
+		}
+	}
+	return len(values)
+}
+
+// registerOrReuse registers c with reg. If an identical collector is already
+// registered, which happens when metrics are set up twice, that one is returned
+// instead so callers keep recording to the series that get exposed.
+func registerOrReuse[T prometheus.Collector](reg prometheus.Registerer, c T) (T, error) {
+	err := reg.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing, nil
+		}
+	}
+	return c, err
+}
+
+// metricsRegisterer is where the custom metrics are registered and
+// metricsGatherer is what NewServer exposes, the default registry unless
+// configureConstLabels moved the custom metrics to a registry of their own
+var (
+	metricsRegisterer = prometheus.DefaultRegisterer
+	metricsGatherer   = prometheus.DefaultGatherer
+)
+
+// configureConstLabels registers every custom metric again with labels added
+// to its const labels. A registry never accepts a metric name with other label
+// names than the first time, so they move to a new registry that is gathered
+// along with the default one. Nothing changes if the labels are invalid or
+// collide with the labels of a metric. It must be called before NewServer.
+func configureConstLabels(labels map[string]string) error {
+	if len(labels) == 0 {
+		return nil
+	}
+	reg := prometheus.NewRegistry()
+	wrapped := prometheus.WrapRegistererWith(labels, reg)
+	if err := registerMetrics(wrapped); err != nil {
+		return fmt.Errorf("invalid metric const labels %v: %w", labels, err)
+	}
+
+	for _, c := range collectors() {
+		metricsRegisterer.Unregister(c)
+	}
+	metricsRegisterer = wrapped
+	metricsGatherer = prometheus.Gatherers{prometheus.DefaultGatherer, reg}
+	return nil
+}
+
+// goCollector and processCollector are the Go and process collectors of the
+// default registry, the ones it starts out with until configureRuntimeCollectors
+var (
+	goCollector      = promcollectors.NewGoCollector()
+	processCollector = promcollectors.NewProcessCollector(promcollectors.ProcessCollectorOpts{})
+)
+
+// goRuntimeMetricRules are the runtime/metrics rules of the
+// config.GoRuntimeMetricGroups
+var goRuntimeMetricRules = map[string]promcollectors.GoRuntimeMetricsRule{
+	"gc":        promcollectors.MetricsGC,
+	"memory":    promcollectors.MetricsMemory,
+	"scheduler": promcollectors.MetricsScheduler,
+	"all":       promcollectors.MetricsAll,
+}
+
+// configureRuntimeCollectors replaces the Go and process collectors of the
+// default registry with the ones cfg asks for, the Go collector adding the
+// runtime/metrics groups of GoRuntimeMetrics to the memstats based go_
+// metrics. It is safe to call more than once and must be called before
+// NewServer.
+func configureRuntimeCollectors(cfg config.Metrics) {
+	if goCollector != nil {
+		prometheus.DefaultRegisterer.Unregister(goCollector)
+		goCollector = nil
+	}
+	if processCollector != nil {
+		prometheus.DefaultRegisterer.Unregister(processCollector)
+		processCollector = nil
+	}
+
+	if !cfg.DisableGoCollector {
+		var rules []promcollectors.GoRuntimeMetricsRule
+		for _, group := range cfg.GoRuntimeMetrics {
+			rules = append(rules, goRuntimeMetricRules[group])
+		}
+		goCollector = promcollectors.NewGoCollector(promcollectors.WithGoCollectorRuntimeMetrics(rules...))
+		prometheus.DefaultRegisterer.MustRegister(goCollector)
+	}
+	if !cfg.DisableProcessCollector {
+		processCollector = promcollectors.NewProcessCollector(promcollectors.ProcessCollectorOpts{})
+		prometheus.DefaultRegisterer.MustRegister(processCollector)
+	}
+}
+
+// registerMetrics registers every custom metric with reg, it is safe to call more than once
+func registerMetrics(reg prometheus.Registerer) error {
+	for _, c := range collectors() {
+		if _, err := registerOrReuse(reg, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newMetricsHandler returns the /api/metrics handler for gatherer.
+// The exposition is encoded straight to the response as it is gathered,
+// and scrapes beyond MaxRequestsInFlight or Timeout are rejected with a 503.
+// Responses are gzipped by gzipResponseMiddleware rather than promhttp so
+// the compression savings are counted.
+func newMetricsHandler(gatherer prometheus.Gatherer, cfg config.Metrics) http.Handler {
+	h := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{
+		DisableCompression:  true,
+		MaxRequestsInFlight: cfg.MaxRequestsInFlight,
+		Timeout:             cfg.Timeout,
+		// exemplars are only exposed in the OpenMetrics format
+		EnableOpenMetrics: true,
+	}))
+	if !cfg.DisableCompression {
+		h = gzipResponseMiddleware(h)
+	}
+	return metricsAuth(cfg.Auth, h)
+}
+
+// metricsAuth rejects scrapes without the basic auth or bearer token
+// credentials of auth with a 401, so a scrape_config with basic_auth or
+// authorization can be tried against the demo. With no credentials
+// configured every scrape is served.
+func metricsAuth(auth config.MetricsAuth, next http.Handler) http.Handler {
+	if auth.Username == "" && auth.BearerToken == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); ok && auth.Username != "" &&
+			secretEqual(user, auth.Username) && secretEqual(password, auth.Password) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if header := r.Header.Get("Authorization"); auth.BearerToken != "" && strings.HasPrefix(header, "Bearer ") &&
+			secretEqual(strings.TrimPrefix(header, "Bearer "), auth.BearerToken) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		metricsAuthFailures.Inc()
+		if auth.Username != "" {
+			w.Header().Add("WWW-Authenticate", `Basic realm="metrics"`)
+		}
+		if auth.BearerToken != "" {
+			w.Header().Add("WWW-Authenticate", `Bearer realm="metrics"`)
+		}
+		writeError(w, r, http.StatusUnauthorized, "missing or wrong credentials")
+	})
+}
+
+// secretEqual compares a credential in constant time, so its value cannot be
+// guessed from how long the comparison takes
+func secretEqual(got, want string) bool {
+	return subtle.ConstantTimeCompare([]byte(got), []byte(want)) == 1
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestMetricsHandlerMaxRequestsInFlight(t *testing.T) {
+	gathering := make(chan struct{})
+	release := make(chan struct{})
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		gathering <- struct{}{}
+		<-release
+		return prometheus.DefaultGatherer.Gather()
+	})
+
+	h := newMetricsHandler(gatherer, config.Metrics{MaxRequestsInFlight: 1})
+
+	done := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+		done <- rr.Code
+	}()
+	<-gathering
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d for a scrape over the limit, but got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	close(release)
+	if status := <-done; status != http.StatusOK {
+		t.Errorf("Expected status %d for the scrape in flight, but got %d", http.StatusOK, status)
+	}
+}
+
+func TestMetricsHandlerTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		<-release
+		return nil, nil
+	})
+
+	h := newMetricsHandler(gatherer, config.Metrics{Timeout: 10 * time.Millisecond})
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d for a scrape over the timeout, but got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	auth := config.MetricsAuth{Username: "prometheus", Password: "s3cret", BearerToken: "t0ken"}
+	h := newMetricsHandler(prometheus.DefaultGatherer, config.Metrics{Auth: auth, DisableCompression: true})
+
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+		status int
+	}{
+		{"no credentials", func(r *http.Request) {}, http.StatusUnauthorized},
+		{"basic auth", func(r *http.Request) { r.SetBasicAuth("prometheus", "s3cret") }, http.StatusOK},
+		{"wrong password", func(r *http.Request) { r.SetBasicAuth("prometheus", "hunter2") }, http.StatusUnauthorized},
+		{"bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer t0ken") }, http.StatusOK},
+		{"wrong bearer token", func(r *http.Request) { r.Header.Set("Authorization", "Bearer hunter2") }, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(metricsAuthFailures)
+			req := httptest.NewRequest(http.MethodGet, "/api/metrics", nil)
+			tt.modify(req)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Fatalf("Expected status %d, but got %d", tt.status, rr.Code)
+			}
+			want := 0.0
+			if tt.status == http.StatusUnauthorized {
+				want = 1
+				if got := rr.Header().Values("WWW-Authenticate"); len(got) != 2 {
+					t.Errorf("Expected a basic and a bearer challenge, but got %v", got)
+				}
+			}
+			if got := testutil.ToFloat64(metricsAuthFailures) - before; got != want {
+				t.Errorf("Expected metrics_auth_failures_total to increase by %v, but got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestMetricsHandlerDisableCompression(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		h := newMetricsHandler(prometheus.DefaultGatherer, config.Metrics{DisableCompression: disabled})
+
+		req := httptest.NewRequest(http.MethodGet, "/api/metrics", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+
+		gzipped := rr.Header().Get("Content-Encoding") == "gzip"
+		if gzipped == disabled {
+			t.Errorf("Expected gzip encoding to be %t with compression disabled %t", !disabled, disabled)
+		}
+	}
+}
+
+func TestHTTPDurationBucketConfig(t *testing.T) {
+	defer configureHTTPDuration(prometheus.DefBuckets, 0)
+
+	buckets := []float64{0.005, 0.25, 1}
+	configureHTTPDuration(buckets, 0)
+
+	if got := testutil.CollectAndCount(httpDurationBucketConfig); got != len(buckets) {
+		t.Errorf("Expected %d bucket config series, but got %d", len(buckets), got)
+	}
+	for _, le := range []string{"0.005", "0.25", "1"} {
+		if got := testutil.ToFloat64(httpDurationBucketConfig.WithLabelValues(le)); got != 1 {
+			t.Errorf("Expected http_duration_bucket_config{le=%q} to be 1, but got %v", le, got)
+		}
+	}
+
+	httpDuration.WithLabelValues("/api/hits", "GET", "200").Observe(0.1)
+	var m dto.Metric
+	if err := httpDuration.WithLabelValues("/api/hits", "GET", "200").(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	if got := len(m.GetHistogram().GetBucket()); got != len(buckets) {
+		t.Errorf("Expected the histogram to use %d buckets, but got %d", len(buckets), got)
+	}
+}
+
+func TestNativeHistogram(t *testing.T) {
+	defer configureHTTPDuration(prometheus.DefBuckets, 0)
+
+	configureHTTPDuration(prometheus.DefBuckets, 1.1)
+	for _, v := range []float64{0.0002, 0.003, 0.04} {
+		httpDuration.WithLabelValues("/api/hits", "GET", "200").Observe(v)
+		httpRequestDuration.Observe(v)
+	}
+
+	for name, o := range map[string]prometheus.Observer{
+		"http_response_time_seconds":    httpDuration.WithLabelValues("/api/hits", "GET", "200"),
+		"http_request_duration_seconds": httpRequestDuration,
+	} {
+		var m dto.Metric
+		if err := o.(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+		h := m.GetHistogram()
+		if h.GetSchema() == 0 && len(h.GetPositiveSpan()) == 0 {
+			t.Errorf("Expected %s to be a native histogram", name)
+		}
+		// the classic buckets are kept for the text format
+		if got := len(h.GetBucket()); got != len(prometheus.DefBuckets) {
+			t.Errorf("Expected %s to keep %d classic buckets, but got %d", name, len(prometheus.DefBuckets), got)
+		}
+	}
+
+	configureHTTPDuration(prometheus.DefBuckets, 0)
+	httpDuration.WithLabelValues("/api/hits", "GET", "200").Observe(0.1)
+	var m dto.Metric
+	if err := httpDuration.WithLabelValues("/api/hits", "GET", "200").(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	if len(m.GetHistogram().GetPositiveSpan()) != 0 {
+		t.Errorf("Expected a classic histogram with a zero factor")
+	}
+}
+
+// histogramSum returns the sum of the observations recorded by a histogram
+func histogramSum(t *testing.T, o prometheus.Observer) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := o.(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	return m.GetHistogram().GetSampleSum()
+}
+
+func TestTimeToFirstByte(t *testing.T) {
+	delay := 50 * time.Millisecond
+	router := mux.NewRouter()
+	router.Use(prometheusMiddleware(newLabelGuard("path", 0)))
+	router.Path("/test/ttfb").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		w.Write([]byte("first"))
+		time.Sleep(delay)
+		w.Write([]byte("second"))
+	})
+
+	ttfbBefore := histogramSum(t, httpTTFB.WithLabelValues("/test/ttfb"))
+	durationBefore := histogramSum(t, httpDuration.WithLabelValues("/test/ttfb", "GET", "200"))
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/ttfb", nil))
+
+	ttfb := histogramSum(t, httpTTFB.WithLabelValues("/test/ttfb")) - ttfbBefore
+	duration := histogramSum(t, httpDuration.WithLabelValues("/test/ttfb", "GET", "200")) - durationBefore
+
+	if ttfb < delay.Seconds() {
+		t.Errorf("Expected a time to first byte of at least %s, but got %fs", delay, ttfb)
+	}
+	if ttfb >= 2*delay.Seconds() || ttfb >= duration {
+		t.Errorf("Expected the time to first byte %fs to exclude the rest of the %fs response", ttfb, duration)
+	}
+}
+
+func TestRequestBytesReceived(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(prometheusMiddleware(newLabelGuard("path", 0)))
+	router.Path("/test/upload").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	})
+
+	body := "hello, prometheus"
+	tests := []struct {
+		name          string
+		contentLength int64
+	}{
+		{"known length", int64(len(body))},
+		{"chunked", -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(requestBytesReceived.WithLabelValues("/test/upload"))
+
+			req := httptest.NewRequest(http.MethodPost, "/test/upload", strings.NewReader(body))
+			req.ContentLength = tt.contentLength
+			router.ServeHTTP(httptest.NewRecorder(), req)
+
+			got := testutil.ToFloat64(requestBytesReceived.WithLabelValues("/test/upload")) - before
+			if got != float64(len(body)) {
+				t.Errorf("Expected http_request_bytes_received_total to increase by %d, but got %v", len(body), got)
+			}
+		})
+	}
+}
+
+func TestRequestResponseSize(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(prometheusMiddleware(newLabelGuard("path", 0)))
+	router.Path("/test/size").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("0123456789"))
+		w.Write([]byte("0123456789"))
+	})
+
+	requestBefore := histogramSum(t, httpRequestSize.WithLabelValues("/test/size"))
+	responseBefore := histogramSum(t, httpResponseSize.WithLabelValues("/test/size"))
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/test/size", strings.NewReader("hello")))
+
+	if got := histogramSum(t, httpRequestSize.WithLabelValues("/test/size")) - requestBefore; got != 5 {
+		t.Errorf("Expected http_request_size_bytes to observe 5 bytes, but got %v", got)
+	}
+	if got := histogramSum(t, httpResponseSize.WithLabelValues("/test/size")) - responseBefore; got != 20 {
+		t.Errorf("Expected http_response_size_bytes to observe 20 bytes, but got %v", got)
+	}
+}
+
+func TestRequestsInFlight(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(prometheusMiddleware(newLabelGuard("path", 0)))
+	var during float64
+	router.Path("/test/inflight").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		during = testutil.ToFloat64(httpRequestsInFlight.WithLabelValues("/test/inflight"))
+	})
+
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/inflight", nil))
+	if during != 1 {
+		t.Errorf("Expected http_requests_in_flight to be 1 while serving, but got %v", during)
+	}
+	if got := testutil.ToFloat64(httpRequestsInFlight.WithLabelValues("/test/inflight")); got != 0 {
+		t.Errorf("Expected http_requests_in_flight to be 0 once served, but got %v", got)
+	}
+}
+
+func TestRequestLabels(t *testing.T) {
+	router := mux.NewRouter()
+	router.Use(prometheusMiddleware(newLabelGuard("path", 0)))
+	router.Path("/test/labels").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.WriteHeader(http.StatusCreated)
+		}
+	})
+
+	tests := []struct {
+		method string
+		labels []string
+	}{
+		{http.MethodGet, []string{"/test/labels", "GET", "200"}},
+		{http.MethodPost, []string{"/test/labels", "POST", "201"}},
+		{"PURGE", []string{"/test/labels", "other", "200"}},
+	}
+	for _, tt := range tests {
+		before := testutil.ToFloat64(totalRequests.WithLabelValues(tt.labels...))
+		durationBefore := histogramCount(t, httpDuration.WithLabelValues(tt.labels...))
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, "/test/labels", nil))
+
+		if got := testutil.ToFloat64(totalRequests.WithLabelValues(tt.labels...)) - before; got != 1 {
+			t.Errorf("Expected http_requests_total%v to increase by 1 for a %s, but got %v", tt.labels, tt.method, got)
+		}
+		if got := histogramCount(t, httpDuration.WithLabelValues(tt.labels...)) - durationBefore; got != 1 {
+			t.Errorf("Expected http_response_time_seconds%v to count 1 %s, but got %d", tt.labels, tt.method, got)
+		}
+	}
+}
+
+func TestLegacyRequestLabels(t *testing.T) {
+	defer func() {
+		configureRequestLabels(false)
+		for _, c := range collectors() {
+			metricsRegisterer.Unregister(c)
+		}
+		metricsRegisterer = prometheus.DefaultRegisterer
+		metricsGatherer = prometheus.DefaultGatherer
+		registerMetrics(metricsRegisterer)
+	}()
+	configureRequestLabels(true)
+
+	router := mux.NewRouter()
+	router.Use(prometheusMiddleware(newLabelGuard("path", 0)))
+	router.Path("/test/legacy").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/test/legacy", nil))
+
+	if got := testutil.ToFloat64(totalRequests.WithLabelValues("/test/legacy")); got != 1 {
+		t.Errorf("Expected http_requests_total{path=\"/test/legacy\"} to be 1, but got %v", got)
+	}
+	if got := histogramCount(t, httpDuration.WithLabelValues("/test/legacy")); got != 1 {
+		t.Errorf("Expected http_response_time_seconds{path=\"/test/legacy\"} to count 1 request, but got %d", got)
+	}
+
+	rr := httptest.NewRecorder()
+	NewServer(testConfig(t)).Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+	if !strings.Contains(rr.Body.String(), `http_requests_total{metrics="custom",path="/test/legacy"} 1`) {
+		t.Errorf("Expected /api/metrics to expose the legacy series")
+	}
+}
+
+func TestRegisterMetricsTwice(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	for i := 0; i < 2; i++ {
+		if err := registerMetrics(reg); err != nil {
+			t.Fatalf("Expected registering the metrics again to succeed, but got %v", err)
+		}
+	}
+	if err := registerMetrics(prometheus.DefaultRegisterer); err != nil {
+		t.Errorf("Expected registering the metrics again after init to succeed, but got %v", err)
+	}
+
+	duplicate := newHTTPRequests()
+	got, err := registerOrReuse(prometheus.DefaultRegisterer, duplicate)
+	if err != nil {
+		t.Fatalf("Failed to register the duplicate collector: %v", err)
+	}
+	if got != totalRequests {
+		t.Errorf("Expected the registered http_requests_total collector to be reused")
+	}
+
+	conflicting := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "http_requests_total",
+		Help:        "Number of get requests.",
+		ConstLabels: prometheus.Labels{"metrics": "custom"},
+	})
+	if _, err := registerOrReuse(prometheus.DefaultRegisterer, conflicting); err == nil {
+		t.Errorf("Expected an error for a conflicting collector")
+	}
+}
+
+func TestDistinctPaths(t *testing.T) {
+	resetRequestMetrics()
+	defer resetRequestMetrics()
+
+	// a router without seeded routes, so only requested paths are tracked
+	router := mux.NewRouter()
+	router.Use(prometheusMiddleware(newLabelGuard("path", 0)))
+	for _, path := range []string{"/test/a", "/test/b", "/test/c"} {
+		router.Path(path).HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	}
+	for _, path := range []string{"/test/a", "/test/b", "/test/c", "/test/a"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := testutil.ToFloat64(distinctPaths); got != 3 {
+		t.Errorf("Expected http_distinct_paths to be 3, but got %v", got)
+	}
+}
+
+func TestSeedRouteMetrics(t *testing.T) {
+	t.Setenv("DEBUG", "true")
+	s, reg := NewTestServer(t)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Failed to gather metrics: %v", err)
+	}
+	series := map[string]map[string]bool{}
+	for _, mf := range families {
+		series[mf.GetName()] = map[string]bool{}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "path" {
+					series[mf.GetName()][l.GetValue()] = true
+				}
+			}
+		}
+	}
+
+	for _, path := range []string{"/", "/api/hits", "/api/metrics", "/api/debug/routes"} {
+		for _, name := range []string{"http_requests_total", "http_response_status_by_path_total", "http_response_time_seconds"} {
+			if !series[name][path] {
+				t.Errorf("Expected %s{path=%q} to exist before any traffic", name, path)
+			}
+		}
+		if got := pathRequests(path); got != 0 {
+			t.Errorf("Expected http_requests_total{path=%q} to be 0, but got %v", path, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+	if !strings.Contains(rr.Body.String(), `http_requests_total{method="GET",metrics="custom",path="/api/hits",status="200"} 0`) {
+		t.Errorf("Expected /api/metrics to expose the zero valued series for /api/hits")
+	}
+}
+
+func TestHTTPRequestDuration(t *testing.T) {
+	s, _ := NewTestServer(t)
+	before := histogramCount(t, httpRequestDuration)
+
+	paths := []string{"/", "/api/hits", "/api/healthz", "/api/does-not-exist", "/api/hits"}
+	for _, path := range paths {
+		s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if got := histogramCount(t, httpRequestDuration) - before; got != uint64(len(paths)) {
+		t.Errorf("Expected http_request_duration_seconds to count %d requests, but got %d", len(paths), got)
+	}
+	total := 0.0
+	for _, path := range []string{"/", "/api/hits", "/api/healthz"} {
+		total += pathRequests(path)
+	}
+	if total != float64(len(paths)) {
+		t.Errorf("Expected http_requests_total to add up to %d requests, but got %v", len(paths), total)
+	}
+}
+
+func TestCompressionBytes(t *testing.T) {
+	s, _ := NewTestServer(t)
+	uncompressedBefore := testutil.ToFloat64(httpUncompressedBytes)
+	compressedBefore := testutil.ToFloat64(httpCompressedBytes)
+
+	var sent, decompressed int
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/api/metrics", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		if rr.Header().Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Expected a gzipped response, but got Content-Encoding %q", rr.Header().Get("Content-Encoding"))
+		}
+
+		sent += rr.Body.Len()
+		zr, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("Failed to read the gzipped response: %v", err)
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("Failed to decompress the response: %v", err)
+		}
+		decompressed += len(body)
+	}
+
+	// responses that are not gzipped do not count
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+
+	uncompressed := testutil.ToFloat64(httpUncompressedBytes) - uncompressedBefore
+	compressed := testutil.ToFloat64(httpCompressedBytes) - compressedBefore
+	if compressed != float64(sent) {
+		t.Errorf("Expected http_compressed_bytes_total to increase by the %d bytes sent, but got %v", sent, compressed)
+	}
+	if uncompressed != float64(decompressed) {
+		t.Errorf("Expected http_uncompressed_bytes_total to increase by the %d decompressed bytes, but got %v", decompressed, uncompressed)
+	}
+	if compressed >= uncompressed {
+		t.Errorf("Expected the metrics exposition to compress, but %v bytes became %v", uncompressed, compressed)
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"br", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", tt.header)
+		if got := acceptsGzip(req); got != tt.want {
+			t.Errorf("Expected acceptsGzip(%q) to be %t, but got %t", tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestConfigureConstLabels(t *testing.T) {
+	defer func() {
+		for _, c := range collectors() {
+			metricsRegisterer.Unregister(c)
+		}
+		metricsRegisterer = prometheus.DefaultRegisterer
+		metricsGatherer = prometheus.DefaultGatherer
+		registerMetrics(metricsRegisterer)
+	}()
+
+	if err := configureConstLabels(map[string]string{"path": "/"}); err == nil {
+		t.Errorf("Expected an error for a const label colliding with a metric label")
+	}
+	if err := configureConstLabels(map[string]string{"env": "test", "team": "workshop"}); err != nil {
+		t.Fatalf("Failed to configure const labels: %v", err)
+	}
+
+	router := NewServer(testConfig(t)).Handler()
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+
+	for _, series := range []string{
+		`http_requests_total{env="test",method="GET",metrics="custom",path="/api/hits",status="200",team="workshop"}`,
+		`app_goroutines{env="test",metrics="custom",team="workshop"}`,
+	} {
+		if !strings.Contains(rr.Body.String(), series) {
+			t.Errorf("Expected /api/metrics to expose %s", series)
+		}
+	}
+	if strings.Contains(rr.Body.String(), `http_requests_total{method="GET",metrics="custom",path="/api/hits",status="200"}`) {
+		t.Errorf("Expected http_requests_total to only be exposed with the const labels")
+	}
+}
+
+func TestConfigureRuntimeCollectors(t *testing.T) {
+	defer configureRuntimeCollectors(config.Metrics{})
+
+	// families returns which of names the default registry exposes
+	families := func(names ...string) map[string]bool {
+		t.Helper()
+		mfs, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatalf("Failed to gather metrics: %v", err)
+		}
+		found := map[string]bool{}
+		for _, mf := range mfs {
+			for _, name := range names {
+				if mf.GetName() == name {
+					found[name] = true
+				}
+			}
+		}
+		return found
+	}
+
+	configureRuntimeCollectors(config.Metrics{GoRuntimeMetrics: []string{"gc"}})
+	found := families("go_goroutines", "go_gc_heap_allocs_bytes_total", "process_start_time_seconds")
+	for _, name := range []string{"go_goroutines", "go_gc_heap_allocs_bytes_total"} {
+		if !found[name] {
+			t.Errorf("Expected %s with the gc runtime metrics", name)
+		}
+	}
+	if runtime.GOOS == "linux" && !found["process_start_time_seconds"] {
+		t.Errorf("Expected process_start_time_seconds with the process collector")
+	}
+
+	configureRuntimeCollectors(config.Metrics{DisableGoCollector: true, DisableProcessCollector: true})
+	for name := range families("go_goroutines", "go_gc_heap_allocs_bytes_total", "process_start_time_seconds") {
+		t.Errorf("Expected %s to be gone with the collectors disabled", name)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// otlpCumulative is the OTLP AGGREGATION_TEMPORALITY_CUMULATIVE, Prometheus counters never reset between exports
+const otlpCumulative = 2
+
+// The subset of the OTLP metrics data model we export, encoded with the OTLP/JSON mapping
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Gauge       *otlpGauge     `json:"gauge,omitempty"`
+	Sum         *otlpSum       `json:"sum,omitempty"`
+	Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	Summary     *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpHistogramDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryDataPoint `json:"dataPoints"`
+}
+
+type otlpSummaryDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	QuantileValues    []otlpQuantile `json:"quantileValues"`
+}
+
+type otlpQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// unixNano formats t the way OTLP/JSON encodes 64 bit integers
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// finite reports whether v can be encoded as a JSON number
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func otlpAttributes(labels []*dto.LabelPair) []otlpKeyValue {
+	attrs := make([]otlpKeyValue, 0, len(labels))
+	for _, l := range labels {
+		attrs = append(attrs, otlpKeyValue{Key: l.GetName(), Value: otlpValue{StringValue: l.GetValue()}})
+	}
+	return attrs
+}
+
+// toOTLP converts gathered metric families to an OTLP export request.
+// Counters become monotonic cumulative sums, untyped metrics become gauges and
+// samples that are NaN or infinite are dropped since JSON cannot encode them.
+func toOTLP(families []*dto.MetricFamily, service string, start, now time.Time) *otlpRequest {
+	startNano, nowNano := unixNano(start), unixNano(now)
+	metrics := make([]otlpMetric, 0, len(families))
+
+	for _, mf := range families {
+		metric := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+		var points []otlpNumberDataPoint
+
+		for _, m := range mf.GetMetric() {
+			attrs := otlpAttributes(m.GetLabel())
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				if v := m.GetCounter().GetValue(); finite(v) {
+					points = append(points, otlpNumberDataPoint{Attributes: attrs, StartTimeUnixNano: startNano, TimeUnixNano: nowNano, AsDouble: v})
+				}
+			case dto.MetricType_GAUGE:
+				if v := m.GetGauge().GetValue(); finite(v) {
+					points = append(points, otlpNumberDataPoint{Attributes: attrs, TimeUnixNano: nowNano, AsDouble: v})
+				}
+			case dto.MetricType_UNTYPED:
+				if v := m.GetUntyped().GetValue(); finite(v) {
+					points = append(points, otlpNumberDataPoint{Attributes: attrs, TimeUnixNano: nowNano, AsDouble: v})
+				}
+			case dto.MetricType_HISTOGRAM:
+				if metric.Histogram == nil {
+					metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+				}
+				h := m.GetHistogram()
+				point := otlpHistogramDataPoint{
+					Attributes:        attrs,
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      nowNano,
+					Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+					Sum:               h.GetSampleSum(),
+				}
+				// Prometheus buckets are cumulative, OTLP counts each bucket separately
+				// and has an implicit +Inf bucket at the end
+				var previous uint64
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+					point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-previous, 10))
+					previous = b.GetCumulativeCount()
+				}
+				point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-previous, 10))
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, point)
+			case dto.MetricType_SUMMARY:
+				if metric.Summary == nil {
+					metric.Summary = &otlpSummary{}
+				}
+				s := m.GetSummary()
+				point := otlpSummaryDataPoint{
+					Attributes:        attrs,
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      nowNano,
+					Count:             strconv.FormatUint(s.GetSampleCount(), 10),
+					Sum:               s.GetSampleSum(),
+				}
+				for _, q := range s.GetQuantile() {
+					if finite(q.GetValue()) {
+						point.QuantileValues = append(point.QuantileValues, otlpQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+					}
+				}
+				metric.Summary.DataPoints = append(metric.Summary.DataPoints, point)
+			}
+		}
+
+		switch mf.GetType() {
+		case dto.MetricType_COUNTER:
+			metric.Sum = &otlpSum{DataPoints: points, AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			metric.Gauge = &otlpGauge{DataPoints: points}
+		}
+		if metric.Sum == nil && metric.Gauge == nil && metric.Histogram == nil && metric.Summary == nil {
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return &otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpValue{StringValue: service}},
+			{Key: "service.version", Value: otlpValue{StringValue: version}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "github.com/cmwylie19/prometheus-workshop"},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// otlpExporter sends OTLP export requests to a collector
+type otlpExporter interface {
+	Export(ctx context.Context, req *otlpRequest) error
+}
+
+// httpOTLPExporter sends metrics or spans to an OTLP/HTTP endpoint using the JSON encoding
+type httpOTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func newHTTPOTLPExporter(endpoint string) *httpOTLPExporter {
+	return &httpOTLPExporter{endpoint: endpoint, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (e *httpOTLPExporter) Export(ctx context.Context, req *otlpRequest) error {
+	return e.post(ctx, req)
+}
+
+func (e *httpOTLPExporter) ExportSpans(ctx context.Context, req *otlpTraceRequest) error {
+	return e.post(ctx, req)
+}
+
+// post sends req as JSON to the endpoint
+func (e *httpOTLPExporter) post(ctx context.Context, req interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint %s returned %s", e.endpoint, resp.Status)
+	}
+	return nil
+}
+
+// otlpPusher periodically exports everything gatherer collects
+type otlpPusher struct {
+	gatherer prometheus.Gatherer
+	exporter otlpExporter
+	interval time.Duration
+	service  string
+	start    time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+func newOTLPPusher(gatherer prometheus.Gatherer, exporter otlpExporter, interval time.Duration, service string) *otlpPusher {
+	return &otlpPusher{
+		gatherer: gatherer,
+		exporter: exporter,
+		interval: interval,
+		service:  service,
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// push gathers and exports the metrics once
+func (p *otlpPusher) push(ctx context.Context) error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("gathering metrics: %w", err)
+	}
+	return p.exporter.Export(ctx, toOTLP(families, p.service, p.start, time.Now()))
+}
+
+// Run exports the metrics every interval until Shutdown is called
+func (p *otlpPusher) Run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+			if err := p.push(ctx); err != nil {
+				utils.WriteLog("ERROR", fmt.Sprintf("Failed to export metrics over OTLP: %s", err))
+			}
+			cancel()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Shutdown stops Run and flushes the metrics one last time so the final
+// values are not lost, giving up once ctx is done
+func (p *otlpPusher) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.push(ctx)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// memoryExporter keeps every export request in memory
+type memoryExporter struct {
+	mu       sync.Mutex
+	requests []*otlpRequest
+}
+
+func (e *memoryExporter) Export(ctx context.Context, req *otlpRequest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests = append(e.requests, req)
+	return nil
+}
+
+func (e *memoryExporter) exported() []*otlpRequest {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.requests
+}
+
+// otlpMetrics indexes the metrics of an export request by name
+func otlpMetrics(req *otlpRequest) map[string]otlpMetric {
+	metrics := map[string]otlpMetric{}
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			for _, m := range sm.Metrics {
+				metrics[m.Name] = m
+			}
+		}
+	}
+	return metrics
+}
+
+func TestOTLPPusher(t *testing.T) {
+	s, reg := NewTestServer(t)
+	s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+
+	exporter := &memoryExporter{}
+	pusher := newOTLPPusher(reg, exporter, time.Hour, "demo-blog")
+	if err := pusher.push(context.Background()); err != nil {
+		t.Fatalf("Failed to push metrics: %v", err)
+	}
+
+	requests := exporter.exported()
+	if len(requests) != 1 {
+		t.Fatalf("Expected 1 export, but got %d", len(requests))
+	}
+	metrics := otlpMetrics(requests[0])
+
+	requestsTotal, ok := metrics["http_requests_total"]
+	if !ok || requestsTotal.Sum == nil {
+		t.Fatalf("Expected http_requests_total to be exported as a sum, but got %+v", requestsTotal)
+	}
+	if !requestsTotal.Sum.IsMonotonic || requestsTotal.Sum.AggregationTemporality != otlpCumulative {
+		t.Errorf("Expected a monotonic cumulative sum, but got %+v", requestsTotal.Sum)
+	}
+	hits := 0.0
+	for _, point := range requestsTotal.Sum.DataPoints {
+		for _, attr := range point.Attributes {
+			if attr.Key == "path" && attr.Value.StringValue == "/api/hits" {
+				hits = point.AsDouble
+			}
+		}
+	}
+	if hits != 1 {
+		t.Errorf("Expected a data point of 1 for /api/hits, but got %+v", requestsTotal.Sum.DataPoints)
+	}
+
+	duration, ok := metrics["http_response_time_seconds"]
+	if !ok || duration.Histogram == nil || len(duration.Histogram.DataPoints) == 0 {
+		t.Fatalf("Expected http_response_time_seconds to be exported as a histogram, but got %+v", duration)
+	}
+	var point otlpHistogramDataPoint
+	for _, p := range duration.Histogram.DataPoints {
+		if p.Count != "0" {
+			point = p
+		}
+	}
+	if len(point.BucketCounts) != len(point.ExplicitBounds)+1 || len(point.ExplicitBounds) != len(prometheus.DefBuckets) {
+		t.Errorf("Expected %d bounds and one more bucket, but got %d bounds and %d buckets", len(prometheus.DefBuckets), len(point.ExplicitBounds), len(point.BucketCounts))
+	}
+	if point.Count != "1" {
+		t.Errorf("Expected a histogram count of 1, but got %s", point.Count)
+	}
+
+	if features, ok := metrics["feature_enabled"]; !ok || features.Gauge == nil {
+		t.Errorf("Expected feature_enabled to be exported as a gauge, but got %+v", features)
+	}
+}
+
+func TestOTLPPusherFlushOnShutdown(t *testing.T) {
+	exporter := &memoryExporter{}
+	pusher := newOTLPPusher(prometheus.NewRegistry(), exporter, time.Hour, "demo-blog")
+	go pusher.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := pusher.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	if got := len(exporter.exported()); got != 1 {
+		t.Errorf("Expected the metrics to be flushed once on shutdown, but got %d exports", got)
+	}
+}
+
+func TestHTTPOTLPExporter(t *testing.T) {
+	received := make(chan *otlpRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- &req
+	}))
+	defer collector.Close()
+
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_otlp_total"})
+	counter.Inc()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(counter)
+
+	pusher := newOTLPPusher(reg, newHTTPOTLPExporter(collector.URL+"/v1/metrics"), time.Hour, "demo-blog")
+	if err := pusher.push(context.Background()); err != nil {
+		t.Fatalf("Failed to push metrics: %v", err)
+	}
+
+	req := <-received
+	if _, ok := otlpMetrics(req)["test_otlp_total"]; !ok {
+		t.Errorf("Expected test_otlp_total to be received, but got %+v", req)
+	}
+	if attrs := req.ResourceMetrics[0].Resource.Attributes; attrs[0].Value.StringValue != "demo-blog" {
+		t.Errorf("Expected service.name demo-blog, but got %+v", attrs)
+	}
+
+	if err := newHTTPOTLPExporter(collector.URL+"/wrong").Export(context.Background(), req); err == nil {
+		t.Errorf("Expected an error when the collector rejects the export")
+	}
+}
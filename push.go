@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Push results counted by metrics_push_total
+const (
+	pushSuccess = "success"
+	pushFailure = "failure"
+)
+
+// metricsPusher pushes everything its gatherer collects every interval, so
+// metrics outlive a short-lived process like they would for a batch job
+type metricsPusher struct {
+	mode     string
+	interval time.Duration
+	send     func(ctx context.Context) error
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+	// started is set by whichever of Run and Shutdown comes first, so
+	// Shutdown does not wait on a Run that never started
+	started atomic.Bool
+}
+
+func newMetricsPusher(gatherer prometheus.Gatherer, cfg config.Push) *metricsPusher {
+	client := &http.Client{Timeout: 10 * time.Second}
+	p := &metricsPusher{
+		mode:     cfg.Mode,
+		interval: cfg.Interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	grouping := map[string]string{"job": cfg.Job, "instance": cfg.Instance}
+	for name, value := range cfg.Labels {
+		grouping[name] = value
+	}
+	if cfg.Mode == config.PushRemoteWrite {
+		p.send = func(ctx context.Context) error {
+			families, err := gatherer.Gather()
+			if err != nil {
+				return fmt.Errorf("gathering metrics: %w", err)
+			}
+			return remoteWrite(ctx, client, cfg.URL, toRemoteWrite(families, grouping, time.Now()))
+		}
+	} else {
+		// the Pushgateway groups by every label but the job
+		pusher := push.New(cfg.URL, cfg.Job).Gatherer(gatherer).Client(client)
+		for name, value := range grouping {
+			if name != "job" {
+				pusher = pusher.Grouping(name, value)
+			}
+		}
+		p.send = pusher.PushContext
+	}
+
+	pushes.WithLabelValues(cfg.Mode, pushSuccess)
+	pushes.WithLabelValues(cfg.Mode, pushFailure)
+	return p
+}
+
+// push sends the metrics once, counting the result
+func (p *metricsPusher) push(ctx context.Context) error {
+	start := time.Now()
+	err := p.send(ctx)
+	pushDuration.WithLabelValues(p.mode).Observe(time.Since(start).Seconds())
+	if err != nil {
+		pushes.WithLabelValues(p.mode, pushFailure).Inc()
+		return err
+	}
+	pushes.WithLabelValues(p.mode, pushSuccess).Inc()
+	lastPushSuccess.WithLabelValues(p.mode).SetToCurrentTime()
+	return nil
+}
+
+// Run pushes the metrics every interval until Shutdown is called
+func (p *metricsPusher) Run() {
+	if !p.started.CompareAndSwap(false, true) {
+		return
+	}
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+			if err := p.push(ctx); err != nil {
+				utils.WriteLog("ERROR", fmt.Sprintf("Failed to push metrics (%s): %s", p.mode, err))
+			}
+			cancel()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Shutdown stops Run and pushes the metrics one last time, so a job that
+// ends between two pushes still leaves its final values behind
+func (p *metricsPusher) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	if p.started.CompareAndSwap(false, true) {
+		close(p.done)
+	}
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return p.push(ctx)
+}
+
+// toRemoteWrite converts metric families to a remote_write request with the
+// samples at now. Histograms and summaries are sent as their _bucket, _sum
+// and _count series like a scrape would store them, the grouping labels are
+// added to every series.
+func toRemoteWrite(families []*dto.MetricFamily, grouping map[string]string, now time.Time) *prompb.WriteRequest {
+	ts := now.UnixMilli()
+	req := &prompb.WriteRequest{}
+	add := func(name string, m *dto.Metric, value float64, extra ...string) {
+		labels := map[string]string{"__name__": name}
+		for _, l := range m.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		for name, value := range grouping {
+			labels[name] = value
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			labels[extra[i]] = extra[i+1]
+		}
+		series := prompb.TimeSeries{Samples: []prompb.Sample{{Value: value, Timestamp: ts}}}
+		for name, value := range labels {
+			series.Labels = append(series.Labels, prompb.Label{Name: name, Value: value})
+		}
+		// remote_write receivers expect the labels sorted by name
+		sort.Slice(series.Labels, func(i, j int) bool { return series.Labels[i].Name < series.Labels[j].Name })
+		req.Timeseries = append(req.Timeseries, series)
+	}
+
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m, m.GetGauge().GetValue())
+			case dto.MetricType_UNTYPED:
+				add(name, m, m.GetUntyped().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", m, float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add(name+"_bucket", m, float64(h.GetSampleCount()), "le", "+Inf")
+				add(name+"_sum", m, h.GetSampleSum())
+				add(name+"_count", m, float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, m, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", m, s.GetSampleSum())
+				add(name+"_count", m, float64(s.GetSampleCount()))
+			}
+		}
+	}
+	return req
+}
+
+// formatFloat formats a bucket bound or quantile the way the exposition formats do
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// remoteWrite sends req to the remote_write endpoint at url, snappy
+// compressed protobuf as the remote_write protocol requires
+func remoteWrite(ctx context.Context, client *http.Client, url string, req *prompb.WriteRequest) error {
+	data, err := req.Marshal()
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(snappy.Encode(nil, data)))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Encoding", "snappy")
+	httpReq.Header.Set("Content-Type", "application/x-protobuf")
+	httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote_write endpoint returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+// pushTestRegistry returns a registry with a counter and a histogram to push
+func pushTestRegistry(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	jobs := prometheus.NewCounter(prometheus.CounterOpts{Name: "batch_jobs_total", Help: "Jobs."})
+	jobs.Add(3)
+	duration := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "batch_duration_seconds", Help: "Duration.", Buckets: []float64{1}})
+	duration.Observe(0.5)
+	reg.MustRegister(jobs, duration)
+	return reg
+}
+
+func TestPushgateway(t *testing.T) {
+	var method, path, body string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer gateway.Close()
+
+	p := newMetricsPusher(pushTestRegistry(t), config.Push{
+		Mode:     config.PushPushgateway,
+		URL:      gateway.URL,
+		Interval: time.Minute,
+		Job:      "batch",
+		Instance: "worker-1",
+		Labels:   map[string]string{"env": "test"},
+	})
+	before := testutil.ToFloat64(pushes.WithLabelValues(config.PushPushgateway, pushSuccess))
+	if err := p.push(context.Background()); err != nil {
+		t.Fatalf("Failed to push: %v", err)
+	}
+
+	if method != http.MethodPut {
+		t.Errorf("Expected the metrics to be pushed with a PUT, but got %s", method)
+	}
+	for _, part := range []string{"/metrics/job/batch", "/instance/worker-1", "/env/test"} {
+		if !strings.Contains(path, part) {
+			t.Errorf("Expected the push path %q to contain %s", path, part)
+		}
+	}
+	if len(body) == 0 {
+		t.Errorf("Expected the metrics to be pushed")
+	}
+	if got := testutil.ToFloat64(pushes.WithLabelValues(config.PushPushgateway, pushSuccess)) - before; got != 1 {
+		t.Errorf("Expected metrics_push_total{result=%q} to increase by 1, but got %v", pushSuccess, got)
+	}
+}
+
+func TestPushFailure(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer gateway.Close()
+
+	for _, mode := range []string{config.PushPushgateway, config.PushRemoteWrite} {
+		p := newMetricsPusher(pushTestRegistry(t), config.Push{Mode: mode, URL: gateway.URL, Interval: time.Minute, Job: "batch", Instance: "worker-1"})
+		before := testutil.ToFloat64(pushes.WithLabelValues(mode, pushFailure))
+		if err := p.push(context.Background()); err == nil {
+			t.Errorf("Expected an error pushing (%s) to a failing endpoint", mode)
+		}
+		if got := testutil.ToFloat64(pushes.WithLabelValues(mode, pushFailure)) - before; got != 1 {
+			t.Errorf("Expected metrics_push_total{mode=%q,result=%q} to increase by 1, but got %v", mode, pushFailure, got)
+		}
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	received := make(chan *prompb.WriteRequest, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, err := remote.DecodeWriteRequest(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		received <- req
+	}))
+	defer receiver.Close()
+
+	p := newMetricsPusher(pushTestRegistry(t), config.Push{Mode: config.PushRemoteWrite, URL: receiver.URL, Interval: time.Minute, Job: "batch", Instance: "worker-1"})
+	go p.Run()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to push on shutdown: %v", err)
+	}
+
+	series := map[string]float64{}
+	for _, ts := range (<-received).Timeseries {
+		labels := make([]string, 0, len(ts.Labels))
+		for _, l := range ts.Labels {
+			labels = append(labels, l.Name+"="+l.Value)
+		}
+		series[strings.Join(labels, ",")] = ts.Samples[0].Value
+	}
+	expected := map[string]float64{
+		"__name__=batch_jobs_total,instance=worker-1,job=batch":                      3,
+		"__name__=batch_duration_seconds_bucket,instance=worker-1,job=batch,le=1":    1,
+		"__name__=batch_duration_seconds_bucket,instance=worker-1,job=batch,le=+Inf": 1,
+		"__name__=batch_duration_seconds_count,instance=worker-1,job=batch":          1,
+		"__name__=batch_duration_seconds_sum,instance=worker-1,job=batch":            0.5,
+	}
+	for labels, value := range expected {
+		if got, ok := series[labels]; !ok || got != value {
+			t.Errorf("Expected series {%s} with value %v, but got %v (found %v)", labels, value, got, ok)
+		}
+	}
+}
+
+func TestPushShutdownWithoutRun(t *testing.T) {
+	pushed := make(chan struct{}, 1)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushed <- struct{}{}
+	}))
+	defer gateway.Close()
+
+	p := newMetricsPusher(pushTestRegistry(t), config.Push{Mode: config.PushPushgateway, URL: gateway.URL, Interval: time.Minute, Job: "batch", Instance: "worker-1"})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to push on shutdown: %v", err)
+	}
+	select {
+	case <-pushed:
+	default:
+		t.Errorf("Expected Shutdown to push the final metrics without Run")
+	}
+	// a Run after Shutdown returns at once
+	p.Run()
+}
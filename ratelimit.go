@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/time/rate"
+)
+
+// unlimitedRoutes are never rate limited so probes and scrapes keep working under load
+var unlimitedRoutes = map[string]bool{
+	"/api/health":  true,
+	"/api/healthz": true,
+	"/api/readyz":  true,
+	"/api/metrics": true,
+}
+
+// setRetryAfter tells the client how long to back off, rounded up to whole seconds
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// ipLimiterSweepInterval is how often ipLimiters drops the limiters of idle clients
+const ipLimiterSweepInterval = time.Minute
+
+// ipLimiters hands out a token bucket per client IP. A bucket that refilled
+// is dropped on the next sweep, since a new one would be the same, so only
+// the clients seen lately are kept.
+type ipLimiters struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	limiters  map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+func newIPLimiters(limit rate.Limit, burst int) *ipLimiters {
+	return &ipLimiters{limit: limit, burst: burst, limiters: map[string]*rate.Limiter{}, lastSweep: time.Now()}
+}
+
+// get returns the limiter of ip at now, nil without a per-IP limit
+func (l *ipLimiters) get(ip string, now time.Time) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == rate.Inf {
+		return nil
+	}
+	if now.Sub(l.lastSweep) >= ipLimiterSweepInterval {
+		for key, limiter := range l.limiters {
+			if limiter.TokensAt(now) >= float64(l.burst) {
+				delete(l.limiters, key)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	limiter, ok := l.limiters[ip]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[ip] = limiter
+	}
+	return limiter
+}
+
+// set changes the per-IP limit of every client
+func (l *ipLimiters) set(limit rate.Limit, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit, l.burst = limit, burst
+	if limit == rate.Inf {
+		l.limiters = map[string]*rate.Limiter{}
+		return
+	}
+	for _, limiter := range l.limiters {
+		limiter.SetLimit(limit)
+		limiter.SetBurst(burst)
+	}
+}
+
+// activeLimiter is the global limiter rate_limiter_tokens reports on
+var activeLimiter atomic.Pointer[rate.Limiter]
+
+// limiterTokens returns the tokens left in the active limiter, 0 when rate
+// limiting is disabled
+func limiterTokens() float64 {
+	limiter := activeLimiter.Load()
+	if limiter == nil || limiter.Limit() == rate.Inf {
+		return 0
+	}
+	return limiter.Tokens()
+}
+
+// throttle rejects r with a 429 and a Retry-After of delay
+func throttle(w http.ResponseWriter, r *http.Request, delay time.Duration) {
+	throttledRequests.WithLabelValues(pathLabel(r)).Inc()
+	setRetryAfter(w, delay)
+	writeError(w, r, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+}
+
+// reserve takes a token from limiter, returning how long to wait for one
+// instead if there is none left. A nil limiter always has a token.
+func reserve(limiter *rate.Limiter, now time.Time) (*rate.Reservation, time.Duration) {
+	if limiter == nil {
+		return nil, 0
+	}
+	reservation := limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return nil, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return nil, delay
+	}
+	return reservation, 0
+}
+
+// rateLimitMiddleware rejects requests with a 429 once the limiter of their
+// client IP or the global limiter runs out of tokens, counting them in
+// http_requests_throttled_total. A client going over its own limit does not
+// use up the global one.
+func rateLimitMiddleware(limiter *rate.Limiter, perIP *ipLimiters) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if unlimitedRoutes[routeTemplate(r)] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			now := time.Now()
+			client, delay := reserve(perIP.get(clientIP(r), now), now)
+			if delay > 0 {
+				throttle(w, r, delay)
+				return
+			}
+			if _, delay := reserve(limiter, now); delay > 0 {
+				if client != nil {
+					client.CancelAt(now)
+				}
+				throttle(w, r, delay)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
+)
+
+func newTestRouter(mwf ...mux.MiddlewareFunc) *mux.Router {
+	router := mux.NewRouter()
+	router.Use(mwf...)
+	router.Path("/api/hits").HandlerFunc(handleHit)
+	router.Path("/api/healthz").HandlerFunc(HealthCheckHandler)
+	return router
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	router := newTestRouter(rateLimitMiddleware(rate.NewLimiter(0.5, 1), newIPLimiters(rate.Inf, 0)))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d for the first request, but got %d", http.StatusOK, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status %d once the limit is hit, but got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("Expected a numeric Retry-After header, but got %q", rr.Header().Get("Retry-After"))
+	}
+	if retryAfter < 1 || retryAfter > 2 {
+		t.Errorf("Expected Retry-After between 1 and 2 seconds, but got %d", retryAfter)
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected the health check not to be rate limited, but got %d", rr.Code)
+	}
+}
+
+func TestRateLimitMetrics(t *testing.T) {
+	t.Setenv("RATE_LIMIT_RPS", "10")
+	t.Setenv("RATE_LIMIT_BURST", "20")
+	s, _ := NewTestServer(t)
+
+	if got := testutil.ToFloat64(rateLimiterLimit); got != 10 {
+		t.Errorf("Expected rate_limiter_limit_rps to be 10, but got %v", got)
+	}
+	if got := testutil.ToFloat64(rateLimiterBurst); got != 20 {
+		t.Errorf("Expected rate_limiter_burst to be 20, but got %v", got)
+	}
+
+	cfg := testConfig(t)
+	cfg.RateLimit = config.RateLimit{RPS: 2.5}
+	if err := s.Reload(cfg); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if got := testutil.ToFloat64(rateLimiterLimit); got != 2.5 {
+		t.Errorf("Expected rate_limiter_limit_rps to be 2.5 after the reload, but got %v", got)
+	}
+	// the burst defaults to the rps rounded up
+	if got := testutil.ToFloat64(rateLimiterBurst); got != 3 {
+		t.Errorf("Expected rate_limiter_burst to be 3 after the reload, but got %v", got)
+	}
+
+	cfg.RateLimit = config.RateLimit{}
+	if err := s.Reload(cfg); err != nil {
+		t.Fatalf("Failed to reload: %v", err)
+	}
+	if got := testutil.ToFloat64(rateLimiterLimit); got != 0 {
+		t.Errorf("Expected rate_limiter_limit_rps to be 0 once disabled, but got %v", got)
+	}
+}
+
+func TestRateLimitPerIP(t *testing.T) {
+	router := newTestRouter(rateLimitMiddleware(rate.NewLimiter(0.5, 2), newIPLimiters(0.5, 1)))
+	throttled := throttledRequests.WithLabelValues("/api/hits")
+	before := testutil.ToFloat64(throttled)
+
+	tests := []struct {
+		ip     string
+		status int
+	}{
+		{"10.0.0.1", http.StatusOK},
+		// over its own limit, which leaves the global token for the next client
+		{"10.0.0.1", http.StatusTooManyRequests},
+		{"10.0.0.2", http.StatusOK},
+		// within its own limit, but the global one is used up
+		{"10.0.0.3", http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/hits", nil)
+		req.RemoteAddr = tt.ip + ":1234"
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != tt.status {
+			t.Errorf("Expected status %d for %s, but got %d", tt.status, tt.ip, rr.Code)
+		}
+	}
+
+	if got := testutil.ToFloat64(throttled) - before; got != 2 {
+		t.Errorf("Expected http_requests_throttled_total to count 2 requests, but got %v", got)
+	}
+}
+
+func TestIPLimitersSweep(t *testing.T) {
+	// a bucket takes far longer than a sweep interval to refill
+	limiters := newIPLimiters(0.001, 1)
+	now := time.Now()
+	limiters.get("10.0.0.1", now).ReserveN(now, 1)
+	limiters.get("10.0.0.2", now)
+
+	limiters.get("10.0.0.3", now.Add(ipLimiterSweepInterval))
+	if _, ok := limiters.limiters["10.0.0.2"]; ok {
+		t.Errorf("Expected the full limiter of 10.0.0.2 to be dropped")
+	}
+	if _, ok := limiters.limiters["10.0.0.1"]; !ok {
+		t.Errorf("Expected the limiter of 10.0.0.1 to be kept until it refilled")
+	}
+
+	limiters.set(rate.Inf, 0)
+	if limiter := limiters.get("10.0.0.1", now); limiter != nil || len(limiters.limiters) != 0 {
+		t.Errorf("Expected no per-IP limiters once disabled, but got %v", limiters.limiters)
+	}
+}
+
+func TestRateLimiterTokens(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.RateLimit = config.RateLimit{RPS: 0.1, Burst: 5}
+	router := NewServer(cfg).Handler()
+
+	if got := testutil.ToFloat64(rateLimiterTokens); got != 5 {
+		t.Errorf("Expected rate_limiter_tokens to be 5, but got %v", got)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	if got := testutil.ToFloat64(rateLimiterTokens); got < 4 || got >= 4.1 {
+		t.Errorf("Expected rate_limiter_tokens to be about 4 after a request, but got %v", got)
+	}
+
+	NewServer(testConfig(t))
+	if got := testutil.ToFloat64(rateLimiterTokens); got != 0 {
+		t.Errorf("Expected rate_limiter_tokens to be 0 without a rate limit, but got %v", got)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+)
+
+// ReadinessCheck returns an error if a dependency is not ready to serve traffic
+type ReadinessCheck func() error
+
+// readiness tracks whether the server should receive traffic.
+// The server is ready once the warmup delay has elapsed and every
+// registered check passes.
+type readiness struct {
+	mu       sync.RWMutex
+	readyAt  time.Time
+	checks   map[string]ReadinessCheck
+	draining atomic.Bool
+	// failing fails readiness on purpose, to watch the server being taken out of rotation
+	failing atomic.Bool
+}
+
+func newReadiness(delay time.Duration) *readiness {
+	return &readiness{
+		readyAt: time.Now().Add(delay),
+		checks:  map[string]ReadinessCheck{},
+	}
+}
+
+// AddCheck registers a named readiness check
+func (rd *readiness) AddCheck(name string, check ReadinessCheck) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	rd.checks[name] = check
+}
+
+// SetDraining marks the server as shutting down so it is taken out of rotation
+func (rd *readiness) SetDraining() {
+	rd.draining.Store(true)
+}
+
+// Draining returns whether the server is shutting down
+func (rd *readiness) Draining() bool {
+	return rd.draining.Load()
+}
+
+// SetFailing fails readiness on purpose while failing is set
+func (rd *readiness) SetFailing(failing bool) {
+	rd.failing.Store(failing)
+}
+
+// Ready returns nil if the server is not draining or failing on purpose, the
+// warmup delay has elapsed and all checks pass
+func (rd *readiness) Ready() error {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+
+	if rd.Draining() {
+		return errors.New("shutting down")
+	}
+
+	if rd.failing.Load() {
+		return errors.New("failing readiness on purpose")
+	}
+
+	if remaining := time.Until(rd.readyAt); remaining > 0 {
+		return fmt.Errorf("warming up, ready in %s", remaining.Round(time.Millisecond))
+	}
+
+	names := make([]string, 0, len(rd.checks))
+	for name := range rd.checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := rd.checks[name](); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// handleReady returns a 200 if the server is ready to receive traffic and a 503 otherwise
+func (rd *readiness) handleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := rd.Ready(); err != nil {
+		utils.WriteLog("INFO", fmt.Sprintf("Request to readyz endpoint, not ready: %s", err))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ready": false, "reason": err.Error()})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ready": true})
+}
+
+// handleFailReady makes readiness fail on purpose while the enabled query
+// parameter is true, the default, and pass again once it is false
+func (rd *readiness) handleFailReady(w http.ResponseWriter, r *http.Request) {
+	failing := true
+	if value := r.URL.Query().Get("enabled"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid enabled %q", value))
+			return
+		}
+		failing = parsed
+	}
+	rd.SetFailing(failing)
+	utils.WriteLog("INFO", fmt.Sprintf("Set failing readiness on purpose to %t", failing))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"failReady": failing})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getReadyStatus(rd *readiness) int {
+	rr := httptest.NewRecorder()
+	rd.handleReady(rr, httptest.NewRequest(http.MethodGet, "/api/readyz", nil))
+	return rr.Code
+}
+
+func TestReadinessDelay(t *testing.T) {
+	rd := newReadiness(100 * time.Millisecond)
+
+	if status := getReadyStatus(rd); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d before the delay, but got %d", http.StatusServiceUnavailable, status)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if status := getReadyStatus(rd); status != http.StatusOK {
+		t.Errorf("Expected status %d after the delay, but got %d", http.StatusOK, status)
+	}
+}
+
+func TestReadinessChecks(t *testing.T) {
+	rd := newReadiness(0)
+
+	var checkErr error = errors.New("not connected")
+	rd.AddCheck("store", func() error { return checkErr })
+
+	if status := getReadyStatus(rd); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d with a failing check, but got %d", http.StatusServiceUnavailable, status)
+	}
+
+	checkErr = nil
+
+	if status := getReadyStatus(rd); status != http.StatusOK {
+		t.Errorf("Expected status %d with passing checks, but got %d", http.StatusOK, status)
+	}
+}
+
+func TestReadinessDraining(t *testing.T) {
+	rd := newReadiness(0)
+	rd.SetDraining()
+
+	if status := getReadyStatus(rd); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d while draining, but got %d", http.StatusServiceUnavailable, status)
+	}
+}
+
+func TestReadinessFailReady(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	cfg.FailReady = true
+	s := NewServer(cfg)
+
+	ready := func() int {
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/readyz", nil))
+		return rr.Code
+	}
+	toggle := func(query string) int {
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/debug/fail-ready"+query, nil))
+		return rr.Code
+	}
+
+	if status := ready(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d with FailReady set, but got %d", http.StatusServiceUnavailable, status)
+	}
+	if status := toggle("?enabled=false"); status != http.StatusOK {
+		t.Fatalf("Expected status %d turning fail-ready off, but got %d", http.StatusOK, status)
+	}
+	if status := ready(); status != http.StatusOK {
+		t.Errorf("Expected status %d once fail-ready is off, but got %d", http.StatusOK, status)
+	}
+	if status := toggle(""); status != http.StatusOK {
+		t.Fatalf("Expected status %d turning fail-ready on, but got %d", http.StatusOK, status)
+	}
+	if status := ready(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d once fail-ready is on again, but got %d", http.StatusServiceUnavailable, status)
+	}
+	if status := toggle("?enabled=maybe"); status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid enabled, but got %d", http.StatusBadRequest, status)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+)
+
+type clientIPKey struct{}
+
+// trustedProxies decides which X-Forwarded-For hops can be believed
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a list of CIDRs, a bare IP is trusted on its own.
+// Invalid entries are skipped so a typo never widens the trusted range.
+func parseTrustedProxies(cidrs []string) trustedProxies {
+	var trusted trustedProxies
+	for _, cidr := range cidrs {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			if ip := net.ParseIP(cidr); ip != nil && ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			utils.WriteLog("ERROR", fmt.Sprintf("Ignoring invalid trusted proxy %q: %s", cidr, err))
+			continue
+		}
+		trusted = append(trusted, ipNet)
+	}
+	return trusted
+}
+
+// contains returns whether ip is within a trusted range
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, ipNet := range t {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client that sent r. X-Forwarded-For is only
+// honored when the connection comes from a trusted proxy, and the chain is
+// walked from the nearest hop back to the first one that is not trusted.
+func (t trustedProxies) ClientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+
+	ip := net.ParseIP(remote)
+	if ip == nil || !t.contains(ip) {
+		return remote
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	client := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		hopIP := net.ParseIP(hops[i])
+		if hopIP == nil {
+			break
+		}
+		client = hops[i]
+		if !t.contains(hopIP) {
+			break
+		}
+	}
+	return client
+}
+
+// clientIPMiddleware stores the client IP in the request context
+func (t trustedProxies) clientIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPKey{}, t.ClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// clientIP returns the client IP stored by clientIPMiddleware, falling back to the remote address
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return trustedProxies(nil).ClientIP(r)
+}
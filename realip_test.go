@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "not-a-cidr"})
+	if len(trusted) != 2 {
+		t.Fatalf("Expected 2 trusted ranges, but got %d", len(trusted))
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        string
+		expected   string
+	}{
+		{
+			name:       "no forwarded header",
+			remoteAddr: "203.0.113.7:4242",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "spoofed header from an untrusted source",
+			remoteAddr: "203.0.113.7:4242",
+			xff:        "1.2.3.4",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "header from a trusted proxy",
+			remoteAddr: "10.1.2.3:4242",
+			xff:        "198.51.100.20",
+			expected:   "198.51.100.20",
+		},
+		{
+			name:       "chain through trusted proxies stops at the first untrusted hop",
+			remoteAddr: "10.1.2.3:4242",
+			xff:        "1.2.3.4, 198.51.100.20, 192.168.1.1",
+			expected:   "198.51.100.20",
+		},
+		{
+			name:       "every hop trusted",
+			remoteAddr: "10.1.2.3:4242",
+			xff:        "10.9.9.9",
+			expected:   "10.9.9.9",
+		},
+		{
+			name:       "garbage hop",
+			remoteAddr: "10.1.2.3:4242",
+			xff:        "198.51.100.20, garbage",
+			expected:   "10.1.2.3",
+		},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.xff != "" {
+			req.Header.Set("X-Forwarded-For", tt.xff)
+		}
+
+		if ip := trusted.ClientIP(req); ip != tt.expected {
+			t.Errorf("%s: expected client IP %q, but got %q", tt.name, tt.expected, ip)
+		}
+	}
+}
+
+func TestClientIPMiddleware(t *testing.T) {
+	var got string
+	h := parseTrustedProxies([]string{"10.0.0.0/8"}).clientIPMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = clientIP(r)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.1.2.3:4242"
+	req.Header.Set("X-Forwarded-For", "198.51.100.20")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got != "198.51.100.20" {
+		t.Errorf("Expected client IP %q in the request context, but got %q", "198.51.100.20", got)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+)
+
+// recoveryMiddleware turns a panicking handler into a 500 instead of letting
+// net/http drop the connection, counting it in http_panics_total. A handler
+// that panics after sending its headers can't be given a 500 anymore, so
+// its response is aborted and the connection closed instead.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw, ok := w.(*responseWriter)
+		if !ok {
+			rw = NewResponseWriter(w)
+		}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// net/http uses ErrAbortHandler to abort a response on purpose
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			path := pathLabel(r)
+			httpPanics.WithLabelValues(path).Inc()
+			utils.WriteLogFields("ERROR", fmt.Sprintf("Recovered from panic serving %s: %v\n%s", r.URL.Path, v, debug.Stack()), map[string]interface{}{
+				"request_id": requestIDFromContext(r.Context()),
+			})
+			if rw.wroteHeader() {
+				// the client already has a status, cut the response short so it
+				// can't mistake it for a complete one
+				panic(http.ErrAbortHandler)
+			}
+			writeError(rw, r, http.StatusInternalServerError, http.StatusText(http.StatusInternalServerError))
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// handlePanic panics on purpose so the recovery middleware can be tried out
+func handlePanic(w http.ResponseWriter, r *http.Request) {
+	panic("panic requested through /api/debug/panic")
+}
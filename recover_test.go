@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Debug = true
+	router := NewServer(cfg).Handler()
+
+	panicsBefore := testutil.ToFloat64(httpPanics.WithLabelValues("/api/debug/panic"))
+	statusBefore := testutil.ToFloat64(responseStatusByPath.WithLabelValues("/api/debug/panic", "500"))
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/api/debug/panic", nil))
+
+	if rr.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, but got %d", http.StatusInternalServerError, rr.Code)
+	}
+	if got := testutil.ToFloat64(httpPanics.WithLabelValues("/api/debug/panic")) - panicsBefore; got != 1 {
+		t.Errorf("Expected http_panics_total to increase by 1, but got %v", got)
+	}
+	if got := testutil.ToFloat64(responseStatusByPath.WithLabelValues("/api/debug/panic", "500")) - statusBefore; got != 1 {
+		t.Errorf("Expected the 500 to be recorded for /api/debug/panic, but got %v", got)
+	}
+
+	// the server survived the panic
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d after the panic, but got %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestRecoveryMiddlewarePartialWrite(t *testing.T) {
+	router := newTestRouter(recoveryMiddleware)
+	router.Path("/api/stream").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("partial"))
+		panic("panic after the headers were sent")
+	})
+
+	var serverLog bytes.Buffer
+	ts := httptest.NewUnstartedServer(router)
+	ts.Config.ErrorLog = log.New(&serverLog, "", 0)
+	ts.Start()
+	defer ts.Close()
+
+	before := testutil.ToFloat64(httpPanics.WithLabelValues("/api/stream"))
+
+	resp, err := http.Get(ts.URL + "/api/stream")
+	if err == nil {
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected the status already sent, %d, but got %d", http.StatusOK, resp.StatusCode)
+		}
+		if _, err := io.ReadAll(resp.Body); err == nil {
+			t.Errorf("Expected the aborted response body to fail to read")
+		}
+		resp.Body.Close()
+	}
+
+	if got := testutil.ToFloat64(httpPanics.WithLabelValues("/api/stream")) - before; got != 1 {
+		t.Errorf("Expected http_panics_total to increase by 1, but got %v", got)
+	}
+	if strings.Contains(serverLog.String(), "superfluous") {
+		t.Errorf("Expected no superfluous WriteHeader, but the server logged %q", serverLog.String())
+	}
+}
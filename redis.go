@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/cmwylie19/prometheus-workshop/utils"
+)
+
+// redisBackoff is how long the first retry of a failed Redis command waits, doubling on every retry
+const redisBackoff = 50 * time.Millisecond
+
+// redisError is an error reply from the Redis server, it is not retried since
+// sending the same command again would fail the same way
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to Redis with its reply reader
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisClient speaks just enough of the Redis protocol for the hit and item
+// stores. It keeps up to poolSize idle connections and retries commands that
+// fail on a broken connection up to retries times with exponential backoff,
+// as long as retrying cannot run a command twice.
+type redisClient struct {
+	addr     string
+	password string
+	db       int
+	retries  int
+	dialer   net.Dialer
+	pool     chan *redisConn
+}
+
+func newRedisClient(cfg config.Redis) *redisClient {
+	size := cfg.PoolSize
+	if size <= 0 {
+		size = 1
+	}
+	return &redisClient{
+		addr:     cfg.Addr,
+		password: cfg.Password,
+		db:       cfg.DB,
+		retries:  cfg.MaxRetries,
+		dialer:   net.Dialer{Timeout: time.Second},
+		pool:     make(chan *redisConn, size),
+	}
+}
+
+// conn returns an idle connection from the pool, or a new one if there is none
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.pool:
+		return conn, nil
+	default:
+	}
+
+	nc, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if c.password != "" {
+		if _, err := conn.do("AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// put returns conn to the pool, closing it if the pool is full
+func (c *redisClient) put(conn *redisConn) {
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// redisRepeatable are the commands that are safe to send again after a
+// connection broke while they may have run, repeating an INCR would count a
+// hit twice and repeating an HDEL would report a deleted item as missing
+var redisRepeatable = map[string]bool{
+	"GET": true, "SET": true, "PING": true,
+	"HGET": true, "HSET": true, "HVALS": true, "HEXISTS": true,
+}
+
+// Do sends a command and returns its reply, nil for a missing value. A
+// command is retried if it never reached Redis, or if it is repeatable.
+func (c *redisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+	backoff := redisBackoff
+	for attempt := 0; ; attempt++ {
+		reply, sent, err := c.try(ctx, args)
+		var replyErr redisError
+		if err == nil || errors.As(err, &replyErr) || attempt >= c.retries || ctx.Err() != nil {
+			return reply, err
+		}
+		if sent && !redisRepeatable[args[0]] {
+			return nil, fmt.Errorf("redis: %s may have run, not retrying: %w", args[0], err)
+		}
+
+		utils.WriteLog("DEBUG", fmt.Sprintf("Redis %s failed, retrying in %s: %s", args[0], backoff, err))
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// try sends a command once and reports whether it was written to Redis, a
+// connection is only put back in the pool once its reply was read in full
+func (c *redisClient) try(ctx context.Context, args []string) (interface{}, bool, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	if err := conn.send(args); err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	reply, err := conn.reply()
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, true, err
+	}
+	c.put(conn)
+	return reply, true, err
+}
+
+// Close closes the idle connections
+func (c *redisClient) Close() {
+	for {
+		select {
+		case conn := <-c.pool:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// do writes a command and reads its reply
+func (conn *redisConn) do(args ...string) (interface{}, error) {
+	if err := conn.send(args); err != nil {
+		return nil, err
+	}
+	return conn.reply()
+}
+
+// send writes a command, Redis only runs it once it was written in full
+func (conn *redisConn) send(args []string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := io.WriteString(conn, b.String())
+	return err
+}
+
+// reply reads a simple string, error, integer, bulk string or array reply
+func (conn *redisConn) reply() (interface{}, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = conn.reply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unsupported reply %q", line)
+	}
+}
+
+// redisStore keeps the hit count in Redis, so every replica shares it and it
+// survives restarts
+type redisStore struct {
+	client *redisClient
+	key    string
+}
+
+func newRedisStore(cfg config.Redis) *redisStore {
+	return &redisStore{client: newRedisClient(cfg), key: cfg.Key}
+}
+
+// integer returns the integer reply, or err if the command failed
+func integer(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case nil:
+		return 0, nil
+	case int64:
+		return v, nil
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	default:
+		return 0, fmt.Errorf("redis: unexpected reply %v", reply)
+	}
+}
+
+// errRedisDisabled fails the Redis commands of the stores while the redis
+// feature flag is off, the hit store then falls back to memory
+var errRedisDisabled = errors.New("redis is disabled by the redis feature flag")
+
+// storeDo sends a command of a store through client while the redis feature is enabled
+func storeDo(ctx context.Context, client *redisClient, args ...string) (interface{}, error) {
+	if !activeFeatureEnabled(featureRedis) {
+		return nil, errRedisDisabled
+	}
+	return client.Do(ctx, args...)
+}
+
+func (s *redisStore) Get(ctx context.Context) (int64, error) {
+	return integer(storeDo(ctx, s.client, "GET", s.key))
+}
+
+func (s *redisStore) Incr(ctx context.Context) (int64, error) {
+	return integer(storeDo(ctx, s.client, "INCR", s.key))
+}
+
+func (s *redisStore) Add(ctx context.Context, n int64) (int64, error) {
+	return integer(storeDo(ctx, s.client, "INCRBY", s.key, strconv.FormatInt(n, 10)))
+}
+
+func (s *redisStore) Reset(ctx context.Context) error {
+	_, err := storeDo(ctx, s.client, "SET", s.key, "0")
+	return err
+}
+
+// fallbackStore serves from fallback while primary fails, so the web app
+// keeps counting hits while Redis is unreachable. The counts diverge while it
+// is falling back, and primary's count is used again once it is back.
+type fallbackStore struct {
+	primary  HitStore
+	fallback HitStore
+	name     string
+
+	mu          sync.Mutex
+	fallingBack bool
+}
+
+func newFallbackStore(name string, primary, fallback HitStore) *fallbackStore {
+	return &fallbackStore{primary: primary, fallback: fallback, name: name}
+}
+
+// use records whether primary failed with err, and returns whether to use fallback instead
+func (s *fallbackStore) use(ctx context.Context, err error) bool {
+	// the request went away, primary is not to blame. A deadline is still
+	// primary's fault, it is how the hit store timeout catches a hung Redis.
+	if err != nil && errors.Is(ctx.Err(), context.Canceled) {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		if s.fallingBack {
+			s.fallingBack = false
+			setHitStoreBackend(s.name)
+			utils.WriteLog("INFO", fmt.Sprintf("The %s hit store is reachable again", s.name))
+		}
+		return false
+	}
+
+	hitStoreFallbacks.Inc()
+	if !s.fallingBack {
+		s.fallingBack = true
+		setHitStoreBackend(backendMemory)
+		utils.WriteLog("WARNING", fmt.Sprintf("The %s hit store failed, counting hits in memory until it is back: %s", s.name, err))
+	}
+	return true
+}
+
+func (s *fallbackStore) Get(ctx context.Context) (int64, error) {
+	n, err := s.primary.Get(ctx)
+	if s.use(ctx, err) {
+		return s.fallback.Get(ctx)
+	}
+	return n, err
+}
+
+func (s *fallbackStore) Incr(ctx context.Context) (int64, error) {
+	n, err := s.primary.Incr(ctx)
+	if s.use(ctx, err) {
+		return s.fallback.Incr(ctx)
+	}
+	return n, err
+}
+
+func (s *fallbackStore) Add(ctx context.Context, n int64) (int64, error) {
+	total, err := s.primary.Add(ctx, n)
+	if s.use(ctx, err) {
+		return s.fallback.Add(ctx, n)
+	}
+	return total, err
+}
+
+func (s *fallbackStore) Reset(ctx context.Context) error {
+	err := s.primary.Reset(ctx)
+	if s.use(ctx, err) {
+		return s.fallback.Reset(ctx)
+	}
+	return err
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeRedis serves the Redis commands the hit and item stores use from maps
+type fakeRedis struct {
+	l        net.Listener
+	password string
+	// the first dropConns connections are closed without a reply
+	dropConns atomic.Int64
+
+	mu     sync.Mutex
+	values map[string]int64
+	hashes map[string]map[string]string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	r := &fakeRedis{l: l, password: password, values: map[string]int64{}, hashes: map[string]map[string]string{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return r
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	authed := r.password == ""
+	for {
+		args, err := readCommand(br)
+		if err != nil {
+			return
+		}
+		if r.dropConns.Add(-1) >= 0 {
+			return
+		}
+
+		r.mu.Lock()
+		switch {
+		case args[0] == "AUTH":
+			if args[1] == r.password {
+				authed = true
+				fmt.Fprint(conn, "+OK\r\n")
+			} else {
+				fmt.Fprint(conn, "-WRONGPASS invalid password\r\n")
+			}
+		case !authed:
+			fmt.Fprint(conn, "-NOAUTH Authentication required.\r\n")
+		case args[0] == "PING":
+			fmt.Fprint(conn, "+PONG\r\n")
+		case args[0] == "GET":
+			if v, ok := r.values[args[1]]; ok {
+				s := strconv.FormatInt(v, 10)
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(s), s)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case args[0] == "INCR":
+			r.values[args[1]]++
+			fmt.Fprintf(conn, ":%d\r\n", r.values[args[1]])
+		case args[0] == "INCRBY":
+			n, _ := strconv.ParseInt(args[2], 10, 64)
+			r.values[args[1]] += n
+			fmt.Fprintf(conn, ":%d\r\n", r.values[args[1]])
+		case args[0] == "SET":
+			n, _ := strconv.ParseInt(args[2], 10, 64)
+			r.values[args[1]] = n
+			fmt.Fprint(conn, "+OK\r\n")
+		case args[0] == "HSET":
+			if r.hashes[args[1]] == nil {
+				r.hashes[args[1]] = map[string]string{}
+			}
+			_, exists := r.hashes[args[1]][args[2]]
+			r.hashes[args[1]][args[2]] = args[3]
+			fmt.Fprintf(conn, ":%d\r\n", map[bool]int{true: 0, false: 1}[exists])
+		case args[0] == "HGET":
+			if v, ok := r.hashes[args[1]][args[2]]; ok {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprint(conn, "$-1\r\n")
+			}
+		case args[0] == "HEXISTS" || args[0] == "HDEL":
+			_, exists := r.hashes[args[1]][args[2]]
+			if args[0] == "HDEL" {
+				delete(r.hashes[args[1]], args[2])
+			}
+			fmt.Fprintf(conn, ":%d\r\n", map[bool]int{true: 1, false: 0}[exists])
+		case args[0] == "HVALS":
+			fmt.Fprintf(conn, "*%d\r\n", len(r.hashes[args[1]]))
+			for _, v := range r.hashes[args[1]] {
+				fmt.Fprintf(conn, "$%d\r\n%s\r\n", len(v), v)
+			}
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+		r.mu.Unlock()
+	}
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(br *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(br, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(br, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(br, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	server := newFakeRedis(t, "s3cret")
+	cfg := config.Default().HitStore.Redis
+	cfg.Addr = server.l.Addr().String()
+	cfg.Password = "s3cret"
+
+	// two replicas share the count
+	first, second := newRedisStore(cfg), newRedisStore(cfg)
+	defer first.client.Close()
+	defer second.client.Close()
+	ctx := context.Background()
+
+	if n, err := first.Get(ctx); err != nil || n != 0 {
+		t.Fatalf("Expected Get to return 0 before any hits, but got %d, %v", n, err)
+	}
+	if _, err := first.Incr(ctx); err != nil {
+		t.Fatalf("Failed to increment hits: %v", err)
+	}
+	if n, err := second.Add(ctx, 41); err != nil || n != 42 {
+		t.Errorf("Expected Add on the other replica to return 42, but got %d, %v", n, err)
+	}
+	if n, _ := first.Get(ctx); n != 42 {
+		t.Errorf("Expected Get to return 42, but got %d", n)
+	}
+	if err := second.Reset(ctx); err != nil {
+		t.Fatalf("Failed to reset hits: %v", err)
+	}
+	if n, _ := first.Get(ctx); n != 0 {
+		t.Errorf("Expected Get to return 0 after Reset, but got %d", n)
+	}
+
+	cfg.Password = "wrong"
+	if _, err := newRedisStore(cfg).Get(ctx); err == nil {
+		t.Errorf("Expected an error with the wrong password")
+	}
+}
+
+func TestRedisStoreRetry(t *testing.T) {
+	server := newFakeRedis(t, "")
+	cfg := config.Default().HitStore.Redis
+	cfg.Addr = server.l.Addr().String()
+	store := newRedisStore(cfg)
+	defer store.client.Close()
+
+	// the first connections break before replying
+	server.dropConns.Store(int64(cfg.MaxRetries))
+	if n, err := store.Get(context.Background()); err != nil || n != 0 {
+		t.Errorf("Expected Get to succeed after %d retries, but got %d, %v", cfg.MaxRetries, n, err)
+	}
+
+	server.dropConns.Store(int64(cfg.MaxRetries + 1))
+	if _, err := store.Get(context.Background()); err == nil {
+		t.Errorf("Expected Get to fail once the retries are used up")
+	}
+
+	// an INCR that reached Redis may have counted the hit, it is not sent again
+	server.dropConns.Store(1)
+	if _, err := store.Incr(context.Background()); err == nil {
+		t.Errorf("Expected Incr to fail without a retry once it was sent")
+	}
+	if server.dropConns.Load() != 0 {
+		t.Errorf("Expected Incr to be sent once, but it was sent %d times", 1-server.dropConns.Load())
+	}
+}
+
+// toggleStore fails every operation while failing is set
+type toggleStore struct {
+	HitStore
+	failing atomic.Bool
+}
+
+func (s *toggleStore) Incr(ctx context.Context) (int64, error) {
+	if s.failing.Load() {
+		return 0, errors.New("connection refused")
+	}
+	return s.HitStore.Incr(ctx)
+}
+
+func TestFallbackStore(t *testing.T) {
+	defer setHitStoreBackend(backendMemory)
+	setHitStoreBackend(backendRedis)
+
+	primary := &toggleStore{HitStore: newMemoryStore()}
+	store := newFallbackStore(backendRedis, primary, newMemoryStore())
+	ctx := context.Background()
+	before := testutil.ToFloat64(hitStoreFallbacks)
+
+	primary.failing.Store(true)
+	if n, err := store.Incr(ctx); err != nil || n != 1 {
+		t.Errorf("Expected Incr to be counted in memory, but got %d, %v", n, err)
+	}
+	if got := testutil.ToFloat64(hitStoreFallbacks) - before; got != 1 {
+		t.Errorf("Expected hit_store_fallbacks_total to increase by 1, but got %v", got)
+	}
+	if got := testutil.ToFloat64(hitStoreBackend.WithLabelValues(backendMemory)); got != 1 {
+		t.Errorf("Expected hit_store_backend{type=\"memory\"} while falling back, but got %v", got)
+	}
+
+	primary.failing.Store(false)
+	if n, err := store.Incr(ctx); err != nil || n != 1 {
+		t.Errorf("Expected Incr to use the primary again once it is back, but got %d, %v", n, err)
+	}
+	if got := testutil.ToFloat64(hitStoreBackend.WithLabelValues(backendRedis)); got != 1 {
+		t.Errorf("Expected hit_store_backend{type=\"redis\"} once it is back, but got %v", got)
+	}
+
+	// an unreachable Redis does not fail the web app
+	cfg := config.Default().HitStore
+	cfg.Backend = backendRedis
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	cfg.Redis.Addr = l.Addr().String()
+	l.Close()
+	cfg.Redis.MaxRetries = 0
+	unreachable, err := newHitStore(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create the redis hit store: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if _, err := unreachable.Incr(ctx); err != nil {
+		t.Errorf("Expected Incr to fall back to memory with Redis unreachable, but got %v", err)
+	}
+}
+
+func TestFallbackStoreTimeout(t *testing.T) {
+	defer setHitStoreBackend(backendMemory)
+
+	// a Redis that accepts connections but never replies
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	cfg := config.Default().HitStore
+	cfg.Backend = backendRedis
+	cfg.Redis.Addr = l.Addr().String()
+	cfg.Redis.MaxRetries = 0
+	hung, err := newHitStore(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create the redis hit store: %v", err)
+	}
+	store := newTimeoutStore(hung, 50*time.Millisecond)
+	before := testutil.ToFloat64(hitStoreFallbacks)
+
+	if n, err := store.Incr(context.Background()); err != nil || n != 1 {
+		t.Errorf("Expected Incr to fall back to memory once the store timeout passes, but got %d, %v", n, err)
+	}
+	if got := testutil.ToFloat64(hitStoreFallbacks) - before; got != 1 {
+		t.Errorf("Expected hit_store_fallbacks_total to increase by 1, but got %v", got)
+	}
+
+	// a request that goes away is not counted against Redis
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.Incr(ctx); err == nil {
+		t.Errorf("Expected Incr to fail once the request is canceled")
+	}
+}
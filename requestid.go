@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// requestIDHeader identifies a request across the proxies, logs and exemplars it goes through
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength keeps a request ID along with a trace ID within the
+// ExemplarMaxRunes OpenMetrics allows the labels of an exemplar
+const maxRequestIDLength = 64
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID of the request ctx belongs to, empty
+// outside of requestIDMiddleware
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID reports whether id is a request ID worth honoring, short
+// and made of the characters UUIDs and the IDs proxies generate use, so it
+// is safe in a log line, an exemplar or a response header
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random request ID
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// requestIDMiddleware honors the X-Request-Id of a request, such as one set
+// by an ingress, or generates one when it is missing or invalid. The ID is
+// put in the request context for the access log, spans and exemplars, and
+// returned in the response so a client can quote it. It wraps the whole
+// router, so the 404s and 405s of unmatched requests carry one too.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		// handlers passing the headers on propagate the ID
+		r.Header.Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidRequestID(t *testing.T) {
+	tests := []struct {
+		id       string
+		expected bool
+	}{
+		{"3f2b9c1e-8d4a-4b7e-9f0a-1c2d3e4f5a6b", true},
+		{"req_42.a:b", true},
+		{"", false},
+		{"has space", false},
+		{"quote\"", false},
+		{strings.Repeat("a", maxRequestIDLength+1), false},
+	}
+	for _, tt := range tests {
+		if got := validRequestID(tt.id); got != tt.expected {
+			t.Errorf("Expected validRequestID(%q) to be %v, but got %v", tt.id, tt.expected, got)
+		}
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name   string
+		header string
+		honor  bool
+	}{
+		{"honored", "ingress-1234", true},
+		{"missing", "", false},
+		{"invalid", "not a request id", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.header != "" {
+				req.Header.Set(requestIDHeader, tt.header)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			returned := rr.Header().Get(requestIDHeader)
+			if returned != seen || !validRequestID(seen) {
+				t.Errorf("Expected the handler to see the returned request ID %q, but got %q", returned, seen)
+			}
+			if honored := seen == tt.header; honored != tt.honor {
+				t.Errorf("Expected honoring %q to be %v, but got request ID %q", tt.header, tt.honor, seen)
+			}
+			if got := req.Header.Get(requestIDHeader); got != seen {
+				t.Errorf("Expected the request header to carry %q on, but got %q", seen, got)
+			}
+		})
+	}
+}
+
+func TestRequestIDLogged(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := testConfig(t)
+	cfg.AccessLog.Enabled = true
+	cfg.BasePath = "/blog"
+	router := NewServer(cfg).Handler()
+
+	// requests outside of the base path get an ID too
+	for _, path := range []string{"/blog/api/hits", "/outside"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if path == "/blog/api/hits" {
+			req.Header.Set(requestIDHeader, "logged-request-1")
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Header().Get(requestIDHeader) == "" {
+			t.Errorf("Expected a request ID in the response to %s", path)
+		}
+	}
+	if !strings.Contains(logs.String(), `"request_id":"logged-request-1"`) {
+		t.Errorf("Expected the access log to have the request ID, but got %s", logs.String())
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+)
+
+// Root modes, selecting what is served at /
+const (
+	rootStatic   = "static"
+	rootRedirect = "redirect"
+	rootJSON     = "json"
+)
+
+// rootHandler returns the handler for / according to the configured root mode.
+// Unknown modes, or a redirect without a URL, fall back to serving static files.
+func (s *Server) rootHandler() http.Handler {
+	switch s.cfg.RootMode {
+	case rootRedirect:
+		if s.cfg.RootRedirectURL != "" {
+			return http.RedirectHandler(s.cfg.RootRedirectURL, http.StatusMovedPermanently)
+		}
+		utils.WriteLog("WARNING", "Root mode redirect needs a redirect URL, serving static files")
+	case rootJSON:
+		return http.HandlerFunc(handleRootJSON)
+	case rootStatic, "":
+	default:
+		utils.WriteLog("WARNING", fmt.Sprintf("Unknown root mode %q, serving static files", s.cfg.RootMode))
+	}
+
+	// Static files, StaticDir is a colon-separated list where later directories override earlier ones
+	fs := newOverlayFS(s.cfg.StaticDir)
+	files := newInstrumentedFS(fs)
+	fileServer := contentTypeMiddleware(s.cfg.StaticContentType, s.cfg.StaticContentTypes, http.FileServer(files))
+	if s.cfg.StaticPlaceholder && fs.empty() {
+		utils.WriteLog("WARNING", fmt.Sprintf("Static directory %s has no files, serving a placeholder page at /", s.cfg.StaticDir))
+		return s.drainingMiddleware(fs, staticMetricsMiddleware(placeholderMiddleware(jsonErrors(fileServer))))
+	}
+	if s.cfg.SPAFallback {
+		return s.drainingMiddleware(fs, staticMetricsMiddleware(jsonErrors(newSPAHandler(files, fileServer))))
+	}
+	return s.drainingMiddleware(fs, staticMetricsMiddleware(jsonErrors(fileServer)))
+}
+
+// placeholderPage is served at / when the static directories have no files
+const placeholderPage = `<!DOCTYPE html>
+<html>
+<head><title>Prometheus Workshop</title></head>
+<body><p>The demo blog is running, but its static directory is empty. Add an index.html to see it here.</p></body>
+</html>
+`
+
+// placeholderMiddleware serves placeholderPage at / instead of a 404
+func placeholderMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, placeholderPage)
+	})
+}
+
+// drainingPage is served at / while draining when no static directory has a draining.html
+const drainingPage = `<!DOCTYPE html>
+<html>
+<head><title>Prometheus Workshop</title></head>
+<body><p>This server is restarting for an update, please refresh in a few seconds.</p></body>
+</html>
+`
+
+// drainingRetryAfter is how long users are asked to wait before refreshing while draining
+const drainingRetryAfter = 10 * time.Second
+
+// drainingMiddleware lets users know the server is going away while it drains.
+// Every response gets an X-Draining header and / serves draining.html from fs
+// with a 503, so a rolling update shows a message instead of a reset connection.
+func (s *Server) drainingMiddleware(fs http.FileSystem, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Draining() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-Draining", "true")
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		setRetryAfter(w, drainingRetryAfter)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if f, err := fs.Open("/draining.html"); err == nil {
+			defer f.Close()
+			io.Copy(w, f)
+			return
+		}
+		io.WriteString(w, drainingPage)
+	})
+}
+
+// handleRootJSON returns a small status document for API-only deployments
+func handleRootJSON(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"service": "demo-blog",
+		"status":  "ok",
+		"version": version,
+	})
+}
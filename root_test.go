@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRootModes(t *testing.T) {
+	tests := []struct {
+		mode   string
+		url    string
+		status int
+		check  func(t *testing.T, rr *httptest.ResponseRecorder)
+	}{
+		{
+			mode:   rootStatic,
+			status: http.StatusOK,
+			check: func(t *testing.T, rr *httptest.ResponseRecorder) {
+				if !strings.Contains(rr.Body.String(), "<html") {
+					t.Errorf("Expected the static web app, but got %q", rr.Body.String())
+				}
+			},
+		},
+		{
+			mode:   rootRedirect,
+			url:    "https://example.com/workshop",
+			status: http.StatusMovedPermanently,
+			check: func(t *testing.T, rr *httptest.ResponseRecorder) {
+				if got := rr.Header().Get("Location"); got != "https://example.com/workshop" {
+					t.Errorf("Expected a redirect to %q, but got %q", "https://example.com/workshop", got)
+				}
+			},
+		},
+		{
+			mode:   rootJSON,
+			status: http.StatusOK,
+			check: func(t *testing.T, rr *httptest.ResponseRecorder) {
+				var body map[string]string
+				if err := json.NewDecoder(rr.Body).Decode(&body); err != nil {
+					t.Fatalf("Failed to decode root JSON: %v", err)
+				}
+				if body["status"] != "ok" || body["version"] != version {
+					t.Errorf("Expected status ok and version %q, but got %v", version, body)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.RootMode = tt.mode
+			cfg.RootRedirectURL = tt.url
+			router := NewServer(cfg).Handler()
+
+			before := getHits(t, router)
+
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rr.Code != tt.status {
+				t.Fatalf("Expected status %d, but got %d", tt.status, rr.Code)
+			}
+			tt.check(t, rr)
+
+			if after := getHits(t, router); after != before+1 {
+				t.Errorf("Expected hits to be %d after visiting /, but got %d", before+1, after)
+			}
+		})
+	}
+}
+
+func TestRootDraining(t *testing.T) {
+	custom := t.TempDir()
+	writeFile(t, custom, "index.html", "<html>blog</html>")
+	writeFile(t, custom, "draining.html", "<html>back soon</html>")
+
+	tests := []struct {
+		name      string
+		staticDir string
+		body      string
+	}{
+		{"built-in page", "./static", "restarting for an update"},
+		{"draining.html", custom, "back soon"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("STATIC_DIR", tt.staticDir)
+			s := NewServer(testConfig(t))
+			s.ready.SetDraining()
+
+			rr := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rr.Code != http.StatusServiceUnavailable {
+				t.Errorf("Expected status %d while draining, but got %d", http.StatusServiceUnavailable, rr.Code)
+			}
+			if rr.Header().Get("X-Draining") != "true" || rr.Header().Get("Retry-After") == "" {
+				t.Errorf("Expected X-Draining and Retry-After headers, but got %v", rr.Header())
+			}
+			if !strings.Contains(rr.Body.String(), tt.body) {
+				t.Errorf("Expected the draining page to contain %q, but got %q", tt.body, rr.Body.String())
+			}
+		})
+	}
+
+	// other static files are still served while draining
+	s := NewServer(testConfig(t))
+	s.ready.SetDraining()
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/w3.css", nil))
+	if rr.Code != http.StatusOK || rr.Header().Get("X-Draining") != "true" {
+		t.Errorf("Expected /w3.css to be served with X-Draining, but got %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestRootPlaceholder(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		cfg := testConfig(t)
+		cfg.StaticDir = t.TempDir()
+		cfg.StaticPlaceholder = enabled
+		router := NewServer(cfg).Handler()
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if !enabled {
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("Expected status %d without the placeholder, but got %d", http.StatusNotFound, rr.Code)
+			}
+			continue
+		}
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected status %d for the placeholder, but got %d", http.StatusOK, rr.Code)
+		}
+		if rr.Body.String() != placeholderPage {
+			t.Errorf("Expected the placeholder page, but got %q", rr.Body.String())
+		}
+
+		rr = httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/app.js", nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d for other paths, but got %d", http.StatusNotFound, rr.Code)
+		}
+	}
+}
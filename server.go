@@ -0,0 +1,754 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/cmwylie19/prometheus-workshop/utils"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/time/rate"
+)
+
+// Server is the demo blog web app
+type Server struct {
+	srv *http.Server
+	// admin serves the operational endpoints on AdminPort, it is nil when
+	// they are served by srv along with the web app
+	admin       *http.Server
+	adminRouter *mux.Router
+
+	mu  sync.Mutex
+	cfg config.Config
+
+	ready         *readiness
+	health        *healthRegistry
+	idempotency   *idempotencyCache
+	limiter       *rate.Limiter
+	perIP         *ipLimiters
+	gatherer      prometheus.Gatherer
+	otlp          *otlpPusher
+	pusher        *metricsPusher
+	tracer        *tracer
+	features      *featureFlags
+	slowThreshold atomic.Int64
+	scrapeOnly    atomic.Bool
+	webInflight   atomic.Int64
+	// addr and adminAddr are the addresses Start listens on
+	addr      atomic.Value
+	adminAddr atomic.Value
+	loadgen   loadgenRun
+	chaos     *chaos
+	items     *itemsAPI
+	slo       *sloTracker
+	// draining is closed once Shutdown starts draining, ending the /live
+	// streams that would otherwise hold it up
+	draining     chan struct{}
+	drainingOnce sync.Once
+}
+
+// NewServer returns a Server for the web app configured by cfg
+func NewServer(cfg *config.Config) *Server {
+	return newServer(cfg, metricsGatherer)
+}
+
+// newServer returns a Server whose /api/metrics exposes the metrics of gatherer
+func newServer(cfg *config.Config, gatherer prometheus.Gatherer) *Server {
+	s := &Server{
+		gatherer:    gatherer,
+		cfg:         *cfg,
+		ready:       newReadiness(cfg.ReadyAfter),
+		health:      newHealthRegistry(),
+		idempotency: newIdempotencyCache(cfg.IdempotencyTTL, cfg.IdempotencyCacheSize),
+		limiter:     rate.NewLimiter(rateLimit(cfg.RateLimit)),
+		perIP:       newIPLimiters(perIPRateLimit(cfg.RateLimit)),
+		features:    newFeatureFlags(cfg.Features),
+		chaos:       newChaos(cfg.Chaos),
+		items:       newItemsAPI(newItemStore(cfg.Items, cfg.HitStore.Redis), cfg.Items.Latency),
+		slo:         newSLOTracker(cfg.SLO),
+		draining:    make(chan struct{}),
+	}
+	s.health.Register("hitStore", hitStoreCheck)
+	s.health.Register("rateLimiter", limiterCheck(s.limiter))
+	s.health.Register("staticDir", staticDirCheck(cfg.StaticDir))
+	if cfg.HitStore.Backend == backendFile {
+		s.health.Register("disk", diskCheck(filepath.Dir(cfg.HitStore.File)))
+	}
+	if cfg.HitStore.Backend == backendRedis {
+		s.health.Register("redis", redisCheck(newRedisClient(cfg.HitStore.Redis)))
+		s.ready.AddCheck("redis", s.health.ReadinessCheck("redis"))
+	}
+	s.ready.AddCheck("staticDir", s.health.ReadinessCheck("staticDir"))
+	s.ready.SetFailing(cfg.FailReady)
+	s.slowThreshold.Store(int64(cfg.SlowThreshold))
+	setRateLimitMetrics(cfg.RateLimit)
+	activeLimiter.Store(s.limiter)
+	activeFeatures.Store(s.features)
+	sloObjective.Set(cfg.SLO.Objective)
+	if cfg.OTLP.Endpoint != "" && cfg.OTLP.Interval > 0 {
+		s.otlp = newOTLPPusher(gatherer, newHTTPOTLPExporter(cfg.OTLP.Endpoint), cfg.OTLP.Interval, cfg.OTLP.ServiceName)
+		go s.otlp.Run()
+		utils.WriteLog("INFO", fmt.Sprintf("Exporting metrics over OTLP to %s every %s", cfg.Redacted().OTLP.Endpoint, cfg.OTLP.Interval))
+	}
+	if cfg.Push.URL != "" {
+		s.pusher = newMetricsPusher(gatherer, cfg.Push)
+		go s.pusher.Run()
+		utils.WriteLog("INFO", fmt.Sprintf("Pushing metrics (%s) to %s every %s as job %s", cfg.Push.Mode, cfg.Redacted().Push.URL, cfg.Push.Interval, cfg.Push.Job))
+	}
+	if cfg.Tracing.Endpoint != "" {
+		s.tracer = newTracer(newHTTPOTLPExporter(cfg.Tracing.Endpoint), cfg.OTLP.ServiceName, cfg.Tracing.SampleRatio)
+		go s.tracer.Run()
+		utils.WriteLog("INFO", fmt.Sprintf("Exporting traces over OTLP to %s, sampling %g of new traces", cfg.Redacted().Tracing.Endpoint, cfg.Tracing.SampleRatio))
+	}
+	// the default is never zero, so a zero timeout was configured on purpose
+	if cfg.ReadHeaderTimeout <= 0 {
+		utils.WriteLog("WARNING", "ReadHeaderTimeout is disabled, slow clients can hold connections open indefinitely (slowloris)")
+	}
+	handler := requestIDMiddleware(withBasePath(cfg.BasePath, s.finalScrapeMiddleware(s.newRouter())))
+	if cfg.EnableH2C {
+		// HTTP/2 without TLS, HTTP/1.1 clients are still served as usual
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	s.srv = &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ConnContext:       withConn,
+		ConnState:         countTLSHandshakeErrors(newConnTracker(httpConnections).ConnState),
+	}
+	// every response closes its connection, so each request needs a new one
+	s.srv.SetKeepAlivesEnabled(!cfg.DisableKeepAlive)
+	if s.adminRouter != nil {
+		seedRouteMetrics(s.adminRouter, newLabelGuard("path", cfg.MaxPathLabels))
+		s.admin = &http.Server{
+			Addr:              ":" + cfg.AdminPort,
+			Handler:           requestIDMiddleware(withBasePath(cfg.BasePath, s.adminRouter)),
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		}
+	}
+	shutdownDrainTimeout.Set(cfg.DrainTimeout.Seconds())
+	return s
+}
+
+// logStartup logs a summary of the effective config in a single line, with
+// secrets and the password of URLs masked by Redacted, to make misconfigurations easy to spot
+func logStartup(cfg *config.Config) {
+	redacted := cfg.Redacted()
+
+	rateLimited := "disabled"
+	if limit, burst := rateLimit(redacted.RateLimit); limit != rate.Inf {
+		rateLimited = fmt.Sprintf("%g rps, burst %d", float64(limit), burst)
+	}
+	otlp := "disabled"
+	if redacted.OTLP.Endpoint != "" {
+		otlp = redacted.OTLP.Endpoint
+	}
+	tracing := "disabled"
+	if redacted.Tracing.Endpoint != "" {
+		tracing = redacted.Tracing.Endpoint
+	}
+	adminAddr := "disabled"
+	if redacted.AdminPort != "" {
+		adminAddr = ":" + redacted.AdminPort
+	}
+	pushed := "disabled"
+	if redacted.Push.URL != "" {
+		pushed = redacted.Push.Mode + " " + redacted.Push.URL
+	}
+
+	utils.WriteLogFields("INFO", fmt.Sprintf("Server started at port %s", redacted.Port), map[string]interface{}{
+		"addr":        ":" + redacted.Port,
+		"adminAddr":   adminAddr,
+		"basePath":    redacted.BasePath,
+		"metricsPath": path.Join("/", redacted.BasePath, "/api/metrics"),
+		"hitStore":    redacted.HitStore.Backend,
+		"tls":         redacted.TLS.Enabled(),
+		"rateLimit":   rateLimited,
+		"buckets":     len(redacted.HTTPDurationBuckets),
+		"native":      redacted.Metrics.NativeHistogramBucketFactor > 0,
+		"otlp":        otlp,
+		"tracing":     tracing,
+		"push":        pushed,
+		"debug":       redacted.Debug,
+	})
+}
+
+// rateLimit returns the limiter settings for rl, an unset RPS disables rate limiting
+func rateLimit(rl config.RateLimit) (rate.Limit, int) {
+	if rl.RPS <= 0 {
+		return rate.Inf, 0
+	}
+	burst := rl.Burst
+	if burst <= 0 {
+		burst = int(math.Ceil(rl.RPS))
+	}
+	return rate.Limit(rl.RPS), burst
+}
+
+// perIPRateLimit returns the per-IP limiter settings for rl, an unset
+// PerIPRPS disables the per-IP limits
+func perIPRateLimit(rl config.RateLimit) (rate.Limit, int) {
+	return rateLimit(config.RateLimit{RPS: rl.PerIPRPS, Burst: rl.PerIPBurst})
+}
+
+// setRateLimitMetrics exposes the limiter settings for rl, so dashboards can show usage against the limit
+func setRateLimitMetrics(rl config.RateLimit) {
+	limit, burst := rateLimit(rl)
+	if limit == rate.Inf {
+		limit = 0
+	}
+	rateLimiterLimit.Set(float64(limit))
+	rateLimiterBurst.Set(float64(burst))
+}
+
+// newRouter wires every endpoint and middleware of the web app
+func (s *Server) newRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.NotFoundHandler = notFoundHandler()
+	router.MethodNotAllowedHandler = errorHandler(http.StatusMethodNotAllowed)
+	trace := newMiddlewareTrace(s.cfg.Debug && s.cfg.TraceMiddleware)
+	router.Use(trace.wrap("clientIP", parseTrustedProxies(s.cfg.TrustedProxies).clientIPMiddleware))
+	if s.tracer != nil {
+		router.Use(trace.wrap("tracing", s.features.gate(featureTracing, s.tracer.middleware)))
+	}
+	if s.cfg.AccessLog.Enabled {
+		router.Use(trace.wrap("accessLog", accessLogMiddleware(s.cfg.AccessLog)))
+	}
+	paths := newLabelGuard("path", s.cfg.MaxPathLabels)
+	router.Use(trace.wrap("prometheus", prometheusMiddleware(paths)))
+	if s.cfg.SLO.Objective > 0 {
+		router.Use(trace.wrap("slo", s.slo.middleware))
+	}
+	router.Use(trace.wrap("recovery", recoveryMiddleware))
+	if s.cfg.CanonicalHost != "" {
+		router.Use(trace.wrap("canonicalHost", canonicalHostMiddleware(s.cfg.CanonicalHost)))
+	}
+	router.Use(trace.wrap("slowRequest", s.slowRequestMiddleware))
+	router.Use(trace.wrap("cors", corsMiddleware(s.cfg.CORS)))
+	if s.cfg.VersionHeaderEnabled {
+		router.Use(trace.wrap("versionHeader", versionHeaderMiddleware(s.cfg.VersionHeader)))
+	}
+	router.Use(trace.wrap("rateLimit", s.features.gate(featureRateLimit, rateLimitMiddleware(s.limiter, s.perIP))))
+	if s.cfg.BodyReadTimeout > 0 {
+		router.Use(trace.wrap("bodyReadTimeout", bodyReadTimeoutMiddleware(s.cfg.BodyReadTimeout)))
+	}
+	router.Use(trace.wrap("contentLength", contentLengthMiddleware(int64(s.cfg.MaxBodyBytes))))
+	router.Use(trace.wrap("gzipBody", gzipBodyMiddleware(int64(s.cfg.MaxBodyBytes))))
+	if len(s.cfg.RouteConcurrency) > 0 {
+		router.Use(trace.wrap("routeConcurrency", routeConcurrencyMiddleware(s.cfg.RouteConcurrency)))
+	}
+	if s.cfg.WorkerPool.Size > 0 {
+		router.Use(trace.wrap("workerPool", newWorkerPool(s.cfg.WorkerPool.Size, s.cfg.WorkerPool.QueueSize, s.cfg.WorkerPool.Routes).middleware()))
+	}
+	if s.cfg.RequestTimeout > 0 || len(s.cfg.RouteTimeouts) > 0 {
+		router.Use(trace.wrap("timeout", timeoutMiddleware(s.cfg.RequestTimeout, s.cfg.RouteTimeouts)))
+	}
+	// with debug on, chaos can be injected at any time through /api/debug/chaos
+	if s.cfg.Debug || (s.cfg.Chaos.LatencyProb > 0 && s.cfg.Chaos.Latency > 0) {
+		router.Use(trace.wrap("chaosLatency", s.chaos.latencyMiddleware))
+	}
+	if s.cfg.Debug || s.cfg.Chaos.ErrorProb > 0 {
+		router.Use(trace.wrap("chaosErrors", s.chaos.errorMiddleware))
+	}
+
+	// dashboard, hits, items, live and remoteWrite are web app routes, the rest is served
+	// by the admin listener when it is enabled
+	admin := router
+	if s.cfg.AdminPort != "" {
+		admin = s.newAdminRouter()
+	}
+	s.adminRoutes(admin, router, trace)
+
+	// Grafana dashboard for the custom metrics, bundled in the binary
+	router.Path("/dashboard.json").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(handleDashboard)
+
+	// hits at the web app endpoint
+	router.Path("/api/hits").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(handleHit)
+
+	// items API, a CRUD API with latencies and errors worth graphing
+	s.items.routes(router)
+
+	// live metric snapshots, rendered by live.html
+	router.Path(liveRoute).Methods(http.MethodGet, http.MethodOptions).HandlerFunc(s.handleLive)
+
+	// remoteWrite endpoint
+	router.Path("/api/remote").Methods(http.MethodPost, http.MethodOptions).HandlerFunc(handleMetrics)
+
+	// web app
+	router.PathPrefix("/").Handler(hitCounterMiddleware(s.rootHandler(), s.cfg.HitMethods))
+
+	seedRouteMetrics(router, paths)
+	return router
+}
+
+// newAdminRouter returns the router of the admin listener. It only runs the
+// middlewares the operational endpoints need, so a rate limit or an injected
+// fault of the web app never gets in the way of a scrape or a probe.
+func (s *Server) newAdminRouter() *mux.Router {
+	router := mux.NewRouter()
+	router.NotFoundHandler = notFoundHandler()
+	router.MethodNotAllowedHandler = errorHandler(http.StatusMethodNotAllowed)
+	router.Use(parseTrustedProxies(s.cfg.TrustedProxies).clientIPMiddleware)
+	router.Use(prometheusMiddleware(newLabelGuard("path", s.cfg.MaxPathLabels)))
+	router.Use(recoveryMiddleware)
+	s.adminRouter = router
+	return router
+}
+
+// adminRoutes wires the metrics, probe and debug endpoints to router, app is
+// the router of the web app listed by /api/debug/routes
+func (s *Server) adminRoutes(router, app *mux.Router, trace *middlewareTrace) {
+	// metrics endpoint
+	uncompressed := s.cfg.Metrics
+	uncompressed.DisableCompression = true
+	router.Path("/api/metrics").Methods(http.MethodGet, http.MethodOptions).Handler(s.features.choose(featureGzip,
+		newMetricsHandler(s.gatherer, s.cfg.Metrics),
+		newMetricsHandler(s.gatherer, uncompressed)))
+
+	// health check endpoint
+	router.Path("/api/healthz").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(HealthCheckHandler)
+
+	// subsystem health endpoint
+	router.Path("/api/health").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(s.health.handleHealth)
+
+	// readiness endpoint, held back until ReadyAfter elapses so sidecars can initialize
+	router.Path("/api/readyz").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(s.ready.handleReady)
+
+	// error budget burn of the SLO
+	s.slo.routes(router)
+
+	// debug endpoints
+	if s.cfg.Debug {
+		router.Path("/api/debug/routes").Methods(http.MethodGet, http.MethodOptions).Handler(routesHandler(app))
+		router.Path("/api/hits/reset").Methods(http.MethodPost, http.MethodOptions).Handler(s.idempotency.middleware(http.HandlerFunc(handleReset)))
+		router.Path("/api/hits/add").Methods(http.MethodPost, http.MethodOptions).Handler(s.idempotency.middleware(http.HandlerFunc(handleAdd)))
+		router.Path("/api/debug/slow").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(handleSlow)
+		router.Path("/api/debug/gc").Methods(http.MethodPost, http.MethodOptions).HandlerFunc(handleGC)
+		router.Path("/api/debug/panic").Methods(http.MethodPost, http.MethodOptions).HandlerFunc(handlePanic)
+		router.Path("/api/debug/config").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(s.handleConfig)
+		router.Path("/api/debug/middleware-order").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(trace.handleMiddlewareOrder)
+		router.Path("/api/debug/echo").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(handleEcho)
+		router.Path("/api/debug/metric/{name}").Methods(http.MethodGet, http.MethodOptions).HandlerFunc(s.handleMetric)
+		router.Path("/api/debug/loadgen").Methods(http.MethodPost, http.MethodDelete, http.MethodOptions).HandlerFunc(s.handleLoadgen)
+		router.Path(chaosRoute).Methods(http.MethodGet, http.MethodPost, http.MethodDelete, http.MethodOptions).HandlerFunc(s.chaos.handleChaos)
+		router.Path("/api/debug/fail-ready").Methods(http.MethodPost, http.MethodOptions).HandlerFunc(s.ready.handleFailReady)
+		router.Path("/api/debug/metrics/reset-path").Methods(http.MethodPost, http.MethodOptions).HandlerFunc(handleResetPath)
+	}
+
+	// profiling endpoints, a CPU profile or trace lasts its seconds parameter
+	// so a request timeout on this listener has to allow for it
+	if s.cfg.Pprof {
+		router.PathPrefix(pprofRoute).Methods(http.MethodGet, http.MethodPost).Handler(pprofHandler())
+	}
+}
+
+// finalScrapeMiddleware rejects every request but scrapes of /api/metrics
+// once Shutdown has started draining the web app for the final scrape, and
+// counts the web app requests in flight it waits for
+func (s *Server) finalScrapeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// counted before scrapeOnly is checked, so Shutdown cannot miss it
+		s.webInflight.Add(1)
+		defer s.webInflight.Add(-1)
+		if s.scrapeOnly.Load() {
+			w.Header().Set("Connection", "close")
+			setRetryAfter(w, drainingRetryAfter)
+			writeError(w, r, http.StatusServiceUnavailable, "server is shutting down")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// slowRequestMiddleware logs a warning for requests slower than the slow threshold
+func (s *Server) slowRequestMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		next.ServeHTTP(w, r)
+
+		threshold := time.Duration(s.slowThreshold.Load())
+		if elapsed := time.Since(start); threshold > 0 && elapsed > threshold {
+			utils.WriteLog("WARNING", fmt.Sprintf("Slow request to %s from %s took %s", r.URL.Path, clientIP(r), elapsed))
+		}
+	})
+}
+
+// Handler returns the fully configured handler, including every middleware
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler
+}
+
+// ListenAndServe listens on the configured addresses and serves the web app
+// until the server stops, like Start does without returning
+func (s *Server) ListenAndServe() error {
+	served, err := s.Start()
+	if err != nil {
+		return err
+	}
+	return <-served
+}
+
+// Start listens on the configured address and serves the web app in the
+// background, so a port conflict is returned before anything waits on the
+// server. The returned channel receives the result of serving once the
+// server stops, http.ErrServerClosed after a Shutdown.
+func (s *Server) Start() (<-chan error, error) {
+	l, err := listen("web app", s.srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if s.admin != nil {
+		adminListener, err := listen("admin", s.admin.Addr)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		s.adminAddr.Store(adminListener.Addr().String())
+		go func() {
+			if err := s.serveOn(s.admin, adminListener); err != nil && err != http.ErrServerClosed {
+				utils.WriteLog("ERROR", fmt.Sprintf("Admin listener stopped: %s", err))
+			}
+		}()
+	}
+	s.addr.Store(l.Addr().String())
+
+	served := make(chan error, 1)
+	go func() { served <- s.serve(l) }()
+	return served, nil
+}
+
+// Addr returns the address the server listens on once it was started
+func (s *Server) Addr() string {
+	addr, _ := s.addr.Load().(string)
+	return addr
+}
+
+// AdminAddr returns the address the admin listener listens on once the
+// server was started, "" if it is disabled
+func (s *Server) AdminAddr() string {
+	addr, _ := s.adminAddr.Load().(string)
+	return addr
+}
+
+// serve serves the web app on l, over TLS if it is configured
+func (s *Server) serve(l net.Listener) error {
+	return s.serveOn(s.srv, l)
+}
+
+// serveOn serves srv on l, over TLS if it is configured
+func (s *Server) serveOn(srv *http.Server, l net.Listener) error {
+	if !s.cfg.TLS.Enabled() {
+		return srv.Serve(l)
+	}
+	if s.cfg.TLS.CertFile != "" {
+		return srv.ServeTLS(l, s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
+	}
+	cert, err := selfSignedCert()
+	if err != nil {
+		return fmt.Errorf("generating a self-signed certificate: %w", err)
+	}
+	utils.WriteLog("WARNING", "Serving HTTPS with a self-signed certificate, this is only meant for development")
+	srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	return srv.ServeTLS(l, "", "")
+}
+
+// listen binds addr before serving so a port conflict is reported with the
+// name of the listener and the port instead of an opaque bind error
+func listen(name, addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if errors.Is(err, syscall.EADDRINUSE) {
+		_, port, _ := net.SplitHostPort(addr)
+		return nil, fmt.Errorf("%s port %s is already in use, stop the process using it or configure another port: %w", name, port, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s for the %s: %w", addr, name, err)
+	}
+	return l, nil
+}
+
+// Serve serves the web app on l, which lets tests use an ephemeral port
+func (s *Server) Serve(l net.Listener) error {
+	return s.srv.Serve(l)
+}
+
+// Shutdown stops the server gracefully. Readiness fails straight away so the
+// server is taken out of rotation, requests are still served for ShutdownDelay,
+// then in-flight requests are drained for up to DrainTimeout or until ctx is
+// done. Once the web app is drained /api/metrics is still served for
+// FinalScrapeWait, on the admin listener when there is one, so Prometheus
+// scrapes the final values, including those of the drained requests, then the
+// listener serving it is closed too. The final metrics, including how long the
+// shutdown took, are exported over OTLP once requests are drained.
+func (s *Server) Shutdown(ctx context.Context) error {
+	start := time.Now()
+	shutdownInProgress.Set(1)
+	s.ready.SetDraining()
+	s.loadgen.mu.Lock()
+	s.loadgen.stop()
+	s.loadgen.mu.Unlock()
+	s.chaos.Reset()
+	utils.WriteLog("INFO", fmt.Sprintf("Shutting down, serving for another %s before draining", s.cfg.ShutdownDelay))
+
+	select {
+	case <-time.After(s.cfg.ShutdownDelay):
+	case <-ctx.Done():
+	}
+
+	drainCtx, cancel := s.drainContext(ctx)
+	defer cancel()
+	s.drainingOnce.Do(func() { close(s.draining) })
+	var err error
+	if s.admin == nil && s.cfg.FinalScrapeWait > 0 {
+		// the web app's listener serves the metrics too, so it stays open for
+		// /api/metrics only until the final scrape
+		s.scrapeOnly.Store(true)
+		if err = s.drainWebApp(drainCtx); err == nil {
+			s.waitFinalScrape(ctx)
+			drainCtx, cancel = s.drainContext(ctx)
+			defer cancel()
+		}
+		if shutdownErr := s.srv.Shutdown(drainCtx); err == nil {
+			err = shutdownErr
+		}
+	} else {
+		err = s.srv.Shutdown(drainCtx)
+	}
+	// the admin listener goes last, so the probes and metrics stay up while
+	// the web app drains and for the final scrape after it
+	if s.admin != nil {
+		s.waitFinalScrape(ctx)
+		adminCtx, cancel := s.drainContext(ctx)
+		defer cancel()
+		if adminErr := s.admin.Shutdown(adminCtx); adminErr != nil {
+			utils.WriteLog("ERROR", fmt.Sprintf("Failed to shut down the admin listener: %s", adminErr))
+		}
+	}
+	shutdownDuration.Set(time.Since(start).Seconds())
+	utils.WriteLog("INFO", fmt.Sprintf("Shut down in %s", time.Since(start).Round(time.Millisecond)))
+	if s.tracer != nil {
+		if tracerErr := s.tracer.Shutdown(ctx); tracerErr != nil {
+			utils.WriteLog("ERROR", fmt.Sprintf("Failed to flush spans over OTLP: %s", tracerErr))
+		}
+	}
+	if s.otlp != nil {
+		if otlpErr := s.otlp.Shutdown(ctx); otlpErr != nil {
+			utils.WriteLog("ERROR", fmt.Sprintf("Failed to flush metrics over OTLP: %s", otlpErr))
+		}
+	}
+	if s.pusher != nil {
+		if pushErr := s.pusher.Shutdown(ctx); pushErr != nil {
+			utils.WriteLog("ERROR", fmt.Sprintf("Failed to push the final metrics: %s", pushErr))
+		}
+	}
+	return err
+}
+
+// Reload applies the hot-reloadable subset of cfg: log level and format, rate limits,
+// the slow request threshold, disabling keep-alives and feature flags. Every other
+// setting needs a restart and is ignored.
+func (s *Server) Reload(cfg *config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if cfg.Port != s.cfg.Port {
+		utils.WriteLog("WARNING", fmt.Sprintf("Changing the port from %s to %s requires a restart, ignoring", s.cfg.Port, cfg.Port))
+	}
+
+	if cfg.LogLevel != s.cfg.LogLevel {
+		if err := utils.SetLogLevel(cfg.LogLevel); err != nil {
+			return err
+		}
+		utils.WriteLog("INFO", fmt.Sprintf("Reloaded log level from %s to %s", s.cfg.LogLevel, cfg.LogLevel))
+		s.cfg.LogLevel = cfg.LogLevel
+	}
+
+	if cfg.LogFormat != s.cfg.LogFormat {
+		if err := utils.SetLogFormat(cfg.LogFormat); err != nil {
+			return err
+		}
+		utils.WriteLog("INFO", fmt.Sprintf("Reloaded log format from %s to %s", s.cfg.LogFormat, cfg.LogFormat))
+		s.cfg.LogFormat = cfg.LogFormat
+	}
+
+	if cfg.RateLimit != s.cfg.RateLimit {
+		limit, burst := rateLimit(cfg.RateLimit)
+		s.limiter.SetLimit(limit)
+		s.limiter.SetBurst(burst)
+		s.perIP.set(perIPRateLimit(cfg.RateLimit))
+		setRateLimitMetrics(cfg.RateLimit)
+		utils.WriteLog("INFO", fmt.Sprintf("Reloaded rate limit from %+v to %+v", s.cfg.RateLimit, cfg.RateLimit))
+		s.cfg.RateLimit = cfg.RateLimit
+	}
+
+	if cfg.SlowThreshold != s.cfg.SlowThreshold {
+		s.slowThreshold.Store(int64(cfg.SlowThreshold))
+		utils.WriteLog("INFO", fmt.Sprintf("Reloaded slow threshold from %s to %s", s.cfg.SlowThreshold, cfg.SlowThreshold))
+		s.cfg.SlowThreshold = cfg.SlowThreshold
+	}
+
+	if cfg.DisableKeepAlive != s.cfg.DisableKeepAlive {
+		s.srv.SetKeepAlivesEnabled(!cfg.DisableKeepAlive)
+		utils.WriteLog("INFO", fmt.Sprintf("Reloaded disable keep-alive from %t to %t", s.cfg.DisableKeepAlive, cfg.DisableKeepAlive))
+		s.cfg.DisableKeepAlive = cfg.DisableKeepAlive
+	}
+
+	if !reflect.DeepEqual(cfg.Features, s.cfg.Features) {
+		s.features.Set(cfg.Features)
+		utils.WriteLog("INFO", fmt.Sprintf("Reloaded feature flags from %v to %v", s.cfg.Features, cfg.Features))
+		s.cfg.Features = cfg.Features
+	}
+
+	return nil
+}
+
+// reloadFile loads the config file of flags and applies it with the flags on
+// top, recording the outcome in the config reload metrics
+func (s *Server) reloadFile(flags *config.Flags) error {
+	configReloads.Inc()
+	cfg, err := flags.Load()
+	if err == nil {
+		err = s.Reload(cfg)
+	}
+	if err != nil {
+		configReloadErrors.Inc()
+		return err
+	}
+	configLastReload.SetToCurrentTime()
+	return nil
+}
+
+// WatchReload reloads the config file of flags on every SIGHUP until the
+// returned stop func is called, the flags keep overriding the file
+func (s *Server) WatchReload(flags *config.Flags) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for {
+			select {
+			case <-hup:
+				utils.WriteLog("INFO", fmt.Sprintf("Received SIGHUP, reloading %s", flags.ConfigFile))
+				if err := s.reloadFile(flags); err != nil {
+					utils.WriteLog("ERROR", fmt.Sprintf("Failed to reload config: %s", err))
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(hup)
+		close(done)
+	}
+}
+
+// drainContext bounds ctx by DrainTimeout, if there is one
+func (s *Server) drainContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.cfg.DrainTimeout > 0 {
+		return context.WithTimeout(ctx, s.cfg.DrainTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// drainWebApp waits until the web app requests in flight have finished or
+// ctx is done, while the listener is kept open for /api/metrics
+func (s *Server) drainWebApp(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.webInflight.Load() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// waitFinalScrape serves /api/metrics for another FinalScrapeWait once the
+// web app is drained, or until ctx is done
+func (s *Server) waitFinalScrape(ctx context.Context) {
+	if s.cfg.FinalScrapeWait <= 0 {
+		return
+	}
+	utils.WriteLog("INFO", fmt.Sprintf("Only serving /api/metrics for another %s so the final values are scraped", s.cfg.FinalScrapeWait))
+	select {
+	case <-time.After(s.cfg.FinalScrapeWait):
+	case <-ctx.Done():
+	}
+}
+
+// ShutdownOnSignal shuts the server down gracefully on SIGTERM or SIGINT and
+// returns the result of the shutdown on the returned channel. A second signal
+// during the shutdown closes the server straight away instead.
+func (s *Server) ShutdownOnSignal() <-chan error {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+
+	result := make(chan error, 1)
+	go func() {
+		defer signal.Stop(sig)
+		result <- s.shutdownOnSignal(sig)
+	}()
+	return result
+}
+
+// shutdownOnSignal shuts the server down once sig receives, and closes it if
+// sig receives again before the graceful shutdown finished
+func (s *Server) shutdownOnSignal(sig <-chan os.Signal) error {
+	first := <-sig
+	utils.WriteLog("INFO", fmt.Sprintf("Received %s, shutting down", first))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+
+	select {
+	case err := <-shutdown:
+		return err
+	case second := <-sig:
+		utils.WriteLog("WARNING", fmt.Sprintf("Received %s while shutting down, forcing the shutdown and dropping in-flight requests", second))
+		cancel()
+		return s.srv.Close()
+	}
+}
+
+// withBasePath mounts h under base so the app can live behind a shared ingress.
+// The prefix is stripped before h sees the request, so routes and metric labels stay unprefixed.
+func withBasePath(base string, h http.Handler) http.Handler {
+	base = "/" + strings.Trim(base, "/")
+	if base == "/" {
+		return h
+	}
+
+	router := mux.NewRouter()
+	router.NotFoundHandler = notFoundHandler()
+	router.Path(base).Handler(http.RedirectHandler(base+"/", http.StatusMovedPermanently))
+	router.PathPrefix(base + "/").Handler(http.StripPrefix(base, h))
+	return router
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/gorilla/mux"
+)
+
+// sloRoute reports the error budget burn of the SLO as JSON
+const sloRoute = "/slo"
+
+// sloWindows are the windows /slo reports the burn rate over, those of the
+// multi-window burn rate alerts
+var sloWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+// sloBucket counts the requests of a minute
+type sloBucket struct {
+	minute      int64
+	total, good float64
+}
+
+// sloTracker counts the good and total requests of the SLO, since the start
+// in slo_requests_good_total and slo_requests_total and per minute over the
+// longest of sloWindows for /slo
+type sloTracker struct {
+	cfg config.SLO
+	now func() time.Time
+
+	mu          sync.Mutex
+	buckets     [6 * 60]sloBucket
+	total, good float64
+}
+
+func newSLOTracker(cfg config.SLO) *sloTracker {
+	return &sloTracker{cfg: cfg, now: time.Now}
+}
+
+// isGood reports whether a request answered with status in elapsed meets the SLO
+func (t *sloTracker) isGood(status int, elapsed time.Duration) bool {
+	if status >= http.StatusInternalServerError {
+		return false
+	}
+	return t.cfg.Latency <= 0 || elapsed <= t.cfg.Latency
+}
+
+// record counts a request
+func (t *sloTracker) record(good bool) {
+	sloRequests.Inc()
+	if good {
+		sloGoodRequests.Inc()
+	}
+
+	minute := t.now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := &t.buckets[minute%int64(len(t.buckets))]
+	if b.minute != minute {
+		*b = sloBucket{minute: minute}
+	}
+	b.total++
+	t.total++
+	if good {
+		b.good++
+		t.good++
+	}
+}
+
+// window returns the total and good requests of the last window, to the minute
+func (t *sloTracker) window(window time.Duration) (total, good float64) {
+	minute := t.now().Unix() / 60
+	since := minute - int64(window/time.Minute)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.buckets {
+		if b.minute > since && b.minute <= minute {
+			total += b.total
+			good += b.good
+		}
+	}
+	return total, good
+}
+
+// burnRate returns how many times faster than the SLO allows bad requests
+// use up the error budget, 1 spends it exactly over the SLO period
+func (t *sloTracker) burnRate(total, good float64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return (total - good) / total / (1 - t.cfg.Objective)
+}
+
+// middleware counts the requests of the web app against the SLO. Probes and
+// scrapes are not part of it, nor /live whose duration is the stream's.
+func (t *sloTracker) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		if operationalRoutes[route] || route == liveRoute {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r)
+		t.record(t.isGood(rw.statusCode, time.Since(start)))
+	})
+}
+
+// sloWindowReport is the burn rate of a window in /slo
+type sloWindowReport struct {
+	Window   string  `json:"window"`
+	Total    float64 `json:"total"`
+	Good     float64 `json:"good"`
+	BurnRate float64 `json:"burnRate"`
+}
+
+// sloReport is the /slo response. ErrorBudgetRemaining is the share of the
+// error budget of the requests since the start left, negative once overspent.
+type sloReport struct {
+	Objective            float64           `json:"objective"`
+	LatencySeconds       float64           `json:"latencySeconds"`
+	Total                float64           `json:"total"`
+	Good                 float64           `json:"good"`
+	ErrorBudgetRemaining float64           `json:"errorBudgetRemaining"`
+	Windows              []sloWindowReport `json:"windows"`
+}
+
+// handleSLO reports the SLO, the requests counted since the start and the
+// burn rate over every one of sloWindows
+func (t *sloTracker) handleSLO(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	total, good := t.total, t.good
+	t.mu.Unlock()
+
+	report := sloReport{
+		Objective:            t.cfg.Objective,
+		LatencySeconds:       t.cfg.Latency.Seconds(),
+		Total:                total,
+		Good:                 good,
+		ErrorBudgetRemaining: 1 - t.burnRate(total, good),
+	}
+	for _, window := range sloWindows {
+		total, good := t.window(window)
+		report.Windows = append(report.Windows, sloWindowReport{
+			Window:   formatWindow(window),
+			Total:    total,
+			Good:     good,
+			BurnRate: t.burnRate(total, good),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// formatWindow formats window the way PromQL range selectors do, such as 5m or 6h
+func formatWindow(window time.Duration) string {
+	if window%time.Hour == 0 {
+		return strconv.FormatInt(int64(window/time.Hour), 10) + "h"
+	}
+	return strconv.FormatInt(int64(window/time.Minute), 10) + "m"
+}
+
+// routes wires /slo to router when the SLO is enabled
+func (t *sloTracker) routes(router *mux.Router) {
+	if t.cfg.Objective <= 0 {
+		return
+	}
+	router.Path(sloRoute).Methods(http.MethodGet, http.MethodOptions).HandlerFunc(t.handleSLO)
+}
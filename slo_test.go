@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSLOTracker(t *testing.T) {
+	tracker := newSLOTracker(config.SLO{Objective: 0.99, Latency: 300 * time.Millisecond})
+	now := time.Unix(1700000000, 0)
+	tracker.now = func() time.Time { return now }
+
+	tests := []struct {
+		status   int
+		elapsed  time.Duration
+		expected bool
+	}{
+		{http.StatusOK, 100 * time.Millisecond, true},
+		{http.StatusNotFound, 300 * time.Millisecond, true},
+		{http.StatusOK, 301 * time.Millisecond, false},
+		{http.StatusServiceUnavailable, time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		if got := tracker.isGood(tt.status, tt.elapsed); got != tt.expected {
+			t.Errorf("Expected a %d in %s to be good %v, but got %v", tt.status, tt.elapsed, tt.expected, got)
+		}
+	}
+
+	// 2 bad requests an hour ago, then 1 of 100 bad requests now
+	now = now.Add(-time.Hour)
+	tracker.record(false)
+	tracker.record(false)
+	now = now.Add(time.Hour)
+	for i := 0; i < 99; i++ {
+		tracker.record(true)
+	}
+	tracker.record(false)
+
+	if total, good := tracker.window(5 * time.Minute); total != 100 || good != 99 {
+		t.Errorf("Expected 99 of 100 good requests in 5m, but got %v of %v", good, total)
+	}
+	if total, _ := tracker.window(6 * time.Hour); total != 102 {
+		t.Errorf("Expected 102 requests in 6h, but got %v", total)
+	}
+	if got := tracker.burnRate(tracker.window(5 * time.Minute)); math.Abs(got-1) > 1e-9 {
+		t.Errorf("Expected a burn rate of 1, but got %v", got)
+	}
+
+	// a bucket is reused once its minute is out of the longest window
+	now = now.Add(5 * time.Hour)
+	tracker.record(true)
+	if total, _ := tracker.window(6 * time.Hour); total != 101 {
+		t.Errorf("Expected the requests of 6h ago to be dropped, leaving 101, but got %v", total)
+	}
+}
+
+func TestSLO(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SLO = config.SLO{Objective: 0.9, Latency: time.Second}
+	router := NewServer(cfg).Handler()
+
+	total := testutil.ToFloat64(sloRequests)
+	good := testutil.ToFloat64(sloGoodRequests)
+	for _, path := range []string{"/api/hits", "/api/hits", "/api/healthz", "/api/metrics"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	if got := testutil.ToFloat64(sloRequests) - total; got != 2 {
+		t.Errorf("Expected slo_requests_total to count the 2 web app requests, but got %v", got)
+	}
+	if got := testutil.ToFloat64(sloGoodRequests) - good; got != 2 {
+		t.Errorf("Expected slo_requests_good_total to count 2 good requests, but got %v", got)
+	}
+	if got := testutil.ToFloat64(sloObjective); got != 0.9 {
+		t.Errorf("Expected slo_objective_ratio 0.9, but got %v", got)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, sloRoute, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+	var report sloReport
+	if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to decode %s: %v", rr.Body.String(), err)
+	}
+	if report.Total != 2 || report.Good != 2 || report.ErrorBudgetRemaining != 1 {
+		t.Errorf("Expected 2 good requests and the whole error budget left, but got %+v", report)
+	}
+	if len(report.Windows) != len(sloWindows) || report.Windows[0].Window != "5m" || report.Windows[3].Window != "6h" {
+		t.Errorf("Expected the windows 5m to 6h, but got %+v", report.Windows)
+	}
+}
+
+func TestSLODisabled(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.SLO.Objective = 0
+	router := NewServer(cfg).Handler()
+
+	total := testutil.ToFloat64(sloRequests)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+	if got := testutil.ToFloat64(sloRequests) - total; got != 0 {
+		t.Errorf("Expected no requests counted without an SLO, but got %v", got)
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, sloRoute, nil))
+	if rr.Code == http.StatusOK {
+		t.Errorf("Expected no %s without an SLO, but got status %d", sloRoute, rr.Code)
+	}
+}
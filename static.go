@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// staticExtensions are the extensions counted by static_requests_total, anything else is "other"
+var staticExtensions = map[string]bool{
+	"js":   true,
+	"css":  true,
+	"png":  true,
+	"svg":  true,
+	"html": true,
+}
+
+// staticExtension returns the bounded extension label for a static file path
+func staticExtension(p string) string {
+	if p == "" || strings.HasSuffix(p, "/") {
+		// directories are served by their index.html
+		return "html"
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+	if !staticExtensions[ext] {
+		return "other"
+	}
+	return ext
+}
+
+// staticWriter records the status and body size of a static file response
+type staticWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *staticWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *staticWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// staticMetricsMiddleware counts static file requests by extension, the bytes
+// served and the conditional requests the client's cached copy answered
+func staticMetricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		staticRequests.WithLabelValues(staticExtension(r.URL.Path)).Inc()
+
+		sw := &staticWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		staticBytesServed.Add(float64(sw.bytes))
+		if sw.status == http.StatusNotModified {
+			staticNotModified.Inc()
+		}
+	})
+}
+
+// staticContentType returns the Content-Type to serve the static file at p with,
+// or "" to leave it to the file server. An override for p wins over the longest
+// override for a prefix ending in /, and the default only applies to files
+// without a recognized extension.
+func staticContentType(p, defaultType string, overrides map[string]string) string {
+	if contentType, ok := overrides[p]; ok {
+		return contentType
+	}
+	prefix := ""
+	for candidate := range overrides {
+		if strings.HasSuffix(candidate, "/") && strings.HasPrefix(p, candidate) && len(candidate) > len(prefix) {
+			prefix = candidate
+		}
+	}
+	if prefix != "" {
+		return overrides[prefix]
+	}
+	// directories are served by their index.html
+	if defaultType != "" && !strings.HasSuffix(p, "/") && mime.TypeByExtension(path.Ext(p)) == "" {
+		return defaultType
+	}
+	return ""
+}
+
+// contentTypeWriter sets the Content-Type of a successful response before it is written
+type contentTypeWriter struct {
+	http.ResponseWriter
+	contentType string
+	wroteHeader bool
+}
+
+func (w *contentTypeWriter) WriteHeader(code int) {
+	if !w.wroteHeader && (code == http.StatusOK || code == http.StatusPartialContent) &&
+		!strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/") {
+		w.Header().Set("Content-Type", w.contentType)
+	}
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *contentTypeWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// contentTypeMiddleware serves static files with the Content-Type chosen by
+// staticContentType instead of the one the file server detected
+func contentTypeMiddleware(defaultType string, overrides map[string]string, next http.Handler) http.Handler {
+	if defaultType == "" && len(overrides) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType := staticContentType(r.URL.Path, defaultType, overrides)
+		if contentType == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&contentTypeWriter{ResponseWriter: w, contentType: contentType}, r)
+	})
+}
+
+// spaHandler serves static files and falls back to index.html for deep links,
+// paths without an extension that do not exist, so client-side routing works
+type spaHandler struct {
+	fs   http.FileSystem
+	next http.Handler
+}
+
+// newSPAHandler returns a spaHandler looking files up in fs and serving them with next
+func newSPAHandler(fs http.FileSystem, next http.Handler) spaHandler {
+	return spaHandler{fs: fs, next: next}
+}
+
+func (h spaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean("/" + r.URL.Path)
+	if path.Ext(name) == "" && !strings.HasPrefix(name, "/api/") {
+		f, err := h.fs.Open(name)
+		if os.IsNotExist(err) {
+			spaFallback.Inc()
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/"
+			r2.URL.RawPath = ""
+			h.next.ServeHTTP(w, r2)
+			return
+		}
+		if err == nil {
+			f.Close()
+		}
+	}
+	h.next.ServeHTTP(w, r)
+}
+
+// overlayFS serves files from a list of directories where later
+// directories override earlier ones. Directory listings are disabled,
+// a directory can only be opened if it resolves to an index.html.
+type overlayFS []http.FileSystem
+
+// newOverlayFS returns an overlayFS for a colon-separated list of directories
+func newOverlayFS(dirs string) overlayFS {
+	var fs overlayFS
+	for _, dir := range strings.Split(dirs, ":") {
+		if dir == "" {
+			continue
+		}
+		fs = append(fs, http.Dir(dir))
+	}
+	return fs
+}
+
+// empty reports whether none of the directories has any file or directory in it
+func (o overlayFS) empty() bool {
+	for _, dir := range o {
+		f, err := dir.Open("/")
+		if err != nil {
+			continue
+		}
+		entries, _ := f.Readdir(1)
+		f.Close()
+		if len(entries) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Open opens name from the last directory that contains it
+func (o overlayFS) Open(name string) (http.File, error) {
+	for i := len(o) - 1; i >= 0; i-- {
+		f, err := o[i].Open(name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if stat.IsDir() {
+			index, err := o.Open(path.Join(name, "index.html"))
+			if err != nil {
+				f.Close()
+				return nil, os.ErrNotExist
+			}
+			index.Close()
+		}
+		return f, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+// Reasons counted by static_read_errors_total
+const (
+	readErrorNotFound = "not_found"
+	readErrorIO       = "io"
+)
+
+// countReadError counts err by static_read_errors_total unless it is nil or io.EOF
+func countReadError(err error) {
+	switch {
+	case err == nil || errors.Is(err, io.EOF):
+	case errors.Is(err, fs.ErrNotExist):
+		staticReadErrors.WithLabelValues(readErrorNotFound).Inc()
+	default:
+		staticReadErrors.WithLabelValues(readErrorIO).Inc()
+	}
+}
+
+// instrumentedFS counts the open, stat and read failures of the wrapped
+// file system, telling missing files apart from real IO errors
+type instrumentedFS struct {
+	fs http.FileSystem
+}
+
+func newInstrumentedFS(fs http.FileSystem) instrumentedFS {
+	return instrumentedFS{fs: fs}
+}
+
+func (i instrumentedFS) Open(name string) (http.File, error) {
+	f, err := i.fs.Open(name)
+	countReadError(err)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedFile{f}, nil
+}
+
+// instrumentedFile counts the stat and read failures of the wrapped file
+type instrumentedFile struct {
+	http.File
+}
+
+func (f instrumentedFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	countReadError(err)
+	return n, err
+}
+
+func (f instrumentedFile) Stat() (fs.FileInfo, error) {
+	info, err := f.File.Stat()
+	countReadError(err)
+	return info, err
+}
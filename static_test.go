@@ -0,0 +1,308 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func writeFile(t *testing.T, dir, name, content string) {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatalf("Failed to create directory for %s: %v", name, err)
+	}
+	if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+func TestOverlayFS(t *testing.T) {
+	base := t.TempDir()
+	overlay := t.TempDir()
+
+	writeFile(t, base, "index.html", "base index")
+	writeFile(t, base, "w3.css", "base css")
+	writeFile(t, base, "assets/logo.svg", "base logo")
+	writeFile(t, overlay, "w3.css", "overlay css")
+
+	fs := http.FileServer(newOverlayFS(base + ":" + overlay))
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{path: "/", status: http.StatusOK, expected: "base index"},
+		{path: "/w3.css", status: http.StatusOK, expected: "overlay css"},
+		{path: "/assets/logo.svg", status: http.StatusOK, expected: "base logo"},
+		{path: "/assets/", status: http.StatusNotFound},
+		{path: "/missing.js", status: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		fs.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if rr.Code != tt.status {
+			t.Errorf("Expected status %d for %s, but got %d", tt.status, tt.path, rr.Code)
+		}
+
+		body, _ := io.ReadAll(rr.Body)
+		if tt.expected != "" && string(body) != tt.expected {
+			t.Errorf("Expected body %q for %s, but got %q", tt.expected, tt.path, string(body))
+		}
+	}
+}
+
+func TestStaticExtension(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "/", expected: "html"},
+		{path: "/index.html", expected: "html"},
+		{path: "/app.JS", expected: "js"},
+		{path: "/w3.css", expected: "css"},
+		{path: "/pic.jpg", expected: "other"},
+		{path: "/LICENSE", expected: "other"},
+	}
+
+	for _, tt := range tests {
+		if ext := staticExtension(tt.path); ext != tt.expected {
+			t.Errorf("Expected extension %q for %s, but got %q", tt.expected, tt.path, ext)
+		}
+	}
+}
+
+func TestStaticRequests(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "app.js", "console.log('hi')")
+	writeFile(t, dir, "logo.png", "png")
+
+	cfg := testConfig(t)
+	cfg.StaticDir = dir
+	router := NewServer(cfg).Handler()
+
+	before := map[string]float64{}
+	for _, ext := range []string{"js", "png", "css"} {
+		before[ext] = testutil.ToFloat64(staticRequests.WithLabelValues(ext))
+	}
+
+	for _, path := range []string{"/app.js", "/logo.png", "/api/hits"} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected status %d for %s, but got %d", http.StatusOK, path, rr.Code)
+		}
+	}
+
+	for ext, expected := range map[string]float64{"js": 1, "png": 1, "css": 0} {
+		if got := testutil.ToFloat64(staticRequests.WithLabelValues(ext)) - before[ext]; got != expected {
+			t.Errorf("Expected %v static requests for %s, but got %v", expected, ext, got)
+		}
+	}
+}
+
+func TestSPAFallback(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "index.html", "spa index")
+	writeFile(t, dir, "w3.css", "css")
+
+	cfg := testConfig(t)
+	cfg.StaticDir = dir
+	cfg.SPAFallback = true
+	router := NewServer(cfg).Handler()
+
+	tests := []struct {
+		path     string
+		status   int
+		expected string
+		fallback float64
+	}{
+		{path: "/blog/post-1", status: http.StatusOK, expected: "spa index", fallback: 1},
+		{path: "/w3.css", status: http.StatusOK, expected: "css", fallback: 0},
+		{path: "/missing.js", status: http.StatusNotFound, fallback: 0},
+	}
+
+	for _, tt := range tests {
+		before := testutil.ToFloat64(spaFallback)
+
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if rr.Code != tt.status {
+			t.Errorf("Expected status %d for %s, but got %d", tt.status, tt.path, rr.Code)
+		}
+		if tt.expected != "" && rr.Body.String() != tt.expected {
+			t.Errorf("Expected body %q for %s, but got %q", tt.expected, tt.path, rr.Body.String())
+		}
+		if got := testutil.ToFloat64(spaFallback) - before; got != tt.fallback {
+			t.Errorf("Expected %v fallbacks for %s, but got %v", tt.fallback, tt.path, got)
+		}
+	}
+}
+
+// failingFS fails to open every file with err
+type failingFS struct {
+	err error
+}
+
+func (f failingFS) Open(name string) (http.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: f.err}
+}
+
+func TestStaticReadErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		reason string
+		other  string
+	}{
+		{"permission denied", fs.ErrPermission, readErrorIO, readErrorNotFound},
+		{"not found", fs.ErrNotExist, readErrorNotFound, readErrorIO},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.FileServer(newInstrumentedFS(failingFS{tt.err}))
+			before := testutil.ToFloat64(staticReadErrors.WithLabelValues(tt.reason))
+			otherBefore := testutil.ToFloat64(staticReadErrors.WithLabelValues(tt.other))
+
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/app.js", nil))
+
+			if got := testutil.ToFloat64(staticReadErrors.WithLabelValues(tt.reason)) - before; got != 1 {
+				t.Errorf("Expected static_read_errors_total{reason=%q} to increase by 1, but got %v", tt.reason, got)
+			}
+			if got := testutil.ToFloat64(staticReadErrors.WithLabelValues(tt.other)) - otherBefore; got != 0 {
+				t.Errorf("Expected static_read_errors_total{reason=%q} to stay the same, but got %v", tt.other, got)
+			}
+		})
+	}
+}
+
+func TestStaticCatchAll(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "index.html", "<html>blog</html>")
+	writeFile(t, dir, "style.css", "body {}")
+	writeFile(t, dir, "css/nested.css", "h1 {}")
+	// files shadowing API routes must never be served in their place
+	writeFile(t, dir, "api/hits", "not the hits")
+	writeFile(t, dir, "api/healthz", "not the health check")
+
+	t.Setenv("STATIC_DIR", dir)
+	router := NewServer(testConfig(t)).Handler()
+
+	for path, body := range map[string]string{
+		"/style.css":      "body {}",
+		"/css/nested.css": "h1 {}",
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != body {
+			t.Errorf("Expected %s to be served from the static directory, but got %d %q", path, rr.Code, rr.Body.String())
+		}
+	}
+
+	getHits(t, router)
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/healthz", nil))
+	if rr.Body.String() != `{"alive": true}` {
+		t.Errorf("Expected /api/healthz to be routed to the health check, but got %q", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/metrics", nil))
+	if !strings.Contains(rr.Body.String(), "http_requests_total") {
+		t.Errorf("Expected /api/metrics to be routed to the metrics handler")
+	}
+}
+
+func TestStaticContentType(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "index.html", "<html>blog</html>")
+	writeFile(t, dir, "about", "about the blog")
+	writeFile(t, dir, "feeds/latest", "<rss></rss>")
+	writeFile(t, dir, "app.js", "console.log('hi')")
+
+	cfg := testConfig(t)
+	cfg.StaticDir = dir
+	cfg.StaticContentType = "text/html; charset=utf-8"
+	cfg.StaticContentTypes = map[string]string{"/feeds/": "application/rss+xml"}
+	router := NewServer(cfg).Handler()
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/about", "text/html; charset=utf-8"},
+		{"/feeds/latest", "application/rss+xml"},
+		{"/app.js", "text/javascript; charset=utf-8"},
+		{"/", "text/html; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("Expected status %d for %s, but got %d", http.StatusOK, tt.path, rr.Code)
+		}
+		if got := rr.Header().Get("Content-Type"); got != tt.expected {
+			t.Errorf("Expected Content-Type %q for %s, but got %q", tt.expected, tt.path, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if got := rr.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain") {
+		t.Errorf("Expected the 404 to keep its plain text Content-Type, but got %q", got)
+	}
+}
+
+func TestStaticNotModified(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "w3.css", "body {}")
+
+	cfg := testConfig(t)
+	cfg.StaticDir = dir
+	router := NewServer(cfg).Handler()
+
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/w3.css", nil))
+	lastModified := rr.Header().Get("Last-Modified")
+	if rr.Code != http.StatusOK || lastModified == "" {
+		t.Fatalf("Expected a 200 with Last-Modified, but got %d %q", rr.Code, lastModified)
+	}
+
+	notModifiedBefore := testutil.ToFloat64(staticNotModified)
+	bytesBefore := testutil.ToFloat64(staticBytesServed)
+
+	req := httptest.NewRequest(http.MethodGet, "/w3.css", nil)
+	req.Header.Set("If-Modified-Since", lastModified)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("Expected status %d for a current copy, but got %d", http.StatusNotModified, rr.Code)
+	}
+	if got := testutil.ToFloat64(staticNotModified) - notModifiedBefore; got != 1 {
+		t.Errorf("Expected static_not_modified_total to increase by 1, but got %v", got)
+	}
+	if got := testutil.ToFloat64(staticBytesServed) - bytesBefore; got != 0 {
+		t.Errorf("Expected static_bytes_served_total to stay the same, but got %v", got)
+	}
+
+	// the full response is counted in bytes served
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/w3.css", nil))
+	if got := testutil.ToFloat64(staticBytesServed) - bytesBefore; got != float64(len("body {}")) {
+		t.Errorf("Expected static_bytes_served_total to increase by %d, but got %v", len("body {}"), got)
+	}
+}
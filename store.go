@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sync/singleflight"
+)
+
+// Hit store backends
+const (
+	backendMemory = "memory"
+	backendFile   = "file"
+	backendRedis  = "redis"
+)
+
+// newHitStore returns the hit store for cfg.Backend. The redis backend falls
+// back to counting in memory while Redis is unreachable.
+func newHitStore(cfg config.HitStore) (HitStore, error) {
+	switch cfg.Backend {
+	case backendMemory:
+		return newMemoryStore(), nil
+	case backendFile:
+		return newFileStore(cfg.File), nil
+	case backendRedis:
+		return newFallbackStore(backendRedis, newRedisStore(cfg.Redis), newMemoryStore()), nil
+	default:
+		return nil, fmt.Errorf("unknown hit store backend %q", cfg.Backend)
+	}
+}
+
+// HitStore persists the number of hits to the web app
+type HitStore interface {
+	// Get returns the current number of hits
+	Get(ctx context.Context) (int64, error)
+	// Incr increments the number of hits and returns the new value
+	Incr(ctx context.Context) (int64, error)
+	// Add adds n to the number of hits and returns the new value
+	Add(ctx context.Context, n int64) (int64, error)
+	// Reset sets the number of hits back to zero
+	Reset(ctx context.Context) error
+}
+
+// memoryStore keeps the hit count in memory.
+// This only works if there is one replica of the backend.
+// This data is ephemeral and will be lost if the backend is restarted.
+// Use the redis backend to share the count between replicas.
+type memoryStore struct {
+	count int64
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) Get(ctx context.Context) (int64, error) {
+	return atomic.LoadInt64(&s.count), nil
+}
+
+func (s *memoryStore) Incr(ctx context.Context) (int64, error) {
+	return s.Add(ctx, 1)
+}
+
+func (s *memoryStore) Add(ctx context.Context, n int64) (int64, error) {
+	return atomic.AddInt64(&s.count, n), nil
+}
+
+func (s *memoryStore) Reset(ctx context.Context) error {
+	atomic.StoreInt64(&s.count, 0)
+	return nil
+}
+
+// fileStore persists the hit count to a file so it survives restarts
+type fileStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func newFileStore(path string) *fileStore {
+	return &fileStore{path: path}
+}
+
+func (s *fileStore) read() (int64, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (s *fileStore) Get(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.read()
+}
+
+// write replaces the stored count, writing to a temporary file and renaming it
+// so a crash never leaves a partial count
+func (s *fileStore) write(count int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(strconv.FormatInt(count, 10)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *fileStore) Incr(ctx context.Context) (int64, error) {
+	return s.Add(ctx, 1)
+}
+
+func (s *fileStore) Add(ctx context.Context, n int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count, err := s.read()
+	if err != nil {
+		return 0, err
+	}
+	count += n
+	if err := s.write(count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *fileStore) Reset(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(0)
+}
+
+// instrumentedStore records the duration of every operation on the wrapped store
+type instrumentedStore struct {
+	store    HitStore
+	duration prometheus.ObserverVec
+}
+
+func newInstrumentedStore(store HitStore, duration prometheus.ObserverVec) *instrumentedStore {
+	return &instrumentedStore{store: store, duration: duration}
+}
+
+func (s *instrumentedStore) Get(ctx context.Context) (int64, error) {
+	timer := prometheus.NewTimer(s.duration.WithLabelValues("get"))
+	defer timer.ObserveDuration()
+	return s.store.Get(ctx)
+}
+
+func (s *instrumentedStore) Incr(ctx context.Context) (int64, error) {
+	timer := prometheus.NewTimer(s.duration.WithLabelValues("incr"))
+	defer timer.ObserveDuration()
+	return s.store.Incr(ctx)
+}
+
+func (s *instrumentedStore) Add(ctx context.Context, n int64) (int64, error) {
+	timer := prometheus.NewTimer(s.duration.WithLabelValues("add"))
+	defer timer.ObserveDuration()
+	return s.store.Add(ctx, n)
+}
+
+func (s *instrumentedStore) Reset(ctx context.Context) error {
+	timer := prometheus.NewTimer(s.duration.WithLabelValues("reset"))
+	defer timer.ObserveDuration()
+	return s.store.Reset(ctx)
+}
+
+// timeoutStore cancels every call to store that takes longer than timeout
+type timeoutStore struct {
+	store   HitStore
+	timeout time.Duration
+}
+
+func newTimeoutStore(store HitStore, timeout time.Duration) *timeoutStore {
+	return &timeoutStore{store: store, timeout: timeout}
+}
+
+func (s *timeoutStore) Get(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.store.Get(ctx)
+}
+
+func (s *timeoutStore) Incr(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.store.Incr(ctx)
+}
+
+func (s *timeoutStore) Add(ctx context.Context, n int64) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.store.Add(ctx, n)
+}
+
+func (s *timeoutStore) Reset(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	return s.store.Reset(ctx)
+}
+
+// cachedStore serves Get from a short lived cache, and concurrent reads of an
+// expired cache share a single call to the wrapped store. Writes go straight to
+// the wrapped store and advance the cache to the value they leave behind.
+// The shared call runs with its own context bounded by timeout, so a reader
+// that goes away does not fail the others waiting on it.
+type cachedStore struct {
+	store   HitStore
+	ttl     time.Duration
+	timeout time.Duration
+	group   singleflight.Group
+
+	mu      sync.Mutex
+	value   int64
+	expires time.Time
+	// generation is bumped by every write so a read that started before it
+	// never overwrites the newer value
+	generation uint64
+}
+
+func newCachedStore(store HitStore, ttl, timeout time.Duration) *cachedStore {
+	return &cachedStore{store: store, ttl: ttl, timeout: timeout}
+}
+
+// set caches value as the latest number of hits
+func (s *cachedStore) set(value int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	s.value = value
+	s.expires = time.Now().Add(s.ttl)
+}
+
+func (s *cachedStore) Get(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	if time.Now().Before(s.expires) {
+		value := s.value
+		s.mu.Unlock()
+		return value, nil
+	}
+	generation := s.generation
+	s.mu.Unlock()
+
+	ch := s.group.DoChan("get", func() (interface{}, error) {
+		loadCtx := context.Background()
+		if s.timeout > 0 {
+			var cancel context.CancelFunc
+			loadCtx, cancel = context.WithTimeout(loadCtx, s.timeout)
+			defer cancel()
+		}
+		value, err := s.store.Get(loadCtx)
+		if err != nil {
+			return int64(0), err
+		}
+		s.mu.Lock()
+		if s.generation == generation {
+			s.value = value
+			s.expires = time.Now().Add(s.ttl)
+		}
+		s.mu.Unlock()
+		return value, nil
+	})
+	select {
+	case res := <-ch:
+		return res.Val.(int64), res.Err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (s *cachedStore) Incr(ctx context.Context) (int64, error) {
+	value, err := s.store.Incr(ctx)
+	if err == nil {
+		s.set(value)
+	}
+	return value, err
+}
+
+func (s *cachedStore) Add(ctx context.Context, n int64) (int64, error) {
+	value, err := s.store.Add(ctx, n)
+	if err == nil {
+		s.set(value)
+	}
+	return value, err
+}
+
+func (s *cachedStore) Reset(ctx context.Context) error {
+	err := s.store.Reset(ctx)
+	if err == nil {
+		s.set(0)
+	}
+	return err
+}
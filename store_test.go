@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// slowStore delays every operation on the wrapped store
+type slowStore struct {
+	HitStore
+	delay time.Duration
+}
+
+func (s *slowStore) Get(ctx context.Context) (int64, error) {
+	time.Sleep(s.delay)
+	return s.HitStore.Get(ctx)
+}
+
+func (s *slowStore) Incr(ctx context.Context) (int64, error) {
+	time.Sleep(s.delay)
+	return s.HitStore.Incr(ctx)
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := newMemoryStore()
+	ctx := context.Background()
+
+	for i := 1; i <= 3; i++ {
+		n, err := store.Incr(ctx)
+		if err != nil {
+			t.Fatalf("Failed to increment hits: %v", err)
+		}
+		if n != int64(i) {
+			t.Errorf("Expected Incr to return %d, but got %d", i, n)
+		}
+	}
+
+	n, err := store.Get(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get hits: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected Get to return %d, but got %d", 3, n)
+	}
+
+	if err := store.Reset(ctx); err != nil {
+		t.Fatalf("Failed to reset hits: %v", err)
+	}
+	if n, _ := store.Get(ctx); n != 0 {
+		t.Errorf("Expected Get to return %d after Reset, but got %d", 0, n)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hits")
+	ctx := context.Background()
+
+	store := newFileStore(path)
+	for i := 0; i < 2; i++ {
+		if _, err := store.Incr(ctx); err != nil {
+			t.Fatalf("Failed to increment hits: %v", err)
+		}
+	}
+
+	// a new store on the same file picks up where the last one left off
+	store = newFileStore(path)
+	n, err := store.Incr(ctx)
+	if err != nil {
+		t.Fatalf("Failed to increment hits: %v", err)
+	}
+	if n != 3 {
+		t.Errorf("Expected Incr to return %d, but got %d", 3, n)
+	}
+
+	if err := store.Reset(ctx); err != nil {
+		t.Fatalf("Failed to reset hits: %v", err)
+	}
+	if n, _ := newFileStore(path).Get(ctx); n != 0 {
+		t.Errorf("Expected Get to return %d after Reset, but got %d", 0, n)
+	}
+}
+
+func TestStoreAdd(t *testing.T) {
+	stores := map[string]HitStore{
+		backendMemory: newMemoryStore(),
+		backendFile:   newFileStore(filepath.Join(t.TempDir(), "hits")),
+	}
+	ctx := context.Background()
+
+	for backend, store := range stores {
+		if _, err := store.Incr(ctx); err != nil {
+			t.Fatalf("Failed to increment %s hits: %v", backend, err)
+		}
+		n, err := store.Add(ctx, 41)
+		if err != nil {
+			t.Fatalf("Failed to add %s hits: %v", backend, err)
+		}
+		if n != 42 {
+			t.Errorf("Expected %s Add to return %d, but got %d", backend, 42, n)
+		}
+		if n, _ := store.Get(ctx); n != 42 {
+			t.Errorf("Expected %s Get to return %d after Add, but got %d", backend, 42, n)
+		}
+	}
+}
+
+// countingStore counts the calls to Get on the wrapped store
+type countingStore struct {
+	HitStore
+	gets atomic.Int64
+}
+
+func (s *countingStore) Get(ctx context.Context) (int64, error) {
+	s.gets.Add(1)
+	return s.HitStore.Get(ctx)
+}
+
+func TestCachedStore(t *testing.T) {
+	s, _ := NewTestServer(t)
+	backend := &countingStore{HitStore: &slowStore{newMemoryStore(), 20 * time.Millisecond}}
+	hitStore = newCachedStore(backend, 100*time.Millisecond, time.Second)
+
+	const readers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+			if rr.Code != http.StatusOK {
+				t.Errorf("Expected status %d for /api/hits, but got %d", http.StatusOK, rr.Code)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if gets := backend.gets.Load(); gets > 5 {
+		t.Errorf("Expected %d concurrent reads to share a few backend calls, but got %d", readers, gets)
+	}
+
+	// writes advance the cache instead of leaving a stale value behind
+	if _, err := hitStore.Add(context.Background(), 3); err != nil {
+		t.Fatalf("Failed to add hits: %v", err)
+	}
+	gets := backend.gets.Load()
+	if hits := getHits(t, s.Handler()); hits != 3 {
+		t.Errorf("Expected %d hits after Add, but got %d", 3, hits)
+	}
+	if err := hitStore.Reset(context.Background()); err != nil {
+		t.Fatalf("Failed to reset hits: %v", err)
+	}
+	if hits := getHits(t, s.Handler()); hits != 0 {
+		t.Errorf("Expected %d hits after Reset, but got %d", 0, hits)
+	}
+	if got := backend.gets.Load(); got != gets {
+		t.Errorf("Expected reads after writes to be served from the cache, but got %d more backend calls", got-gets)
+	}
+}
+
+// ctxStore delays Get like slowStore, but gives up once ctx is done
+type ctxStore struct {
+	HitStore
+	delay time.Duration
+}
+
+func (s *ctxStore) Get(ctx context.Context) (int64, error) {
+	select {
+	case <-time.After(s.delay):
+		return s.HitStore.Get(ctx)
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func TestCachedStoreCanceledReader(t *testing.T) {
+	backend := newMemoryStore()
+	backend.Add(context.Background(), 7)
+	store := newCachedStore(&ctxStore{backend, 50 * time.Millisecond}, time.Minute, time.Second)
+
+	// the first reader starts the shared call and goes away during it
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := store.Get(ctx)
+		canceled <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+
+	if n, err := store.Get(context.Background()); err != nil || n != 7 {
+		t.Errorf("Expected the other reader to get 7 hits, but got %d, %v", n, err)
+	}
+	if err := <-canceled; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the reader that went away to get %v, but got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestHitStoreBackend(t *testing.T) {
+	defer setHitStoreBackend(backendMemory)
+
+	for _, backend := range []string{backendFile, backendMemory} {
+		if err := configureHitStore(config.HitStore{Backend: backend, File: filepath.Join(t.TempDir(), "hits")}); err != nil {
+			t.Fatalf("Failed to configure %s hit store: %v", backend, err)
+		}
+
+		if got := testutil.ToFloat64(hitStoreBackend.WithLabelValues(backend)); got != 1 {
+			t.Errorf("Expected hit_store_backend{type=%q} to be 1, but got %v", backend, got)
+		}
+		if got := testutil.CollectAndCount(hitStoreBackend); got != 1 {
+			t.Errorf("Expected a single hit_store_backend series, but got %d", got)
+		}
+	}
+
+	if err := configureHitStore(config.HitStore{Backend: "postgres"}); err == nil {
+		t.Errorf("Expected an error for an unknown backend")
+	}
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	delay := 20 * time.Millisecond
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "test_hit_store_op_duration_seconds",
+	}, []string{"op"})
+	store := newInstrumentedStore(&slowStore{newMemoryStore(), delay}, duration)
+	ctx := context.Background()
+
+	if _, err := store.Incr(ctx); err != nil {
+		t.Fatalf("Failed to increment hits: %v", err)
+	}
+	if _, err := store.Get(ctx); err != nil {
+		t.Fatalf("Failed to get hits: %v", err)
+	}
+
+	for _, op := range []string{"get", "incr"} {
+		var m dto.Metric
+		if err := duration.WithLabelValues(op).(prometheus.Histogram).Write(&m); err != nil {
+			t.Fatalf("Failed to read histogram for op %s: %v", op, err)
+		}
+		if m.GetHistogram().GetSampleCount() != 1 {
+			t.Errorf("Expected 1 observation for op %s, but got %d", op, m.GetHistogram().GetSampleCount())
+		}
+		if sum := m.GetHistogram().GetSampleSum(); sum < delay.Seconds() {
+			t.Errorf("Expected op %s to record at least %s, but got %fs", op, delay, sum)
+		}
+	}
+}
+
+// contextStore records the context of the last call to Incr
+type contextStore struct {
+	HitStore
+	ctx context.Context
+}
+
+func (s *contextStore) Incr(ctx context.Context) (int64, error) {
+	s.ctx = ctx
+	return s.HitStore.Incr(ctx)
+}
+
+func TestHitStoreContext(t *testing.T) {
+	s, _ := NewTestServer(t)
+	backend := &contextStore{HitStore: newMemoryStore()}
+	hitStore = newTimeoutStore(backend, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	if backend.ctx == nil {
+		t.Fatalf("Expected the request to increment the hits")
+	}
+	if !errors.Is(backend.ctx.Err(), context.Canceled) {
+		t.Errorf("Expected Incr to receive the cancelled request context, but got error %v", backend.ctx.Err())
+	}
+	if _, ok := backend.ctx.Deadline(); !ok {
+		t.Errorf("Expected Incr to receive a context with the store deadline")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// resetRequestMetrics drops every series recorded while serving requests
+func resetRequestMetrics() {
+	for _, vec := range []interface{ Reset() }{
+		totalRequests,
+		responseStatus,
+		responseStatusByPath,
+		requestsByAgent,
+		httpDuration,
+		httpTTFB,
+		requestBytesReceived,
+		httpRequestSize,
+		httpResponseSize,
+		httpRequestsInFlight,
+		staticRequests,
+		staticReadErrors,
+		httpPanics,
+		hitStoreOpDuration,
+	} {
+		vec.Reset()
+	}
+}
+
+// pathRequests returns http_requests_total for path, summed over every method and status
+func pathRequests(path string) float64 {
+	ch := make(chan prometheus.Metric, 100)
+	go func() {
+		totalRequests.Collect(ch)
+		close(ch)
+	}()
+	total := 0.0
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "path" && l.GetValue() == path {
+				total += pb.GetCounter().GetValue()
+			}
+		}
+	}
+	return total
+}
+
+// NewTestServer returns a Server configured from the environment with a fresh
+// in-memory hit store, whose /api/metrics only exposes the returned registry of
+// custom metrics. The per-request series are reset so tests using it never see
+// each other's requests, and the hit store is restored once the test ends.
+// The metrics are still package globals, so these tests must not run in parallel.
+func NewTestServer(t *testing.T) (*Server, *prometheus.Registry) {
+	t.Helper()
+
+	reg := prometheus.NewRegistry()
+	if err := registerMetrics(reg); err != nil {
+		t.Fatalf("Failed to register metrics: %v", err)
+	}
+
+	resetRequestMetrics()
+	store := hitStore
+	hitStore = newInstrumentedStore(newMemoryStore(), hitStoreOpDuration)
+	t.Cleanup(func() {
+		hitStore = store
+		resetRequestMetrics()
+	})
+
+	return newServer(testConfig(t), reg), reg
+}
+
+// testIsolation serves requests to the web app and asserts that only those are recorded
+func testIsolation(t *testing.T, requests int) {
+	s, reg := NewTestServer(t)
+	for i := 0; i < requests; i++ {
+		s.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	if hits := getHits(t, s.Handler()); hits != int64(requests) {
+		t.Errorf("Expected %d hits, but got %d", requests, hits)
+	}
+
+	// every request so far, including the one to /api/hits
+	expected := strings.NewReader(`
+# HELP http_requests_by_agent_total Number of requests by user-agent category.
+# TYPE http_requests_by_agent_total counter
+http_requests_by_agent_total{category="other",metrics="custom"} ` + strconv.Itoa(requests+1) + `
+`)
+	if err := testutil.GatherAndCompare(reg, expected, "http_requests_by_agent_total"); err != nil {
+		t.Errorf("Unexpected http_requests_by_agent_total: %v", err)
+	}
+}
+
+func TestNewTestServerIsolationOne(t *testing.T) {
+	testIsolation(t, 1)
+}
+
+func TestNewTestServerIsolationTwo(t *testing.T) {
+	testIsolation(t, 2)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// timeoutRetryAfter is how long clients are asked to back off after a timeout
+const timeoutRetryAfter = 5 * time.Second
+
+// unavailableWriter adds a Retry-After header to 503 responses that lack one
+type unavailableWriter struct {
+	http.ResponseWriter
+}
+
+func (w unavailableWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable && w.Header().Get("Retry-After") == "" {
+		setRetryAfter(w, timeoutRetryAfter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// withTimeout wraps next in a http.TimeoutHandler, a timeout of zero or less disables it
+func withTimeout(next http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return next
+	}
+	h := jsonErrors(http.TimeoutHandler(next, timeout, "request timed out"))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(unavailableWriter{w}, r)
+	})
+}
+
+// timeoutMiddleware responds with a 503 if a handler takes longer than timeout,
+// or than the override for its route template. The metrics endpoint and the
+// /live stream are skipped because http.TimeoutHandler buffers the whole
+// response.
+func timeoutMiddleware(timeout time.Duration, overrides map[string]time.Duration) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		h := withTimeout(next, timeout)
+		routes := make(map[string]http.Handler, len(overrides))
+		for route, d := range overrides {
+			routes[route] = withTimeout(next, d)
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			route := routeTemplate(r)
+			if route == "/api/metrics" || route == liveRoute {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if override, ok := routes[route]; ok {
+				override.ServeHTTP(w, r)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
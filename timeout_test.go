@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTimeoutMiddleware(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	h := timeoutMiddleware(10*time.Millisecond, nil)(slow)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected status %d, but got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	retryAfter, err := strconv.Atoi(rr.Header().Get("Retry-After"))
+	if err != nil {
+		t.Fatalf("Expected a numeric Retry-After header, but got %q", rr.Header().Get("Retry-After"))
+	}
+	if retryAfter != int(timeoutRetryAfter.Seconds()) {
+		t.Errorf("Expected Retry-After %v, but got %d", timeoutRetryAfter.Seconds(), retryAfter)
+	}
+}
+
+func TestTimeoutMiddlewareFast(t *testing.T) {
+	h := timeoutMiddleware(time.Second, nil)(http.HandlerFunc(HealthCheckHandler))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "" {
+		t.Errorf("Expected no Retry-After header, but got %q", rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestTimeoutMiddlewareRouteOverrides(t *testing.T) {
+	sleep := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			w.Write([]byte("done"))
+		case <-r.Context().Done():
+		}
+	})
+
+	router := mux.NewRouter()
+	router.Use(timeoutMiddleware(50*time.Millisecond, map[string]time.Duration{
+		"/test/fast": 10 * time.Millisecond,
+		"/test/slow": time.Second,
+	}))
+	for _, path := range []string{"/test/fast", "/test/slow", "/test/default"} {
+		router.Path(path).Handler(sleep)
+	}
+
+	for path, status := range map[string]int{
+		"/test/fast":    http.StatusServiceUnavailable,
+		"/test/slow":    http.StatusOK,
+		"/test/default": http.StatusServiceUnavailable,
+	} {
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, path, nil))
+		if rr.Code != status {
+			t.Errorf("Expected status %d for %s, but got %d", status, path, rr.Code)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// countTLSHandshakeErrors wraps a http.Server ConnState hook to count TLS
+// connections that close before their handshake completes. net/http only logs
+// some of these, and not plain HTTP requests sent to the TLS port at all.
+func countTLSHandshakeErrors(next func(net.Conn, http.ConnState)) func(net.Conn, http.ConnState) {
+	return func(conn net.Conn, state http.ConnState) {
+		if tlsConn, ok := conn.(*tls.Conn); ok && state == http.StateClosed && !tlsConn.ConnectionState().HandshakeComplete {
+			tlsHandshakeErrors.Inc()
+		}
+		next(conn, state)
+	}
+}
+
+// selfSignedValidity is how long a generated certificate is valid for
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// selfSignedCert generates a certificate for localhost, the loopback
+// addresses and the hostname, for serving HTTPS in development without
+// a certificate at hand. Clients have to skip verifying it, with curl -k
+// or insecure_skip_verify in a scrape_config.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "prometheus-workshop"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
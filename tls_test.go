@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 to dir and returns its files
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "prometheus-workshop"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	writeFile(t, dir, "tls.crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeFile(t, dir, "tls.key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+}
+
+// waitForTLSHandshakeErrors waits until tls_handshake_errors_total reaches want, connections are closed asynchronously
+func waitForTLSHandshakeErrors(want float64) float64 {
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(tlsHandshakeErrors) < want && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return testutil.ToFloat64(tlsHandshakeErrors)
+}
+
+func TestTLSHandshakeErrors(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+
+	cfg := testConfig(t)
+	cfg.TLS.CertFile, cfg.TLS.KeyFile = certFile, keyFile
+	s := NewServer(cfg)
+	go s.srv.ServeTLS(l, certFile, keyFile)
+	defer s.srv.Close()
+
+	before := testutil.ToFloat64(tlsHandshakeErrors)
+
+	// plain HTTP to the TLS port
+	status, _ := get(t, "http://"+l.Addr().String()+"/api/healthz")
+	if status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for plain HTTP, but got %d", http.StatusBadRequest, status)
+	}
+	if got := waitForTLSHandshakeErrors(before+1) - before; got != 1 {
+		t.Errorf("Expected tls_handshake_errors_total to increase by 1, but got %v", got)
+	}
+
+	// a successful handshake is not an error
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + l.Addr().String() + "/api/healthz")
+	if err != nil {
+		t.Fatalf("Failed to get /api/healthz over TLS: %v", err)
+	}
+	resp.Body.Close()
+	client.CloseIdleConnections()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d over TLS, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := testutil.ToFloat64(tlsHandshakeErrors) - before; got != 1 {
+		t.Errorf("Expected a successful handshake not to count as an error, but got %v errors", got)
+	}
+}
+
+func TestSelfSignedTLS(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Port = "0"
+	cfg.TLS.SelfSigned = true
+	s := NewServer(cfg)
+	served, err := s.Start()
+	if err != nil {
+		t.Fatalf("Failed to start the server: %v", err)
+	}
+	defer func() {
+		s.srv.Close()
+		<-served
+	}()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get("https://" + s.Addr() + "/api/healthz")
+	if err != nil {
+		t.Fatalf("Failed to get /api/healthz over TLS: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %d over TLS, but got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp.TLS == nil || resp.TLS.PeerCertificates[0].Subject.CommonName != "prometheus-workshop" {
+		t.Errorf("Expected the generated certificate to be served, but got %+v", resp.TLS)
+	}
+}
+
+func TestSelfSignedTLSLoadgen(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.Port = "0"
+	cfg.Debug = true
+	cfg.TLS.SelfSigned = true
+	s := NewServer(cfg)
+	served, err := s.Start()
+	if err != nil {
+		t.Fatalf("Failed to start the server: %v", err)
+	}
+	defer func() {
+		s.srv.Close()
+		<-served
+	}()
+
+	// the load generator reaches the server over HTTPS, despite the self-signed certificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	defer client.CloseIdleConnections()
+	success := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenSuccess))
+	failures := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenError))
+	resp, err := client.Post("https://"+s.Addr()+"/api/debug/loadgen?rps=100&duration=200ms&paths=/api/healthz&workers=1", "", nil)
+	if err != nil {
+		t.Fatalf("Failed to start the load generator: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected status %d starting the load generator, but got %d", http.StatusAccepted, resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenSuccess)) == success && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenSuccess)) - success; got == 0 {
+		t.Errorf("Expected the load generator to reach the self-signed server")
+	}
+	// the run is over before its errors are counted
+	for testutil.ToFloat64(loadgenActiveWorkers) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(loadgenRequests.WithLabelValues(loadgenError)) - failures; got != 0 {
+		t.Errorf("Expected no load generator errors, but got %v", got)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cmwylie19/prometheus-workshop/utils"
+)
+
+// traceparentHeader carries the W3C trace context of a request
+const traceparentHeader = "traceparent"
+
+// Spans are exported in batches of up to tracingBatchSize every tracingFlushInterval,
+// and dropped once tracingQueueSize are waiting
+const (
+	tracingBatchSize     = 512
+	tracingFlushInterval = time.Second
+	tracingQueueSize     = 2048
+)
+
+// otlpSpanKindServer is the OTLP SPAN_KIND_SERVER, every span is a request the web app served
+const otlpSpanKindServer = 2
+
+// otlpStatusError is the OTLP STATUS_CODE_ERROR
+const otlpStatusError = 2
+
+// spanContext identifies a span within a W3C trace
+type spanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (sc spanContext) traceID() string {
+	return hex.EncodeToString(sc.TraceID[:])
+}
+
+func (sc spanContext) spanID() string {
+	return hex.EncodeToString(sc.SpanID[:])
+}
+
+// traceparent formats sc as a version 00 traceparent header
+func (sc spanContext) traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.traceID(), sc.spanID(), flags)
+}
+
+// parseTraceparent parses a traceparent header, returning false if it is
+// invalid so a new trace is started instead
+func parseTraceparent(value string) (spanContext, bool) {
+	var sc spanContext
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	// later versions may append fields, version 00 has exactly four
+	if len(parts) < 4 || (parts[0] == "00" && len(parts) != 4) || parts[0] == "ff" {
+		return sc, false
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !lowerHex(version, 2) || !lowerHex(traceID, 32) || !lowerHex(spanID, 16) || !lowerHex(flags, 2) {
+		return sc, false
+	}
+	hex.Decode(sc.TraceID[:], []byte(traceID))
+	hex.Decode(sc.SpanID[:], []byte(spanID))
+	if sc.TraceID == ([16]byte{}) || sc.SpanID == ([8]byte{}) {
+		return sc, false
+	}
+	f, _ := strconv.ParseUint(flags, 16, 8)
+	sc.Sampled = f&1 == 1
+	return sc, true
+}
+
+// lowerHex reports whether s is n lowercase hex digits
+func lowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type spanContextKey struct{}
+
+// spanFromContext returns the span of the request ctx belongs to, if it is traced
+func spanFromContext(ctx context.Context) (spanContext, bool) {
+	sc, ok := ctx.Value(spanContextKey{}).(spanContext)
+	return sc, ok
+}
+
+// span is a request the web app served
+type span struct {
+	name      string
+	ctx       spanContext
+	parent    [8]byte
+	start     time.Time
+	end       time.Time
+	method    string
+	route     string
+	status    int
+	requestID string
+}
+
+// The subset of the OTLP traces data model we export, encoded with the
+// OTLP/JSON mapping, which encodes IDs as hex
+type otlpTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpSpanStatus  `json:"status"`
+}
+
+// otlpAttribute is a span attribute, which unlike metric labels may be an integer
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    string  `json:"intValue,omitempty"`
+}
+
+type otlpSpanStatus struct {
+	Code int `json:"code,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpAnyValue{StringValue: &value}}
+}
+
+// toOTLPSpans converts spans to an OTLP traces export request, requests that
+// failed with a 5xx are marked as errors
+func toOTLPSpans(spans []*span, service string) *otlpTraceRequest {
+	out := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.ctx.traceID(),
+			SpanID:            s.ctx.spanID(),
+			Name:              s.name,
+			Kind:              otlpSpanKindServer,
+			StartTimeUnixNano: unixNano(s.start),
+			EndTimeUnixNano:   unixNano(s.end),
+			Attributes: []otlpAttribute{
+				stringAttribute("http.method", s.method),
+				stringAttribute("http.route", s.route),
+				{Key: "http.status_code", Value: otlpAnyValue{IntValue: strconv.Itoa(s.status)}},
+			},
+		}
+		if s.requestID != "" {
+			o.Attributes = append(o.Attributes, stringAttribute("http.request_id", s.requestID))
+		}
+		if s.parent != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.status >= 500 {
+			o.Status.Code = otlpStatusError
+		}
+		out = append(out, o)
+	}
+
+	return &otlpTraceRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpKeyValue{
+			{Key: "service.name", Value: otlpValue{StringValue: service}},
+			{Key: "service.version", Value: otlpValue{StringValue: version}},
+		}},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "github.com/cmwylie19/prometheus-workshop"},
+			Spans: out,
+		}},
+	}}}
+}
+
+// spanExporter sends OTLP traces export requests to a collector
+type spanExporter interface {
+	ExportSpans(ctx context.Context, req *otlpTraceRequest) error
+}
+
+// tracer records a span for every request and exports them in batches.
+// Requests continue the trace of their traceparent header and keep its
+// sampling decision, other requests start a trace sampled with probability ratio.
+type tracer struct {
+	exporter spanExporter
+	service  string
+	ratio    float64
+	spans    chan *span
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+	// pending are the spans Run had not exported yet when it stopped
+	pending []*span
+}
+
+func newTracer(exporter spanExporter, service string, ratio float64) *tracer {
+	return &tracer{
+		exporter: exporter,
+		service:  service,
+		ratio:    ratio,
+		spans:    make(chan *span, tracingQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// middleware records a span for every request and puts its span context in
+// the request context for exemplars
+func (t *tracer) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := &span{start: time.Now(), method: r.Method, route: routeTemplate(r), requestID: requestIDFromContext(r.Context())}
+		s.name = r.Method + " " + s.route
+
+		if parent, ok := parseTraceparent(r.Header.Get(traceparentHeader)); ok {
+			s.ctx.TraceID = parent.TraceID
+			s.ctx.Sampled = parent.Sampled
+			s.parent = parent.SpanID
+		} else {
+			rand.Read(s.ctx.TraceID[:])
+			s.ctx.Sampled = mathrand.Float64() < t.ratio
+		}
+		rand.Read(s.ctx.SpanID[:])
+		// handlers passing the headers on propagate the trace with this span as the parent
+		r.Header.Set(traceparentHeader, s.ctx.traceparent())
+
+		rw := NewResponseWriter(w)
+		next.ServeHTTP(rw, r.WithContext(context.WithValue(r.Context(), spanContextKey{}, s.ctx)))
+
+		if !s.ctx.Sampled {
+			return
+		}
+		s.end = time.Now()
+		s.status = rw.statusCode
+		select {
+		case t.spans <- s:
+		default:
+			tracingSpansDropped.Inc()
+		}
+	})
+}
+
+// export sends batch, logging a failure since spans are best effort
+func (t *tracer) export(ctx context.Context, batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := t.exporter.ExportSpans(ctx, toOTLPSpans(batch, t.service)); err != nil {
+		tracingSpansDropped.Add(float64(len(batch)))
+		utils.WriteLog("ERROR", fmt.Sprintf("Failed to export %d spans over OTLP: %s", len(batch), err))
+	}
+}
+
+// Run exports the recorded spans until Shutdown is called
+func (t *tracer) Run() {
+	defer close(t.done)
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*span, 0, tracingBatchSize)
+	flush := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		t.export(ctx, batch)
+		cancel()
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) == tracingBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			// Shutdown exports what is left
+			t.pending = batch
+			return
+		}
+	}
+}
+
+// Shutdown stops Run and exports the spans that are left, giving up once ctx is done
+func (t *tracer) Shutdown(ctx context.Context) error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	batch := t.pending
+	for len(t.spans) > 0 {
+		batch = append(batch, <-t.spans)
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return t.exporter.ExportSpans(ctx, toOTLPSpans(batch, t.service))
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// memorySpanExporter keeps every exported span in memory
+type memorySpanExporter struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func (e *memorySpanExporter) ExportSpans(ctx context.Context, req *otlpTraceRequest) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			e.spans = append(e.spans, ss.Spans...)
+		}
+	}
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		header  string
+		valid   bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		// a later version with an extra field
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-01", false, false},
+		{"", false, false},
+	}
+
+	for _, tt := range tests {
+		sc, ok := parseTraceparent(tt.header)
+		if ok != tt.valid {
+			t.Errorf("Expected %q to be valid %v, but got %v", tt.header, tt.valid, ok)
+			continue
+		}
+		if ok && sc.Sampled != tt.sampled {
+			t.Errorf("Expected %q to be sampled %v, but got %v", tt.header, tt.sampled, sc.Sampled)
+		}
+		if ok && tt.header[:2] == "00" && sc.traceparent() != tt.header {
+			t.Errorf("Expected %q to format back unchanged, but got %q", tt.header, sc.traceparent())
+		}
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	exporter := &memorySpanExporter{}
+	tr := newTracer(exporter, "test", 1)
+	go tr.Run()
+
+	var propagated string
+	router := newTestRouter(tr.middleware)
+	router.Path("/api/traced").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		propagated = r.Header.Get(traceparentHeader)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/traced", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/hits", nil))
+
+	// an unsampled trace is propagated but not exported
+	req = httptest.NewRequest(http.MethodGet, "/api/hits", nil)
+	req.Header.Set(traceparentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down the tracer: %v", err)
+	}
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 sampled spans to be exported, but got %d", len(exporter.spans))
+	}
+
+	continued := exporter.spans[0]
+	if continued.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || continued.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected the span to continue the incoming trace, but got trace %s parent %s", continued.TraceID, continued.ParentSpanID)
+	}
+	if continued.Name != "GET /api/traced" || continued.Status.Code != otlpStatusError {
+		t.Errorf("Expected a failed span named %q, but got %q with status %d", "GET /api/traced", continued.Name, continued.Status.Code)
+	}
+	if want := "00-" + continued.TraceID + "-" + continued.SpanID + "-01"; propagated != want {
+		t.Errorf("Expected the handler to see traceparent %q, but got %q", want, propagated)
+	}
+
+	started := exporter.spans[1]
+	if started.TraceID == continued.TraceID || started.ParentSpanID != "" {
+		t.Errorf("Expected a request without traceparent to start a new trace, but got trace %s parent %q", started.TraceID, started.ParentSpanID)
+	}
+}
+
+func TestTracingExemplar(t *testing.T) {
+	collector := make(chan []byte, 10)
+	otlp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		collector <- body
+	}))
+	defer otlp.Close()
+
+	cfg := testConfig(t)
+	cfg.Tracing.Endpoint = otlp.URL
+	_, reg := NewTestServer(t)
+	s := newServer(cfg, reg)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/hits", nil)
+	req.Header.Set(traceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set(requestIDHeader, "traced-request-1")
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	var m dto.Metric
+	if err := httpDuration.WithLabelValues("/api/hits", "GET", "200").(prometheus.Histogram).Write(&m); err != nil {
+		t.Fatalf("Failed to read histogram: %v", err)
+	}
+	found := false
+	for _, b := range m.GetHistogram().GetBucket() {
+		for _, l := range b.GetExemplar().GetLabel() {
+			if l.GetName() == "trace_id" && l.GetValue() == "4bf92f3577b34da6a3ce929d0e0e4736" {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected an exemplar with the trace ID on http_response_time_seconds")
+	}
+
+	if err := s.tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to flush spans: %v", err)
+	}
+	body := string(<-collector)
+	if !strings.Contains(body, `"traceId":"4bf92f3577b34da6a3ce929d0e0e4736"`) {
+		t.Errorf("Expected the span to be exported over OTLP, but got %s", body)
+	}
+	if !strings.Contains(body, `"key":"http.request_id","value":{"stringValue":"traced-request-1"}`) {
+		t.Errorf("Expected the span to have the request ID, but got %s", body)
+	}
+}
@@ -2,15 +2,21 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
 type Log struct {
-	Timestamp string `json:"timestamp"`
-	Level     string `json:"level"`
-	Message   string `json:"message"`
+	Timestamp string                 `json:"timestamp"`
+	Level     string                 `json:"level"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
 }
 
 func GetPort() string {
@@ -21,19 +27,204 @@ func GetPort() string {
 	return port
 }
 
+// GetEnv returns the value of the environment variable key, or fallback if it is unset
+func GetEnv(key string, fallback string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// GetEnvList returns the comma-separated list set in the environment variable key,
+// or fallback if it is unset
+func GetEnvList(key string, fallback []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	return SplitList(value)
+}
+
+// SplitList splits a comma-separated list, trimming spaces and dropping empty items
+func SplitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// GetEnvBool returns the boolean set in the environment variable key,
+// or fallback if it is unset or cannot be parsed
+func GetEnvBool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		WriteLog("WARNING", fmt.Sprintf("Invalid boolean %q for %s, using %t", value, key, fallback))
+		return fallback
+	}
+	return b
+}
+
+// GetEnvInt returns the integer set in the environment variable key,
+// or fallback if it is unset or cannot be parsed
+func GetEnvInt(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		WriteLog("WARNING", fmt.Sprintf("Invalid integer %q for %s, using %d", value, key, fallback))
+		return fallback
+	}
+	return i
+}
+
+// GetEnvFloat returns the float set in the environment variable key,
+// or fallback if it is unset or cannot be parsed
+func GetEnvFloat(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		WriteLog("WARNING", fmt.Sprintf("Invalid number %q for %s, using %g", value, key, fallback))
+		return fallback
+	}
+	return f
+}
+
+// GetEnvDuration returns the duration set in the environment variable key,
+// or fallback if it is unset or cannot be parsed
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		WriteLog("WARNING", fmt.Sprintf("Invalid duration %q for %s, using %s", value, key, fallback))
+		return fallback
+	}
+	return d
+}
+
+// logLevels orders the supported log levels by severity
+var logLevels = map[string]int32{
+	"DEBUG":   0,
+	"INFO":    1,
+	"WARNING": 2,
+	"ERROR":   3,
+}
+
+// logLevel is the minimum severity written by WriteLog
+var logLevel atomic.Value
+
+func init() {
+	logLevel.Store("INFO")
+	logFormat.Store(LogFormatJSON)
+}
+
+// Log formats, one JSON object or one line of logfmt key=value pairs per log
+const (
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+)
+
+// logFormat is the format WriteLog writes in
+var logFormat atomic.Value
+
+// SetLogFormat sets the format WriteLog writes in
+func SetLogFormat(format string) error {
+	format = strings.ToLower(format)
+	if format != LogFormatJSON && format != LogFormatLogfmt {
+		return fmt.Errorf("unknown log format %q, expected %s or %s", format, LogFormatJSON, LogFormatLogfmt)
+	}
+	logFormat.Store(format)
+	return nil
+}
+
+// GetLogFormat returns the format WriteLog writes in
+func GetLogFormat() string {
+	return logFormat.Load().(string)
+}
+
+// SetLogLevel sets the minimum level written by WriteLog
+func SetLogLevel(level string) error {
+	level = strings.ToUpper(level)
+	if _, ok := logLevels[level]; !ok {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	logLevel.Store(level)
+	return nil
+}
+
+// GetLogLevel returns the minimum level written by WriteLog
+func GetLogLevel() string {
+	return logLevel.Load().(string)
+}
+
 func WriteLog(level string, message string) {
+	WriteLogFields(level, message, nil)
+}
+
+// WriteLogFields writes a log line like WriteLog with fields attached for
+// log pipelines to filter on
+func WriteLogFields(level string, message string, fields map[string]interface{}) {
+	if severity, ok := logLevels[level]; ok && severity < logLevels[GetLogLevel()] {
+		return
+	}
+
 	logData := Log{
 		Timestamp: time.Now().Format(time.RFC3339),
 		Level:     level,
 		Message:   message,
+		Fields:    fields,
 	}
 
+	// remove timestamp prefix
+	log.SetFlags(0)
+	if GetLogFormat() == LogFormatLogfmt {
+		log.Println(logData.logfmt())
+		return
+	}
 	logBytes, err := json.Marshal(logData)
 	if err != nil {
 		log.Fatal(err)
 	}
-	// remove timestamp prefix
-	log.SetFlags(0)
 	log.Println(string(logBytes))
 
 }
+
+// logfmt formats l as logfmt, with the fields after the message in key order
+func (l Log) logfmt() string {
+	var b strings.Builder
+	b.WriteString("timestamp=" + logfmtValue(l.Timestamp))
+	b.WriteString(" level=" + logfmtValue(l.Level))
+	b.WriteString(" message=" + logfmtValue(l.Message))
+	keys := make([]string, 0, len(l.Fields))
+	for key := range l.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		b.WriteString(" " + key + "=" + logfmtValue(fmt.Sprint(l.Fields[key])))
+	}
+	return b.String()
+}
+
+// logfmtValue quotes value if it is empty or has spaces, quotes or equal signs
+func logfmtValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=\\") {
+		return strconv.Quote(value)
+	}
+	return value
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestGetPort(t *testing.T) {
@@ -25,6 +26,110 @@ func TestGetPort(t *testing.T) {
 	}
 }
 
+func TestGetEnv(t *testing.T) {
+	os.Setenv("TEST_ENV", "value")
+	if value := GetEnv("TEST_ENV", "fallback"); value != "value" {
+		t.Errorf("Expected value to be %q, but got %q", "value", value)
+	}
+
+	os.Unsetenv("TEST_ENV")
+	if value := GetEnv("TEST_ENV", "fallback"); value != "fallback" {
+		t.Errorf("Expected value to be %q, but got %q", "fallback", value)
+	}
+}
+
+func TestGetEnvList(t *testing.T) {
+	os.Setenv("TEST_LIST", "a, b,,c")
+	list := GetEnvList("TEST_LIST", nil)
+	if strings.Join(list, "|") != "a|b|c" {
+		t.Errorf("Expected list %q, but got %q", []string{"a", "b", "c"}, list)
+	}
+
+	os.Unsetenv("TEST_LIST")
+	list = GetEnvList("TEST_LIST", []string{"fallback"})
+	if len(list) != 1 || list[0] != "fallback" {
+		t.Errorf("Expected the fallback list, but got %q", list)
+	}
+}
+
+func TestGetEnvBool(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		value    string
+		expected bool
+	}{
+		{value: "", expected: true},
+		{value: "false", expected: false},
+		{value: "1", expected: true},
+		{value: "maybe", expected: true},
+	}
+
+	for _, tt := range tests {
+		os.Setenv("TEST_BOOL", tt.value)
+		if b := GetEnvBool("TEST_BOOL", true); b != tt.expected {
+			t.Errorf("Expected %t for %q, but got %t", tt.expected, tt.value, b)
+		}
+	}
+	os.Unsetenv("TEST_BOOL")
+}
+
+func TestGetEnvNumbers(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	os.Setenv("TEST_NUMBER", "12")
+	if i := GetEnvInt("TEST_NUMBER", 3); i != 12 {
+		t.Errorf("Expected integer %d, but got %d", 12, i)
+	}
+	if f := GetEnvFloat("TEST_NUMBER", 3); f != 12 {
+		t.Errorf("Expected float %g, but got %g", 12.0, f)
+	}
+
+	os.Setenv("TEST_NUMBER", "2.5")
+	if i := GetEnvInt("TEST_NUMBER", 3); i != 3 {
+		t.Errorf("Expected fallback integer %d, but got %d", 3, i)
+	}
+	if f := GetEnvFloat("TEST_NUMBER", 3); f != 2.5 {
+		t.Errorf("Expected float %g, but got %g", 2.5, f)
+	}
+
+	os.Unsetenv("TEST_NUMBER")
+	if i := GetEnvInt("TEST_NUMBER", 3); i != 3 {
+		t.Errorf("Expected fallback integer %d, but got %d", 3, i)
+	}
+	if f := GetEnvFloat("TEST_NUMBER", 3); f != 3 {
+		t.Errorf("Expected fallback float %g, but got %g", 3.0, f)
+	}
+}
+
+func TestGetEnvDuration(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{value: "", expected: time.Second},
+		{value: "250ms", expected: 250 * time.Millisecond},
+		{value: "not-a-duration", expected: time.Second},
+	}
+
+	for _, tt := range tests {
+		os.Setenv("TEST_DURATION", tt.value)
+		d := GetEnvDuration("TEST_DURATION", time.Second)
+		if d != tt.expected {
+			t.Errorf("Expected duration %s for %q, but got %s", tt.expected, tt.value, d)
+		}
+	}
+	os.Unsetenv("TEST_DURATION")
+}
+
 func TestWriteLog(t *testing.T) {
 	var buf bytes.Buffer
 
@@ -67,3 +172,76 @@ func TestWriteLog(t *testing.T) {
 		buf.Reset() // clear the buffer before the next test
 	}
 }
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel("INFO")
+
+	if err := SetLogLevel("warning"); err != nil {
+		t.Fatalf("Failed to set log level: %v", err)
+	}
+	if level := GetLogLevel(); level != "WARNING" {
+		t.Errorf("Expected log level %q, but got %q", "WARNING", level)
+	}
+
+	WriteLog("INFO", "dropped")
+	if buf.Len() != 0 {
+		t.Errorf("Expected INFO logs to be dropped, but got %q", buf.String())
+	}
+
+	WriteLog("ERROR", "written")
+	if !strings.Contains(buf.String(), "written") {
+		t.Errorf("Expected ERROR logs to be written, but got %q", buf.String())
+	}
+
+	if err := SetLogLevel("verbose"); err == nil {
+		t.Errorf("Expected an error for an unknown log level")
+	}
+}
+
+func TestWriteLogFields(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	WriteLogFields("INFO", "with fields", map[string]interface{}{"port": "8080", "tls": false})
+
+	var logEntry Log
+	if err := json.NewDecoder(&buf).Decode(&logEntry); err != nil {
+		t.Fatalf("Failed to decode log entry: %v", err)
+	}
+	if logEntry.Fields["port"] != "8080" || logEntry.Fields["tls"] != false {
+		t.Errorf("Expected the fields to be logged, but got %v", logEntry.Fields)
+	}
+
+	buf.Reset()
+	WriteLog("INFO", "without fields")
+	if strings.Contains(buf.String(), `"fields"`) {
+		t.Errorf("Expected no fields key without fields, but got %q", buf.String())
+	}
+}
+
+func TestWriteLogFieldsLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogFormat(LogFormatJSON)
+
+	if err := SetLogFormat("xml"); err == nil {
+		t.Errorf("Expected an error for an unknown log format")
+	}
+	if err := SetLogFormat("LOGFMT"); err != nil {
+		t.Fatalf("Failed to set the log format: %v", err)
+	}
+	WriteLogFields("INFO", "GET /api/hits 200", map[string]interface{}{"status": 200, "path": "/api/hits", "agent": ""})
+
+	line := strings.TrimSpace(buf.String())
+	if !strings.HasPrefix(line, "timestamp=") {
+		t.Errorf("Expected a logfmt line starting with the timestamp, but got %q", line)
+	}
+	if expected := ` level=INFO message="GET /api/hits 200" agent="" path=/api/hits status=200`; !strings.HasSuffix(line, expected) {
+		t.Errorf("Expected the logfmt line to end with %q, but got %q", expected, line)
+	}
+}
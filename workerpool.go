@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// workerPoolRetryAfter is how long clients are asked to back off when the queue is full
+const workerPoolRetryAfter = time.Second
+
+// workerPool bounds how many requests to expensive routes run at once. Requests
+// beyond size wait in a queue of queueSize, and are rejected with a 503 once it is full.
+type workerPool struct {
+	workers chan struct{}
+	queue   chan struct{}
+	routes  map[string]bool
+}
+
+func newWorkerPool(size, queueSize int, routes []string) *workerPool {
+	p := &workerPool{
+		workers: make(chan struct{}, size),
+		queue:   make(chan struct{}, queueSize),
+		routes:  map[string]bool{},
+	}
+	for _, route := range routes {
+		p.routes[route] = true
+	}
+	workerPoolQueueDepth.Set(0)
+	return p
+}
+
+// acquire waits for a free worker, it returns false if the queue is full or
+// the request is canceled while queued
+func (p *workerPool) acquire(r *http.Request) bool {
+	select {
+	case p.workers <- struct{}{}:
+		return true
+	default:
+	}
+
+	select {
+	case p.queue <- struct{}{}:
+	default:
+		return false
+	}
+	workerPoolQueueDepth.Inc()
+	defer func() {
+		<-p.queue
+		workerPoolQueueDepth.Dec()
+	}()
+
+	select {
+	case p.workers <- struct{}{}:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (p *workerPool) release() {
+	<-p.workers
+}
+
+// middleware runs the requests to the pool's routes on its workers, other routes are not limited
+func (p *workerPool) middleware() mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !p.routes[routeTemplate(r)] {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !p.acquire(r) {
+				workerPoolRejected.Inc()
+				setRetryAfter(w, workerPoolRetryAfter)
+				writeError(w, r, http.StatusServiceUnavailable, "server busy")
+				return
+			}
+			defer p.release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWorkerPool(t *testing.T) {
+	release := make(chan struct{})
+	router := mux.NewRouter()
+	router.Use(newWorkerPool(1, 1, []string{"/test/expensive"}).middleware())
+	router.Path("/test/expensive").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	router.Path("/test/cheap").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	rejectedBefore := testutil.ToFloat64(workerPoolRejected)
+
+	// one request runs on the only worker and one waits in the queue
+	var wg sync.WaitGroup
+	statuses := make(chan int, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/test/expensive", nil))
+			statuses <- rr.Code
+		}()
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(workerPoolQueueDepth) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := testutil.ToFloat64(workerPoolQueueDepth); got != 1 {
+		t.Fatalf("Expected worker_pool_queue_depth to be 1, but got %v", got)
+	}
+
+	// the pool and its queue are full
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/test/expensive", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d once the queue is full, but got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+	if got := testutil.ToFloat64(workerPoolRejected) - rejectedBefore; got != 1 {
+		t.Errorf("Expected worker_pool_rejected_total to increase by 1, but got %v", got)
+	}
+
+	// routes outside the pool are not limited
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/test/cheap", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status %d for a route outside the pool, but got %d", http.StatusOK, rr.Code)
+	}
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusOK {
+			t.Errorf("Expected the running and queued requests to succeed, but got %d", status)
+		}
+	}
+	if got := testutil.ToFloat64(workerPoolQueueDepth); got != 0 {
+		t.Errorf("Expected worker_pool_queue_depth to be 0 once drained, but got %v", got)
+	}
+}